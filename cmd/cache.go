@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/slashcmd"
+	"github.com/pterm/pterm"
+)
+
+const (
+	CacheCmd   = "cache"
+	CacheClear = "clear"
+	CacheStats = "stats"
+
+	// NoCachePrefix starts a request whose answer must not come from the cache
+	NoCachePrefix = "--no-cache "
+)
+
+// runCacheCommand runs "/cache [stats|clear]"
+func runCacheCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return showCacheStats()
+	}
+	if len(args) != 1 {
+		return slashcmd.ErrUsage
+	}
+
+	switch args[0] {
+	case CacheStats:
+		return showCacheStats()
+	case CacheClear:
+		return clearCache()
+	default:
+		return slashcmd.ErrUsage
+	}
+}
+
+func showCacheStats() error {
+	cache := llms.GetCache()
+	stats, err := cache.Stats()
+	if err != nil {
+		return err
+	}
+
+	state := "disabled, enable it with cache.enabled in the config or NUWA_CACHE=1"
+	if cache.Enabled() {
+		state = "enabled"
+	}
+	oldest := "-"
+	if !stats.Oldest.IsZero() {
+		oldest = stats.Oldest.Format("2006-01-02 15:04:05")
+	}
+	data := pterm.TableData{
+		{"Cache", state},
+		{"Answers", strconv.Itoa(stats.Entries)},
+		{"Expired", strconv.Itoa(stats.Expired)},
+		{"Size", fmt.Sprintf("%.1f KB", float64(stats.Bytes)/1024)},
+		{"Oldest", oldest},
+		{"Hits", strconv.Itoa(stats.Hits)},
+		{"Misses", strconv.Itoa(stats.Misses)},
+	}
+	return pterm.DefaultTable.WithData(data).Render()
+}
+
+func clearCache() error {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	removed, err := llms.GetCache().Clear()
+	if err != nil {
+		return err
+	}
+	logger.Info("NUWA TERMINAL: cache cleared", logger.Args("answers", removed))
+	return nil
+}
@@ -14,6 +14,8 @@ type CommandFlags struct {
 	taskMode    bool
 	agentMode   bool
 	query       string
+	resume      string
+	profile     string
 	help        bool
 }
 
@@ -27,6 +29,8 @@ func ParseCmdParams() *CommandFlags {
 	flag.BoolVar(&flags.taskMode, "t", false, "Task mode")
 	flag.BoolVar(&flags.agentMode, "a", false, "Agent mode")
 	flag.StringVar(&flags.query, "q", "", "Query to process")
+	flag.StringVar(&flags.resume, "r", "", "Resume the session with the given id")
+	flag.StringVar(&flags.profile, "profile", "", "LLM profile of the config file to use in every mode")
 	flag.BoolVar(&flags.help, "h", false, "Show help message")
 	flag.Parse()
 
@@ -46,17 +50,45 @@ func PrintHelp(flags *CommandFlags) {
 		fmt.Println("  -t    Task mode, you can create a task with natural language，then nuwa will create a script to complete the task")
 		fmt.Println("  -a    Agent mode, this is a experimental feature，you can ask Nuwa to help you execute more complex tasks, but the result may not be as expected")
 		fmt.Println("  -q    User's input like a question, query or instruction")
+		fmt.Println("  -r    Resume a saved session by its id, use '/sessions list' to find the id")
+		fmt.Println("  --profile <name>    Use the LLM profile of ~/.nuwa-terminal/config.yaml in every mode")
 		fmt.Println("  -h    Show this help message")
 		fmt.Println("\nShortcuts (in interactive mode):")
-		fmt.Println("  Ctrl+C    Switch to Chat mode")
+		fmt.Println("  Ctrl+T    Switch to Chat mode")
+		fmt.Println("  Ctrl+C    Interrupt the running request or command")
 		fmt.Println("  Ctrl+F    Switch to Command mode")
 		fmt.Println("  Ctrl+S    Switch to Task mode")
 		fmt.Println("  Ctrl+A    Switch to Agent mode")
+		fmt.Println("  Ctrl+O    Switch to Auto mode, every input goes to the mode which fits it")
+		fmt.Println("  Ctrl+R    Search the inputs of past sessions, press again for the next match")
 		fmt.Println("  Ctrl+B    Switch to Bash mode")
+		fmt.Println("\nSlash commands (in interactive mode):")
+		fmt.Println("  /help [command]         List the commands, like /model, /profile, /undo and /quit")
+		fmt.Println("  /mode [name]            Switch to chat, cmd, task, agent or auto mode")
+		fmt.Println("  /clear                  Clear the chat history of the current chat session")
+		fmt.Println("  /new                    Start a new chat session")
+		fmt.Println("  /bash                   Start a bash shell, exit it to come back")
+		fmt.Println("  /sessions list          List saved sessions")
+		fmt.Println("  /sessions show <id>     Show what happened in a session")
+		fmt.Println("  /sessions resume <id>   Continue a saved session")
+		fmt.Println("  /sessions delete <id>   Delete a saved session")
+		fmt.Println("  /scripts list           List the scripts kept in the script library")
+		fmt.Println("  /scripts search <query> Search the scripts by request, name or tags")
+		fmt.Println("  /scripts show|run|edit|rm <name>   Show, run, edit or delete a script")
+		fmt.Println("  /scripts tag <name> [tag...]       Set the tags of a script")
+		fmt.Println("  /scripts run <name> --sandbox      Try a script in the sandbox, its changes are dropped")
+		fmt.Println("  /usage                  Show the tokens and cost of this session per mode and profile")
+		fmt.Println("  /usage all              Show the tokens and cost of every saved session")
+		fmt.Println("  /cache stats            Show what is in the response cache")
+		fmt.Println("  /cache clear            Remove every cached answer")
+		fmt.Println("  --no-cache <request>    Ask the model even if the answer is cached")
+		fmt.Println("  The words without the slash, like clearchat, chatmode or sessions list, are deprecated")
 		fmt.Println("\nExamples:")
 		fmt.Println("  nuwa-terminal -c -q \"who are you?\"")
 		fmt.Println("  nuwa-terminal -i")
 		fmt.Println("  nuwa-terminal -m -q \"list all files\"")
+		fmt.Println("  nuwa-terminal -r 20240608-070526-1a2b3c4d")
+		fmt.Println("  nuwa-terminal --profile local -c -q \"who are you?\"")
 		os.Exit(0)
 	}
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/history"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nmemory"
+
+	goterm "github.com/c-bata/go-prompt"
+	"github.com/pterm/pterm"
+)
+
+// inputHistory keeps the inputs of every session, the prompt starts with them
+var inputHistory = history.NewStore(history.DefaultHistoryPath(), history.DefaultMaxEntries)
+
+// loadInputHistory reads the inputs of the past sessions
+func loadInputHistory() {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	if err := inputHistory.Load(); err != nil {
+		logger.Warn("NUWA TERMINAL: failed to load input history,", logger.Args("err", err.Error()))
+	}
+}
+
+// historyRecord is an input on its way to the history, the mode and the
+// commands are known once it is handled
+type historyRecord struct {
+	input string
+	mode  string
+	// start is where the entries of the input begin in the session
+	start int
+	saved bool
+}
+
+// pendingRecord is the input being handled, quit saves it before exiting
+var pendingRecord *historyRecord
+
+func newHistoryRecord(in string) *historyRecord {
+	return &historyRecord{input: in, start: -1}
+}
+
+// setMode tags the input with the mode it goes to
+func (r *historyRecord) setMode(mode string) {
+	r.mode = mode
+	if session != nil {
+		r.start = len(session.Session().Entries)
+	}
+}
+
+// save adds the input to the history with the commands it ran, once
+func (r *historyRecord) save() {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	if r.saved {
+		return
+	}
+	r.saved = true
+	commands := []string{}
+	if session != nil && r.start >= 0 {
+		entries := session.Session().Entries
+		for _, entry := range entries[min(r.start, len(entries)):] {
+			if entry.Kind == nmemory.EntryCommand {
+				commands = append(commands, entry.Content)
+			}
+		}
+	}
+	err := inputHistory.Add(history.Entry{Mode: r.mode, Input: r.input, Commands: commands})
+	if err != nil {
+		logger.Warn("NUWA TERMINAL: failed to save input history,", logger.Args("err", err.Error()))
+	}
+}
+
+// reverseSearch is the Ctrl+R search of the history: the line is replaced
+// by the best match of what is typed, and pressing Ctrl+R again goes on
+// with the next match
+type reverseSearch struct {
+	matches []history.Match
+	index   int
+}
+
+var historySearch = &reverseSearch{}
+
+func (r *reverseSearch) next(b *goterm.Buffer) {
+	text := b.Text()
+	if len(r.matches) > 0 && text == r.matches[r.index].Text {
+		r.index = (r.index + 1) % len(r.matches)
+	} else {
+		r.matches = inputHistory.Search(text)
+		r.index = 0
+	}
+	if len(r.matches) == 0 {
+		return
+	}
+
+	b.CursorRight(len([]rune(text)))
+	b.DeleteBeforeCursor(len([]rune(text)))
+	b.InsertText(r.matches[r.index].Text, false, true)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/pterm/pterm"
+)
+
+// interrupt cancels the request in progress, Ctrl+C stops the generation or
+// the command of the request instead of ending nuwa
+var interrupt struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// handleInterrupts starts cancelling the request in progress on SIGINT. When
+// no request is in progress the signal is ignored, the prompt handles Ctrl+C
+// itself by clearing the line.
+func handleInterrupts() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		for range signals {
+			interrupt.mu.Lock()
+			if interrupt.cancel != nil {
+				interrupt.cancel()
+			}
+			interrupt.mu.Unlock()
+		}
+	}()
+}
+
+// requestContext returns the context of a request, it is cancelled on Ctrl+C
+// until done is called
+func requestContext(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	interrupt.mu.Lock()
+	interrupt.cancel = cancel
+	interrupt.mu.Unlock()
+
+	return ctx, func() {
+		interrupt.mu.Lock()
+		interrupt.cancel = nil
+		interrupt.mu.Unlock()
+		cancel()
+	}
+}
+
+// reportInterrupted tells the request was interrupted, if it was
+func reportInterrupted(ctx context.Context) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	logger.Warn("NUWA TERMINAL: interrupted")
+	return true
+}
@@ -8,7 +8,12 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/cmdexe"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/nuwa"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/policy"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/slashcmd"
 
 	goterm "github.com/c-bata/go-prompt"
 	"github.com/pterm/pterm"
@@ -16,17 +21,25 @@ import (
 )
 
 const (
-	Exit      = "exit"
-	Catchdir   = ".nuwa-terminal"
+	Exit       = "exit"
+	ClearChat  = "clearchat"
+	NewChat    = "newchat"
+	Catchdir   = config.Catchdir
 	ScriptsDir = "scripts"
 )
 
 var modeManager nuwa.NuwaModeManager = nil
 
+// chatSession keeps the conversation of chat mode for the whole interactive session
+var chatSession *nuwa.NuwaChat = nil
 
+// shellSession runs the commands of cmd mode, so the working directory and
+// environment survive between commands
+var shellSession *cmdexe.ShellSession = nil
 
-func GetPromptAccordingToCurrentMode(in string) string {
-	sysPrompt := modeManager.GetSysPrompt()
+// GetPromptOfMode returns the input with the system prompt of the mode
+func GetPromptOfMode(mode string, in string) string {
+	sysPrompt := modeManager.GetModeSysPrompt(mode)
 	return sysPrompt + "\n" + in
 }
 
@@ -55,7 +68,7 @@ func handleScriptMode(ctx context.Context, in string) (bool, error) {
 			scriptPath = filepath.Join(curDir, scriptPath)
 		}
 
-		err := handleNuwaScript(ctx, scriptPath)
+		err := handleNuwaScript(llms.WithMode(ctx, nuwa.ScriptMode), scriptPath)
 		if err != nil {
 			logger.Error("NUWA TERMINAL: failed to execute script,", logger.Args("err", err.Error()))
 			return true, err
@@ -68,13 +81,45 @@ func handleScriptMode(ctx context.Context, in string) (bool, error) {
 // handleChatMode 处理聊天模式
 func handleChatMode(ctx context.Context, input string) error {
 	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
-	sysPrompt := modeManager.GetSysPrompt()
-	nuwa, err := nuwa.NewNuwaChat(ctx, sysPrompt)
-	if err != nil {
-		logger.Error("NUWA TERMINAL: failed to create NuwaChat,", logger.Args("err", err.Error()))
-		return err
+	if chatSession == nil {
+		sysPrompt := modeManager.GetModeSysPrompt(nuwa.ChatMode)
+		chat, err := nuwa.NewNuwaChat(ctx, sysPrompt)
+		if err != nil {
+			logger.Error("NUWA TERMINAL: failed to create NuwaChat,", logger.Args("err", err.Error()))
+			return err
+		}
+		if session != nil {
+			if err := chat.SetSession(session); err != nil {
+				logger.Error("NUWA TERMINAL: failed to restore chat session,", logger.Args("err", err.Error()))
+				return err
+			}
+		}
+		chatSession = chat
 	}
-	return nuwa.Run(input)
+	chatSession.SetContext(ctx)
+	return chatSession.Run(input)
+}
+
+// handleClearChat forgets the conversation but keeps the current chat session
+func handleClearChat() {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	if chatSession != nil {
+		chatSession.Reset()
+	}
+	logger.Info("NUWA TERMINAL: chat history cleared")
+}
+
+// handleNewChat saves the current session and starts a new one, the chat
+// session is created on the next chat input
+func handleNewChat() {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	saveSession()
+	if err := startSession(""); err != nil {
+		logger.Error("NUWA TERMINAL: failed to start new session,", logger.Args("err", err.Error()))
+		return
+	}
+	chatSession = nil
+	logger.Info("NUWA TERMINAL: new chat session started", logger.Args("id", session.Session().ID))
 }
 
 // handleCmdMode 处理命令模式
@@ -85,9 +130,38 @@ func handleCmdMode(ctx context.Context, prompt string) error {
 		logger.Error("NUWA TERMINAL: failed to create NuwaCmd,", logger.Args("err", err.Error()))
 		return err
 	}
+	if shellSession == nil {
+		if shellSession, err = cmdexe.NewShellSession(); err != nil {
+			logger.Error("NUWA TERMINAL: failed to start shell session,", logger.Args("err", err.Error()))
+			return err
+		}
+	}
+	nuwa.SetSession(session)
+	nuwa.SetShell(shellSession)
+	defer followShellDir()
 	return nuwa.Run(prompt)
 }
 
+// followShellDir changes into the working directory of the shell session, so
+// the prompt and the other modes see where cmd mode went
+func followShellDir() {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	if shellSession == nil {
+		return
+	}
+	if err := os.Chdir(shellSession.Dir()); err != nil {
+		logger.Warn("NUWA TERMINAL: failed to change directory,", logger.Args("err", err.Error()))
+	}
+}
+
+// closeShellSession ends the shell of cmd mode
+func closeShellSession() {
+	if shellSession != nil {
+		shellSession.Close()
+		shellSession = nil
+	}
+}
+
 // handleNuwaScript execute nuwa script according to the filepath
 func handleNuwaScript(ctx context.Context, filepath string) error {
 	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
@@ -96,17 +170,21 @@ func handleNuwaScript(ctx context.Context, filepath string) error {
 		logger.Error("NUWA TERMINAL: failed to create NuwaScript,", logger.Args("err", err.Error()))
 		return err
 	}
+	nuwa.SetSession(session)
 	return nuwa.Run(filepath)
 }
 
-// handleTaskMode execute task according to the prompt
-func handleTaskMode(ctx context.Context, prompt string) error {
+// handleTaskMode execute task according to the prompt, the input of the
+// user describes the script in the script library
+func handleTaskMode(ctx context.Context, prompt string, in string) error {
 	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
 	nuwa, err := nuwa.NewNuwaTask(ctx, prompt)
 	if err != nil {
 		logger.Error("NUWA TERMINAL: failed to create NuwaTask,", logger.Args("err", err.Error()))
 		return err
 	}
+	nuwa.SetSession(session)
+	nuwa.SetRequest(in)
 	return nuwa.Run(prompt)
 }
 
@@ -118,10 +196,10 @@ func handleAgentMode(ctx context.Context, input string) error {
 		logger.Error("NUWA TERMINAL: failed to create NuwaAgent,", logger.Args("err", err.Error()))
 		return err
 	}
+	nuwa.SetSession(session)
 	return nuwa.Run(input)
 }
 
-
 func newBashSession() {
 	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
 	cmd := exec.Command("bash")
@@ -135,6 +213,22 @@ func newBashSession() {
 	}
 }
 
+// exit ends the process, the tests replace it
+var exit = os.Exit
+
+// quit saves the input history and the session and exits the terminal, the
+// deferred saves do not run after exit
+func quit() {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	if pendingRecord != nil {
+		pendingRecord.save()
+	}
+	saveSession()
+	closeShellSession()
+	logger.Info("NUWA TERMINAL: Goodbye!")
+	exit(0)
+}
+
 // executor 主执行函数
 func executor(in string) {
 	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
@@ -144,50 +238,93 @@ func executor(in string) {
 		return
 	}
 
-	if in == Exit {
-		logger.Info("NUWA TERMINAL: Goodbye!")
-		os.Exit(0)
-	}
+	// every input is kept in the history, with the mode it went to and the
+	// commands it produced
+	record := newHistoryRecord(in)
+	pendingRecord = record
+	defer record.save()
 
-	if in == nuwa.BashMode {
-		newBashSession()
-		return
+	// the words the commands were typed with before they had a slash
+	if command, word, ok := slashcmd.Deprecated(in); ok {
+		logger.Warn("NUWA TERMINAL: " + word + " is deprecated, use " + command)
+		in = command
 	}
 
-	// 处理模式切换
-	if (in == nuwa.ChatMode) || (in == nuwa.CmdMode) || (in == nuwa.TaskMode) || (in == nuwa.AgentMode) {
-		modeManager.SwitchMode(in)
+	if slashcmd.IsCommand(in) {
+		ctx, done := requestContext(context.Background())
+		defer done()
+		if err := slashcmd.Execute(ctx, in); err != nil && !reportInterrupted(ctx) {
+			logger.Error("NUWA TERMINAL: failed to handle command,", logger.Args("err", err.Error()))
+		}
 		return
 	}
 
-	ctx := context.Background()
+	// Ctrl+C cancels the request, nuwa goes back to the prompt
+	ctx, done := requestContext(context.Background())
+	defer done()
+	if rest, ok := strings.CutPrefix(in, NoCachePrefix); ok {
+		// the answer to this request is asked to the model even if it is cached
+		in = strings.TrimSpace(rest)
+		ctx = llms.WithoutCache(ctx)
+	}
 	if isScript, err := handleScriptMode(ctx, in); err != nil {
+		if reportInterrupted(ctx) {
+			return
+		}
 		logger.Error("NUWA TERMINAL: failed to handle script mode,", logger.Args("err", err.Error()))
 		return
 	} else if isScript {
 		return
 	}
 
-	prompt := GetPromptAccordingToCurrentMode(in)
 	AddSuggest(in, "")
+	// in auto mode every input goes to the mode which fits it
+	route := modeManager.ResolveMode(ctx, in)
+	if route.By != "" {
+		logger.Info("NUWA TERMINAL: auto mode chose "+route.Mode, logger.Args("by", route.By))
+	}
+	mode, in := route.Mode, route.Input
+	record.setMode(mode)
+	prompt := GetPromptOfMode(mode, in)
+	ctx = llms.WithMode(ctx, mode)
+	ctx = nuwa.WithModeSandbox(ctx, mode)
+	if mode != nuwa.ChatMode {
+		recordUserInput(mode, in)
+	}
 
 	// 根据当前模式处理输入
 	var err error
-	switch modeManager.GetCurrentMode() {
+	switch mode {
 	case nuwa.ChatMode:
 		err = handleChatMode(ctx, in)
 	case nuwa.CmdMode:
 		err = handleCmdMode(ctx, prompt)
 		modeManager.CheckDirChanged()
 	case nuwa.TaskMode:
-		err = handleTaskMode(ctx, prompt)
+		err = handleTaskMode(ctx, prompt, in)
 	case nuwa.AgentMode:
 		err = handleAgentMode(ctx, in)
 	}
 
+	if reportInterrupted(ctx) {
+		return
+	}
+	if err != nil {
+		logger.Error("NUWA TERMINAL: Error executing command", logger.Args("mode", mode, "error", err.Error()))
+	}
+}
+
+// setupConfig loads the config file and makes the models use its profiles
+func setupConfig(path string, profile string) error {
+	cfg, err := config.LoadConfig(path)
 	if err != nil {
-		logger.Error("NUWA TERMINAL: Error executing command", logger.Args("mode", modeManager.GetCurrentMode(), "error", err.Error()))
+		return err
 	}
+	if err := cfg.SetOverride(profile); err != nil {
+		return fmt.Errorf("invalid --profile: %w", err)
+	}
+	llms.SetConfig(cfg)
+	return nil
 }
 
 func setCurrentWorkMode(flags *CommandFlags) {
@@ -229,6 +366,34 @@ func main() {
 	// Set initial mode
 	setCurrentWorkMode(flags)
 
+	// Load the LLM profiles, --profile selects one for every mode
+	if err := setupConfig(config.DefaultConfigPath(), flags.profile); err != nil {
+		logger.Fatal("NUWA TERMINAL: failed to load config,", logger.Args("err", err.Error()))
+	}
+
+	// Register the /commands of the terminal
+	if err := registerSlashCommands(); err != nil {
+		logger.Fatal("NUWA TERMINAL: failed to register commands,", logger.Args("err", err.Error()))
+	}
+
+	// Check every command against the policy before it runs
+	if err := nuwa.SetupPolicy(policy.DefaultConfigPath()); err != nil {
+		logger.Fatal("NUWA TERMINAL: failed to set up command policy,", logger.Args("err", err.Error()))
+	}
+
+	// Start a new session, or resume the saved one
+	if err := startSession(flags.resume); err != nil {
+		logger.Fatal("NUWA TERMINAL: failed to start session,", logger.Args("err", err.Error()))
+	}
+	defer saveSession()
+	defer closeShellSession()
+	llms.SetUsageRecorder(recordUsage)
+	loadInputHistory()
+	handleInterrupts()
+	if flags.resume != "" {
+		logger.Info("NUWA TERMINAL: session resumed", logger.Args("id", flags.resume))
+	}
+
 	// If there is a query, process it directly and exit
 	if flags.query != "" {
 		executor(flags.query)
@@ -248,11 +413,14 @@ func main() {
 			goterm.OptionPrefix(""),
 			goterm.OptionLivePrefix(modeManager.GetLivePrefix),
 			goterm.OptionTitle("NUWA TERMINAL"),
+			goterm.OptionHistory(inputHistory.Inputs()),
 			goterm.OptionAddKeyBind(
-				goterm.KeyBind{Key: goterm.ControlC, Fn: func(b *goterm.Buffer) { modeManager.SwitchMode(nuwa.ChatMode) }},
+				goterm.KeyBind{Key: goterm.ControlT, Fn: func(b *goterm.Buffer) { modeManager.SwitchMode(nuwa.ChatMode) }},
 				goterm.KeyBind{Key: goterm.ControlF, Fn: func(b *goterm.Buffer) { modeManager.SwitchMode(nuwa.CmdMode) }},
 				goterm.KeyBind{Key: goterm.ControlS, Fn: func(b *goterm.Buffer) { modeManager.SwitchMode(nuwa.TaskMode) }},
 				goterm.KeyBind{Key: goterm.ControlA, Fn: func(b *goterm.Buffer) { modeManager.SwitchMode(nuwa.AgentMode) }},
+				goterm.KeyBind{Key: goterm.ControlO, Fn: func(b *goterm.Buffer) { modeManager.SwitchMode(nuwa.AutoMode) }},
+				goterm.KeyBind{Key: goterm.ControlR, Fn: historySearch.next},
 			),
 		)
 		p.Run()
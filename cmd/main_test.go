@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/history"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nmemory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuitSavesLastInput(t *testing.T) {
+	dir := t.TempDir()
+	historyPath := filepath.Join(dir, "history")
+	inputHistory = history.NewStore(historyPath, history.DefaultMaxEntries)
+	sessionStore = nmemory.NewFileSessionStore(filepath.Join(dir, "sessions"))
+	assert.NoError(t, startSession(""))
+	assert.NoError(t, registerSlashCommands())
+	// the deferred saves do not run after os.Exit, what is on disk when
+	// exit is called is what is kept
+	code := -1
+	var inputs []string
+	exit = func(c int) {
+		code = c
+		saved := history.NewStore(historyPath, history.DefaultMaxEntries)
+		assert.NoError(t, saved.Load())
+		inputs = saved.Inputs()
+	}
+	t.Cleanup(func() { exit = os.Exit })
+
+	executor("/quit")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, []string{"/quit"}, inputs)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/cmdexe"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nmemory"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nuwa"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/scriptlib"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/slashcmd"
+	"github.com/pterm/pterm"
+)
+
+const (
+	ScriptsCmd    = "scripts"
+	ScriptsList   = "list"
+	ScriptsSearch = "search"
+	ScriptsShow   = "show"
+	ScriptsRun    = "run"
+	ScriptsEdit   = "edit"
+	ScriptsRemove = "rm"
+	ScriptsTag    = "tag"
+	// ScriptsSandbox makes "/scripts run" run the script in the sandbox
+	ScriptsSandbox = "--sandbox"
+)
+
+// runScriptsCommand runs "/scripts [list|search|show|run|edit|rm|tag]"
+func runScriptsCommand(ctx context.Context, args []string) error {
+	library := scriptlib.NewLibrary(scriptlib.DefaultLibraryDir())
+	sandboxed := slices.Contains(args, ScriptsSandbox)
+	if sandboxed {
+		args = slices.DeleteFunc(slices.Clone(args), func(arg string) bool { return arg == ScriptsSandbox })
+		ctx = cmdexe.WithSandbox(ctx, nuwa.NewSandbox())
+	}
+	if sandboxed && (len(args) != 2 || args[0] != ScriptsRun) {
+		return slashcmd.ErrUsage
+	}
+	if len(args) == 0 || (len(args) == 1 && args[0] == ScriptsList) {
+		return listScripts(library, "")
+	}
+
+	action := args[0]
+	if action == ScriptsSearch && len(args) > 1 {
+		return listScripts(library, strings.Join(args[1:], " "))
+	}
+	if action == ScriptsTag && len(args) > 1 {
+		return tagScript(library, args[1], args[2:])
+	}
+	if len(args) != 2 {
+		return slashcmd.ErrUsage
+	}
+
+	name := args[1]
+	switch action {
+	case ScriptsShow:
+		return showScript(library, name)
+	case ScriptsRun:
+		return runScript(ctx, library, name)
+	case ScriptsEdit:
+		return editScript(library, name)
+	case ScriptsRemove:
+		return removeScript(library, name)
+	default:
+		return slashcmd.ErrUsage
+	}
+}
+
+// completeScripts completes the action, then the name of a script of the library
+func completeScripts(args []string) []slashcmd.Suggestion {
+	switch {
+	case len(args) == 1:
+		return []slashcmd.Suggestion{
+			{Text: ScriptsList, Description: "List the scripts kept in the script library"},
+			{Text: ScriptsSearch, Description: "Search the scripts by request, name or tags"},
+			{Text: ScriptsShow, Description: "Show a script and its runs"},
+			{Text: ScriptsRun, Description: "Run a script, --sandbox tries it in the sandbox"},
+			{Text: ScriptsEdit, Description: "Edit a script in $EDITOR"},
+			{Text: ScriptsRemove, Description: "Delete a script"},
+			{Text: ScriptsTag, Description: "Set the tags of a script"},
+		}
+	case len(args) == 2 && args[0] != ScriptsList && args[0] != ScriptsSearch:
+		scripts, err := scriptlib.NewLibrary(scriptlib.DefaultLibraryDir()).List()
+		if err != nil {
+			return nil
+		}
+		suggestions := []slashcmd.Suggestion{}
+		for _, s := range scripts {
+			suggestions = append(suggestions, slashcmd.Suggestion{Text: s.Name, Description: s.Prompt})
+		}
+		return suggestions
+	case len(args) == 3 && args[0] == ScriptsRun:
+		return []slashcmd.Suggestion{{Text: ScriptsSandbox, Description: "Try the script in the sandbox"}}
+	}
+	return nil
+}
+
+// listScripts shows the scripts of the library, the ones matching the query if there is one
+func listScripts(library *scriptlib.Library, query string) error {
+	var scripts []*scriptlib.Script
+	var err error
+	if query == "" {
+		scripts, err = library.List()
+	} else {
+		scripts, err = library.Search(query)
+	}
+	if err != nil {
+		return err
+	}
+	if len(scripts) == 0 {
+		pterm.Info.Println("No scripts found, the scripts of task mode which worked are kept here")
+		return nil
+	}
+
+	data := pterm.TableData{{"Name", "Request", "Tags", "Runs", "Last run"}}
+	for _, s := range scripts {
+		lastRun := "never"
+		if run := s.LastRun(); run != nil {
+			lastRun = fmt.Sprintf("%s, exit %d", run.Time.Format("2006-01-02 15:04:05"), run.ExitCode)
+		}
+		data = append(data, []string{s.Name, s.Prompt, strings.Join(s.Tags, ", "), strconv.Itoa(len(s.Runs)), lastRun})
+	}
+	return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
+
+func showScript(library *scriptlib.Library, name string) error {
+	s, err := library.Get(name)
+	if err != nil {
+		return err
+	}
+
+	pterm.DefaultSection.Println(s.Name)
+	fmt.Println("Request: " + s.Prompt)
+	if s.Model != "" {
+		fmt.Println("Model:   " + s.Model)
+	}
+	if s.Language != "" {
+		fmt.Println("Lang:    " + s.Language)
+	}
+	if len(s.Tags) > 0 {
+		fmt.Println("Tags:    " + strings.Join(s.Tags, ", "))
+	}
+	fmt.Println("Created: " + s.CreatedAt.Format("2006-01-02 15:04:05"))
+	fmt.Println("Updated: " + s.UpdatedAt.Format("2006-01-02 15:04:05"))
+	fmt.Println("File:    " + library.Path(s))
+	pterm.DefaultBox.WithTitle("Script").Println(strings.TrimRight(s.Content, "\n"))
+
+	if len(s.Runs) > 0 {
+		data := pterm.TableData{{"Run", "Exit code", "Duration"}}
+		for _, run := range s.Runs {
+			data = append(data, []string{run.Time.Format("2006-01-02 15:04:05"), strconv.Itoa(run.ExitCode), run.Duration.Round(time.Millisecond).String()})
+		}
+		return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+	}
+	return nil
+}
+
+// runScript runs a script of the library, the run is added to its history
+// and to the session. A run in the sandbox is not added to the history.
+func runScript(ctx context.Context, library *scriptlib.Library, name string) error {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	s, err := library.Get(name)
+	if err != nil {
+		return err
+	}
+	interpreter, err := nuwa.Interpreters().Lookup(s.Language)
+	if err != nil {
+		return err
+	}
+	input := slashcmd.Prefix + ScriptsCmd + " " + ScriptsRun + " " + name
+	if cmdexe.SandboxFrom(ctx) != nil {
+		input += " " + ScriptsSandbox
+	}
+	recordUserInput(nuwa.TaskMode, input)
+
+	result, err := interpreter.Run(ctx, library.Path(s))
+	if result == nil {
+		return err
+	}
+	recordSessionEntry(nuwa.TaskMode, nmemory.EntryOutput, result.String())
+	if result.Sandboxed {
+		nuwa.ShowSandboxChanges(result)
+		if err != nil {
+			return err
+		}
+		logger.Info("NUWA TERMINAL: script executed in the sandbox, run it on the system with: " + slashcmd.Prefix + ScriptsCmd + " " + ScriptsRun + " " + name)
+		return nil
+	}
+	if recordErr := library.RecordRun(name, scriptlib.Run{ExitCode: result.ExitCode, Duration: result.Duration}); recordErr != nil {
+		logger.Warn("NUWA TERMINAL: failed to record script run,", logger.Args("err", recordErr.Error()))
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info("NUWA TERMINAL: script executed", logger.Args("name", name))
+	return nil
+}
+
+func editScript(library *scriptlib.Library, name string) error {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	s, err := library.Get(name)
+	if err != nil {
+		return err
+	}
+	edited, err := nuwa.EditInEditor(s.Content)
+	if err != nil {
+		return err
+	}
+	if edited == s.Content {
+		pterm.Info.Println("The script is not changed")
+		return nil
+	}
+	s.Content = edited
+	s.UpdatedAt = time.Now()
+	if err := library.Save(s); err != nil {
+		return err
+	}
+	logger.Info("NUWA TERMINAL: script saved", logger.Args("name", name))
+	return nil
+}
+
+func removeScript(library *scriptlib.Library, name string) error {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	if err := library.Delete(name); err != nil {
+		return err
+	}
+	logger.Info("NUWA TERMINAL: script deleted", logger.Args("name", name))
+	return nil
+}
+
+// tagScript replaces the tags of a script, no tags removes them
+func tagScript(library *scriptlib.Library, name string, tags []string) error {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	s, err := library.Get(name)
+	if err != nil {
+		return err
+	}
+	s.Tags = tags
+	s.UpdatedAt = time.Now()
+	if err := library.Save(s); err != nil {
+		return err
+	}
+	logger.Info("NUWA TERMINAL: script tagged", logger.Args("name", name, "tags", strings.Join(tags, ", ")))
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nmemory"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/slashcmd"
+	"github.com/pterm/pterm"
+)
+
+const (
+	SessionsCmd    = "sessions"
+	SessionsList   = "list"
+	SessionsShow   = "show"
+	SessionsResume = "resume"
+	SessionsDelete = "delete"
+)
+
+var (
+	sessionStore nmemory.SessionStore = nmemory.NewFileSessionStore(nmemory.DefaultSessionDir())
+	// session records everything happening in the terminal, it is saved after every change
+	session *nmemory.ChatHistory = nil
+)
+
+// startSession starts a new session, or resumes the session with the given id
+func startSession(id string) error {
+	if id == "" {
+		session = nmemory.NewFileChatHistory(sessionStore, nmemory.NewSession())
+		return nil
+	}
+
+	saved, err := sessionStore.Load(id)
+	if err != nil {
+		return err
+	}
+	session = nmemory.NewFileChatHistory(sessionStore, saved)
+	// the chat mode is created again with the messages of the resumed session
+	chatSession = nil
+	return nil
+}
+
+// saveSession writes the current session to disk
+func saveSession() {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	if session == nil {
+		return
+	}
+	if err := session.Save(); err != nil {
+		logger.Error("NUWA TERMINAL: failed to save session,", logger.Args("err", err.Error()))
+	}
+}
+
+// recordUserInput records the input of the modes which do not record it by themselves
+func recordUserInput(mode string, in string) {
+	recordSessionEntry(mode, nmemory.EntryUser, in)
+}
+
+// recordSessionEntry records what happened in the current session
+func recordSessionEntry(mode string, kind nmemory.EntryKind, content string) {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	if session == nil {
+		return
+	}
+	if err := session.AddEntry(mode, kind, content); err != nil {
+		logger.Warn("NUWA TERMINAL: failed to save session,", logger.Args("err", err.Error()))
+	}
+}
+
+// runSessionsCommand runs "/sessions [list|show|resume|delete <id>]"
+func runSessionsCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 || (len(args) == 1 && args[0] == SessionsList) {
+		return listSessions()
+	}
+	if len(args) != 2 {
+		return slashcmd.ErrUsage
+	}
+
+	action, id := args[0], args[1]
+	switch action {
+	case SessionsShow:
+		return showSession(id)
+	case SessionsResume:
+		return resumeSession(id)
+	case SessionsDelete:
+		return deleteSession(id)
+	default:
+		return slashcmd.ErrUsage
+	}
+}
+
+// completeSessions completes the action, then the id of a saved session
+func completeSessions(args []string) []slashcmd.Suggestion {
+	if len(args) == 1 {
+		return []slashcmd.Suggestion{
+			{Text: SessionsList, Description: "List saved sessions"},
+			{Text: SessionsShow, Description: "Show what happened in a session"},
+			{Text: SessionsResume, Description: "Continue a saved session"},
+			{Text: SessionsDelete, Description: "Delete a saved session"},
+		}
+	}
+	if len(args) != 2 || args[0] == SessionsList {
+		return nil
+	}
+	sessions, err := sessionStore.List()
+	if err != nil {
+		return nil
+	}
+	suggestions := []slashcmd.Suggestion{}
+	for _, s := range sessions {
+		suggestions = append(suggestions, slashcmd.Suggestion{Text: s.ID, Description: s.Title})
+	}
+	return suggestions
+}
+
+func listSessions() error {
+	sessions, err := sessionStore.List()
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		pterm.Info.Println("No saved sessions")
+		return nil
+	}
+
+	data := pterm.TableData{{"ID", "Title", "Entries", "Updated"}}
+	for _, s := range sessions {
+		data = append(data, []string{s.ID, s.Title, strconv.Itoa(len(s.Entries)), s.UpdatedAt.Format("2006-01-02 15:04:05")})
+	}
+	return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
+
+func showSession(id string) error {
+	saved, err := sessionStore.Load(id)
+	if err != nil {
+		return err
+	}
+
+	pterm.DefaultSection.Println(saved.ID + " " + saved.Title)
+	printEntries(saved.Entries)
+	return nil
+}
+
+// printEntries shows the entries of a session, colored by their kind
+func printEntries(entries []nmemory.Entry) {
+	for _, entry := range entries {
+		header := fmt.Sprintf("[%s] %s %s", entry.Time.Format("15:04:05"), entry.Mode, entry.Kind)
+		switch entry.Kind {
+		case nmemory.EntryUser:
+			pterm.FgCyan.Println(header)
+		case nmemory.EntryAI:
+			pterm.FgLightMagenta.Println(header)
+		default:
+			pterm.FgGray.Println(header)
+		}
+		if entry.Content != "" {
+			fmt.Println(entry.Content)
+		}
+	}
+}
+
+func resumeSession(id string) error {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	saveSession()
+	if err := startSession(id); err != nil {
+		return err
+	}
+	logger.Info("NUWA TERMINAL: session resumed", logger.Args("id", id))
+	return nil
+}
+
+func deleteSession(id string) error {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	if session != nil && session.Session().ID == id {
+		return fmt.Errorf("can not delete the current session %s", id)
+	}
+	if err := sessionStore.Delete(id); err != nil {
+		return err
+	}
+	logger.Info("NUWA TERMINAL: session deleted", logger.Args("id", id))
+	return nil
+}
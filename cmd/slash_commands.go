@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nmemory"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nuwa"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/slashcmd"
+	"github.com/pterm/pterm"
+)
+
+// defaultHistoryEntries is how many entries /history shows without a number
+const defaultHistoryEntries = 10
+
+// switchableModes are the modes /mode switches to
+var switchableModes = []string{nuwa.ChatMode, nuwa.CmdMode, nuwa.TaskMode, nuwa.AgentMode, nuwa.AutoMode}
+
+// registerSlashCommands adds the commands of the terminal, /help is built in
+func registerSlashCommands() error {
+	commands := []*slashcmd.Command{
+		{
+			Name:        "mode",
+			Args:        "[name]",
+			Description: "Show the current mode, or switch to chat, cmd, task, agent or auto mode",
+			Complete:    completeFirst(modeSuggestions),
+			Run:         runModeCommand,
+		},
+		{
+			Name:        "model",
+			Args:        "[name|default]",
+			Description: "Show the model of every mode, or use another model with the current profiles",
+			Complete:    completeFirst(modelSuggestions),
+			Run:         runModelCommand,
+		},
+		{
+			Name:        "profile",
+			Args:        "[name|default]",
+			Description: "List the LLM profiles, or use one in every mode like --profile",
+			Complete:    completeFirst(profileSuggestions),
+			Run:         runProfileCommand,
+		},
+		{
+			Name:        "sandbox",
+			Args:        "[on|off]",
+			Description: "Show whether the commands of the current mode run in the sandbox, or put them in or out of it",
+			Complete: completeFirst(func() []slashcmd.Suggestion {
+				return []slashcmd.Suggestion{{Text: "on"}, {Text: "off"}}
+			}),
+			Run: runSandboxCommand,
+		},
+		{
+			Name:        "clear",
+			Description: "Clear the chat history of the current chat session",
+			Run: func(ctx context.Context, args []string) error {
+				if len(args) != 0 {
+					return slashcmd.ErrUsage
+				}
+				handleClearChat()
+				return nil
+			},
+		},
+		{
+			Name:        "new",
+			Description: "Save the session and start a new chat session",
+			Run: func(ctx context.Context, args []string) error {
+				if len(args) != 0 {
+					return slashcmd.ErrUsage
+				}
+				handleNewChat()
+				return nil
+			},
+		},
+		{
+			Name:        "bash",
+			Description: "Start a bash shell, exit it to come back",
+			Run: func(ctx context.Context, args []string) error {
+				if len(args) != 0 {
+					return slashcmd.ErrUsage
+				}
+				newBashSession()
+				return nil
+			},
+		},
+		{
+			Name:        "save",
+			Args:        "[file]",
+			Description: "Save the session, and write its transcript to the file if one is given",
+			Run:         runSaveCommand,
+		},
+		{
+			Name:        "history",
+			Args:        "[n]",
+			Description: "Show the last entries of the session, " + strconv.Itoa(defaultHistoryEntries) + " by default",
+			Run:         runHistoryCommand,
+		},
+		{
+			Name:        "undo",
+			Description: "Forget the last input and the answer to it, commands already run are not undone",
+			Run:         runUndoCommand,
+		},
+		{
+			Name:        SessionsCmd,
+			Args:        "[list|show|resume|delete <id>]",
+			Description: "List the saved sessions, or show, resume or delete one",
+			Complete:    completeSessions,
+			Run:         runSessionsCommand,
+		},
+		{
+			Name:        UsageCmd,
+			Args:        "[all|<id>]",
+			Description: "Show the tokens and cost of this session, of every saved session, or of one",
+			Complete: completeFirst(func() []slashcmd.Suggestion {
+				return []slashcmd.Suggestion{{Text: UsageAll, Description: "every saved session"}}
+			}),
+			Run: runUsageCommand,
+		},
+		{
+			Name:        CacheCmd,
+			Args:        "[stats|clear]",
+			Description: "Show what is in the response cache, or remove every cached answer",
+			Complete: completeFirst(func() []slashcmd.Suggestion {
+				return []slashcmd.Suggestion{{Text: CacheStats}, {Text: CacheClear}}
+			}),
+			Run: runCacheCommand,
+		},
+		{
+			Name:        ScriptsCmd,
+			Args:        "[list|search <query>|show|run|edit|rm <name>|tag <name> [tag...]]",
+			Description: "List, search, show, run, edit, delete or tag the scripts of the script library",
+			Complete:    completeScripts,
+			Run:         runScriptsCommand,
+		},
+		{
+			Name:        "config",
+			Description: "Show the config file and the profile and model of every mode",
+			Run:         runConfigCommand,
+		},
+		{
+			Name:        "quit",
+			Aliases:     []string{"exit"},
+			Description: "Save the session and exit the terminal",
+			Run: func(ctx context.Context, args []string) error {
+				quit()
+				return nil
+			},
+		},
+	}
+	for _, cmd := range commands {
+		if err := slashcmd.Register(cmd); err != nil {
+			return err
+		}
+	}
+	return registerDeprecatedWords()
+}
+
+// registerDeprecatedWords keeps the words the commands were typed with
+// before they had a slash, they print a warning
+func registerDeprecatedWords() error {
+	words := map[string]string{
+		ClearChat:     "/clear",
+		NewChat:       "/new",
+		Exit:          "/quit",
+		nuwa.BashMode: "/bash",
+		SessionsCmd:   "/" + SessionsCmd,
+		UsageCmd:      "/" + UsageCmd,
+		CacheCmd:      "/" + CacheCmd,
+		ScriptsCmd:    "/" + ScriptsCmd,
+	}
+	for _, mode := range switchableModes {
+		words[mode] = "/mode " + strings.TrimSuffix(mode, "mode")
+	}
+	for word, input := range words {
+		if err := slashcmd.Deprecate(word, input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// completeFirst completes the first argument only
+func completeFirst(suggestions func() []slashcmd.Suggestion) func(args []string) []slashcmd.Suggestion {
+	return func(args []string) []slashcmd.Suggestion {
+		if len(args) > 1 {
+			return nil
+		}
+		return suggestions()
+	}
+}
+
+func modeSuggestions() []slashcmd.Suggestion {
+	suggestions := []slashcmd.Suggestion{}
+	for _, mode := range switchableModes {
+		suggestions = append(suggestions, slashcmd.Suggestion{Text: strings.TrimSuffix(mode, "mode")})
+	}
+	return suggestions
+}
+
+func modelSuggestions() []slashcmd.Suggestion {
+	seen := map[string]bool{}
+	suggestions := []slashcmd.Suggestion{{Text: config.DefaultProfileName, Description: "the model of the profile"}}
+	cfg := llms.GetConfig()
+	for _, name := range cfg.ProfileNames() {
+		model := cfg.Profiles[name].Model
+		if model == "" || seen[model] {
+			continue
+		}
+		seen[model] = true
+		suggestions = append(suggestions, slashcmd.Suggestion{Text: model, Description: "profile " + name})
+	}
+	return suggestions
+}
+
+func profileSuggestions() []slashcmd.Suggestion {
+	suggestions := []slashcmd.Suggestion{{Text: config.DefaultProfileName, Description: "the profiles of the config"}}
+	cfg := llms.GetConfig()
+	for _, name := range cfg.ProfileNames() {
+		suggestions = append(suggestions, slashcmd.Suggestion{Text: name, Description: cfg.Profiles[name].Backend})
+	}
+	return suggestions
+}
+
+// parseMode accepts a mode with or without its "mode" suffix, like "cmd"
+func parseMode(name string) (string, bool) {
+	name = strings.ToLower(name)
+	for _, mode := range switchableModes {
+		if name == mode || name+"mode" == mode {
+			return mode, true
+		}
+	}
+	return "", false
+}
+
+func runModeCommand(ctx context.Context, args []string) error {
+	switch len(args) {
+	case 0:
+		fmt.Println("Current mode: " + modeManager.GetCurrentMode())
+		return nil
+	case 1:
+		mode, ok := parseMode(args[0])
+		if !ok {
+			return fmt.Errorf("unknown mode %s", args[0])
+		}
+		modeManager.SwitchMode(mode)
+		return nil
+	default:
+		return slashcmd.ErrUsage
+	}
+}
+
+func runSandboxCommand(ctx context.Context, args []string) error {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	cfg := llms.GetConfig()
+	mode := modeManager.GetCurrentMode()
+	switch {
+	case len(args) == 0:
+		if cfg.Sandboxed(mode) {
+			fmt.Println("The commands of " + mode + " run in the sandbox: " + nuwa.NewSandbox().String())
+		} else {
+			fmt.Println("The commands of " + mode + " run on the system")
+		}
+		return nil
+	case len(args) == 1 && (args[0] == "on" || args[0] == "off"):
+		if os.Getenv(config.SandboxEnv) != "" {
+			logger.Warn("NUWA TERMINAL: " + config.SandboxEnv + " is set, it wins over /sandbox")
+		}
+		cfg.SetSandboxed(mode, args[0] == "on")
+		logger.Info("NUWA TERMINAL: sandbox "+args[0], logger.Args("mode", mode))
+		return nil
+	default:
+		return slashcmd.ErrUsage
+	}
+}
+
+func runModelCommand(ctx context.Context, args []string) error {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	switch len(args) {
+	case 0:
+		return showModeProfiles()
+	case 1:
+		model := args[0]
+		if model == config.DefaultProfileName {
+			model = ""
+		}
+		llms.GetConfig().SetModel(model)
+		// the chat mode is created again with the new model, its history is
+		// restored from the session
+		chatSession = nil
+		if model == "" {
+			logger.Info("NUWA TERMINAL: using the models of the profiles")
+		} else {
+			logger.Info("NUWA TERMINAL: using model " + model + " in every mode")
+		}
+		return nil
+	default:
+		return slashcmd.ErrUsage
+	}
+}
+
+func runProfileCommand(ctx context.Context, args []string) error {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	cfg := llms.GetConfig()
+	switch len(args) {
+	case 0:
+		names := cfg.ProfileNames()
+		if len(names) == 0 {
+			pterm.Info.Println("No profiles are configured in " + config.DefaultConfigPath())
+			return nil
+		}
+		data := pterm.TableData{{"Profile", "Backend", "Model", "Base URL"}}
+		for _, name := range names {
+			p := cfg.Profiles[name]
+			data = append(data, []string{name, p.Backend, p.Model, p.BaseURL})
+		}
+		return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+	case 1:
+		name := args[0]
+		if name == config.DefaultProfileName {
+			if _, ok := cfg.Profiles[name]; !ok {
+				name = ""
+			}
+		}
+		if err := cfg.SetOverride(name); err != nil {
+			return err
+		}
+		chatSession = nil
+		if name == "" {
+			logger.Info("NUWA TERMINAL: using the profiles of the config")
+		} else {
+			logger.Info("NUWA TERMINAL: using profile " + name + " in every mode")
+		}
+		return nil
+	default:
+		return slashcmd.ErrUsage
+	}
+}
+
+func runSaveCommand(ctx context.Context, args []string) error {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	if len(args) > 1 {
+		return slashcmd.ErrUsage
+	}
+	if session == nil {
+		return fmt.Errorf("no session is active")
+	}
+	if err := session.Save(); err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+	logger.Info("NUWA TERMINAL: session saved", logger.Args("id", session.Session().ID))
+	if len(args) == 0 {
+		return nil
+	}
+
+	if err := os.WriteFile(args[0], []byte(transcript(session.Session())), 0644); err != nil {
+		return fmt.Errorf("failed to write transcript: %w", err)
+	}
+	logger.Info("NUWA TERMINAL: transcript written", logger.Args("file", args[0]))
+	return nil
+}
+
+// transcript is the session as markdown
+func transcript(s *nmemory.Session) string {
+	var text strings.Builder
+	title := s.Title
+	if title == "" {
+		title = s.ID
+	}
+	text.WriteString("# " + title + "\n")
+	for _, entry := range s.Entries {
+		fmt.Fprintf(&text, "\n## [%s] %s %s\n", entry.Time.Format("2006-01-02 15:04:05"), entry.Mode, entry.Kind)
+		if entry.Content != "" {
+			text.WriteString("\n" + entry.Content + "\n")
+		}
+	}
+	return text.String()
+}
+
+func runHistoryCommand(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return slashcmd.ErrUsage
+	}
+	count := defaultHistoryEntries
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return slashcmd.ErrUsage
+		}
+		count = n
+	}
+	if session == nil {
+		return fmt.Errorf("no session is active")
+	}
+
+	entries := session.Session().Entries
+	if len(entries) == 0 {
+		pterm.Info.Println("Nothing happened in this session yet")
+		return nil
+	}
+	printEntries(entries[max(0, len(entries)-count):])
+	return nil
+}
+
+func runUndoCommand(ctx context.Context, args []string) error {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	if len(args) != 0 {
+		return slashcmd.ErrUsage
+	}
+	if session == nil {
+		return fmt.Errorf("no session is active")
+	}
+	removed, err := session.Undo(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to undo: %w", err)
+	}
+	if len(removed) == 0 {
+		pterm.Info.Println("Nothing to undo")
+		return nil
+	}
+	if chatSession != nil {
+		if err := chatSession.SetSession(session); err != nil {
+			return err
+		}
+	}
+	logger.Info("NUWA TERMINAL: undone", logger.Args("mode", removed[0].Mode, "input", removed[0].Content))
+	return nil
+}
+
+func runConfigCommand(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return slashcmd.ErrUsage
+	}
+	fmt.Println("Config file: " + config.DefaultConfigPath())
+	return showModeProfiles()
+}
+
+// showModeProfiles shows the profile and model each mode uses
+func showModeProfiles() error {
+	cfg := llms.GetConfig()
+	modes := append(append([]string{}, switchableModes...), nuwa.ScriptMode)
+	sort.Strings(modes)
+	data := pterm.TableData{{"Mode", "Profile", "Backend", "Model"}}
+	for _, mode := range modes {
+		profile, err := cfg.Profile(mode)
+		if err != nil {
+			data = append(data, []string{mode, cfg.ProfileName(mode), "", err.Error()})
+			continue
+		}
+		data = append(data, []string{mode, profile.Name, profile.Backend, profile.Model})
+	}
+	return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
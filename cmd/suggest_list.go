@@ -5,15 +5,14 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/slashcmd"
+
 	goterm "github.com/c-bata/go-prompt"
 )
 
+// suggests are the past inputs, the commands are completed by slashcmd
 var suggests = []goterm.Suggest{
-	{Text: "chatmode", Description: "Set terminal as a pure chat robot mode"},
-	{Text: "cmdmode", Description: "Set terminal as a command mode, use natural language to communicate"},
-	{Text: "taskmode", Description: "Set terminal as a task mode, use natural language to communicate to execute tasks"},
-	{Text: "agentmode", Description: "Set terminal as an agent mode, use agent to do some automation work"},
-	{Text: "exit", Description: "Exit the terminal"},
+	{Text: "/help", Description: "List the slash commands of the terminal"},
 }
 
 func AddSuggest(text string, description string) {
@@ -36,6 +35,15 @@ func completer(in goterm.Document) []goterm.Suggest {
 	}
 	suggest := []goterm.Suggest{}
 
+	// slash commands complete their names and arguments, a path like /usr
+	// falls through to the file path completion
+	if commands := slashcmd.Complete(in.TextBeforeCursor()); len(commands) > 0 {
+		for _, c := range commands {
+			suggest = append(suggest, goterm.Suggest{Text: c.Text, Description: c.Description})
+		}
+		return suggest
+	}
+
 	// 检查是否是文件路径补全
 	if strings.HasPrefix(in.Text, "./") || strings.HasPrefix(in.Text, "/") {
 		dir := filepath.Dir(in.Text)
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nmemory"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/slashcmd"
+	"github.com/pterm/pterm"
+)
+
+const (
+	UsageCmd = "usage"
+	UsageAll = "all"
+)
+
+// recordUsage records the tokens of every call to a model in the current session
+func recordUsage(ctx context.Context, usage llms.Usage) {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	if session == nil {
+		return
+	}
+	err := session.AddUsage(nmemory.Usage{
+		Mode:             usage.Mode,
+		Profile:          usage.Profile,
+		Backend:          usage.Backend,
+		Model:            usage.Model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		Estimated:        usage.Estimated,
+	})
+	if err != nil {
+		logger.Warn("NUWA TERMINAL: failed to save session,", logger.Args("err", err.Error()))
+	}
+}
+
+// runUsageCommand runs "/usage [all|<session id>]"
+func runUsageCommand(ctx context.Context, args []string) error {
+	switch {
+	case len(args) == 0:
+		if session == nil {
+			return fmt.Errorf("no session is active")
+		}
+		return showUsage(session.Session())
+	case len(args) == 1 && args[0] == UsageAll:
+		return showAllUsage()
+	case len(args) == 1:
+		saved, err := sessionStore.Load(args[0])
+		if err != nil {
+			return err
+		}
+		return showUsage(saved)
+	default:
+		return slashcmd.ErrUsage
+	}
+}
+
+// usageTotal adds up the usage of several calls
+type usageTotal struct {
+	calls            int
+	promptTokens     int
+	completionTokens int
+	cost             float64
+	// unpriced is set when a model without a known price was used
+	unpriced bool
+	// estimated is set when the tokens of a call were estimated
+	estimated bool
+}
+
+func (t *usageTotal) add(usage nmemory.Usage) {
+	t.calls++
+	t.promptTokens += usage.PromptTokens
+	t.completionTokens += usage.CompletionTokens
+	cost, ok := llms.Cost(usage.Backend, usage.Model, usage.PromptTokens, usage.CompletionTokens)
+	t.cost += cost
+	t.unpriced = t.unpriced || !ok
+	t.estimated = t.estimated || usage.Estimated
+}
+
+// row returns the columns of the total: calls, prompt and completion
+// tokens, and the cost
+func (t *usageTotal) row() []string {
+	tokens := func(n int) string {
+		if t.estimated {
+			return "~" + strconv.Itoa(n)
+		}
+		return strconv.Itoa(n)
+	}
+	cost := fmt.Sprintf("$%.4f", t.cost)
+	if t.unpriced {
+		cost += " (unpriced models)"
+	}
+	return []string{strconv.Itoa(t.calls), tokens(t.promptTokens), tokens(t.completionTokens), cost}
+}
+
+// showUsage shows the usage of a session per mode and per profile
+func showUsage(s *nmemory.Session) error {
+	if len(s.Usage) == 0 {
+		pterm.Info.Println("No LLM calls in this session")
+		return nil
+	}
+
+	byMode := map[string]*usageTotal{}
+	byProfile := map[string]*usageTotal{}
+	total := &usageTotal{}
+	for _, usage := range s.Usage {
+		addTo(byMode, valueOrNone(usage.Mode), usage)
+		profile := usage.Profile
+		if usage.Model != "" {
+			profile += " (" + usage.Model + ")"
+		}
+		addTo(byProfile, profile, usage)
+		total.add(usage)
+	}
+
+	pterm.DefaultSection.Println("Usage of session " + s.ID)
+	if err := renderUsage("Mode", byMode, total); err != nil {
+		return err
+	}
+	return renderUsage("Profile", byProfile, total)
+}
+
+// showAllUsage shows the usage of every saved session
+func showAllUsage() error {
+	sessions, err := sessionStore.List()
+	if err != nil {
+		return err
+	}
+
+	data := pterm.TableData{{"ID", "Title", "Calls", "Prompt tokens", "Completion tokens", "Cost"}}
+	total := &usageTotal{}
+	for _, s := range sessions {
+		if len(s.Usage) == 0 {
+			continue
+		}
+		sessionTotal := &usageTotal{}
+		for _, usage := range s.Usage {
+			sessionTotal.add(usage)
+			total.add(usage)
+		}
+		data = append(data, append([]string{s.ID, s.Title}, sessionTotal.row()...))
+	}
+	if len(data) == 1 {
+		pterm.Info.Println("No LLM calls in the saved sessions")
+		return nil
+	}
+	data = append(data, append([]string{"Total", ""}, total.row()...))
+	return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
+
+func addTo(totals map[string]*usageTotal, key string, usage nmemory.Usage) {
+	if totals[key] == nil {
+		totals[key] = &usageTotal{}
+	}
+	totals[key].add(usage)
+}
+
+func renderUsage(header string, totals map[string]*usageTotal, total *usageTotal) error {
+	keys := make([]string, 0, len(totals))
+	for key := range totals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	data := pterm.TableData{{header, "Calls", "Prompt tokens", "Completion tokens", "Cost"}}
+	for _, key := range keys {
+		data = append(data, append([]string{key}, totals[key].row()...))
+	}
+	data = append(data, append([]string{"Total"}, total.row()...))
+	return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
+
+func valueOrNone(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
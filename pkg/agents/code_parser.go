@@ -6,6 +6,9 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/interpreter"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/parser"
 	"github.com/google/uuid"
 	"github.com/pterm/pterm"
@@ -13,7 +16,7 @@ import (
 )
 
 const (
-	Catchdir   = ".nuwa-terminal"
+	Catchdir   = config.Catchdir
 	ScriptsDir = "scripts"
 )
 
@@ -66,8 +69,13 @@ func ParseScript(response string) (filename, content string, err error) {
 	}
 
 	sources[0].ParseFileContent()
+	runner, err := interpreter.FromConfig(llms.GetConfig()).Lookup(sources[0].Language)
+	if err != nil {
+		logger.Error("No interpreter for the script in LLM response, error:", logger.Args("err", err.Error()))
+		return "", "", err
+	}
 
-	filename = uuid.New().String() + ".sh"
+	filename = uuid.New().String() + runner.Extension
 	content = sources[0].FileContent
 	return filename, content, nil
 }
@@ -0,0 +1,219 @@
+package agents
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	nuwaprmp "github.com/darmenliu/nuwa-terminal-chat/pkg/prompts"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/prompts"
+	"github.com/tmc/langchaingo/schema"
+	"github.com/tmc/langchaingo/tools"
+)
+
+// SchemaTool is a tool whose arguments are described with a JSON schema.
+// When the model calls tools natively, the JSON object of the arguments is
+// the input of Call.
+type SchemaTool interface {
+	tools.Tool
+	Parameters() map[string]any
+}
+
+// inputParameters are the arguments of a tool without a schema, its input
+// is a single string
+func inputParameters(tool tools.Tool) map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"input": map[string]any{
+				"type":        "string",
+				"description": "the input of " + tool.Name(),
+			},
+		},
+		"required": []string{"input"},
+	}
+}
+
+// toolDefinitions describes the tools to the model
+func toolDefinitions(agentTools []tools.Tool) []llms.Tool {
+	definitions := make([]llms.Tool, 0, len(agentTools))
+	for _, tool := range agentTools {
+		parameters := inputParameters(tool)
+		if schemaTool, ok := tool.(SchemaTool); ok {
+			parameters = schemaTool.Parameters()
+		}
+		definitions = append(definitions, llms.Tool{
+			Type: "function",
+			Function: &llms.FunctionDefinition{
+				Name:        tool.Name(),
+				Description: strings.TrimSpace(tool.Description()),
+				Parameters:  parameters,
+			},
+		})
+	}
+	return definitions
+}
+
+// toolInput is the input of the tool for the arguments of a tool call
+func toolInput(tool tools.Tool, arguments string) string {
+	if _, ok := tool.(SchemaTool); ok || tool == nil {
+		return arguments
+	}
+	args := struct {
+		Input string `json:"input"`
+	}{}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return arguments
+	}
+	return args.Input
+}
+
+// toolArguments is the reverse of toolInput, the arguments of the tool call
+// which gave the input
+func toolArguments(tool tools.Tool, input string) string {
+	if _, ok := tool.(SchemaTool); ok || tool == nil {
+		return input
+	}
+	data, err := json.Marshal(map[string]string{"input": input})
+	if err != nil {
+		return input
+	}
+	return string(data)
+}
+
+// createToolCallingPrompt is the system prompt of the agent when the model
+// calls tools natively
+func createToolCallingPrompt(maxSystemInfoLen int) (string, error) {
+	template := prompts.PromptTemplate{
+		Template:       nuwaprmp.SysPromptForAgentToolMode,
+		TemplateFormat: prompts.TemplateFormatGoTemplate,
+		PartialVariables: map[string]any{
+			"system_info":  nuwaprmp.GetSystemInfo(maxSystemInfoLen),
+			"current_time": time.Now().Format(time.RFC3339),
+		},
+	}
+	return template.Format(map[string]any{})
+}
+
+// planWithTools asks the model for the next step with the tools defined in
+// the request. The steps done so far are sent as the tool calls of the model
+// and their results, an answer without tool calls is the final answer.
+func (tbs *TroubleshootingAgent) planWithTools(
+	ctx context.Context,
+	intermediateSteps []schema.AgentStep,
+	inputs map[string]string,
+) ([]schema.AgentAction, *schema.AgentFinish, error) {
+	messages := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, tbs.systemPrompt),
+		llms.TextParts(llms.ChatMessageTypeHuman, inputs["input"]),
+	}
+	for _, step := range intermediateSteps {
+		tool := tbs.tool(step.Action.Tool)
+		messages = append(messages,
+			llms.MessageContent{
+				Role: llms.ChatMessageTypeAI,
+				Parts: []llms.ContentPart{llms.ToolCall{
+					ID:   step.Action.ToolID,
+					Type: "function",
+					FunctionCall: &llms.FunctionCall{
+						Name:      step.Action.Tool,
+						Arguments: toolArguments(tool, step.Action.ToolInput),
+					},
+				}},
+			},
+			llms.MessageContent{
+				Role: llms.ChatMessageTypeTool,
+				Parts: []llms.ContentPart{llms.ToolCallResponse{
+					ToolCallID: step.Action.ToolID,
+					Name:       step.Action.Tool,
+					Content:    step.Observation,
+				}},
+			},
+		)
+	}
+
+	// the answer is shown once it is complete, some clients stream the
+	// arguments of tool calls as raw JSON
+	if tbs.CallbacksHandler != nil {
+		tbs.CallbacksHandler.HandleChainStart(ctx, map[string]any{"input": inputs["input"]})
+	}
+	resp, err := tbs.LLM.GenerateContent(ctx, messages, llms.WithTools(toolDefinitions(tbs.Tools)))
+	if err == nil && len(resp.Choices) == 0 {
+		err = fmt.Errorf("model returned no answer")
+	}
+	if err != nil {
+		if tbs.CallbacksHandler != nil {
+			tbs.CallbacksHandler.HandleChainError(ctx, err)
+		}
+		return nil, nil, err
+	}
+
+	choice := resp.Choices[0]
+	actions := make([]schema.AgentAction, 0, len(choice.ToolCalls))
+	for _, call := range choice.ToolCalls {
+		if call.FunctionCall == nil {
+			continue
+		}
+		actions = append(actions, schema.AgentAction{
+			Tool:      call.FunctionCall.Name,
+			ToolInput: toolInput(tbs.tool(call.FunctionCall.Name), call.FunctionCall.Arguments),
+			Log:       toolCallLog(choice.Content, call.FunctionCall),
+			ToolID:    call.ID,
+		})
+	}
+
+	text := choice.Content
+	if len(actions) > 0 {
+		text = actions[0].Log
+	}
+	if tbs.CallbacksHandler != nil {
+		tbs.CallbacksHandler.HandleChainEnd(ctx, map[string]any{"text": text})
+	}
+	if len(actions) > 0 {
+		return actions, nil, nil
+	}
+
+	return nil, &schema.AgentFinish{
+		ReturnValues: map[string]any{tbs.OutputKey: choice.Content},
+		Log:          choice.Content,
+	}, nil
+}
+
+// toolCallLog describes a tool call like a step of the text format, so
+// the transcript reads the same whichever way the model calls tools
+func toolCallLog(thought string, call *llms.FunctionCall) string {
+	var log strings.Builder
+	if thought = strings.TrimSpace(thought); thought != "" {
+		log.WriteString("Thought: " + thought + "\n")
+	}
+	log.WriteString("Action: " + call.Name + "\nAction_input: " + displayArguments(call.Arguments))
+	return log.String()
+}
+
+// displayArguments shows the only argument of a call as it is, like the
+// script of ScriptExecutor, rather than quoted in JSON
+func displayArguments(arguments string) string {
+	args := map[string]any{}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil || len(args) != 1 {
+		return arguments
+	}
+	for _, value := range args {
+		if text, ok := value.(string); ok {
+			return "\n" + text
+		}
+	}
+	return arguments
+}
+
+// tool returns the tool with the name, or nil
+func (tbs *TroubleshootingAgent) tool(name string) tools.Tool {
+	for _, tool := range tbs.Tools {
+		if strings.EqualFold(tool.Name(), name) {
+			return tool
+		}
+	}
+	return nil
+}
@@ -2,16 +2,26 @@ package agents
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
 
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/cmdexe"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/interpreter"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/scriptcheck"
+	"github.com/google/uuid"
 	"github.com/pterm/pterm"
-	"github.com/tmc/langchaingo/tools"
+	"github.com/tmc/langchaingo/callbacks"
 )
 
 type ScriptExecutor struct {
+	// CallbacksHandler is told when a script starts and what it returned
+	CallbacksHandler callbacks.Handler
 }
 
-var _ tools.Tool = &ScriptExecutor{}
+var _ SchemaTool = &ScriptExecutor{}
 
 // Description returns a string describing the ScriptExecutor tool.
 func (e *ScriptExecutor) Description() string {
@@ -24,21 +34,114 @@ func (e *ScriptExecutor) Name() string {
 	return "ScriptExecutor"
 }
 
+// Parameters returns the arguments of the tool when the model calls it natively.
+func (e *ScriptExecutor) Parameters() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"script": map[string]any{
+				"type":        "string",
+				"description": "the content of the script to execute, a bash script starts with #!/bin/bash",
+			},
+			"language": map[string]any{
+				"type":        "string",
+				"description": "the language of the script, like bash or python, bash if not set",
+			},
+		},
+		"required": []string{"script"},
+	}
+}
+
 func (e *ScriptExecutor) Call(ctx context.Context, input string) (string, error) {
+	if e.CallbacksHandler != nil {
+		e.CallbacksHandler.HandleToolStart(ctx, input)
+	}
+	output, err := e.call(ctx, input)
+	if e.CallbacksHandler != nil {
+		if err != nil {
+			e.CallbacksHandler.HandleToolError(ctx, err)
+		} else {
+			e.CallbacksHandler.HandleToolEnd(ctx, output)
+		}
+	}
+	return output, err
+}
+
+func (e *ScriptExecutor) call(ctx context.Context, input string) (string, error) {
 	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
-	logger.Info("Start to parse the script from input:", logger.Args("input", input))
-	codeParser := &ScriptCodeParser{}
-	scriptfile, err := codeParser.ParseScriptAndSave(input)
+	logger.Info("Start to parse the script from input")
+	scriptfile, err := e.saveScript(input)
+	if errors.Is(err, interpreter.ErrUnsupportedLanguage) {
+		// the agent writes the script in another language on its next step
+		logger.Warn("No interpreter for the script:", logger.Args("err", err.Error()))
+		return "The script was not run: " + err.Error(), nil
+	}
 	if err != nil {
 		logger.Error("Failed to parse script from input, error:", logger.Args("err", err.Error()))
 		return "", err
 	}
+	runner, err := interpreter.FromConfig(llms.GetConfig()).ForFile(scriptfile)
+	if err != nil {
+		logger.Error("Failed to find the interpreter of the script, error:", logger.Args("err", err.Error()))
+		return "", err
+	}
+	if err := runner.Check(); err != nil {
+		logger.Warn("The interpreter of the script is not installed:", logger.Args("err", err.Error()))
+		return "The script was not run: " + err.Error(), nil
+	}
+	findings, err := checkScript(ctx, runner, scriptfile)
+	if err != nil {
+		logger.Error("Failed to check the script, error:", logger.Args("err", err.Error()))
+		return "", err
+	}
+	if scriptcheck.HasErrors(findings) {
+		// the agent fixes the script on its next step, it is not run
+		logger.Warn("The checks of the script found problems:", logger.Args("findings", len(findings)))
+		return "The script was not run, its checks found problems:\n" + scriptcheck.Report(findings), nil
+	}
 	logger.Info("Start to execute the script:", logger.Args("scriptfile", scriptfile))
-	scriptOutput, err := cmdexe.ExecScriptWithOutput(scriptfile)
+	result, err := runner.Run(ctx, scriptfile)
+	var exitErr *cmdexe.ExitError
+	if errors.As(err, &exitErr) {
+		// a failed script is an observation for the agent, not an error
+		logger.Warn("The script failed:", logger.Args("exit code", result.ExitCode))
+		return result.String(), nil
+	}
 	if err != nil {
 		logger.Error("Failed to execute the script, error:", logger.Args("err", err.Error()))
 		return "", err
 	}
-	logger.Info("Script executed successfully, output:", logger.Args("output", scriptOutput))
-	return scriptOutput, nil
+	logger.Info("Script executed successfully")
+	return result.Output(), nil
+}
+
+// checkScript runs the checks of scriptcheck on a saved shell script, the
+// scripts of other languages are not checked
+func checkScript(ctx context.Context, runner *interpreter.Interpreter, scriptfile string) ([]scriptcheck.Finding, error) {
+	if !runner.Shell() {
+		return nil, nil
+	}
+	content, err := os.ReadFile(scriptfile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read script: %w", err)
+	}
+	return scriptcheck.Check(ctx, string(content)), nil
+}
+
+// saveScript saves the script of the input: the arguments of a tool call, or
+// else a text with the script in a code block
+func (e *ScriptExecutor) saveScript(input string) (string, error) {
+	args := struct {
+		Script   string `json:"script"`
+		Language string `json:"language"`
+	}{}
+	if err := json.Unmarshal([]byte(input), &args); err == nil && args.Script != "" {
+		runner, err := interpreter.FromConfig(llms.GetConfig()).Lookup(args.Language)
+		if err != nil {
+			return "", err
+		}
+		return SaveScript(uuid.New().String()+runner.Extension, args.Script)
+	}
+	codeParser := &ScriptCodeParser{}
+	return codeParser.ParseScriptAndSave(input)
 }
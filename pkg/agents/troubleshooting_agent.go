@@ -9,7 +9,6 @@ import (
 	"time"
 
 	nuwaprmp "github.com/darmenliu/nuwa-terminal-chat/pkg/prompts"
-	"github.com/darmenliu/nuwa-terminal-chat/pkg/system"
 	"github.com/pterm/pterm"
 
 	"github.com/tmc/langchaingo/agents"
@@ -34,38 +33,54 @@ type TroubleshootingAgent struct {
 	OutputKey string
 	// CallbacksHandler is the handler for callbacks.
 	CallbacksHandler callbacks.Handler
+	// ToolCalling makes the agent define its tools in the requests to LLM
+	// and run the tool calls of the answers, instead of parsing the text
+	// of the answers with the Chain.
+	ToolCalling bool
+	// LLM is the model asked when ToolCalling is set.
+	LLM llms.Model
+
+	// systemPrompt is the prompt of the model when ToolCalling is set
+	systemPrompt string
 }
 
 const (
 	_troubleshootingFinalAnswerAction = "Final Answer:"
 )
 
-func NewTroubleshootingAgent(llm llms.Model, tools []tools.Tool, outputkey string, callback callbacks.Handler) *TroubleshootingAgent {
-	return &TroubleshootingAgent{
+// NewTroubleshootingAgent creates the agent, the system info in its prompt
+// takes at most maxSystemInfoLen bytes. With toolCalling the model calls
+// the tools natively, otherwise the actions are parsed from its text.
+func NewTroubleshootingAgent(llm llms.Model, tools []tools.Tool, maxSystemInfoLen int, outputkey string, callback callbacks.Handler, toolCalling bool) (*TroubleshootingAgent, error) {
+	agent := &TroubleshootingAgent{
 		Chain: chains.NewLLMChain(
 			llm,
-			CreateTroubleshootingAgentPrompt(tools),
+			CreateTroubleshootingAgentPrompt(tools, maxSystemInfoLen),
 			chains.WithCallback(callback),
 		),
 		Tools:            tools,
 		OutputKey:        outputkey,
 		CallbacksHandler: callback,
+		ToolCalling:      toolCalling,
+		LLM:              llm,
 	}
+	if toolCalling {
+		prompt, err := createToolCallingPrompt(maxSystemInfoLen)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create agent prompt: %w", err)
+		}
+		agent.systemPrompt = prompt
+	}
+	return agent, nil
 }
 
-func CreateTroubleshootingAgentPrompt(tools []tools.Tool) prompts.PromptTemplate {
+func CreateTroubleshootingAgentPrompt(tools []tools.Tool, maxSystemInfoLen int) prompts.PromptTemplate {
 	return prompts.PromptTemplate{
 		Template:       nuwaprmp.SysPromptForAgentMode,
 		TemplateFormat: prompts.TemplateFormatGoTemplate,
 		InputVariables: []string{"input", "agent_scratchpad"},
 		PartialVariables: map[string]any{
-			"system_info": func() string {
-				info, err := system.GetSystemInfo().ToJSON()
-				if err != nil {
-					return ""
-				}
-				return info
-			}(),
+			"system_info":       nuwaprmp.GetSystemInfo(maxSystemInfoLen),
 			"tools":             toolDescriptions(tools),
 			"tool_names":        toolNames(tools),
 			"ShellScriptFormat": nuwaprmp.ShellScriptFormat,
@@ -103,6 +118,10 @@ func (tbs *TroubleshootingAgent) Plan(
 	intermediateSteps []schema.AgentStep,
 	inputs map[string]string,
 ) ([]schema.AgentAction, *schema.AgentFinish, error) {
+	if tbs.ToolCalling {
+		return tbs.planWithTools(ctx, intermediateSteps, inputs)
+	}
+
 	fullInputs := make(map[string]any, len(inputs))
 	for key, value := range inputs {
 		fullInputs[key] = value
@@ -187,9 +206,6 @@ func (tbs *TroubleshootingAgent) parseOutput(output string) ([]schema.AgentActio
 	// Normalize line endings to handle different platforms
 	normalizedOutput := strings.ReplaceAll(output, "\r\n", "\n")
 
-	// Print the normalized output for debugging
-	logger.Info("Parsing output:", logger.Args("output", normalizedOutput))
-
 	// Improved regex to handle dynamic script names and multiline content
 	r := regexp.MustCompile(`(?s)Action: (.*?)\nAction_input:`)
 	matches := r.FindStringSubmatch(normalizedOutput)
@@ -197,7 +213,6 @@ func (tbs *TroubleshootingAgent) parseOutput(output string) ([]schema.AgentActio
 		logger.Error("NUWA TERMINAL: Unable to parse the output,", logger.Args("output", normalizedOutput))
 		return nil, nil, fmt.Errorf("%w: %s", agents.ErrUnableToParseOutput, normalizedOutput)
 	}
-	logger.Info("Matched:", logger.Args("match content for tool name:", matches[0]))
 	return []schema.AgentAction{
 		{Tool: strings.TrimSpace(matches[1]), ToolInput: strings.TrimSpace(normalizedOutput), Log: normalizedOutput},
 	}, nil, nil
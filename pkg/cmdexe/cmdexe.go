@@ -1,19 +1,29 @@
 package cmdexe
 
-import (
-	"os/exec"
-)
+import "context"
 
+// RunCommand executes a command under a pty after checking it against the
+// policy. The output is shown while it arrives, the result is nil if the
+// command did not run and the error is an *ExitError if it failed. The
+// command is killed with its children when the context is cancelled.
+func RunCommand(ctx context.Context, command string) (*ExecResult, error) {
+	if err := CheckPolicy(command); err != nil {
+		return nil, err
+	}
+	return runStreaming(ctx, command, "sh", "-c", command)
+}
+
+// ExecCommandWithOutput executes a command and returns its output, the output
+// is returned when the command failed as well
 func ExecCommandWithOutput(command string) (string, error) {
-	cmd := exec.Command("sh", "-c", command)
-	out, err := cmd.Output()
-	if err != nil {
+	result, err := RunCommand(context.Background(), command)
+	if result == nil {
 		return "", err
 	}
-	return string(out), nil
+	return result.Output(), err
 }
 
 func ExecCommand(command string) error {
-	cmd := exec.Command("sh", "-c", command)
-	return cmd.Run()
+	_, err := RunCommand(context.Background(), command)
+	return err
 }
@@ -0,0 +1,330 @@
+package cmdexe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxCapturedOutput is how much output of a command is kept for the model,
+// the terminal always gets all of it.
+const MaxCapturedOutput = 32 * 1024
+
+// errNoPty is returned when no pty can be opened, the command is run with pipes then
+var errNoPty = errors.New("no pty available")
+
+// drainTimeout is how long the output of a finished command is read, a
+// background process may keep the pty open forever.
+const drainTimeout = 200 * time.Millisecond
+
+// OutputBuffer captures output up to a limit, keeping its head and its tail.
+type OutputBuffer struct {
+	mu      sync.Mutex
+	limit   int
+	head    []byte
+	tail    []byte
+	dropped int
+}
+
+func NewOutputBuffer(limit int) *OutputBuffer {
+	return &OutputBuffer{limit: limit}
+}
+
+func (b *OutputBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(p)
+	half := b.limit / 2
+	if room := half - len(b.head); room > 0 {
+		take := min(room, len(p))
+		b.head = append(b.head, p[:take]...)
+		p = p[take:]
+	}
+	b.tail = append(b.tail, p...)
+	// trim only when the tail is twice as long as needed, so writes stay cheap
+	if len(b.tail) > 2*(b.limit-half) {
+		cut := len(b.tail) - (b.limit - half)
+		b.dropped += cut
+		b.tail = append([]byte{}, b.tail[cut:]...)
+	}
+	return n, nil
+}
+
+// String returns the captured output as plain text, without terminal escape sequences.
+func (b *OutputBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tail := b.tail
+	dropped := b.dropped
+	if extra := len(tail) - (b.limit - b.limit/2); extra > 0 {
+		tail = tail[extra:]
+		dropped += extra
+	}
+	if dropped == 0 {
+		return PlainText(string(b.head) + string(tail))
+	}
+	return PlainText(string(b.head)) + fmt.Sprintf("\n... %d bytes omitted ...\n", dropped) + PlainText(string(tail))
+}
+
+var escapeRe = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\x1b[()][0-9A-Za-z]|\x1b[=>78]`)
+
+// PlainText removes terminal escape sequences and carriage returns from
+// terminal output, a line redrawn with \r keeps only its last version.
+func PlainText(s string) string {
+	s = escapeRe.ReplaceAllString(s, "")
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if j := strings.LastIndex(strings.TrimRight(line, "\r"), "\r"); j >= 0 {
+			line = line[j+1:]
+		}
+		lines[i] = strings.TrimRight(line, "\r")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// outputStream copies the output of a pty or a pipe to the terminal and to
+// the capture buffer of the running command. With a marker, the end of every
+// command is found in the output, the marker itself is not shown.
+type outputStream struct {
+	src    io.Reader
+	marker []byte
+
+	mu      sync.Mutex
+	out     io.Writer
+	capture io.Writer
+	// done gets a value when the marker is seen, closed is closed when the source is
+	done   chan struct{}
+	closed chan struct{}
+}
+
+// newOutputStream starts copying the output of src, the output before the
+// first target is set goes to out.
+func newOutputStream(src io.Reader, out io.Writer, marker string) *outputStream {
+	s := &outputStream{
+		src:    src,
+		out:    out,
+		done:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	if marker != "" {
+		s.marker = []byte(marker)
+	}
+	go s.pump()
+	return s
+}
+
+// setTarget sets where the output of the next command is shown and captured,
+// a marker seen before is forgotten
+func (s *outputStream) setTarget(out io.Writer, capture io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.out = out
+	s.capture = capture
+	select {
+	case <-s.done:
+	default:
+	}
+}
+
+// wait waits until the marker is seen or the source is closed
+func (s *outputStream) wait() {
+	select {
+	case <-s.done:
+	case <-s.closed:
+	}
+}
+
+func (s *outputStream) emit(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.out.Write(p)
+	if s.capture != nil {
+		s.capture.Write(p)
+	}
+}
+
+func (s *outputStream) pump() {
+	buf := make([]byte, 32*1024)
+	pending := []byte{}
+	for {
+		n, err := s.src.Read(buf)
+		if n > 0 {
+			pending = s.scan(append(pending, buf[:n]...))
+		}
+		if err != nil {
+			s.emit(pending)
+			close(s.closed)
+			return
+		}
+	}
+}
+
+// scan emits the output up to the markers it contains, the returned bytes
+// may be the start of a marker and are kept until more output arrives.
+func (s *outputStream) scan(pending []byte) []byte {
+	if s.marker == nil {
+		s.emit(pending)
+		return pending[:0]
+	}
+	for {
+		i := bytes.Index(pending, s.marker)
+		if i < 0 {
+			break
+		}
+		s.emit(pending[:i])
+		pending = pending[i+len(s.marker):]
+		pending = bytes.TrimPrefix(bytes.TrimPrefix(pending, []byte("\r")), []byte("\n"))
+		select {
+		case s.done <- struct{}{}:
+		default:
+		}
+	}
+	keep := 0
+	for k := min(len(s.marker)-1, len(pending)); k > 0; k-- {
+		if bytes.HasSuffix(pending, s.marker[:k]) {
+			keep = k
+			break
+		}
+	}
+	s.emit(pending[:len(pending)-keep])
+	return append([]byte{}, pending[len(pending)-keep:]...)
+}
+
+// crlfWriter turns \n into \r\n, the terminal is in raw mode while a command
+// runs under a pty, and only the output passing the pty gets \r\n
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// terminalStderr is where the stderr of commands under a pty is shown
+func terminalStderr() io.Writer {
+	if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return crlfWriter{w: os.Stderr}
+	}
+	return os.Stderr
+}
+
+// runInPty runs a command with a pty as its terminal, stderr is kept apart on
+// a pipe. The output is streamed to the terminal while bounded copies of it
+// are returned in the result.
+func runInPty(cmd *exec.Cmd, sandbox *sandboxRun) (*ExecResult, error) {
+	master, slave, err := openPty()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNoPty, err)
+	}
+	defer master.Close()
+
+	stdout := NewOutputBuffer(MaxCapturedOutput)
+	stderr := NewOutputBuffer(MaxCapturedOutput)
+	cmd.Stdin, cmd.Stdout = slave, slave
+	cmd.Stderr = sandbox.output(io.MultiWriter(terminalStderr(), stderr))
+	cmd.SysProcAttr = sandbox.procAttr(ptyProcAttr(0))
+	// a background process may keep stderr open forever
+	cmd.WaitDelay = drainTimeout
+	stream := newOutputStream(master, os.Stdout, "")
+	// the output limit of the sandbox applies to the terminal too
+	stream.setTarget(sandbox.output(io.MultiWriter(os.Stdout, stdout)), nil)
+
+	stopResize := watchResize(master)
+	defer stopResize()
+	start := time.Now()
+	err = cmd.Start()
+	slave.Close()
+	if err != nil {
+		return nil, err
+	}
+	stopStdin := forwardStdin(master)
+	cmd.Wait()
+	stopStdin()
+	result := &ExecResult{Duration: time.Since(start)}
+	result.setExitStatus(cmd.ProcessState)
+
+	// the pty is closed once the command and its children exited, the
+	// deadline stops the read when a background process keeps it open
+	master.SetReadDeadline(time.Now().Add(drainTimeout))
+	select {
+	case <-stream.closed:
+	case <-time.After(2 * drainTimeout):
+	}
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	return result, nil
+}
+
+// runCaptured runs a command with pipes when there is no pty, the output is
+// streamed to the terminal as well.
+func runCaptured(cmd *exec.Cmd, sandbox *sandboxRun) (*ExecResult, error) {
+	stdout := NewOutputBuffer(MaxCapturedOutput)
+	stderr := NewOutputBuffer(MaxCapturedOutput)
+	cmd.Stdout = sandbox.output(io.MultiWriter(os.Stdout, stdout))
+	cmd.Stderr = sandbox.output(io.MultiWriter(os.Stderr, stderr))
+	cmd.SysProcAttr = sandbox.procAttr(groupProcAttr())
+	cmd.WaitDelay = drainTimeout
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	cmd.Wait()
+	result := &ExecResult{Stdout: stdout.String(), Stderr: stderr.String(), Duration: time.Since(start)}
+	result.setExitStatus(cmd.ProcessState)
+	return result, nil
+}
+
+// runStreaming runs a command under a pty, or with pipes if no pty can be
+// opened. The error is an *ExitError if the command failed. When the context
+// is cancelled, the command and everything it started are killed and the
+// error wraps the error of the context. With a sandbox in the context, the
+// command runs in it.
+func runStreaming(ctx context.Context, command string, name string, args ...string) (*ExecResult, error) {
+	var sandbox *sandboxRun
+	if s := SandboxFrom(ctx); s != nil {
+		var err error
+		if sandbox, err = s.prepare(name, args); err != nil {
+			return nil, fmt.Errorf("failed to prepare sandbox: %w", err)
+		}
+		name, args = sandbox.name, sandbox.args
+	}
+	newCmd := func() *exec.Cmd {
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Cancel = func() error { return killGroup(cmd.Process) }
+		if sandbox != nil && sandbox.limit != nil {
+			sandbox.limit.kill = func() { killGroup(cmd.Process) }
+		}
+		return cmd
+	}
+	result, err := runInPty(newCmd(), sandbox)
+	if errors.Is(err, errNoPty) {
+		result, err = runCaptured(newCmd(), sandbox)
+	}
+	if sandbox != nil {
+		sandbox.finish(result)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to start command: %w", err)
+	}
+	result.Command = command
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("command interrupted: %w", ctx.Err())
+	}
+	return result, resultError(result)
+}
@@ -0,0 +1,98 @@
+package cmdexe
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputBufferKeepsHeadAndTail(t *testing.T) {
+	buf := NewOutputBuffer(20)
+	buf.Write([]byte("0123456789"))
+	buf.Write([]byte(strings.Repeat("x", 100)))
+	buf.Write([]byte("abcdefghij"))
+	assert.Equal(t, "0123456789\n... 100 bytes omitted ...\nabcdefghij", buf.String())
+
+	small := NewOutputBuffer(20)
+	small.Write([]byte("hello"))
+	assert.Equal(t, "hello", small.String())
+}
+
+func TestPlainText(t *testing.T) {
+	assert.Equal(t, "red\nplain\n", PlainText("\x1b[31mred\x1b[0m\r\nplain\r\n"))
+	assert.Equal(t, "100%", PlainText(" 10%\r 50%\r100%"))
+}
+
+func TestRunCommand(t *testing.T) {
+	result, err := RunCommand(context.Background(), "echo out; echo err >&2")
+	assert.NoError(t, err)
+	assert.Equal(t, "out\n", result.Stdout)
+	assert.Equal(t, "err\n", result.Stderr)
+	assert.Equal(t, "out\nerr\n", result.Output())
+
+	result, err = RunCommand(context.Background(), "echo before; exit 3")
+	var exitErr *ExitError
+	assert.ErrorAs(t, err, &exitErr)
+	assert.Equal(t, 3, result.ExitCode)
+	assert.Equal(t, "before\n", result.Stdout)
+	assert.Contains(t, result.String(), "Exit code: 3")
+
+	result, err = RunCommand(context.Background(), "kill -TERM $$")
+	assert.Error(t, err)
+	assert.Equal(t, "terminated", result.Signal)
+}
+
+func TestShellSessionInterrupt(t *testing.T) {
+	shell, err := NewShellSession()
+	assert.NoError(t, err)
+	defer shell.Close()
+	if shell.master == nil {
+		t.Skip("no pty")
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		shell.master.Write([]byte{3})
+	}()
+	start := time.Now()
+	result, err := shell.Run(context.Background(), "sleep 5; echo after")
+	assert.Error(t, err)
+	assert.Equal(t, 130, result.ExitCode)
+	assert.Less(t, time.Since(start), 3*time.Second)
+
+	result, err = shell.Run(context.Background(), "echo alive")
+	assert.NoError(t, err)
+	assert.Equal(t, "alive\n", result.Stdout)
+}
+
+func TestRunCommandCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	// the background sleep holds the output open, it must be killed as well
+	result, err := RunCommand(ctx, "sleep 5 & sleep 5; echo after")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NotContains(t, result.Stdout, "after")
+	assert.Less(t, time.Since(start), 3*time.Second)
+}
+
+func TestShellSessionCancel(t *testing.T) {
+	shell, err := NewShellSession()
+	assert.NoError(t, err)
+	defer shell.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = shell.Run(ctx, "sleep 5; echo after")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 3*time.Second)
+
+	result, err := shell.Run(context.Background(), "echo alive")
+	assert.NoError(t, err)
+	assert.Equal(t, "alive\n", result.Stdout)
+}
@@ -0,0 +1,94 @@
+package cmdexe
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/policy"
+)
+
+// ConfirmFunc asks the user whether a command the policy wants confirmed may run.
+type ConfirmFunc func(command string, decision policy.Decision) bool
+
+var guard = struct {
+	mu      sync.Mutex
+	engine  *policy.Engine
+	confirm ConfirmFunc
+}{}
+
+// SetPolicy puts the policy engine in front of every command and script
+// executed by this package. Without a confirm func the commands which need a
+// confirmation are blocked.
+func SetPolicy(engine *policy.Engine, confirm ConfirmFunc) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	guard.engine = engine
+	guard.confirm = confirm
+}
+
+// CheckPolicy evaluates a command or script, it returns a *policy.BlockedError
+// if the command may not run.
+func CheckPolicy(command string) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+	return checkPolicy(command, cwd)
+}
+
+// checkPolicy evaluates a command which runs in cwd
+func checkPolicy(command string, cwd string) error {
+	guard.mu.Lock()
+	engine, confirm := guard.engine, guard.confirm
+	guard.mu.Unlock()
+	if engine == nil {
+		return nil
+	}
+
+	return enforce(command, engine.Evaluate(command, cwd), confirm)
+}
+
+// enforce lets the command run if the decision allows it or the user
+// confirms it
+func enforce(command string, decision policy.Decision, confirm ConfirmFunc) error {
+	switch decision.Action {
+	case policy.ActionAllow:
+		return nil
+	case policy.ActionConfirm:
+		if confirm != nil && confirm(command, decision) {
+			return nil
+		}
+	}
+	return &policy.BlockedError{Command: command, Decision: decision}
+}
+
+// checkScriptPolicy evaluates the content of a script file
+func checkScriptPolicy(script string) error {
+	content, err := os.ReadFile(script)
+	if err != nil {
+		return fmt.Errorf("failed to read script: %w", err)
+	}
+	return CheckPolicy(string(content))
+}
+
+// checkCodePolicy evaluates the content of a script of another language than
+// the shell, like python. It is confirmed at least, the user sees the whole
+// script.
+func checkCodePolicy(script string, language string) error {
+	content, err := os.ReadFile(script)
+	if err != nil {
+		return fmt.Errorf("failed to read script: %w", err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+	guard.mu.Lock()
+	engine, confirm := guard.engine, guard.confirm
+	guard.mu.Unlock()
+	if engine == nil {
+		return nil
+	}
+	return enforce(string(content), engine.EvaluateCode(language, string(content), cwd), confirm)
+}
@@ -0,0 +1,40 @@
+package cmdexe
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodePolicy(t *testing.T) {
+	engine, err := policy.NewEngine(policy.DefaultConfig())
+	assert.NoError(t, err)
+	shown := []string{}
+	SetPolicy(engine, func(command string, decision policy.Decision) bool {
+		shown = append(shown, command)
+		return false
+	})
+	t.Cleanup(func() { SetPolicy(nil, nil) })
+	dir := t.TempDir()
+
+	// the shell commands run by a python script are evaluated
+	script := filepath.Join(dir, "clean.py")
+	assert.NoError(t, os.WriteFile(script, []byte("import os\nos.system(\"rm -rf /\")\n"), 0o600))
+	_, err = RunScriptWith(context.Background(), script, "python3")
+	var blocked *policy.BlockedError
+	assert.ErrorAs(t, err, &blocked)
+	assert.Equal(t, policy.ActionDeny, blocked.Decision.Action)
+	assert.Empty(t, shown)
+
+	// the rest of a python script can not be checked, the user confirms it
+	script = filepath.Join(dir, "hello.py")
+	assert.NoError(t, os.WriteFile(script, []byte("print('hello')\n"), 0o600))
+	_, err = RunScriptWith(context.Background(), script, "python3")
+	assert.ErrorAs(t, err, &blocked)
+	assert.Equal(t, policy.ActionConfirm, blocked.Decision.Action)
+	assert.Equal(t, []string{"print('hello')\n"}, shown)
+}
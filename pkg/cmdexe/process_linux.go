@@ -0,0 +1,20 @@
+//go:build linux
+
+package cmdexe
+
+import (
+	"os"
+	"syscall"
+)
+
+// groupProcAttr starts the process in a new process group, so it can be
+// killed together with its children.
+func groupProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killGroup kills a process started in its own process group or session
+// and everything it started.
+func killGroup(process *os.Process) error {
+	return syscall.Kill(-process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package cmdexe
+
+import (
+	"os"
+	"syscall"
+)
+
+// groupProcAttr is only implemented on Linux, the other platforms kill the
+// process alone.
+func groupProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func killGroup(process *os.Process) error {
+	return process.Kill()
+}
@@ -0,0 +1,129 @@
+//go:build linux
+
+package cmdexe
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// openPty opens a new pseudo-terminal pair.
+func openPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open pty: %w", err)
+	}
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to get pty number: %w", err)
+	}
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to open pty slave: %w", err)
+	}
+	return master, slave, nil
+}
+
+// ptyProcAttr starts the process in a new session with the pty as its
+// controlling terminal, ctty is the fd of the pty in the child.
+func ptyProcAttr(ctty int) *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: ctty}
+}
+
+// syncWinsize copies the size of the terminal to the pty, 80x24 is used when
+// nuwa does not run in a terminal.
+func syncWinsize(master *os.File) {
+	ws := &unix.Winsize{Row: 24, Col: 80}
+	if size, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ); err == nil && size.Col > 0 {
+		ws = size
+	}
+	unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, ws)
+}
+
+// watchResize forwards terminal resizes to the pty until stop is called.
+func watchResize(master *os.File) (stop func()) {
+	syncWinsize(master)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch:
+				syncWinsize(master)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+// stdinPollInterval is how often the stdin forwarder checks whether it should stop, in milliseconds
+const stdinPollInterval = 50
+
+// forwardStdin puts the terminal in raw mode and passes what the user types
+// to the pty, so interactive programs work. It polls stdin, so nothing is
+// read after stop returns and the next input goes to the prompt again.
+func forwardStdin(master *os.File) (stop func()) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return func() {}
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 4096)
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			n, err := unix.Poll(fds, stdinPollInterval)
+			if err == unix.EINTR || n == 0 {
+				continue
+			}
+			if err != nil || fds[0].Revents&(unix.POLLHUP|unix.POLLERR) != 0 {
+				return
+			}
+			n, err = unix.Read(fd, buf)
+			if err != nil || n <= 0 {
+				return
+			}
+			if _, err := master.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		term.Restore(fd, state)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package cmdexe
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// openPty is only implemented on Linux, the other platforms run commands with pipes.
+func openPty() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("pty is not supported on this platform")
+}
+
+func ptyProcAttr(ctty int) *syscall.SysProcAttr {
+	return nil
+}
+
+func watchResize(master *os.File) (stop func()) {
+	return func() {}
+}
+
+func forwardStdin(master *os.File) (stop func()) {
+	return func() {}
+}
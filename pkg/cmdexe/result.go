@@ -0,0 +1,100 @@
+package cmdexe
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ExecResult is what happened when a command or script was executed. Stdout
+// and Stderr are bounded copies of the output, without terminal escape sequences.
+type ExecResult struct {
+	Command  string
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Duration time.Duration
+	// Signal is the name of the signal which killed the command, if any
+	Signal string
+	// Sandboxed is set when the command ran in the sandbox, SandboxChanges
+	// are the files it wrote or deleted there, which were dropped
+	Sandboxed      bool
+	SandboxChanges []string
+}
+
+// Failed reports whether the command exited with a non-zero status or was killed.
+func (r *ExecResult) Failed() bool {
+	return r.ExitCode != 0 || r.Signal != ""
+}
+
+// Output returns stdout followed by stderr.
+func (r *ExecResult) Output() string {
+	if r.Stderr == "" {
+		return r.Stdout
+	}
+	if r.Stdout == "" || strings.HasSuffix(r.Stdout, "\n") {
+		return r.Stdout + r.Stderr
+	}
+	return r.Stdout + "\n" + r.Stderr
+}
+
+// String describes the result for the model and the session.
+func (r *ExecResult) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Command: %s\n", r.Command)
+	fmt.Fprintf(&b, "Exit code: %d\n", r.ExitCode)
+	if r.Signal != "" {
+		fmt.Fprintf(&b, "Killed by signal: %s\n", r.Signal)
+	}
+	fmt.Fprintf(&b, "Duration: %s\n", r.Duration.Round(time.Millisecond))
+	fmt.Fprintf(&b, "Stdout:\n%s\n", strings.TrimRight(r.Stdout, "\n"))
+	fmt.Fprintf(&b, "Stderr:\n%s\n", strings.TrimRight(r.Stderr, "\n"))
+	if r.Sandboxed {
+		fmt.Fprintf(&b, "Ran in the sandbox, its changes were dropped:\n%s\n", strings.Join(r.SandboxChanges, "\n"))
+	}
+	return b.String()
+}
+
+// ExitError is returned when a command ran but failed, the result tells why.
+type ExitError struct {
+	Result *ExecResult
+}
+
+func (e *ExitError) Error() string {
+	if e.Result.Signal != "" {
+		return "command killed by signal " + e.Result.Signal
+	}
+	return fmt.Sprintf("command exited with status %d", e.Result.ExitCode)
+}
+
+// resultError returns an *ExitError if the result failed
+func resultError(result *ExecResult) error {
+	if result.Failed() {
+		return &ExitError{Result: result}
+	}
+	return nil
+}
+
+// setExitStatus fills the exit code and signal of a finished process
+func (r *ExecResult) setExitStatus(state *os.ProcessState) {
+	if state == nil {
+		r.ExitCode = -1
+		return
+	}
+	r.ExitCode = state.ExitCode()
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		r.ExitCode = 128 + int(status.Signal())
+		r.Signal = status.Signal().String()
+	}
+}
+
+// setShellStatus fills the exit code reported by bash, which is 128 plus the
+// signal number for commands killed by a signal
+func (r *ExecResult) setShellStatus(code int) {
+	r.ExitCode = code
+	if code > 128 && code <= 128+64 {
+		r.Signal = syscall.Signal(code - 128).String()
+	}
+}
@@ -0,0 +1,195 @@
+package cmdexe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrSandboxUnsupported is returned when a command should run in the sandbox
+// on a platform which has none.
+var ErrSandboxUnsupported = errors.New("the sandbox is only supported on Linux")
+
+// maxSandboxChanges is how many files changed in the sandbox are listed in the result
+const maxSandboxChanges = 50
+
+// Sandbox runs commands and scripts isolated from the system: in their own
+// mount, pid and network namespaces, with the root read only. The working
+// directory, the home directory and /tmp are writable, the writes go to a
+// scratch directory which is dropped when the command ends.
+type Sandbox struct {
+	// Network lets the commands use the network of the host
+	Network bool
+	// CPUTime limits the CPU time of every process, 0 is no limit
+	CPUTime time.Duration
+	// Memory limits the address space of every process in bytes, 0 is no limit
+	Memory int64
+	// MaxOutput kills the command when it writes more bytes, 0 is no limit
+	MaxOutput int64
+}
+
+func (s *Sandbox) String() string {
+	network := "off"
+	if s.Network {
+		network = "on"
+	}
+	return fmt.Sprintf("network %s, cpu time %s, memory %s, output %s", network,
+		limitString(s.CPUTime > 0, s.CPUTime.String()),
+		limitString(s.Memory > 0, fmt.Sprintf("%d MiB", s.Memory>>20)),
+		limitString(s.MaxOutput > 0, fmt.Sprintf("%d KiB", s.MaxOutput>>10)))
+}
+
+func limitString(limited bool, limit string) string {
+	if !limited {
+		return "unlimited"
+	}
+	return limit
+}
+
+type sandboxKey struct{}
+
+// WithSandbox returns a context whose commands and scripts run in the
+// sandbox, a nil sandbox runs them on the system.
+func WithSandbox(ctx context.Context, sandbox *Sandbox) context.Context {
+	return context.WithValue(ctx, sandboxKey{}, sandbox)
+}
+
+// SandboxFrom returns the sandbox of the context, nil if there is none.
+func SandboxFrom(ctx context.Context) *Sandbox {
+	sandbox, _ := ctx.Value(sandboxKey{}).(*Sandbox)
+	return sandbox
+}
+
+// overlay is a writable directory of the sandbox, its writes go to upper
+type overlay struct {
+	Dir   string `json:"dir"`
+	Upper string `json:"upper"`
+	Work  string `json:"work"`
+}
+
+// sandboxSpec is what the sandbox init sets up before it runs the command
+type sandboxSpec struct {
+	Root     string        `json:"root"`
+	Dir      string        `json:"dir"`
+	Overlays []overlay     `json:"overlays"`
+	Network  bool          `json:"network"`
+	CPUTime  time.Duration `json:"cpu_time"`
+	Memory   int64         `json:"memory"`
+}
+
+// sandboxRun is a command prepared to run in the sandbox
+type sandboxRun struct {
+	name    string
+	args    []string
+	scratch string
+	spec    sandboxSpec
+	limit   *outputLimit
+}
+
+// output returns the writer the output of the command goes to, it is
+// limited in the sandbox
+func (r *sandboxRun) output(w io.Writer) io.Writer {
+	if r == nil || r.limit == nil {
+		return w
+	}
+	return r.limit.wrap(w)
+}
+
+// finish adds what the sandbox did to the result and drops the scratch directory
+func (r *sandboxRun) finish(result *ExecResult) {
+	if result != nil {
+		result.Sandboxed = true
+		result.SandboxChanges = r.changes()
+		if r.limit != nil && r.limit.exceeded() {
+			result.Stderr += fmt.Sprintf("\nthe output limit of %d bytes was exceeded, the command was killed\n", r.limit.max)
+		}
+	}
+	// overlayfs leaves directories nobody may read in its work directory
+	filepath.WalkDir(r.scratch, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(path, 0o700)
+		}
+		return nil
+	})
+	os.RemoveAll(r.scratch)
+}
+
+// changes lists the files written or deleted in the writable directories
+func (r *sandboxRun) changes() []string {
+	changes := []string{}
+	for _, o := range r.spec.Overlays {
+		filepath.WalkDir(o.Upper, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || path == o.Upper {
+				return nil
+			}
+			rel, _ := filepath.Rel(o.Upper, path)
+			name := filepath.Join(o.Dir, rel)
+			switch {
+			case d.Type()&fs.ModeCharDevice != 0:
+				// overlayfs marks a deleted file with a character device
+				changes = append(changes, "deleted "+name)
+			case !d.IsDir():
+				changes = append(changes, "written "+name)
+			}
+			return nil
+		})
+	}
+	sort.Strings(changes)
+	if len(changes) > maxSandboxChanges {
+		more := len(changes) - maxSandboxChanges
+		changes = append(changes[:maxSandboxChanges], fmt.Sprintf("... %d more", more))
+	}
+	return changes
+}
+
+// outputLimit kills a command which writes more than max bytes to its
+// stdout and stderr together, the output after the limit is dropped
+type outputLimit struct {
+	mu      sync.Mutex
+	max     int64
+	written int64
+	kill    func()
+}
+
+func (l *outputLimit) wrap(w io.Writer) io.Writer {
+	return limitedWriter{limit: l, w: w}
+}
+
+func (l *outputLimit) exceeded() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.written > l.max
+}
+
+// allow returns how many bytes of a write may pass
+func (l *outputLimit) allow(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	room := l.max - l.written
+	l.written += int64(n)
+	if l.written > l.max && room >= 0 && l.kill != nil {
+		l.kill()
+	}
+	return int(max(0, min(room, int64(n))))
+}
+
+type limitedWriter struct {
+	limit *outputLimit
+	w     io.Writer
+}
+
+func (w limitedWriter) Write(p []byte) (int, error) {
+	if n := w.limit.allow(len(p)); n > 0 {
+		if _, err := w.w.Write(p[:n]); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
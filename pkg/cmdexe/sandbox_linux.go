@@ -0,0 +1,414 @@
+//go:build linux
+
+package cmdexe
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// sandboxInitArg makes the nuwa binary set up the sandbox and run the
+	// command given after the spec, instead of starting
+	sandboxInitArg = "__nuwa_sandbox_init"
+	// sandboxInitFailed is the exit code when the sandbox can not be set up
+	sandboxInitFailed = 125
+)
+
+func init() {
+	if len(os.Args) > 3 && os.Args[1] == sandboxInitArg {
+		err := sandboxInit(os.Args[2], os.Args[3:])
+		fmt.Fprintln(os.Stderr, "nuwa sandbox: "+err.Error())
+		os.Exit(sandboxInitFailed)
+	}
+}
+
+// prepare makes the command run in the sandbox: the nuwa binary is started
+// in new namespaces, sets the sandbox up and runs the command.
+func (s *Sandbox) prepare(name string, args []string) (*sandboxRun, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the nuwa binary: %w", err)
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current directory: %w", err)
+	}
+	scratch, err := os.MkdirTemp("", "nuwa-sandbox-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sandbox directory: %w", err)
+	}
+
+	run := &sandboxRun{scratch: scratch, spec: sandboxSpec{
+		Root:    filepath.Join(scratch, "root"),
+		Dir:     dir,
+		Network: s.Network,
+		CPUTime: s.CPUTime,
+		Memory:  s.Memory,
+	}}
+	if s.MaxOutput > 0 {
+		run.limit = &outputLimit{max: s.MaxOutput}
+	}
+	for i, writable := range writableDirs(dir, os.Getenv("HOME")) {
+		if within(scratch, writable) {
+			// overlayfs can not keep the writes of a directory inside it
+			continue
+		}
+		o := overlay{
+			Dir:   writable,
+			Upper: filepath.Join(scratch, strconv.Itoa(i), "upper"),
+			Work:  filepath.Join(scratch, strconv.Itoa(i), "work"),
+		}
+		run.spec.Overlays = append(run.spec.Overlays, o)
+	}
+	for _, path := range append([]string{run.spec.Root}, overlayDirs(run.spec.Overlays)...) {
+		if err := os.MkdirAll(path, 0o700); err != nil {
+			run.finish(nil)
+			return nil, fmt.Errorf("failed to create sandbox directory: %w", err)
+		}
+	}
+
+	spec, err := json.Marshal(run.spec)
+	if err != nil {
+		run.finish(nil)
+		return nil, fmt.Errorf("failed to encode sandbox: %w", err)
+	}
+	run.name = exe
+	run.args = append([]string{sandboxInitArg, string(spec), name}, args...)
+	return run, nil
+}
+
+func overlayDirs(overlays []overlay) []string {
+	dirs := []string{}
+	for _, o := range overlays {
+		dirs = append(dirs, o.Upper, o.Work)
+	}
+	return dirs
+}
+
+// writableDirs returns the directories the sandboxed commands may write to,
+// a directory inside another one is writable already
+func writableDirs(dirs ...string) []string {
+	writable := []string{}
+	for _, dir := range dirs {
+		if dir == "" || dir == "/" {
+			continue
+		}
+		dir = filepath.Clean(dir)
+		inside := false
+		for i, other := range writable {
+			switch {
+			case within(dir, other):
+				inside = true
+			case within(other, dir):
+				writable[i] = dir
+				inside = true
+			}
+		}
+		if !inside {
+			writable = append(writable, dir)
+		}
+	}
+	return writable
+}
+
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// procAttr adds the namespaces of the sandbox to the attributes of the
+// process. The user keeps the same ids, the capabilities the init needs to
+// set up the sandbox are dropped before the command runs.
+func (r *sandboxRun) procAttr(attr *syscall.SysProcAttr) *syscall.SysProcAttr {
+	if r == nil {
+		return attr
+	}
+	if attr == nil {
+		attr = &syscall.SysProcAttr{}
+	}
+	attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	if !r.spec.Network {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	attr.GidMappingsEnableSetgroups = false
+	attr.AmbientCaps = []uintptr{unix.CAP_SYS_ADMIN, unix.CAP_SYS_CHROOT, unix.CAP_NET_ADMIN, unix.CAP_SETPCAP}
+	return attr
+}
+
+// sandboxInit runs in the namespaces of the sandbox, it only returns if the
+// sandbox can not be set up
+func sandboxInit(encoded string, command []string) error {
+	spec := sandboxSpec{}
+	if err := json.Unmarshal([]byte(encoded), &spec); err != nil {
+		return fmt.Errorf("invalid sandbox: %w", err)
+	}
+	// nothing mounted here is seen by the system
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+	if err := unix.Mount("/", spec.Root, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind the root: %w", err)
+	}
+	if err := hideSocketDirs(spec.Root); err != nil {
+		return err
+	}
+	if err := remountReadOnly(spec.Root); err != nil {
+		return err
+	}
+	if err := unix.Mount("tmpfs", filepath.Join(spec.Root, "tmp"), "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("failed to mount /tmp: %w", err)
+	}
+	for _, o := range spec.Overlays {
+		if err := mountOverlay(spec.Root, o); err != nil {
+			return err
+		}
+	}
+	// a new /proc shows only the processes of the sandbox, the one of the
+	// system stays when it can not be mounted
+	unix.Mount("proc", filepath.Join(spec.Root, "proc"), "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "")
+	if !spec.Network {
+		loopbackUp()
+	}
+
+	if err := unix.Chroot(spec.Root); err != nil {
+		return fmt.Errorf("failed to change root: %w", err)
+	}
+	if err := unix.Chdir(spec.Dir); err != nil {
+		return fmt.Errorf("failed to change directory: %w", err)
+	}
+	if err := setLimits(spec); err != nil {
+		return err
+	}
+	if err := dropCapabilities(); err != nil {
+		return fmt.Errorf("failed to drop capabilities: %w", err)
+	}
+	// without network the sockets of the system are out of reach too
+	if !spec.Network {
+		if err := denyUnixSockets(); err != nil {
+			return fmt.Errorf("failed to deny unix sockets: %w", err)
+		}
+	}
+
+	path, err := lookPath(command[0])
+	if err != nil {
+		return err
+	}
+	return unix.Exec(path, command, os.Environ())
+}
+
+// socketDirs hold the sockets of the services of the system, like
+// /run/docker.sock or the bus of the user, a read only mount does not stop a
+// connect to them
+var socketDirs = []string{"/run", "/var/run"}
+
+// hideSocketDirs mounts an empty tmpfs over the socket directories. The
+// file /etc/resolv.conf links to is kept, so DNS works with the network on.
+func hideSocketDirs(root string) error {
+	resolv, _ := filepath.EvalSymlinks("/etc/resolv.conf")
+	for _, dir := range socketDirs {
+		// /var/run is a link to /run on most systems
+		if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := unix.Mount("tmpfs", filepath.Join(root, dir), "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=755"); err != nil {
+			return fmt.Errorf("failed to hide %s: %w", dir, err)
+		}
+		if resolv == "" || !within(resolv, dir) {
+			continue
+		}
+		kept := filepath.Join(root, resolv)
+		if err := os.MkdirAll(filepath.Dir(kept), 0o755); err != nil {
+			return fmt.Errorf("failed to keep %s: %w", resolv, err)
+		}
+		if err := os.WriteFile(kept, nil, 0o644); err != nil {
+			return fmt.Errorf("failed to keep %s: %w", resolv, err)
+		}
+		if err := unix.Mount(resolv, kept, "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to keep %s: %w", resolv, err)
+		}
+	}
+	return nil
+}
+
+// lookPath finds a command in PATH after the root changed
+func lookPath(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0o111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in PATH", name)
+}
+
+// dropCapabilities drops all the capabilities for good, even root gets none
+// when it runs the command, so the sandbox can not be undone from inside
+func dropCapabilities() error {
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return err
+	}
+	for capability := 0; capability <= unix.CAP_LAST_CAP; capability++ {
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(capability), 0, 0, 0); err != nil && err != unix.EINVAL {
+			return err
+		}
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return err
+	}
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{}
+	return unix.Capset(&header, &data[0])
+}
+
+// statfsFlags maps the flags of statfs to the ones of mount, a remount in a
+// user namespace must keep them
+var statfsFlags = map[int64]uintptr{
+	unix.ST_NOSUID:      unix.MS_NOSUID,
+	unix.ST_NODEV:       unix.MS_NODEV,
+	unix.ST_NOEXEC:      unix.MS_NOEXEC,
+	unix.ST_NOATIME:     unix.MS_NOATIME,
+	unix.ST_NODIRATIME:  unix.MS_NODIRATIME,
+	unix.ST_RELATIME:    unix.MS_RELATIME,
+	unix.ST_SYNCHRONOUS: unix.MS_SYNCHRONOUS,
+}
+
+// remountReadOnly makes every mount under root read only. The mounts of
+// /proc, /sys and /dev the kernel does not let change are left as they are.
+func remountReadOnly(root string) error {
+	mounts, err := mountPoints(root)
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		var st unix.Statfs_t
+		if err := unix.Statfs(mount, &st); err != nil {
+			continue
+		}
+		flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY)
+		for stFlag, msFlag := range statfsFlags {
+			if int64(st.Flags)&stFlag != 0 {
+				flags |= msFlag
+			}
+		}
+		err := unix.Mount("", mount, "", flags, "")
+		if err != nil && !isPseudoMount(root, mount) {
+			return fmt.Errorf("failed to make %s read only: %w", strings.TrimPrefix(mount, root), err)
+		}
+	}
+	return nil
+}
+
+func isPseudoMount(root, mount string) bool {
+	for _, dir := range []string{"/proc", "/sys", "/dev"} {
+		if within(mount, filepath.Join(root, dir)) {
+			return true
+		}
+	}
+	return false
+}
+
+// mountPoints returns the mounts under root, parents before their children
+func mountPoints(root string) ([]string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mounts: %w", err)
+	}
+	defer file.Close()
+
+	mounts := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mount := unescapeMount(fields[4])
+		if within(mount, root) {
+			mounts = append(mounts, mount)
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMount decodes the octal escapes of mountinfo, like \040 for a space
+func unescapeMount(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// mountOverlay makes a directory writable, the writes go to the scratch directory
+func mountOverlay(root string, o overlay) error {
+	target := filepath.Join(root, o.Dir)
+	// a directory in /tmp is made in the tmpfs first
+	os.MkdirAll(target, 0o700)
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", o.Dir, o.Upper, o.Work)
+	// overlayfs wants userxattr in a user namespace since Linux 5.11
+	err := unix.Mount("overlay", target, "overlay", 0, options+",userxattr")
+	if err != nil {
+		err = unix.Mount("overlay", target, "overlay", 0, options)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mount the scratch overlay on %s: %w", o.Dir, err)
+	}
+	return nil
+}
+
+// loopbackUp brings up the loopback of the empty network namespace, so
+// the commands can still use localhost
+func loopbackUp() {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+	defer unix.Close(fd)
+	ifreq, err := unix.NewIfreq("lo")
+	if err != nil {
+		return
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifreq); err != nil {
+		return
+	}
+	ifreq.SetUint16(ifreq.Uint16() | unix.IFF_UP)
+	unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifreq)
+}
+
+// setLimits limits the CPU time and the memory of the command and its children
+func setLimits(spec sandboxSpec) error {
+	if spec.CPUTime > 0 {
+		seconds := uint64((spec.CPUTime + 999_999_999) / 1_000_000_000)
+		// SIGXCPU is sent at the soft limit, SIGKILL a second later
+		if err := unix.Setrlimit(unix.RLIMIT_CPU, &unix.Rlimit{Cur: seconds, Max: seconds + 1}); err != nil {
+			return fmt.Errorf("failed to limit CPU time: %w", err)
+		}
+	}
+	if spec.Memory > 0 {
+		limit := uint64(spec.Memory)
+		if err := unix.Setrlimit(unix.RLIMIT_AS, &unix.Rlimit{Cur: limit, Max: limit}); err != nil {
+			return fmt.Errorf("failed to limit memory: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package cmdexe
+
+import "syscall"
+
+// prepare fails, the sandbox needs the namespaces of Linux
+func (s *Sandbox) prepare(name string, args []string) (*sandboxRun, error) {
+	return nil, ErrSandboxUnsupported
+}
+
+func (r *sandboxRun) procAttr(attr *syscall.SysProcAttr) *syscall.SysProcAttr {
+	return attr
+}
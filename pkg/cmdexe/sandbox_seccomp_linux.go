@@ -0,0 +1,69 @@
+//go:build linux
+
+package cmdexe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// auditArchs are the architectures the seccomp filter knows, the filter
+// checks the architecture of every system call against it
+var auditArchs = map[string]uint32{
+	"amd64":   unix.AUDIT_ARCH_X86_64,
+	"arm64":   unix.AUDIT_ARCH_AARCH64,
+	"riscv64": unix.AUDIT_ARCH_RISCV64,
+	"ppc64le": unix.AUDIT_ARCH_PPC64LE,
+	"s390x":   unix.AUDIT_ARCH_S390X,
+}
+
+// x32SyscallBit marks the system calls of the x32 ABI on amd64, they would
+// get around the filter with other numbers
+const x32SyscallBit = 0x40000000
+
+// denyUnixSockets makes socket(AF_UNIX, ...) fail with EACCES for the
+// command and its children. The mounts can not hide every socket file of
+// the system, like the ones in the home directory, and a socket like
+// /run/docker.sock lets the command act on the system.
+func denyUnixSockets() error {
+	arch, ok := auditArchs[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("no seccomp filter for %s", runtime.GOARCH)
+	}
+	// seccomp_data is {int nr; u32 arch; u64 ip; u64 args[6]}, the low
+	// half of the first argument comes first on little endian
+	familyOffset := uint32(16)
+	if binary.NativeEndian.Uint16([]byte{0, 1}) == 1 {
+		familyOffset = 20
+	}
+	deny := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.EACCES))
+	filter := []unix.SockFilter{
+		// 0: a system call of another architecture is denied
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 4),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, arch, 1, 0),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, deny),
+		// 3: so are the calls of the x32 ABI
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 0),
+		bpfJump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit, 3, 0),
+		// 5: socket(AF_UNIX, ...) is denied, every other call is allowed
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.SYS_SOCKET, 0, 3),
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, familyOffset),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.AF_UNIX, 0, 1),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, deny),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ALLOW),
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	return unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0)
+}
+
+func bpfStmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
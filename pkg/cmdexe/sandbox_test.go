@@ -0,0 +1,123 @@
+//go:build linux
+
+package cmdexe
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sandboxed returns a context running commands in the sandbox, the test is
+// skipped when the kernel does not let the user make namespaces
+func sandboxed(t *testing.T, sandbox *Sandbox) context.Context {
+	ctx := WithSandbox(context.Background(), sandbox)
+	if result, err := RunCommand(ctx, "true"); err != nil {
+		output := ""
+		if result != nil {
+			output = result.Output()
+		}
+		t.Skipf("no sandbox on this system: %v %s", err, output)
+	}
+	return ctx
+}
+
+func TestSandboxDropsWrites(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	assert.NoError(t, os.WriteFile(filepath.Join(home, "kept.txt"), []byte("kept\n"), 0o644))
+	ctx := sandboxed(t, &Sandbox{})
+
+	result, err := RunCommand(ctx, "cat ~/kept.txt && echo new > ~/new.txt && rm ~/kept.txt && cat ~/new.txt && echo tmp > /tmp/nuwa-sandbox-test")
+	assert.NoError(t, err)
+	assert.Equal(t, "kept\nnew\n", result.Stdout)
+	assert.True(t, result.Sandboxed)
+	assert.Equal(t, []string{"deleted " + filepath.Join(home, "kept.txt"), "written " + filepath.Join(home, "new.txt")}, result.SandboxChanges)
+	assert.Contains(t, result.String(), "Ran in the sandbox, its changes were dropped:\ndeleted ")
+
+	// the system did not change
+	_, err = os.Stat(filepath.Join(home, "kept.txt"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(home, "new.txt"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat("/tmp/nuwa-sandbox-test")
+	assert.True(t, os.IsNotExist(err))
+
+	// the rest of the system is read only, even for root
+	result, err = RunCommand(ctx, "touch /usr/nuwa-sandbox-test || mount -o remount,rw /usr")
+	assert.Error(t, err)
+	assert.Contains(t, result.Stderr, "Read-only file system")
+}
+
+func TestSandboxLimits(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ctx := sandboxed(t, &Sandbox{CPUTime: 2 * time.Second, Memory: 512 << 20, MaxOutput: 1000})
+
+	result, err := RunCommand(ctx, "ulimit -t; ulimit -v; cat /proc/net/dev | tail -n +3 | cut -d: -f1")
+	assert.NoError(t, err)
+	assert.Equal(t, "2\n524288\n    lo\n", result.Stdout)
+
+	result, err = RunCommand(ctx, "yes")
+	var exitErr *ExitError
+	assert.ErrorAs(t, err, &exitErr)
+	assert.Equal(t, "killed", result.Signal)
+	assert.LessOrEqual(t, len(result.Stdout), 1000)
+	assert.Contains(t, result.Stderr, "the output limit of 1000 bytes was exceeded")
+}
+
+func TestSandboxDeniesHostSockets(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is needed to connect to a socket")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	ctx := sandboxed(t, &Sandbox{})
+
+	sockets := []string{filepath.Join(home, "probe.sock")}
+	// a socket of the system, when the test may make one
+	if dir, err := os.MkdirTemp("/run", "nuwa-sandbox-test"); err == nil {
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		sockets = append(sockets, filepath.Join(dir, "probe.sock"))
+	}
+	for _, socket := range sockets {
+		listener, err := net.Listen("unix", socket)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		accepted := make(chan struct{}, 1)
+		go func() {
+			if conn, err := listener.Accept(); err == nil {
+				conn.Close()
+				accepted <- struct{}{}
+			}
+		}()
+
+		result, err := RunCommand(ctx, "python3 -c 'import socket,sys; socket.socket(socket.AF_UNIX).connect(sys.argv[1])' "+socket)
+		assert.Error(t, err, socket)
+		assert.NotEmpty(t, result.Stderr, socket)
+		listener.Close()
+		select {
+		case <-accepted:
+			t.Errorf("the sandbox connected to %s", socket)
+		default:
+		}
+	}
+
+	// with network the sockets of the system are hidden, the resolver
+	// config is kept
+	ctx = sandboxed(t, &Sandbox{Network: true})
+	for _, socket := range sockets[1:] {
+		result, err := RunCommand(ctx, "test ! -e "+socket)
+		assert.NoError(t, err, result.Stderr)
+	}
+	if _, err := os.Stat("/etc/resolv.conf"); err == nil {
+		result, err := RunCommand(ctx, "cat /etc/resolv.conf > /dev/null")
+		assert.NoError(t, err, result.Stderr)
+	}
+}
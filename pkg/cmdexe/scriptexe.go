@@ -1,19 +1,46 @@
 package cmdexe
 
-import "os/exec"
+import (
+	"context"
+	"path/filepath"
+)
+
+// shells are the interpreters whose scripts the policy can read
+var shells = map[string]bool{"sh": true, "bash": true, "zsh": true, "dash": true, "ksh": true}
+
+// RunScript executes a shell script like RunCommand executes a command
+func RunScript(ctx context.Context, script string) (*ExecResult, error) {
+	return RunScriptWith(ctx, script, "bash", "-x")
+}
+
+// RunScriptWith executes a script with the interpreter command, the script
+// is its last argument. The policy evaluates the content of shell scripts
+// line by line, the scripts of other languages can not be checked and are
+// confirmed at least.
+func RunScriptWith(ctx context.Context, script string, command ...string) (*ExecResult, error) {
+	if shells[filepath.Base(command[0])] {
+		if err := checkScriptPolicy(script); err != nil {
+			return nil, err
+		}
+	} else if err := checkCodePolicy(script, filepath.Base(command[0])); err != nil {
+		return nil, err
+	}
+	args := append(append([]string{}, command[1:]...), script)
+	return runStreaming(ctx, script, command[0], args...)
+}
 
 // ExecScript executes a shell script
 func ExecScript(script string) error {
-	cmd := exec.Command("bash", "-x", script)
-	return cmd.Run()
+	_, err := RunScript(context.Background(), script)
+	return err
 }
 
-// ExecScriptWithOutput executes a shell script and returns the output
+// ExecScriptWithOutput executes a shell script and returns the output, the
+// output is returned when the script failed as well
 func ExecScriptWithOutput(script string) (string, error) {
-	cmd := exec.Command("bash", "-x", script)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
+	result, err := RunScript(context.Background(), script)
+	if result == nil {
 		return "", err
 	}
-	return string(out), nil
+	return result.Output(), err
 }
@@ -0,0 +1,361 @@
+package cmdexe
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrShellExited is returned when the command ended the shell, like "exit".
+// The next command starts a new shell in the last known directory.
+var ErrShellExited = errors.New("the shell exited")
+
+// ShellSession is a long lived bash process, so the working directory,
+// environment variables and functions survive between commands. Aliases are
+// not expanded, an alias checked by the policy in one command could change
+// what a later command runs.
+//
+// Commands are sent to bash on a pipe. Where a pty is available, commands run
+// with the pty as their terminal, so interactive programs work, their stderr
+// goes to a pipe and bash reports the exit status on another pipe. Otherwise
+// commands run with pipes, and the exit status follows a marker on stdout.
+type ShellSession struct {
+	mu    sync.Mutex
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	// marker ends the output of every command, it is unique per shell so a
+	// command can not fake it
+	marker string
+	dir    string
+
+	// pty mode
+	master    *os.File
+	stream    *outputStream
+	errStream *outputStream
+	status    *bufio.Reader
+
+	// pipe mode
+	stdout *bufio.Reader
+	stderr *bufio.Reader
+}
+
+// NewShellSession starts a bash process in the current directory.
+func NewShellSession() (*ShellSession, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current directory: %w", err)
+	}
+	s := &ShellSession{dir: dir}
+	if err := s.start(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ShellSession) start() error {
+	s.marker = "__NUWA_DONE_" + strings.ReplaceAll(uuid.New().String(), "-", "") + "__"
+	cmd := exec.Command("bash", "--noprofile", "--norc")
+	cmd.Dir = s.dir
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open shell stdin: %w", err)
+	}
+
+	setup := ""
+	if master, slave, err := openPty(); err == nil {
+		if err := s.startPty(cmd, master, slave); err != nil {
+			return err
+		}
+		// ctrl-c stops the whole command line but not the shell, ctrl-z is
+		// disabled as the shell can not resume a stopped command
+		setup = "__nuwa_run() { eval \"$1\"; }; trap 'return 130' INT; trap : QUIT; stty susp undef <&4"
+	} else if err := s.startPipes(cmd); err != nil {
+		return err
+	}
+	s.cmd = cmd
+	s.stdin = stdin
+
+	// the setup is sent as it is, the empty command waits until it is done
+	if _, err := io.WriteString(stdin, setup+"\n"); err != nil {
+		s.kill()
+		return fmt.Errorf("failed to set up shell: %w", err)
+	}
+	if _, err := s.exec(":", io.Discard); err != nil {
+		s.kill()
+		return fmt.Errorf("failed to set up shell: %w", err)
+	}
+	return nil
+}
+
+// startPty starts bash with the pty as fd 4 and its controlling terminal,
+// the exit status of every command is written to fd 3 and the stderr of the
+// commands to fd 5.
+func (s *ShellSession) startPty(cmd *exec.Cmd, master, slave *os.File) error {
+	statusReader, statusWriter, err := os.Pipe()
+	if err != nil {
+		master.Close()
+		slave.Close()
+		return fmt.Errorf("failed to open shell status pipe: %w", err)
+	}
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		master.Close()
+		slave.Close()
+		statusReader.Close()
+		statusWriter.Close()
+		return fmt.Errorf("failed to open shell stderr pipe: %w", err)
+	}
+	cmd.Stdout, cmd.Stderr = slave, slave
+	cmd.ExtraFiles = []*os.File{statusWriter, slave, stderrWriter}
+	cmd.SysProcAttr = ptyProcAttr(4)
+
+	err = cmd.Start()
+	slave.Close()
+	statusWriter.Close()
+	stderrWriter.Close()
+	if err != nil {
+		master.Close()
+		statusReader.Close()
+		stderrReader.Close()
+		return fmt.Errorf("failed to start shell: %w", err)
+	}
+	s.master = master
+	s.stream = newOutputStream(master, os.Stdout, s.marker)
+	s.errStream = newOutputStream(stderrReader, terminalStderr(), s.marker)
+	s.status = bufio.NewReader(statusReader)
+	return nil
+}
+
+func (s *ShellSession) startPipes(cmd *exec.Cmd) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open shell stdout: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open shell stderr: %w", err)
+	}
+	// in its own process group, so an interrupted command dies with the shell
+	cmd.SysProcAttr = groupProcAttr()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start shell: %w", err)
+	}
+	s.stdout = bufio.NewReader(stdout)
+	s.stderr = bufio.NewReader(stderr)
+	return nil
+}
+
+// Dir returns the working directory of the shell after the last command.
+func (s *ShellSession) Dir() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dir
+}
+
+// Run runs a command in the shell after checking it against the policy. The
+// output is streamed to the terminal while it arrives, bounded copies of it
+// are returned in the result. The error is an *ExitError if the command
+// failed, the result is nil if the command did not run. When the context is
+// cancelled the command is interrupted and the error wraps the error of the
+// context.
+func (s *ShellSession) Run(ctx context.Context, command string) (*ExecResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := checkPolicy(command, s.dir); err != nil {
+		return nil, err
+	}
+	if s.cmd == nil {
+		if err := s.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	stop := context.AfterFunc(ctx, s.interrupter())
+	result, err := s.exec(command, os.Stdout)
+	stop()
+	if result != nil {
+		result.Command = command
+		result.Duration = time.Since(start)
+	}
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("command interrupted: %w", ctx.Err())
+	}
+	if err != nil {
+		return result, err
+	}
+	return result, resultError(result)
+}
+
+// interrupter returns a func which stops the running command. With a pty it
+// sends Ctrl+C like the terminal does, the shell survives. Without one the
+// shell is killed with the command and started again for the next command.
+func (s *ShellSession) interrupter() func() {
+	master, process := s.master, s.cmd.Process
+	return func() {
+		if master != nil {
+			master.Write([]byte{3})
+			return
+		}
+		killGroup(process)
+	}
+}
+
+// exec sends the command to the shell and waits for its exit status, the
+// output is streamed to out. The command is run with eval so a syntax error
+// can not swallow what follows it.
+func (s *ShellSession) exec(command string, out io.Writer) (*ExecResult, error) {
+	if s.master != nil {
+		return s.execPty(command, out)
+	}
+	return s.execPipes(command, out)
+}
+
+func (s *ShellSession) execPty(command string, out io.Writer) (*ExecResult, error) {
+	stdout := NewOutputBuffer(MaxCapturedOutput)
+	stderr := NewOutputBuffer(MaxCapturedOutput)
+	errOut := terminalStderr()
+	if out == io.Discard {
+		errOut = io.Discard
+	}
+	s.stream.setTarget(out, stdout)
+	s.errStream.setTarget(errOut, stderr)
+	defer s.stream.setTarget(os.Stdout, nil)
+	defer s.errStream.setTarget(terminalStderr(), nil)
+
+	stopResize := watchResize(s.master)
+	defer stopResize()
+	stopStdin := func() {}
+	if out != io.Discard {
+		stopStdin = forwardStdin(s.master)
+	}
+	defer stopStdin()
+
+	// the markers on the pty and the stderr pipe tell when all the output was read
+	line := fmt.Sprintf("__nuwa_run %s <&4 2>&5 3>&- 4>&- 5>&-; __nuwa_status=$?; printf '%%s\\n' '%s'; printf '%%s\\n' '%s' >&5; printf '%%d %%s\\n' \"$__nuwa_status\" \"$PWD\" >&3\n",
+		shellQuote(command), s.marker, s.marker)
+	if _, err := io.WriteString(s.stdin, line); err != nil {
+		s.kill()
+		return nil, ErrShellExited
+	}
+
+	trailer, err := s.status.ReadString('\n')
+	if err != nil {
+		s.kill()
+		return &ExecResult{Stdout: stdout.String(), Stderr: stderr.String(), ExitCode: -1}, ErrShellExited
+	}
+	s.stream.wait()
+	s.errStream.wait()
+
+	result := &ExecResult{Stdout: stdout.String(), Stderr: stderr.String()}
+	return result, s.parseTrailer(result, trailer)
+}
+
+func (s *ShellSession) execPipes(command string, out io.Writer) (*ExecResult, error) {
+	line := fmt.Sprintf("eval %s </dev/null; __nuwa_status=$?; printf '\\n%s %%d %%s\\n' \"$__nuwa_status\" \"$PWD\"; printf '\\n%s\\n' >&2\n",
+		shellQuote(command), s.marker, s.marker)
+	if _, err := io.WriteString(s.stdin, line); err != nil {
+		s.kill()
+		return nil, ErrShellExited
+	}
+
+	errOut := out
+	if out == os.Stdout {
+		errOut = os.Stderr
+	}
+	var stderr string
+	var stderrErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stderr, _, stderrErr = readUntilMarker(s.stderr, s.marker, errOut)
+	}()
+	stdout, trailer, err := readUntilMarker(s.stdout, s.marker, out)
+	wg.Wait()
+	result := &ExecResult{Stdout: stdout, Stderr: stderr}
+	if err != nil || stderrErr != nil {
+		// the shell is gone
+		s.kill()
+		result.ExitCode = -1
+		return result, ErrShellExited
+	}
+	return result, s.parseTrailer(result, trailer)
+}
+
+// parseTrailer reads the exit status and working directory reported by the shell
+func (s *ShellSession) parseTrailer(result *ExecResult, trailer string) error {
+	status, dir, _ := strings.Cut(strings.TrimSpace(trailer), " ")
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return fmt.Errorf("failed to read exit status from shell: %w", err)
+	}
+	result.setShellStatus(code)
+	if dir != "" {
+		s.dir = dir
+	}
+	return nil
+}
+
+// readUntilMarker streams the output up to the marker line to out, the
+// output and the rest of the marker line are returned.
+func readUntilMarker(r *bufio.Reader, marker string, out io.Writer) (string, string, error) {
+	capture := NewOutputBuffer(MaxCapturedOutput)
+	w := io.MultiWriter(out, capture)
+	// the last line is held back, its newline was printed before the marker
+	// and is not part of the output
+	pending := ""
+	for {
+		line, err := r.ReadString('\n')
+		if strings.HasPrefix(line, marker) {
+			io.WriteString(w, strings.TrimSuffix(pending, "\n"))
+			return capture.String(), strings.TrimSpace(strings.TrimPrefix(line, marker)), nil
+		}
+		io.WriteString(w, pending)
+		pending = line
+		if err != nil {
+			io.WriteString(w, pending)
+			return capture.String(), "", err
+		}
+	}
+}
+
+func (s *ShellSession) kill() {
+	if s.cmd == nil {
+		return
+	}
+	s.stdin.Close()
+	if s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+	}
+	s.cmd.Wait()
+	s.cmd = nil
+	if s.master != nil {
+		s.master.Close()
+		s.master = nil
+	}
+}
+
+// Close ends the shell.
+func (s *ShellSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kill()
+	return nil
+}
+
+// shellQuote quotes s in single quotes for bash, a single quote in s is closed, escaped and reopened.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,55 @@
+package cmdexe
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellSessionKeepsState(t *testing.T) {
+	shell, err := NewShellSession()
+	assert.NoError(t, err)
+	defer shell.Close()
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	assert.NoError(t, err)
+
+	_, err = shell.Run(context.Background(), "cd "+shellQuote(dir)+" && export NUWA_TEST=hello && f() { echo \"f $1\"; }")
+	assert.NoError(t, err)
+	assert.Equal(t, dir, shell.Dir())
+
+	result, err := shell.Run(context.Background(), `pwd; echo "$NUWA_TEST"; f x`)
+	assert.NoError(t, err)
+	assert.Equal(t, dir+"\nhello\nf x\n", result.Stdout)
+
+	// aliases are not expanded, the policy only saw the command defining it
+	_, err = shell.Run(context.Background(), "alias ls='echo hijacked'")
+	assert.NoError(t, err)
+	result, err = shell.Run(context.Background(), "ls -d .")
+	assert.NoError(t, err)
+	assert.Equal(t, ".\n", result.Stdout)
+
+	result, err = shell.Run(context.Background(), "printf partial; echo oops >&2; exit_with() { return $1; }; exit_with 4")
+	var exitErr *ExitError
+	assert.ErrorAs(t, err, &exitErr)
+	assert.Equal(t, "partial", result.Stdout)
+	assert.Equal(t, "oops\n", result.Stderr)
+	assert.Equal(t, 4, result.ExitCode)
+	assert.True(t, result.Failed())
+
+	// a syntax error or a command reading stdin must not break the session
+	result, err = shell.Run(context.Background(), `echo "unterminated`)
+	assert.Error(t, err)
+	assert.Contains(t, result.Stderr, "unexpected EOF")
+	result, err = shell.Run(context.Background(), "read -t 0.1 line || echo fine")
+	assert.NoError(t, err)
+	assert.Equal(t, "fine\n", result.Stdout)
+
+	_, err = shell.Run(context.Background(), "exit 3")
+	assert.ErrorIs(t, err, ErrShellExited)
+	result, err = shell.Run(context.Background(), "pwd")
+	assert.NoError(t, err)
+	assert.Equal(t, dir+"\n", result.Stdout)
+}
@@ -0,0 +1,620 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Catchdir is the directory of nuwa in the home directory, it keeps the
+	// config, the sessions, the history and the other files of nuwa
+	Catchdir       = ".nuwa-terminal"
+	ConfigFileName = "config.yaml"
+
+	// DefaultProfileName is the profile used when the config selects none,
+	// without a config file it is made of the environment variables only.
+	DefaultProfileName = "default"
+
+	// NuwaProfileEnv selects the profile like the --profile flag does.
+	NuwaProfileEnv = "NUWA_PROFILE"
+
+	// CacheEnv turns the response cache on or off, it wins over the config.
+	CacheEnv = "NUWA_CACHE"
+
+	// SandboxEnv runs the commands of every mode in the sandbox when true,
+	// of no mode when false, it wins over the config.
+	SandboxEnv = "NUWA_SANDBOX"
+
+	// ScriptLanguageEnv sets the language task scripts are written in, it
+	// wins over the config.
+	ScriptLanguageEnv = "NUWA_SCRIPT_LANGUAGE"
+
+	// DefaultScriptLanguage is the language of task scripts when the config
+	// sets none.
+	DefaultScriptLanguage = "bash"
+)
+
+// the limits of the response cache when the config sets none
+const (
+	DefaultCacheTTL        = 24 * time.Hour
+	DefaultCacheMaxEntries = 1000
+	DefaultCacheMaxBytes   = 10 << 20
+)
+
+// the limits of the sandbox when the config sets none
+const (
+	DefaultSandboxCPUTime   = time.Minute
+	DefaultSandboxMemoryMB  = 2048
+	DefaultSandboxMaxOutput = 1 << 20
+)
+
+// Environment variables which override the fields of the selected profile.
+const (
+	BackendEnv      = "LLM_BACKEND"
+	ModelEnv        = "LLM_MODEL_NAME"
+	APIKeyEnv       = "LLM_API_KEY"
+	BaseURLEnv      = "LLM_BASE_URL"
+	OllamaServerEnv = "OLLAMA_SERVER_URL"
+	TemperatureEnv  = "LLM_TEMPERATURE"
+	MaxTokensEnv    = "LLM_MAX_TOKENS"
+	TimeoutEnv      = "LLM_TIMEOUT"
+	FixtureEnv      = "LLM_FIXTURE"
+	CassetteEnv     = "LLM_CASSETTE"
+	CassetteModeEnv = "LLM_CASSETTE_MODE"
+	// ContextWindowEnv sets the context window of the model, in tokens
+	ContextWindowEnv = "LLM_CONTEXT_WINDOW"
+)
+
+// the backend and model used when nothing is configured
+const (
+	defaultBackend = "gemini"
+	defaultModel   = "gemini-1.5-pro"
+)
+
+// Profile is a named LLM provider setup.
+type Profile struct {
+	// Name is the key of the profile in the config file
+	Name    string `yaml:"-"`
+	Backend string `yaml:"backend"`
+	Model   string `yaml:"model"`
+	BaseURL string `yaml:"base_url"`
+	// APIKey is the key itself, APIKeyEnv the environment variable holding
+	// it, so the config file does not need to contain secrets
+	APIKey      string        `yaml:"api_key"`
+	APIKeyEnv   string        `yaml:"api_key_env"`
+	Temperature *float64      `yaml:"temperature"`
+	MaxTokens   int           `yaml:"max_tokens"`
+	Timeout     time.Duration `yaml:"timeout"`
+	// ContextWindow is the size of the context of the model in tokens, it
+	// is looked up by the model name when not set
+	ContextWindow int `yaml:"context_window"`
+	// ToolCalls makes the agent use the tool calls of the model instead of
+	// parsing its text, it depends on the backend when not set
+	ToolCalls *bool `yaml:"tool_calls"`
+	// MaxRetries is how many times a failed call is retried, 2 if not set
+	MaxRetries *int `yaml:"max_retries"`
+	// RetryBackoff is the wait before the first retry, it doubles with every retry
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// Fallback are the profiles tried in this order when the profile keeps failing
+	Fallback []string `yaml:"fallback"`
+	// Headers are added to every request sent to the backend
+	Headers map[string]string `yaml:"headers"`
+	TLS     TLSConfig         `yaml:"tls"`
+	// Fixture is the file with the scripted responses of the fake backend
+	Fixture string `yaml:"fixture"`
+	// Cassette is a file the calls are recorded to or played back from,
+	// depending on CassetteMode
+	Cassette     string       `yaml:"cassette"`
+	CassetteMode CassetteMode `yaml:"cassette_mode"`
+}
+
+// CassetteMode is what happens with the cassette of a profile.
+type CassetteMode string
+
+const (
+	// CassetteRecord sends the calls to the backend and records them
+	CassetteRecord CassetteMode = "record"
+	// CassetteReplay answers from the cassette, the backend is not used
+	CassetteReplay CassetteMode = "replay"
+)
+
+// TLSConfig sets how the server of a backend is verified, and the client
+// certificate sent to it.
+type TLSConfig struct {
+	// CAFile is a PEM file with the certificates trusted in addition to the system ones
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// Key returns the API key of the profile, from the config or from its environment variable.
+func (p *Profile) Key() string {
+	if p.APIKey != "" {
+		return p.APIKey
+	}
+	if p.APIKeyEnv != "" {
+		return os.Getenv(p.APIKeyEnv)
+	}
+	return ""
+}
+
+// Validate checks the values of the profile which do not depend on the backend.
+func (p *Profile) Validate() error {
+	if p.Backend == "" {
+		return fmt.Errorf("profile %q: backend is not set", p.Name)
+	}
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+		return fmt.Errorf("profile %q: temperature %v is out of range, it must be between 0 and 2", p.Name, *p.Temperature)
+	}
+	if p.MaxTokens < 0 {
+		return fmt.Errorf("profile %q: max_tokens must not be negative", p.Name)
+	}
+	if p.ContextWindow < 0 {
+		return fmt.Errorf("profile %q: context_window must not be negative", p.Name)
+	}
+	if p.Timeout < 0 {
+		return fmt.Errorf("profile %q: timeout must not be negative", p.Name)
+	}
+	if p.MaxRetries != nil && *p.MaxRetries < 0 {
+		return fmt.Errorf("profile %q: max_retries must not be negative", p.Name)
+	}
+	if p.RetryBackoff < 0 {
+		return fmt.Errorf("profile %q: retry_backoff must not be negative", p.Name)
+	}
+	if p.Cassette != "" && p.CassetteMode != CassetteRecord && p.CassetteMode != CassetteReplay {
+		return fmt.Errorf("profile %q: cassette_mode must be %s or %s", p.Name, CassetteRecord, CassetteReplay)
+	}
+	if (p.TLS.CertFile == "") != (p.TLS.KeyFile == "") {
+		return fmt.Errorf("profile %q: tls.cert_file and tls.key_file must be set together", p.Name)
+	}
+	return nil
+}
+
+// Config is the nuwa configuration, it is read from ~/.nuwa-terminal/config.yaml.
+//
+//	default_profile: deepseek
+//	profiles:
+//	  deepseek:
+//	    backend: deepseek
+//	    model: deepseek-chat
+//	    base_url: https://api.deepseek.com
+//	    api_key_env: DEEPSEEK_API_KEY
+//	    temperature: 0.2
+//	  local:
+//	    backend: ollama
+//	    model: llama3
+//	    base_url: http://localhost:11434
+//	    timeout: 2m
+//	modes:
+//	  chatmode: local
+//	prices:
+//	  deepseek-chat:
+//	    input: 0.27
+//	    output: 1.10
+//	cache:
+//	  enabled: true
+//	  ttl: 12h
+//	sandbox:
+//	  modes: [taskmode, agentmode]
+//	  network: false
+//	  cpu_time: 30s
+//	scripts:
+//	  language: python
+//	  interpreters:
+//	    python:
+//	      command: [python3.12]
+//	    deno:
+//	      command: [deno, run]
+//	      extension: .ts
+//	      aliases: [typescript, ts]
+type Config struct {
+	DefaultProfile string              `yaml:"default_profile"`
+	Profiles       map[string]*Profile `yaml:"profiles"`
+	// Modes selects the profile of a mode, like cmdmode or taskmode
+	Modes map[string]string `yaml:"modes"`
+	// Prices are the prices of the models by model name, they win over the
+	// built-in prices
+	Prices map[string]Price `yaml:"prices"`
+	Cache  CacheConfig      `yaml:"cache"`
+	// Sandbox sets the modes whose commands and scripts run in the sandbox
+	Sandbox SandboxConfig `yaml:"sandbox"`
+	// Scripts sets the language of task scripts and the interpreters running them
+	Scripts ScriptsConfig `yaml:"scripts"`
+
+	// override is the profile given with --profile, it wins over everything
+	override string
+	// model is the model chosen with /model, it replaces the model of every profile
+	model string
+	// sandboxModes are the modes put in or out of the sandbox with /sandbox
+	sandboxModes map[string]bool
+}
+
+// Price is what a model costs, in dollars per million tokens.
+type Price struct {
+	Input  float64 `yaml:"input"`
+	Output float64 `yaml:"output"`
+}
+
+// CacheConfig sets the on-disk cache of the answers to repeated prompts, it
+// is off unless enabled.
+type CacheConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	TTL     time.Duration `yaml:"ttl"`
+	// MaxEntries and MaxBytes limit the cache, the oldest answers are
+	// removed first
+	MaxEntries int   `yaml:"max_entries"`
+	MaxBytes   int64 `yaml:"max_bytes"`
+}
+
+// CacheSettings returns the cache config with NUWA_CACHE and the default
+// limits applied.
+func (c *Config) CacheSettings() CacheConfig {
+	settings := c.Cache
+	if on, err := strconv.ParseBool(os.Getenv(CacheEnv)); err == nil {
+		settings.Enabled = on
+	}
+	if settings.TTL == 0 {
+		settings.TTL = DefaultCacheTTL
+	}
+	if settings.MaxEntries == 0 {
+		settings.MaxEntries = DefaultCacheMaxEntries
+	}
+	if settings.MaxBytes == 0 {
+		settings.MaxBytes = DefaultCacheMaxBytes
+	}
+	return settings
+}
+
+// SandboxConfig sets the Linux sandbox the commands and scripts of some
+// modes run in, isolated from the system.
+type SandboxConfig struct {
+	// Modes are the modes run in the sandbox, like taskmode
+	Modes []string `yaml:"modes"`
+	// Network lets the sandboxed commands use the network of the host
+	Network bool          `yaml:"network"`
+	CPUTime time.Duration `yaml:"cpu_time"`
+	// MemoryMB limits the memory of every process, in MiB
+	MemoryMB int `yaml:"memory_mb"`
+	// MaxOutput kills a command which writes more bytes
+	MaxOutput int64 `yaml:"max_output"`
+}
+
+// SandboxSettings returns the sandbox config with the default limits applied.
+func (c *Config) SandboxSettings() SandboxConfig {
+	settings := c.Sandbox
+	if settings.CPUTime == 0 {
+		settings.CPUTime = DefaultSandboxCPUTime
+	}
+	if settings.MemoryMB == 0 {
+		settings.MemoryMB = DefaultSandboxMemoryMB
+	}
+	if settings.MaxOutput == 0 {
+		settings.MaxOutput = DefaultSandboxMaxOutput
+	}
+	return settings
+}
+
+// Sandboxed returns whether the commands of a mode run in the sandbox.
+// NUWA_SANDBOX wins, then /sandbox and the modes of the config.
+func (c *Config) Sandboxed(mode string) bool {
+	if on, err := strconv.ParseBool(os.Getenv(SandboxEnv)); err == nil {
+		return on
+	}
+	if on, ok := c.sandboxModes[mode]; ok {
+		return on
+	}
+	for _, sandboxed := range c.Sandbox.Modes {
+		if sandboxed == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSandboxed puts a mode in or out of the sandbox until nuwa exits.
+func (c *Config) SetSandboxed(mode string, on bool) {
+	if c.sandboxModes == nil {
+		c.sandboxModes = map[string]bool{}
+	}
+	c.sandboxModes[mode] = on
+}
+
+// ScriptsConfig sets the languages the scripts of the model are written in.
+type ScriptsConfig struct {
+	// Language is the language the model writes task scripts in, unless the
+	// user asks for another one
+	Language string `yaml:"language"`
+	// Interpreters add languages or replace the interpreters of the built-in
+	// ones, by the language of the code blocks
+	Interpreters map[string]InterpreterConfig `yaml:"interpreters"`
+}
+
+// InterpreterConfig is the interpreter of a script language, the fields left
+// empty are the ones of the built-in interpreter of the language.
+type InterpreterConfig struct {
+	// Command runs a script, the file of the script is its last argument
+	Command []string `yaml:"command"`
+	// Extension is the extension of the script files, like .py
+	Extension string `yaml:"extension"`
+	// Aliases are the other names of the language in code blocks
+	Aliases []string `yaml:"aliases"`
+}
+
+// ScriptLanguage returns the language of task scripts, NUWA_SCRIPT_LANGUAGE
+// wins over the config.
+func (c *Config) ScriptLanguage() string {
+	if language := strings.TrimSpace(os.Getenv(ScriptLanguageEnv)); language != "" {
+		return language
+	}
+	if c.Scripts.Language != "" {
+		return c.Scripts.Language
+	}
+	return DefaultScriptLanguage
+}
+
+// HomePath returns the path of a file or directory of nuwa in the home
+// directory, like ~/.nuwa-terminal/sessions.
+func HomePath(name string) string {
+	return filepath.Join(os.Getenv("HOME"), Catchdir, name)
+}
+
+// DefaultConfigPath returns the path of the config file in the home directory.
+func DefaultConfigPath() string {
+	return HomePath(ConfigFileName)
+}
+
+// LoadConfig reads the config file, an empty config is used if it does not
+// exist. Unknown fields and references to missing profiles are errors.
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{Profiles: map[string]*Profile{}, Modes: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if cfg.Profiles == nil {
+		cfg.Profiles = map[string]*Profile{}
+	}
+	if cfg.Modes == nil {
+		cfg.Modes = map[string]string{}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	for name, profile := range c.Profiles {
+		if profile == nil {
+			return fmt.Errorf("profile %q is empty", name)
+		}
+		profile.Name = name
+		if err := profile.Validate(); err != nil {
+			return err
+		}
+	}
+	for name, profile := range c.Profiles {
+		for _, fallback := range profile.Fallback {
+			if fallback == name {
+				return fmt.Errorf("profile %q: fallback to itself", name)
+			}
+			if _, ok := c.Profiles[fallback]; !ok {
+				return fmt.Errorf("profile %q: fallback: %w", name, c.checkProfile(fallback))
+			}
+		}
+	}
+	for model, price := range c.Prices {
+		if price.Input < 0 || price.Output < 0 {
+			return fmt.Errorf("prices.%s: prices must not be negative", model)
+		}
+	}
+	if c.Cache.TTL < 0 || c.Cache.MaxEntries < 0 || c.Cache.MaxBytes < 0 {
+		return fmt.Errorf("cache: ttl, max_entries and max_bytes must not be negative")
+	}
+	if c.Sandbox.CPUTime < 0 || c.Sandbox.MemoryMB < 0 || c.Sandbox.MaxOutput < 0 {
+		return fmt.Errorf("sandbox: cpu_time, memory_mb and max_output must not be negative")
+	}
+	for language, interpreter := range c.Scripts.Interpreters {
+		if len(interpreter.Command) > 0 && strings.TrimSpace(interpreter.Command[0]) == "" {
+			return fmt.Errorf("scripts.interpreters.%s: command must not start with an empty word", language)
+		}
+		if interpreter.Extension != "" && !strings.HasPrefix(interpreter.Extension, ".") {
+			return fmt.Errorf("scripts.interpreters.%s: extension must start with a dot, like .py", language)
+		}
+	}
+	if c.DefaultProfile != "" {
+		if err := c.checkProfile(c.DefaultProfile); err != nil {
+			return fmt.Errorf("default_profile: %w", err)
+		}
+	}
+	for mode, name := range c.Modes {
+		if err := c.checkProfile(name); err != nil {
+			return fmt.Errorf("modes.%s: %w", mode, err)
+		}
+	}
+	return nil
+}
+
+// checkProfile returns an error naming the known profiles if there is no such profile
+func (c *Config) checkProfile(name string) error {
+	if _, ok := c.Profiles[name]; ok {
+		return nil
+	}
+	if name == DefaultProfileName && len(c.Profiles) == 0 {
+		return nil
+	}
+	names := c.ProfileNames()
+	if len(names) == 0 {
+		return fmt.Errorf("unknown profile %q, no profiles are configured in %s", name, DefaultConfigPath())
+	}
+	return fmt.Errorf("unknown profile %q, known profiles: %s", name, strings.Join(names, ", "))
+}
+
+// ProfileNames returns the names of the configured profiles, sorted.
+func (c *Config) ProfileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetOverride makes every mode use the profile, it fails if there is no such profile.
+func (c *Config) SetOverride(name string) error {
+	if name != "" {
+		if err := c.checkProfile(name); err != nil {
+			return err
+		}
+	}
+	c.override = name
+	return nil
+}
+
+// SetModel makes every mode use the model with its profile, an empty name
+// goes back to the model of the profile.
+func (c *Config) SetModel(name string) {
+	c.model = name
+}
+
+// ProfileName returns the name of the profile used by a mode. The --profile
+// flag wins, then NUWA_PROFILE, the profile of the mode and the default profile.
+func (c *Config) ProfileName(mode string) string {
+	if c.override != "" {
+		return c.override
+	}
+	if name := os.Getenv(NuwaProfileEnv); name != "" {
+		return name
+	}
+	if name, ok := c.Modes[mode]; ok && name != "" {
+		return name
+	}
+	if c.DefaultProfile != "" {
+		return c.DefaultProfile
+	}
+	if len(c.Profiles) == 1 {
+		return c.ProfileNames()[0]
+	}
+	return DefaultProfileName
+}
+
+// Profile returns the profile of a mode with the environment variables
+// applied on top of it. The profile is a copy, it can be changed freely.
+func (c *Config) Profile(mode string) (*Profile, error) {
+	name := c.ProfileName(mode)
+	if err := c.checkProfile(name); err != nil {
+		return nil, err
+	}
+
+	profile := &Profile{Name: name}
+	if configured, ok := c.Profiles[name]; ok {
+		*profile = *configured
+		profile.Name = name
+	}
+	if err := applyEnv(profile); err != nil {
+		return nil, err
+	}
+	if c.model != "" {
+		profile.Model = c.model
+	}
+	if profile.Backend == "" && len(c.Profiles) == 0 {
+		// the default of the environment only setup
+		profile.Backend = defaultBackend
+		if profile.Model == "" {
+			profile.Model = defaultModel
+		}
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// NamedProfile returns a copy of a configured profile, without the
+// environment variables, as used for fallbacks.
+func (c *Config) NamedProfile(name string) (*Profile, error) {
+	configured, ok := c.Profiles[name]
+	if !ok {
+		return nil, c.checkProfile(name)
+	}
+	profile := *configured
+	profile.Name = name
+	return &profile, nil
+}
+
+// applyEnv overrides the fields of the profile with the environment variables which are set
+func applyEnv(p *Profile) error {
+	if v := os.Getenv(BackendEnv); v != "" {
+		p.Backend = v
+	}
+	if v := os.Getenv(ModelEnv); v != "" {
+		p.Model = v
+	}
+	if v := os.Getenv(APIKeyEnv); v != "" {
+		p.APIKey = v
+	}
+	if v := os.Getenv(BaseURLEnv); v != "" {
+		p.BaseURL = v
+	}
+	if v := os.Getenv(OllamaServerEnv); v != "" && p.Backend == "ollama" {
+		p.BaseURL = v
+	}
+	if v := os.Getenv(TemperatureEnv); v != "" {
+		temperature, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", TemperatureEnv, err)
+		}
+		p.Temperature = &temperature
+	}
+	if v := os.Getenv(MaxTokensEnv); v != "" {
+		maxTokens, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", MaxTokensEnv, err)
+		}
+		p.MaxTokens = maxTokens
+	}
+	if v := os.Getenv(FixtureEnv); v != "" {
+		p.Fixture = v
+	}
+	if v := os.Getenv(CassetteEnv); v != "" {
+		p.Cassette = v
+	}
+	if v := os.Getenv(CassetteModeEnv); v != "" {
+		p.CassetteMode = CassetteMode(v)
+	}
+	if v := os.Getenv(ContextWindowEnv); v != "" {
+		window, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", ContextWindowEnv, err)
+		}
+		p.ContextWindow = window
+	}
+	if v := os.Getenv(TimeoutEnv); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", TimeoutEnv, err)
+		}
+		p.Timeout = timeout
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `
+default_profile: deepseek
+profiles:
+  deepseek:
+    backend: deepseek
+    model: deepseek-chat
+    base_url: https://api.deepseek.com
+    api_key_env: TEST_DEEPSEEK_KEY
+    temperature: 0.2
+    max_tokens: 1024
+  local:
+    backend: ollama
+    model: llama3
+    base_url: http://localhost:11434
+    timeout: 2m
+modes:
+  chatmode: local
+`
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), ConfigFileName)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+// clearEnv unsets the environment variables which override profiles
+func clearEnv(t *testing.T) {
+	for _, env := range []string{NuwaProfileEnv, BackendEnv, ModelEnv, APIKeyEnv, BaseURLEnv, OllamaServerEnv, TemperatureEnv, MaxTokensEnv, TimeoutEnv, FixtureEnv, CassetteEnv, CassetteModeEnv, ContextWindowEnv} {
+		t.Setenv(env, "")
+	}
+}
+
+func TestProfileSelection(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("TEST_DEEPSEEK_KEY", "secret")
+	cfg, err := LoadConfig(writeConfig(t, testConfig))
+	assert.NoError(t, err)
+
+	profile, err := cfg.Profile("cmdmode")
+	assert.NoError(t, err)
+	assert.Equal(t, "deepseek", profile.Name)
+	assert.Equal(t, "secret", profile.Key())
+	assert.Equal(t, 0.2, *profile.Temperature)
+	assert.Equal(t, 1024, profile.MaxTokens)
+
+	profile, err = cfg.Profile("chatmode")
+	assert.NoError(t, err)
+	assert.Equal(t, "local", profile.Name)
+	assert.Equal(t, 2*time.Minute, profile.Timeout)
+
+	t.Setenv(NuwaProfileEnv, "local")
+	assert.Equal(t, "local", cfg.ProfileName("cmdmode"))
+
+	assert.NoError(t, cfg.SetOverride("deepseek"))
+	assert.Equal(t, "deepseek", cfg.ProfileName("chatmode"))
+	assert.ErrorContains(t, cfg.SetOverride("missing"), "known profiles: deepseek, local")
+}
+
+func TestEnvOverridesProfile(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadConfig(writeConfig(t, testConfig))
+	assert.NoError(t, err)
+
+	t.Setenv(ModelEnv, "deepseek-coder")
+	t.Setenv(TemperatureEnv, "0.7")
+	profile, err := cfg.Profile("taskmode")
+	assert.NoError(t, err)
+	assert.Equal(t, "deepseek-coder", profile.Model)
+	assert.Equal(t, 0.7, *profile.Temperature)
+	// the configured profile is not changed
+	assert.Equal(t, "deepseek-chat", cfg.Profiles["deepseek"].Model)
+
+	t.Setenv(ContextWindowEnv, "32768")
+	profile, err = cfg.Profile("taskmode")
+	assert.NoError(t, err)
+	assert.Equal(t, 32768, profile.ContextWindow)
+
+	// the model chosen in the terminal wins over the environment
+	cfg.SetModel("deepseek-reasoner")
+	profile, err = cfg.Profile("taskmode")
+	assert.NoError(t, err)
+	assert.Equal(t, "deepseek-reasoner", profile.Model)
+	cfg.SetModel("")
+
+	t.Setenv(TemperatureEnv, "hot")
+	_, err = cfg.Profile("taskmode")
+	assert.ErrorContains(t, err, TemperatureEnv)
+}
+
+func TestEnvOnlySetup(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.NoError(t, err)
+
+	profile, err := cfg.Profile("chatmode")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultProfileName, profile.Name)
+	assert.Equal(t, "gemini", profile.Backend)
+	assert.Equal(t, "gemini-1.5-pro", profile.Model)
+
+	t.Setenv(BackendEnv, "ollama")
+	t.Setenv(ModelEnv, "llama3")
+	t.Setenv(OllamaServerEnv, "http://localhost:11434")
+	profile, err = cfg.Profile("chatmode")
+	assert.NoError(t, err)
+	assert.Equal(t, "ollama", profile.Backend)
+	assert.Equal(t, "http://localhost:11434", profile.BaseURL)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	clearEnv(t)
+	_, err := LoadConfig(writeConfig(t, "profiles:\n  a:\n    backend: groq\n    modle: x\n"))
+	assert.ErrorContains(t, err, "modle")
+
+	_, err = LoadConfig(writeConfig(t, "profiles:\n  a:\n    model: x\n"))
+	assert.ErrorContains(t, err, `profile "a": backend is not set`)
+
+	_, err = LoadConfig(writeConfig(t, "profiles:\n  a:\n    backend: groq\n    temperature: 3\n"))
+	assert.ErrorContains(t, err, "out of range")
+
+	_, err = LoadConfig(writeConfig(t, "profiles:\n  a:\n    backend: groq\nmodes:\n  cmdmode: b\n"))
+	assert.ErrorContains(t, err, `modes.cmdmode: unknown profile "b"`)
+
+	_, err = LoadConfig(writeConfig(t, "profiles:\n  a:\n    backend: groq\n    fallback: [local]\n"))
+	assert.ErrorContains(t, err, `profile "a": fallback: unknown profile "local"`)
+
+	_, err = LoadConfig(writeConfig(t, "prices:\n  gpt-4o:\n    input: -1\n"))
+	assert.ErrorContains(t, err, "prices.gpt-4o: prices must not be negative")
+}
+
+func TestSandboxSettings(t *testing.T) {
+	t.Setenv(SandboxEnv, "")
+	cfg, err := LoadConfig(writeConfig(t, "sandbox:\n  modes: [taskmode]\n  cpu_time: 30s\n"))
+	assert.NoError(t, err)
+	assert.True(t, cfg.Sandboxed("taskmode"))
+	assert.False(t, cfg.Sandboxed("cmdmode"))
+	settings := cfg.SandboxSettings()
+	assert.Equal(t, 30*time.Second, settings.CPUTime)
+	assert.Equal(t, DefaultSandboxMemoryMB, settings.MemoryMB)
+	assert.False(t, settings.Network)
+
+	// /sandbox wins over the config, NUWA_SANDBOX over both
+	cfg.SetSandboxed("taskmode", false)
+	cfg.SetSandboxed("cmdmode", true)
+	assert.False(t, cfg.Sandboxed("taskmode"))
+	assert.True(t, cfg.Sandboxed("cmdmode"))
+	t.Setenv(SandboxEnv, "true")
+	assert.True(t, cfg.Sandboxed("taskmode"))
+
+	_, err = LoadConfig(writeConfig(t, "sandbox:\n  memory_mb: -1\n"))
+	assert.ErrorContains(t, err, "sandbox: cpu_time, memory_mb and max_output must not be negative")
+}
+
+func TestScriptLanguage(t *testing.T) {
+	t.Setenv(ScriptLanguageEnv, "")
+	cfg, err := LoadConfig(writeConfig(t, "scripts:\n  interpreters:\n    deno:\n      command: [deno, run]\n      extension: .ts\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultScriptLanguage, cfg.ScriptLanguage())
+	assert.Equal(t, []string{"deno", "run"}, cfg.Scripts.Interpreters["deno"].Command)
+
+	// NUWA_SCRIPT_LANGUAGE wins over the config
+	cfg.Scripts.Language = "python"
+	assert.Equal(t, "python", cfg.ScriptLanguage())
+	t.Setenv(ScriptLanguageEnv, "perl")
+	assert.Equal(t, "perl", cfg.ScriptLanguage())
+
+	_, err = LoadConfig(writeConfig(t, "scripts:\n  interpreters:\n    deno:\n      extension: ts\n"))
+	assert.ErrorContains(t, err, "scripts.interpreters.deno: extension must start with a dot")
+}
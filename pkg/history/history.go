@@ -0,0 +1,190 @@
+// Package history keeps the inputs typed in the interactive terminal across
+// sessions, with the mode they went to and the commands they produced.
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+)
+
+const (
+	HistoryFile = "history"
+
+	// DefaultMaxEntries is how many inputs are kept, the oldest are removed first
+	DefaultMaxEntries = 1000
+	// MaxInputLen is the longest input kept, longer ones like pasted files
+	// are not recorded
+	MaxInputLen = 4096
+)
+
+// Entry is an input of the terminal.
+type Entry struct {
+	Time  time.Time `json:"time"`
+	Mode  string    `json:"mode,omitempty"`
+	Input string    `json:"input"`
+	// Commands are the commands the input produced, like the command of cmd mode
+	Commands []string `json:"commands,omitempty"`
+}
+
+// Store keeps the entries in a file, one JSON object per line, oldest first.
+type Store struct {
+	path       string
+	maxEntries int
+
+	mu      sync.Mutex
+	entries []Entry
+}
+
+// DefaultHistoryPath returns the path of the history file in the home directory.
+func DefaultHistoryPath() string {
+	return config.HomePath(HistoryFile)
+}
+
+// NewStore returns a store of the file keeping at most maxEntries entries,
+// DefaultMaxEntries when it is not positive. The file is read by Load.
+func NewStore(path string, maxEntries int) *Store {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	return &Store{path: path, maxEntries: maxEntries}
+}
+
+// Load reads the entries of the file, a missing file is an empty history.
+// Lines which can not be parsed are skipped.
+func (s *Store) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := s.read()
+	if err != nil {
+		return err
+	}
+	s.entries = entries
+	return nil
+}
+
+// Entries returns the entries, oldest first.
+func (s *Store) Entries() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Entry{}, s.entries...)
+}
+
+// Inputs returns the inputs, oldest first, as the history of the prompt.
+func (s *Store) Inputs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inputs := make([]string, 0, len(s.entries))
+	for _, entry := range s.entries {
+		inputs = append(inputs, entry.Input)
+	}
+	return inputs
+}
+
+// Add records an entry and writes the file. An input typed before in the
+// same mode is moved to the end rather than kept twice. Inputs starting
+// with a space are not recorded, like in bash, nor are empty or too long
+// ones. The file is read again first, so the inputs of other terminals
+// running at the same time are kept.
+func (s *Store) Add(entry Entry) error {
+	if strings.TrimSpace(entry.Input) == "" || strings.HasPrefix(entry.Input, " ") || len(entry.Input) > MaxInputLen {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := s.read()
+	if err != nil {
+		return err
+	}
+	entries = dedup(append(entries, entry))
+	if len(entries) > s.maxEntries {
+		entries = entries[len(entries)-s.maxEntries:]
+	}
+	if err := s.write(entries); err != nil {
+		return err
+	}
+	s.entries = entries
+	return nil
+}
+
+// dedup keeps the last entry of every input and mode
+func dedup(entries []Entry) []Entry {
+	seen := map[string]bool{}
+	kept := make([]Entry, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		key := entries[i].Mode + "\x00" + entries[i].Input
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		kept = append(kept, entries[i])
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	return kept
+}
+
+func (s *Store) read() ([]Entry, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Entry{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	entries := []Entry{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Input == "" {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+	return entries, nil
+}
+
+// write replaces the file, through a temporary file so a crash does not
+// leave half of the history behind
+func (s *Store) write(entries []Entry) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create history directory: %w", err)
+	}
+	var data bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode history: %w", err)
+		}
+		data.Write(line)
+		data.WriteByte('\n')
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return nil
+}
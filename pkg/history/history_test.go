@@ -0,0 +1,66 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreAdd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	store := NewStore(path, 3)
+	assert.NoError(t, store.Load())
+	assert.Empty(t, store.Inputs())
+
+	assert.NoError(t, store.Add(Entry{Mode: "cmdmode", Input: "list files", Commands: []string{"ls -l"}}))
+	assert.NoError(t, store.Add(Entry{Mode: "chatmode", Input: "who are you?"}))
+	assert.NoError(t, store.Add(Entry{Mode: "cmdmode", Input: "list files", Commands: []string{"ls -la"}}))
+	// not recorded
+	assert.NoError(t, store.Add(Entry{Mode: "cmdmode", Input: " secret"}))
+	assert.NoError(t, store.Add(Entry{Mode: "cmdmode", Input: strings.Repeat("x", MaxInputLen+1)}))
+	assert.Equal(t, []string{"who are you?", "list files"}, store.Inputs())
+
+	// the other terminals see the inputs, the oldest are dropped over the limit
+	other := NewStore(path, 3)
+	assert.NoError(t, other.Load())
+	assert.Equal(t, []string{"ls -la"}, other.Entries()[1].Commands)
+	assert.NoError(t, other.Add(Entry{Mode: "taskmode", Input: "backup home"}))
+	assert.NoError(t, store.Add(Entry{Mode: "agentmode", Input: "why is nginx down"}))
+	assert.Equal(t, []string{"list files", "backup home", "why is nginx down"}, store.Inputs())
+
+	// a broken line does not lose the history
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, append(data, []byte("{broken\n")...), 0o600))
+	assert.NoError(t, store.Load())
+	assert.Len(t, store.Entries(), 3)
+}
+
+func TestSearch(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "history"), 0)
+	assert.NoError(t, store.Add(Entry{Mode: "cmdmode", Input: "show disk usage", Commands: []string{"df -h"}}))
+	assert.NoError(t, store.Add(Entry{Mode: "cmdmode", Input: "docker containers", Commands: []string{"docker ps -a"}}))
+	assert.NoError(t, store.Add(Entry{Mode: "chatmode", Input: "what is dns"}))
+
+	matches := store.Search("dps")
+	assert.Equal(t, "docker ps -a", matches[0].Text)
+	assert.True(t, matches[0].Command)
+	assert.Equal(t, "docker containers", matches[0].Entry.Input)
+
+	matches = store.Search("disk")
+	assert.Len(t, matches, 1)
+	assert.Equal(t, "show disk usage", matches[0].Text)
+
+	assert.Empty(t, store.Search("zzz"))
+	// the most recent first
+	assert.Equal(t, "what is dns", store.Search("")[0].Text)
+
+	exact, ok := FuzzyScore("ps", "docker ps")
+	assert.True(t, ok)
+	scattered, ok := FuzzyScore("ps", "please stop")
+	assert.True(t, ok)
+	assert.Greater(t, exact, scattered)
+}
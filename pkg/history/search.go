@@ -0,0 +1,81 @@
+package history
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Match is an input or a command of the history matching a search.
+type Match struct {
+	Text string
+	// Command is set when Text is a command the input of Entry produced
+	Command bool
+	Entry   Entry
+	Score   int
+}
+
+// Search returns the inputs and commands of the history matching the query
+// fuzzily: the characters of the query appear in the text in the same
+// order. The best matches come first, the most recent first among equals.
+// Every text is returned once, an empty query returns all of them.
+func (s *Store) Search(query string) []Match {
+	entries := s.Entries()
+	seen := map[string]bool{}
+	matches := []Match{}
+	add := func(text string, command bool, entry Entry) {
+		if seen[text] {
+			return
+		}
+		if score, ok := FuzzyScore(query, text); ok {
+			seen[text] = true
+			matches = append(matches, Match{Text: text, Command: command, Entry: entry, Score: score})
+		}
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		add(entries[i].Input, false, entries[i])
+		for _, command := range entries[i].Commands {
+			add(command, true, entries[i])
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	return matches
+}
+
+// FuzzyScore tells whether the characters of the query appear in the text in
+// the same order, ignoring the case, and how well: characters following
+// each other or starting a word score more, and the text containing the
+// query as it is scores the most.
+func FuzzyScore(query, text string) (int, bool) {
+	q := []rune(strings.ToLower(query))
+	t := []rune(strings.ToLower(text))
+	if len(q) == 0 {
+		return 0, true
+	}
+
+	score, last := 0, -1
+	for i, j := 0, 0; i < len(q); i++ {
+		for j < len(t) && t[j] != q[i] {
+			j++
+		}
+		if j == len(t) {
+			return 0, false
+		}
+		score++
+		if last >= 0 && j == last+1 {
+			score += 5
+		}
+		if j == 0 || !unicode.IsLetter(t[j-1]) && !unicode.IsDigit(t[j-1]) {
+			score += 3
+		}
+		if last >= 0 {
+			score -= min(j-last-1, 3)
+		}
+		last = j
+		j++
+	}
+	if strings.Contains(string(t), string(q)) {
+		score += 2 * len(q)
+	}
+	return score, true
+}
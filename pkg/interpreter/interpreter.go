@@ -0,0 +1,164 @@
+// Package interpreter picks the program which runs a script by the language
+// of the code block the model wrote it in, like ```python.
+package interpreter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/cmdexe"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+)
+
+var (
+	// ErrUnsupportedLanguage is returned for a language no interpreter runs.
+	ErrUnsupportedLanguage = errors.New("unsupported script language")
+	// ErrNotInstalled is returned when the program of an interpreter is missing.
+	ErrNotInstalled = errors.New("interpreter not installed")
+)
+
+// Interpreter runs the scripts of a language.
+type Interpreter struct {
+	Language string
+	// Command runs a script, the file of the script is its last argument
+	Command []string
+	// Extension is the extension of the script files, like .py
+	Extension string
+	// Aliases are the other names of the language in code blocks
+	Aliases []string
+}
+
+// builtins are the interpreters known without a config, bash runs the code
+// blocks without a language
+var builtins = []Interpreter{
+	{Language: "bash", Command: []string{"bash", "-x"}, Extension: ".sh", Aliases: []string{"sh", "shell"}},
+	{Language: "zsh", Command: []string{"zsh", "-x"}, Extension: ".zsh"},
+	{Language: "python", Command: []string{"python3"}, Extension: ".py", Aliases: []string{"python3", "py"}},
+	{Language: "perl", Command: []string{"perl"}, Extension: ".pl"},
+	{Language: "ruby", Command: []string{"ruby"}, Extension: ".rb", Aliases: []string{"rb"}},
+	{Language: "node", Command: []string{"node"}, Extension: ".js", Aliases: []string{"javascript", "js"}},
+	{Language: "awk", Command: []string{"awk", "-f"}, Extension: ".awk"},
+	{Language: "go", Command: []string{"go", "run"}, Extension: ".go", Aliases: []string{"golang"}},
+}
+
+// DefaultLanguage is the language of the code blocks which have none.
+const DefaultLanguage = "bash"
+
+// Shell returns whether the interpreter is a shell, the scripts of shells
+// are checked and evaluated by the policy line by line.
+func (i *Interpreter) Shell() bool {
+	switch filepath.Base(i.Command[0]) {
+	case "sh", "bash", "zsh", "dash", "ksh":
+		return true
+	}
+	return false
+}
+
+// Check returns an error if the program of the interpreter is not installed.
+func (i *Interpreter) Check() error {
+	if _, err := exec.LookPath(i.Command[0]); err != nil {
+		return fmt.Errorf("%w: %s scripts need %s, install it or set the command of %s under scripts.interpreters in the config",
+			ErrNotInstalled, i.Language, i.Command[0], i.Language)
+	}
+	return nil
+}
+
+// Run executes the script file with the interpreter.
+func (i *Interpreter) Run(ctx context.Context, script string) (*cmdexe.ExecResult, error) {
+	if err := i.Check(); err != nil {
+		return nil, err
+	}
+	return cmdexe.RunScriptWith(ctx, script, i.Command...)
+}
+
+// Registry finds the interpreters by language or by script file.
+type Registry struct {
+	interpreters []*Interpreter
+	byName       map[string]*Interpreter
+	byExtension  map[string]*Interpreter
+}
+
+// New returns the registry of the built-in interpreters with the ones of the
+// config, which add languages or replace the fields they set.
+func New(custom map[string]config.InterpreterConfig) *Registry {
+	merged := map[string]*Interpreter{}
+	for _, builtin := range builtins {
+		interpreter := builtin
+		merged[interpreter.Language] = &interpreter
+	}
+	for language, cfg := range custom {
+		language = strings.ToLower(language)
+		interpreter, ok := merged[language]
+		if !ok {
+			interpreter = &Interpreter{Language: language, Command: []string{language}, Extension: "." + language}
+			merged[language] = interpreter
+		}
+		if len(cfg.Command) > 0 {
+			interpreter.Command = cfg.Command
+		}
+		if cfg.Extension != "" {
+			interpreter.Extension = cfg.Extension
+		}
+		if len(cfg.Aliases) > 0 {
+			interpreter.Aliases = cfg.Aliases
+		}
+	}
+
+	r := &Registry{byName: map[string]*Interpreter{}, byExtension: map[string]*Interpreter{}}
+	for _, interpreter := range merged {
+		r.interpreters = append(r.interpreters, interpreter)
+	}
+	sort.Slice(r.interpreters, func(i, j int) bool { return r.interpreters[i].Language < r.interpreters[j].Language })
+	// the languages win over the aliases of the other interpreters
+	for _, interpreter := range r.interpreters {
+		for _, alias := range interpreter.Aliases {
+			r.byName[strings.ToLower(alias)] = interpreter
+		}
+		r.byExtension[interpreter.Extension] = interpreter
+	}
+	for _, interpreter := range r.interpreters {
+		r.byName[interpreter.Language] = interpreter
+	}
+	return r
+}
+
+// FromConfig returns the registry of the interpreters of the config.
+func FromConfig(cfg *config.Config) *Registry {
+	return New(cfg.Scripts.Interpreters)
+}
+
+// Lookup returns the interpreter of a language as written after the ``` of a
+// code block, bash for none.
+func (r *Registry) Lookup(language string) (*Interpreter, error) {
+	fields := strings.Fields(strings.ToLower(language))
+	if len(fields) == 0 {
+		fields = []string{DefaultLanguage}
+	}
+	if interpreter, ok := r.byName[fields[0]]; ok {
+		return interpreter, nil
+	}
+	return nil, fmt.Errorf("%w: no interpreter for %s, the supported languages are %s, others can be added under scripts.interpreters in the config",
+		ErrUnsupportedLanguage, fields[0], strings.Join(r.Languages(), ", "))
+}
+
+// ForFile returns the interpreter of a script file by its extension.
+func (r *Registry) ForFile(filename string) (*Interpreter, error) {
+	if interpreter, ok := r.byExtension[filepath.Ext(filename)]; ok {
+		return interpreter, nil
+	}
+	return nil, fmt.Errorf("%w: no interpreter for %s files", ErrUnsupportedLanguage, filepath.Ext(filename))
+}
+
+// Languages returns the supported languages sorted by name.
+func (r *Registry) Languages() []string {
+	languages := make([]string, 0, len(r.interpreters))
+	for _, interpreter := range r.interpreters {
+		languages = append(languages, interpreter.Language)
+	}
+	return languages
+}
@@ -0,0 +1,64 @@
+package interpreter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookup(t *testing.T) {
+	registry := New(nil)
+	for language, want := range map[string]string{"": "bash", "shell": "bash", "Python": "python", "py": "python", "js": "node", "go title=main.go": "go"} {
+		interpreter, err := registry.Lookup(language)
+		assert.NoError(t, err)
+		assert.Equal(t, want, interpreter.Language, language)
+	}
+
+	_, err := registry.Lookup("cobol")
+	assert.ErrorIs(t, err, ErrUnsupportedLanguage)
+	assert.ErrorContains(t, err, "no interpreter for cobol, the supported languages are awk, bash, go, node, perl, python, ruby, zsh")
+
+	interpreter, err := registry.ForFile("0b6c1c2e.py")
+	assert.NoError(t, err)
+	assert.Equal(t, "python", interpreter.Language)
+	assert.True(t, registry.byName["bash"].Shell())
+	assert.False(t, interpreter.Shell())
+}
+
+func TestConfiguredInterpreters(t *testing.T) {
+	registry := New(map[string]config.InterpreterConfig{
+		"python": {Command: []string{"nuwa-no-such-python"}},
+		"deno":   {Command: []string{"deno", "run"}, Extension: ".ts", Aliases: []string{"ts"}},
+	})
+
+	// the fields not set are the built-in ones
+	python, err := registry.Lookup("py")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nuwa-no-such-python"}, python.Command)
+	assert.Equal(t, ".py", python.Extension)
+	deno, err := registry.Lookup("ts")
+	assert.NoError(t, err)
+	assert.Equal(t, "deno", deno.Language)
+
+	_, err = python.Run(context.Background(), "script.py")
+	assert.ErrorIs(t, err, ErrNotInstalled)
+	assert.ErrorContains(t, err, "python scripts need nuwa-no-such-python")
+}
+
+func TestRun(t *testing.T) {
+	python, err := New(nil).Lookup("python")
+	assert.NoError(t, err)
+	if python.Check() != nil {
+		t.Skip("python3 is not installed")
+	}
+	script := filepath.Join(t.TempDir(), "hello.py")
+	assert.NoError(t, os.WriteFile(script, []byte("print('hello from', 'python')\n"), 0o600))
+
+	result, err := python.Run(context.Background(), script)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello from python\n", result.Stdout)
+}
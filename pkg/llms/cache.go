@@ -0,0 +1,294 @@
+package llms
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+)
+
+const (
+	CacheDir       = "cache"
+	cacheEntryExt  = ".json"
+	cacheEntryMode = 0o600
+)
+
+// DefaultCacheDir returns the directory of the response cache in the home directory.
+func DefaultCacheDir() string {
+	return config.HomePath(CacheDir)
+}
+
+// Cache keeps the answers to prompts on disk, one file per answer. Answers
+// older than the TTL are not used, and the oldest answers are removed when
+// the cache grows over its limits.
+type Cache struct {
+	dir      string
+	settings config.CacheConfig
+	// now is replaced in tests
+	now func() time.Time
+
+	mu     sync.Mutex
+	hits   int
+	misses int
+}
+
+// cacheEntry is the file of a cached answer
+type cacheEntry struct {
+	Backend   string    `json:"backend"`
+	Model     string    `json:"model"`
+	Response  string    `json:"response"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CacheStats describes what is in the cache, hits and misses are counted
+// since the start.
+type CacheStats struct {
+	Entries int
+	Expired int
+	Bytes   int64
+	Oldest  time.Time
+	Hits    int
+	Misses  int
+}
+
+// NewCache creates a cache in the directory with the settings, the
+// directory is created when the first answer is stored.
+func NewCache(dir string, settings config.CacheConfig) *Cache {
+	return &Cache{dir: dir, settings: settings, now: time.Now}
+}
+
+// Enabled reports whether answers are looked up and stored.
+func (c *Cache) Enabled() bool {
+	return c.settings.Enabled
+}
+
+// Get returns the answer stored for the key if it is not expired.
+func (c *Cache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, err := c.read(c.path(key))
+	if err != nil || c.expired(entry) {
+		c.misses++
+		return "", false
+	}
+	c.hits++
+	return entry.Response, true
+}
+
+// Put stores the answer for the key and removes the expired and the oldest
+// answers if the cache is over its limits.
+func (c *Cache) Put(key string, profile *config.Profile, response string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	now := c.now()
+	data, err := json.Marshal(cacheEntry{
+		Backend:   profile.Backend,
+		Model:     profile.Model,
+		Response:  response,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode cache entry: %w", err)
+	}
+	path := c.path(key)
+	if err := os.WriteFile(path, data, cacheEntryMode); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	// the age of an entry is read from its file when pruning
+	if err := os.Chtimes(path, now, now); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	return c.prune()
+}
+
+// Delete removes the answer stored for the key.
+func (c *Cache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Remove(c.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete cache entry: %w", err)
+	}
+	return nil
+}
+
+// Clear removes every answer, the number of removed answers is returned.
+func (c *Cache) Clear() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files, err := c.files()
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range files {
+		if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, fmt.Errorf("failed to delete cache entry: %w", err)
+		}
+	}
+	return len(files), nil
+}
+
+// Stats returns what is in the cache.
+func (c *Cache) Stats() (CacheStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := CacheStats{Hits: c.hits, Misses: c.misses}
+	files, err := c.files()
+	if err != nil {
+		return stats, err
+	}
+	for _, file := range files {
+		stats.Entries++
+		stats.Bytes += file.size
+		if stats.Oldest.IsZero() || file.modTime.Before(stats.Oldest) {
+			stats.Oldest = file.modTime
+		}
+		if c.now().Sub(file.modTime) > c.settings.TTL {
+			stats.Expired++
+		}
+	}
+	return stats, nil
+}
+
+type cacheFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// files returns the entries of the cache, the oldest first
+func (c *Cache) files() ([]cacheFile, error) {
+	entries, err := os.ReadDir(c.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	files := []cacheFile{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != cacheEntryExt {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, cacheFile{path: filepath.Join(c.dir, entry.Name()), size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	return files, nil
+}
+
+// prune removes the expired answers, then the oldest ones until the cache
+// is within its limits
+func (c *Cache) prune() error {
+	files, err := c.files()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, file := range files {
+		total += file.size
+	}
+	for i, file := range files {
+		over := len(files)-i > c.settings.MaxEntries || total > c.settings.MaxBytes
+		if !over && c.now().Sub(file.modTime) <= c.settings.TTL {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete cache entry: %w", err)
+		}
+		total -= file.size
+	}
+	return nil
+}
+
+func (c *Cache) read(path string) (*cacheEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (c *Cache) expired(entry *cacheEntry) bool {
+	return c.now().Sub(entry.CreatedAt) > c.settings.TTL
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key+cacheEntryExt)
+}
+
+// cacheKey is the key of the answer to a prompt: the backend, model and
+// temperature of the profile and the prompt with its whitespace normalized
+func cacheKey(profile *config.Profile, prompt string) string {
+	temperature := "default"
+	if profile.Temperature != nil {
+		temperature = strconv.FormatFloat(*profile.Temperature, 'f', -1, 64)
+	}
+	hash := sha256.New()
+	for _, part := range []string{profile.Backend, profile.Model, temperature, normalizePrompt(prompt)} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// normalizePrompt trims the prompt and collapses runs of whitespace, so
+// prompts differing only in spacing share an answer
+func normalizePrompt(prompt string) string {
+	return strings.Join(strings.Fields(prompt), " ")
+}
+
+// activeCache is the cache of GenerateContent, it is set up by SetConfig
+var activeCache = NewCache(DefaultCacheDir(), (&config.Config{}).CacheSettings())
+
+// GetCache returns the response cache.
+func GetCache() *Cache {
+	return activeCache
+}
+
+type noCacheKey struct{}
+
+// WithoutCache returns a context whose prompts are sent to the model even if
+// their answer is in the cache, the new answer replaces the cached one.
+func WithoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+// Uncache removes the cached answer of the prompt for the profile of the mode
+// in the context, like when the answer turned out to be wrong.
+func Uncache(ctx context.Context, prompt string) {
+	if !activeCache.Enabled() {
+		return
+	}
+	profile, err := CurrentProfile(ctx)
+	if err != nil {
+		return
+	}
+	activeCache.Delete(cacheKey(profile, prompt))
+}
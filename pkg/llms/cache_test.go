@@ -0,0 +1,88 @@
+package llms
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCache(t *testing.T, settings config.CacheConfig) *Cache {
+	settings.Enabled = true
+	return NewCache(t.TempDir(), settings)
+}
+
+func TestCacheTTL(t *testing.T) {
+	cache := newTestCache(t, config.CacheConfig{TTL: time.Hour, MaxEntries: 10, MaxBytes: 1 << 20})
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	profile := &config.Profile{Backend: "deepseek", Model: "deepseek-chat"}
+
+	key := cacheKey(profile, "show disk usage")
+	assert.NoError(t, cache.Put(key, profile, "execute command: df -h"))
+	answer, ok := cache.Get(cacheKey(profile, "  show   disk usage\n"))
+	assert.True(t, ok)
+	assert.Equal(t, "execute command: df -h", answer)
+
+	cache.now = func() time.Time { return now.Add(2 * time.Hour) }
+	_, ok = cache.Get(key)
+	assert.False(t, ok)
+
+	stats, err := cache.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, 1, stats.Expired)
+	assert.Equal(t, 1, stats.Hits)
+	assert.Equal(t, 1, stats.Misses)
+}
+
+func TestCacheKey(t *testing.T) {
+	cold, hot := 0.0, 0.9
+	profile := &config.Profile{Backend: "deepseek", Model: "deepseek-chat", Temperature: &cold}
+	other := &config.Profile{Backend: "deepseek", Model: "deepseek-chat", Temperature: &hot}
+	assert.NotEqual(t, cacheKey(profile, "ls"), cacheKey(other, "ls"))
+	assert.NotEqual(t, cacheKey(profile, "ls"), cacheKey(profile, "ls -l"))
+}
+
+func TestCacheLimits(t *testing.T) {
+	cache := newTestCache(t, config.CacheConfig{TTL: time.Hour, MaxEntries: 2, MaxBytes: 1 << 20})
+	now := time.Now()
+	profile := &config.Profile{Backend: "groq"}
+	for i, prompt := range []string{"first", "second", "third"} {
+		cache.now = func() time.Time { return now.Add(time.Duration(i) * time.Second) }
+		assert.NoError(t, cache.Put(cacheKey(profile, prompt), profile, prompt))
+	}
+
+	_, ok := cache.Get(cacheKey(profile, "first"))
+	assert.False(t, ok, "the oldest answer is removed")
+	_, ok = cache.Get(cacheKey(profile, "third"))
+	assert.True(t, ok)
+
+	removed, err := cache.Clear()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+}
+
+func TestGenerateContentUsesCache(t *testing.T) {
+	profile := fakeProfile(t, "test", "responses:\n  - content: df -h\n  - content: du -sh\n")
+	useProfiles(t, profile)
+	activeCache = newTestCache(t, config.CacheConfig{TTL: time.Hour, MaxEntries: 10, MaxBytes: 1 << 20})
+
+	ctx := context.Background()
+	answer, err := GenerateContent(ctx, "show disk usage")
+	assert.NoError(t, err)
+	assert.Equal(t, "df -h", answer)
+	answer, err = GenerateContent(ctx, "show disk usage")
+	assert.NoError(t, err)
+	assert.Equal(t, "df -h", answer)
+
+	answer, err = GenerateContent(WithoutCache(ctx), "show disk usage")
+	assert.NoError(t, err)
+	assert.Equal(t, "du -sh", answer)
+
+	Uncache(ctx, "show disk usage")
+	_, err = GenerateContent(ctx, "show disk usage")
+	assert.Error(t, err, "the fixture has no responses left")
+}
@@ -0,0 +1,195 @@
+package llms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	lcllms "github.com/tmc/langchaingo/llms"
+)
+
+const (
+	// DefaultContextWindow is used when the profile sets no context window
+	// and the model is not known.
+	DefaultContextWindow = 8192
+
+	// approxCharsPerToken is the ratio used to estimate token counts
+	// without downloading a tokenizer. English prose averages 4 characters
+	// per token, code and command output fewer, so 3 is used.
+	approxCharsPerToken = 3
+
+	// tokenSafetyMargin is added to the estimates, in percent, so that a
+	// prompt which fits by the estimate fits the real tokenizer too
+	tokenSafetyMargin = 20
+
+	// answerShare is the part of the context window kept for the answer
+	// when the profile sets no max_tokens
+	answerShare = 4
+
+	// maxSystemInfoTokens caps the system info put in the prompts, even
+	// models with a huge context do not need the name of every binary
+	maxSystemInfoTokens = 2048
+)
+
+// ErrPromptTooLong is returned when the prompt does not fit the context
+// window of the model, the model is not called.
+var ErrPromptTooLong = errors.New("the prompt is too long for the context window")
+
+// contextWindows are the context windows of known models by the prefix of
+// their name, the longest matching prefix wins
+var contextWindows = map[string]int{
+	"gemini-1.5-pro":     2097152,
+	"gemini-1.5-flash":   1048576,
+	"gemini-1.0-pro":     32768,
+	"gpt-4o":             128000,
+	"gpt-4-turbo":        128000,
+	"gpt-4":              8192,
+	"gpt-3.5-turbo":      16385,
+	"claude-3":           200000,
+	"deepseek":           65536,
+	"llama3-8b-8192":     8192,
+	"llama3-70b-8192":    8192,
+	"llama-3.1":          131072,
+	"llama3.1":           131072,
+	"llama3":             8192,
+	"mixtral-8x7b-32768": 32768,
+	"qwen2.5":            32768,
+	"gemma2":             8192,
+	"codellama":          16384,
+	"mistral":            32768,
+	"deepseek-coder-v2":  131072,
+}
+
+// ContextWindow returns the context window of the profile in tokens: the
+// one it sets, the one of its model if the model is known, or else
+// DefaultContextWindow.
+func ContextWindow(profile *config.Profile) int {
+	if profile.ContextWindow > 0 {
+		return profile.ContextWindow
+	}
+	model := strings.TrimPrefix(strings.ToLower(profile.Model), "models/")
+	window, matched := DefaultContextWindow, 0
+	for prefix, size := range contextWindows {
+		if strings.HasPrefix(model, prefix) && len(prefix) > matched {
+			window, matched = size, len(prefix)
+		}
+	}
+	return window
+}
+
+// GetContextWindow returns the context window in tokens of the profile of
+// the mode in the context.
+func GetContextWindow(ctx context.Context) int {
+	profile, err := CurrentProfile(ctx)
+	if err != nil {
+		return DefaultContextWindow
+	}
+	return ContextWindow(profile)
+}
+
+// SystemInfoBudget returns how many characters of system info the prompts
+// of the mode in the context may take: a sixteenth of the context window.
+func SystemInfoBudget(ctx context.Context) int {
+	return min(GetContextWindow(ctx)/16, maxSystemInfoTokens) * approxCharsPerToken
+}
+
+// PromptBudget returns how many tokens the prompt may take with the
+// profile: the context window without the room kept for the answer, which
+// is max_tokens of the profile or a quarter of the window.
+func PromptBudget(profile *config.Profile) int {
+	window := ContextWindow(profile)
+	answer := window / answerShare
+	if profile.MaxTokens > 0 && profile.MaxTokens < window {
+		answer = profile.MaxTokens
+	}
+	return window - answer
+}
+
+// GetPromptBudget returns the prompt budget in tokens of the profile of the
+// mode in the context.
+func GetPromptBudget(ctx context.Context) int {
+	profile, err := CurrentProfile(ctx)
+	if err != nil {
+		return DefaultContextWindow - DefaultContextWindow/answerShare
+	}
+	return PromptBudget(profile)
+}
+
+// checkPromptBudget returns ErrPromptTooLong when the messages do not fit
+// the prompt budget of the profile, the model is not called for nothing
+func checkPromptBudget(profile *config.Profile, messages []lcllms.MessageContent) error {
+	tokens, budget := EstimateMessagesTokens(messages), PromptBudget(profile)
+	if tokens > budget {
+		return fmt.Errorf("%w: about %d tokens, %d fit the context window of %s", ErrPromptTooLong, tokens, budget, describeProfile(profile))
+	}
+	return nil
+}
+
+// EstimateTokens returns an upper estimate of the number of tokens for the
+// text: ASCII characters are counted approxCharsPerToken to a token, the
+// other characters, like CJK, one token each, and tokenSafetyMargin is added.
+//
+// It is an approximation, no tokenizer is used: the tiktoken-go of the
+// vendor directory downloads its encodings when it is first used, and most
+// providers have no tokenizer in Go. Text unlike prose and code, like long
+// runs of digits, can take more tokens than estimated. The usage reported by
+// the provider replaces the estimate where there is one.
+func EstimateTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	tokens := ascii/approxCharsPerToken + other
+	return tokens*(100+tokenSafetyMargin)/100 + 1
+}
+
+// EstimateMessagesTokens returns an approximate number of tokens for the messages.
+func EstimateMessagesTokens(messages []lcllms.MessageContent) int {
+	total := 0
+	for _, msg := range messages {
+		for _, part := range msg.Parts {
+			if text, ok := part.(lcllms.TextContent); ok {
+				total += EstimateTokens(text.Text)
+			}
+		}
+		// every message carries a few tokens of role and separator overhead
+		total += 4
+	}
+	return total
+}
+
+// IsContextLengthError reports whether err looks like the provider rejected
+// the request because the prompt exceeded the model's context window.
+func IsContextLengthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrPromptTooLong) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, hint := range []string{
+		"context length",
+		"context_length_exceeded",
+		"context window",
+		"maximum context",
+		"prompt is too long",
+		"too many tokens",
+		"reduce the length",
+	} {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/tmc/langchaingo/llms"
+	"gopkg.in/yaml.v3"
+)
+
+// Interaction is one recorded call of a model.
+type Interaction struct {
+	Request   string     `yaml:"request"`
+	Response  string     `yaml:"response"`
+	ToolCalls []ToolCall `yaml:"tool_calls,omitempty"`
+	Error     string     `yaml:"error,omitempty"`
+}
+
+// Cassette is a file of recorded calls, they can be played back without the
+// provider.
+type Cassette struct {
+	Interactions []Interaction `yaml:"interactions"`
+}
+
+// ErrNotRecorded is returned when the cassette has no response left.
+var ErrNotRecorded = errors.New("cassette: no recorded response left")
+
+// LoadCassette reads a cassette file.
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette file: %w", err)
+	}
+	cassette := &Cassette{}
+	if err := yaml.Unmarshal(data, cassette); err != nil {
+		return nil, fmt.Errorf("failed to parse cassette file %s: %w", path, err)
+	}
+	return cassette, nil
+}
+
+// Save writes the cassette file.
+func (c *Cassette) Save(path string) error {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cassette: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create cassette directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write cassette file: %w", err)
+	}
+	return nil
+}
+
+// Recorder passes every call to a real model and records it to a cassette
+// file, the file is written after every call.
+type Recorder struct {
+	llms.Model
+	path string
+
+	mu       sync.Mutex
+	cassette *Cassette
+}
+
+// NewRecorder records the calls of the model to a new cassette at path.
+func NewRecorder(model llms.Model, path string) *Recorder {
+	return &Recorder{Model: model, path: path, cassette: &Cassette{}}
+}
+
+func (r *Recorder) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	resp, err := r.Model.GenerateContent(ctx, messages, options...)
+	interaction := Interaction{Request: Prompt(messages)}
+	if err != nil {
+		interaction.Error = err.Error()
+	} else if len(resp.Choices) > 0 {
+		interaction.Response = resp.Choices[0].Content
+		interaction.ToolCalls = toolCalls(resp.Choices[0])
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, interaction)
+	if saveErr := r.cassette.Save(r.path); saveErr != nil && err == nil {
+		return nil, saveErr
+	}
+	return resp, err
+}
+
+func (r *Recorder) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, r, prompt, options...)
+}
+
+// Player answers with the calls of a cassette. A request gets the first
+// unused interaction recorded for the same request, or else the next unused
+// one in recorded order, so prompts with the time or the system info in them
+// still play back.
+type Player struct {
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+var _ llms.Model = &Player{}
+
+// NewPlayer plays back the cassette at path.
+func NewPlayer(path string) (*Player, error) {
+	cassette, err := LoadCassette(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Player{
+		interactions: cassette.Interactions,
+		used:         make([]bool, len(cassette.Interactions)),
+	}, nil
+}
+
+func (p *Player) next(request string) (Interaction, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	next := -1
+	for i, interaction := range p.interactions {
+		if p.used[i] {
+			continue
+		}
+		if interaction.Request == request {
+			next = i
+			break
+		}
+		if next < 0 {
+			next = i
+		}
+	}
+	if next < 0 {
+		return Interaction{}, fmt.Errorf("%w for prompt: %s", ErrNotRecorded, lastLine(request))
+	}
+	p.used[next] = true
+	return p.interactions[next], nil
+}
+
+func (p *Player) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	opts := llms.CallOptions{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	interaction, err := p.next(Prompt(messages))
+	if err != nil {
+		return nil, err
+	}
+	if interaction.Error != "" {
+		return nil, errors.New(interaction.Error)
+	}
+	return respond(ctx, interaction.Response, interaction.ToolCalls, opts)
+}
+
+func (p *Player) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, p, prompt, options...)
+}
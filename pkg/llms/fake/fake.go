@@ -0,0 +1,226 @@
+// Package fake has the LLM backends used to test nuwa without a provider:
+// a model answering with scripted responses, and cassettes recording the
+// calls of a real model to play them back offline.
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/tmc/langchaingo/llms"
+	"gopkg.in/yaml.v3"
+)
+
+// Response is a scripted answer of the model.
+//
+// Responses without Match are served once each, in order. A response with
+// Match is served to every prompt the regular expression matches, those are
+// tried first.
+type Response struct {
+	Match   string `yaml:"match,omitempty"`
+	Content string `yaml:"content"`
+	// ToolCalls are the tools the model calls in its answer
+	ToolCalls []ToolCall `yaml:"tool_calls,omitempty"`
+	// Error makes the call fail with this message instead
+	Error string `yaml:"error,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// ToolCall is a call of a tool by the model, Arguments is a JSON object.
+type ToolCall struct {
+	Name      string `yaml:"name"`
+	Arguments string `yaml:"arguments"`
+}
+
+// Fixture is the file the fake backend reads its responses from.
+//
+//	responses:
+//	  - match: disk usage
+//	    content: "execute command: df -h"
+//	  - tool_calls:
+//	      - name: ScriptExecutor
+//	        arguments: '{"script": "df -h"}'
+//	  - content: "Final Answer: done"
+type Fixture struct {
+	Responses []Response `yaml:"responses"`
+}
+
+// ErrNoResponse is returned when no scripted response is left for a prompt.
+var ErrNoResponse = errors.New("fake backend: no response left")
+
+// Model serves the responses of a fixture and remembers the prompts it got.
+type Model struct {
+	mu      sync.Mutex
+	matched []Response
+	queue   []Response
+	prompts []string
+}
+
+var _ llms.Model = &Model{}
+
+// New returns a model serving the responses.
+func New(responses ...Response) (*Model, error) {
+	m := &Model{}
+	for _, r := range responses {
+		if r.Match == "" {
+			m.queue = append(m.queue, r)
+			continue
+		}
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match %q: %w", r.Match, err)
+		}
+		r.re = re
+		m.matched = append(m.matched, r)
+	}
+	return m, nil
+}
+
+// Load returns a model serving the responses of a fixture file.
+func Load(path string) (*Model, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixture file: %w", err)
+	}
+	fixture := &Fixture{}
+	if err := yaml.Unmarshal(data, fixture); err != nil {
+		return nil, fmt.Errorf("failed to parse fixture file %s: %w", path, err)
+	}
+	return New(fixture.Responses...)
+}
+
+// Prompts returns the prompts the model got, one per call.
+func (m *Model) Prompts() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.prompts...)
+}
+
+// Remaining returns how many responses without Match were not served yet.
+func (m *Model) Remaining() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.queue)
+}
+
+func (m *Model) next(prompt string) (Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prompts = append(m.prompts, prompt)
+	for _, r := range m.matched {
+		if r.re.MatchString(prompt) {
+			return r, nil
+		}
+	}
+	if len(m.queue) == 0 {
+		return Response{}, fmt.Errorf("%w for prompt: %s", ErrNoResponse, lastLine(prompt))
+	}
+	r := m.queue[0]
+	m.queue = m.queue[1:]
+	return r, nil
+}
+
+// GenerateContent answers with the next response, stop words cut it like a
+// real model does.
+func (m *Model) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	opts := llms.CallOptions{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	r, err := m.next(Prompt(messages))
+	if err != nil {
+		return nil, err
+	}
+	if r.Error != "" {
+		return nil, errors.New(r.Error)
+	}
+
+	content := r.Content
+	for _, stop := range opts.StopWords {
+		if i := strings.Index(content, stop); i >= 0 {
+			content = content[:i]
+		}
+	}
+	return respond(ctx, content, r.ToolCalls, opts)
+}
+
+// respond returns the content and the tool calls, the content is streamed
+// line by line if the caller asks for streaming
+func respond(ctx context.Context, content string, toolCalls []ToolCall, opts llms.CallOptions) (*llms.ContentResponse, error) {
+	if opts.StreamingFunc != nil {
+		for _, line := range strings.SplitAfter(content, "\n") {
+			if line == "" {
+				continue
+			}
+			if err := opts.StreamingFunc(ctx, []byte(line)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	choice := &llms.ContentChoice{Content: content, StopReason: "stop"}
+	for i, call := range toolCalls {
+		choice.ToolCalls = append(choice.ToolCalls, llms.ToolCall{
+			ID:           fmt.Sprintf("call_%d", i+1),
+			Type:         "function",
+			FunctionCall: &llms.FunctionCall{Name: call.Name, Arguments: call.Arguments},
+		})
+		choice.StopReason = "tool_calls"
+	}
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{choice}}, nil
+}
+
+// toolCalls returns the tool calls of a response of a real model
+func toolCalls(choice *llms.ContentChoice) []ToolCall {
+	var calls []ToolCall
+	for _, call := range choice.ToolCalls {
+		if call.FunctionCall != nil {
+			calls = append(calls, ToolCall{Name: call.FunctionCall.Name, Arguments: call.FunctionCall.Arguments})
+		}
+	}
+	return calls
+}
+
+func (m *Model) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
+}
+
+// Prompt returns the text of the messages, one "role: text" block per
+// message. Tool calls are written as "name(arguments)" and tool results
+// as their content.
+func Prompt(messages []llms.MessageContent) string {
+	var b strings.Builder
+	for i, msg := range messages {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(string(msg.Role) + ": ")
+		for _, part := range msg.Parts {
+			switch part := part.(type) {
+			case llms.TextContent:
+				b.WriteString(part.Text)
+			case llms.ToolCall:
+				if part.FunctionCall != nil {
+					b.WriteString(part.FunctionCall.Name + "(" + part.FunctionCall.Arguments + ")")
+				}
+			case llms.ToolCallResponse:
+				b.WriteString(part.Content)
+			}
+		}
+	}
+	return b.String()
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndex(s, "\n"); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
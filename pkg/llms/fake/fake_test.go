@@ -0,0 +1,117 @@
+package fake
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestModelServesResponses(t *testing.T) {
+	ctx := context.Background()
+	fixture := filepath.Join(t.TempDir(), "fixture.yaml")
+	assert.NoError(t, os.WriteFile(fixture, []byte(`
+responses:
+  - match: disk usage
+    content: "execute command: df -h"
+  - content: first
+  - content: "Action: ScriptExecutor\nObservation: made up"
+  - error: rate limited
+`), 0o644))
+	model, err := Load(fixture)
+	assert.NoError(t, err)
+
+	answer, err := llms.GenerateFromSinglePrompt(ctx, model, "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "first", answer)
+
+	answer, err = llms.GenerateFromSinglePrompt(ctx, model, "show disk usage")
+	assert.NoError(t, err)
+	assert.Equal(t, "execute command: df -h", answer)
+
+	chunks := []string{}
+	answer, err = llms.GenerateFromSinglePrompt(ctx, model, "next",
+		llms.WithStopWords([]string{"\nObservation:"}),
+		llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+			chunks = append(chunks, string(chunk))
+			return nil
+		}))
+	assert.NoError(t, err)
+	assert.Equal(t, "Action: ScriptExecutor", answer)
+	assert.Equal(t, []string{"Action: ScriptExecutor"}, chunks)
+
+	_, err = llms.GenerateFromSinglePrompt(ctx, model, "again")
+	assert.EqualError(t, err, "rate limited")
+	_, err = llms.GenerateFromSinglePrompt(ctx, model, "one more")
+	assert.ErrorIs(t, err, ErrNoResponse)
+
+	assert.Equal(t, 0, model.Remaining())
+	assert.Equal(t, "human: show disk usage", model.Prompts()[1])
+}
+
+func TestCassetteRecordAndReplay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cassettes", "chat.yaml")
+	backend, err := New(Response{Content: "one"}, Response{Content: "two"}, Response{Error: "overloaded"})
+	assert.NoError(t, err)
+
+	recorder := NewRecorder(backend, path)
+	for _, prompt := range []string{"first", "second"} {
+		_, err := llms.GenerateFromSinglePrompt(ctx, recorder, prompt)
+		assert.NoError(t, err)
+	}
+	_, err = llms.GenerateFromSinglePrompt(ctx, recorder, "third")
+	assert.Error(t, err)
+
+	cassette, err := LoadCassette(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []Interaction{
+		{Request: "human: first", Response: "one"},
+		{Request: "human: second", Response: "two"},
+		{Request: "human: third", Error: "overloaded"},
+	}, cassette.Interactions)
+
+	player, err := NewPlayer(path)
+	assert.NoError(t, err)
+	answer, err := llms.GenerateFromSinglePrompt(ctx, player, "second")
+	assert.NoError(t, err)
+	assert.Equal(t, "two", answer)
+	// a request which was not recorded gets the next one in order
+	answer, err = llms.GenerateFromSinglePrompt(ctx, player, "changed")
+	assert.NoError(t, err)
+	assert.Equal(t, "one", answer)
+	_, err = llms.GenerateFromSinglePrompt(ctx, player, "third")
+	assert.EqualError(t, err, "overloaded")
+	_, err = llms.GenerateFromSinglePrompt(ctx, player, "fourth")
+	assert.ErrorIs(t, err, ErrNotRecorded)
+}
+
+func TestCassetteRecordsToolCalls(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	call := ToolCall{Name: "ScriptExecutor", Arguments: `{"script": "uptime"}`}
+	backend, err := New(Response{Content: "checking", ToolCalls: []ToolCall{call}})
+	assert.NoError(t, err)
+
+	messages := []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "is it up?")}
+	_, err = NewRecorder(backend, path).GenerateContent(ctx, messages)
+	assert.NoError(t, err)
+
+	player, err := NewPlayer(path)
+	assert.NoError(t, err)
+	resp, err := player.GenerateContent(ctx, messages)
+	assert.NoError(t, err)
+	assert.Equal(t, "checking", resp.Choices[0].Content)
+	assert.Len(t, resp.Choices[0].ToolCalls, 1)
+	assert.Equal(t, "call_1", resp.Choices[0].ToolCalls[0].ID)
+	assert.Equal(t, &llms.FunctionCall{Name: call.Name, Arguments: call.Arguments}, resp.Choices[0].ToolCalls[0].FunctionCall)
+
+	messages = append(messages,
+		llms.MessageContent{Role: llms.ChatMessageTypeAI, Parts: []llms.ContentPart{resp.Choices[0].ToolCalls[0]}},
+		llms.MessageContent{Role: llms.ChatMessageTypeTool, Parts: []llms.ContentPart{llms.ToolCallResponse{ToolCallID: "call_1", Content: "up 3 days"}}},
+	)
+	assert.Equal(t, "human: is it up?\nai: ScriptExecutor({\"script\": \"uptime\"})\ntool: up 3 days", Prompt(messages))
+}
@@ -0,0 +1,140 @@
+package llms
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+)
+
+// newHTTPClient returns the http client of a profile, with its TLS settings
+// and headers. Without an API key, no Authorization header is sent. The
+// Retry-After of the responses is kept in hints.
+func newHTTPClient(profile *config.Profile, hints *retryHints) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig, err := newTLSConfig(profile)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &http.Client{
+		Transport: &headerTransport{
+			base:     transport,
+			headers:  profile.Headers,
+			dropAuth: profile.Key() == "",
+			hints:    hints,
+		},
+	}, nil
+}
+
+// newTLSConfig returns nil if the profile keeps the default TLS settings
+func newTLSConfig(profile *config.Profile) (*tls.Config, error) {
+	settings := profile.TLS
+	if settings == (config.TLSConfig{}) {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: settings.InsecureSkipVerify}
+	if settings.CAFile != "" {
+		pem, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: failed to read tls.ca_file: %w", profile.Name, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("profile %q: no certificates found in tls.ca_file %s", profile.Name, settings.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if settings.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: failed to load the client certificate: %w", profile.Name, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// headerTransport sets the headers of a profile on every request
+type headerTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+	// dropAuth removes the Authorization header, the clients always send one
+	// even when the server needs no key
+	dropAuth bool
+	hints    *retryHints
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if t.dropAuth {
+		req.Header.Del("Authorization")
+	}
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && t.hints != nil {
+		t.hints.observe(resp)
+	}
+	return resp, err
+}
+
+// retryHints keeps how long the server asked to wait with Retry-After, the
+// clients only report the status code of a failed request
+type retryHints struct {
+	mu         sync.Mutex
+	retryAfter time.Duration
+}
+
+func (h *retryHints) observe(resp *http.Response) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.retryAfter = wait
+}
+
+// take returns the wait asked for by the last failed response and forgets it
+func (h *retryHints) take() time.Duration {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	wait := h.retryAfter
+	h.retryAfter = 0
+	return wait
+}
+
+// parseRetryAfter reads a Retry-After header, in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,99 @@
+package llms
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/stretchr/testify/assert"
+	lcllms "github.com/tmc/langchaingo/llms"
+)
+
+const chatCompletion = `{"id":"1","object":"chat.completion","created":1,"model":"local",
+"choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}]}`
+
+// newChatServer answers every chat completion with hello and keeps the last request
+func newChatServer(t *testing.T, tls bool) (*httptest.Server, *http.Request) {
+	last := &http.Request{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*last = *r.Clone(context.Background())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(chatCompletion))
+	})
+	var server *httptest.Server
+	if tls {
+		server = httptest.NewTLSServer(handler)
+	} else {
+		server = httptest.NewServer(handler)
+	}
+	t.Cleanup(server.Close)
+	return server, last
+}
+
+func TestOpenAICompatibleWithoutKey(t *testing.T) {
+	server, last := newChatServer(t, false)
+	profile := &config.Profile{
+		Name:    "local",
+		Backend: OpenAICompatibleBackend,
+		Model:   "local",
+		BaseURL: server.URL,
+		Headers: map[string]string{"X-Team": "nuwa"},
+	}
+
+	model, err := NewModel(context.Background(), profile)
+	assert.NoError(t, err)
+	answer, err := lcllms.GenerateFromSinglePrompt(context.Background(), model, "hi")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", answer)
+	assert.Equal(t, "/chat/completions", last.URL.Path)
+	assert.Empty(t, last.Header.Get("Authorization"))
+	assert.Equal(t, "nuwa", last.Header.Get("X-Team"))
+
+	profile.APIKey = "secret"
+	model, err = NewModel(context.Background(), profile)
+	assert.NoError(t, err)
+	_, err = lcllms.GenerateFromSinglePrompt(context.Background(), model, "hi")
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer secret", last.Header.Get("Authorization"))
+}
+
+func TestOpenAICompatibleWithCAFile(t *testing.T) {
+	server, _ := newChatServer(t, true)
+	profile := &config.Profile{
+		Name:    "local",
+		Backend: OpenAICompatibleBackend,
+		Model:   "local",
+		BaseURL: server.URL,
+	}
+
+	model, err := NewModel(context.Background(), profile)
+	assert.NoError(t, err)
+	_, err = lcllms.GenerateFromSinglePrompt(context.Background(), model, "hi")
+	assert.ErrorContains(t, err, "certificate")
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, os.WriteFile(caFile, ca, 0o644))
+	profile.TLS.CAFile = caFile
+	model, err = NewModel(context.Background(), profile)
+	assert.NoError(t, err)
+	answer, err := lcllms.GenerateFromSinglePrompt(context.Background(), model, "hi")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", answer)
+}
+
+func TestCheckProfile(t *testing.T) {
+	err := checkProfile(&config.Profile{Name: "local", Backend: OpenAICompatibleBackend, Model: "m"})
+	assert.ErrorContains(t, err, `profile "local" (openai-compatible backend): no base URL, set base_url`)
+
+	err = checkProfile(&config.Profile{Name: "local", Backend: "ollama", Model: "llama3", BaseURL: "http://localhost:11434"})
+	assert.NoError(t, err)
+
+	err = checkProfile(&config.Profile{Name: "cloud", Backend: "groq"})
+	assert.ErrorContains(t, err, "no API key")
+}
@@ -2,11 +2,12 @@ package llms
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"os"
-	"strconv"
+	"sync"
+	"time"
 
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms/fake"
 	"github.com/pterm/pterm"
 	lcllms "github.com/tmc/langchaingo/llms"
 	"github.com/tmc/langchaingo/llms/anthropic"
@@ -29,91 +30,318 @@ type Model interface {
 	CloseBackend() error
 }
 
-// GenerateContent generates content using the specified prompt.
-// It takes a context.Context object and a prompt string as input.
-// The function returns the generated content as a string and an error if any.
-// The function first reads the values of environment variables LLM_BACKEND, LLM_MODEL_NAME, and LLM_TEMPERATURE.
-// If LLM_BACKEND is empty, it defaults to "gemini" and LLM_MODEL_NAME defaults to "gemini-1.5-pro".
-// The function then creates a model based on the value of LLM_BACKEND using the specified context, model name, and temperature.
-// The model is closed using the CloseBackend method before returning the generated content.
-// If an error occurs during model creation or content generation, an error is returned.
+// OpenAICompatibleBackend is any server with the OpenAI chat completions API,
+// like vLLM, llama.cpp server or LM Studio.
+const OpenAICompatibleBackend = "openai-compatible"
+
+// DefaultCallTimeout is how long one call to a model may take when the
+// profile sets no timeout.
+const DefaultCallTimeout = 2 * time.Minute
+
+// FakeBackend answers with the scripted responses of a fixture file, for tests.
+const FakeBackend = "fake"
+
+// sharedModels keeps the models whose state must outlive a call, like the
+// responses left in a fixture, by their file
+var sharedModels = struct {
+	mu     sync.Mutex
+	models map[string]lcllms.Model
+}{models: map[string]lcllms.Model{}}
+
+// sharedModel returns the model created for the key before, or a new one
+func sharedModel(key string, create func() (lcllms.Model, error)) (lcllms.Model, error) {
+	sharedModels.mu.Lock()
+	defer sharedModels.mu.Unlock()
+	if model, ok := sharedModels.models[key]; ok {
+		return model, nil
+	}
+	model, err := create()
+	if err != nil {
+		return nil, err
+	}
+	sharedModels.models[key] = model
+	return model, nil
+}
+
+// activeConfig holds the LLM profiles, without SetConfig only the
+// environment variables are used
+var activeConfig = &config.Config{}
+
+// SetConfig sets the profiles used to create models.
+func SetConfig(cfg *config.Config) {
+	activeConfig = cfg
+	activeCache = NewCache(DefaultCacheDir(), cfg.CacheSettings())
+}
+
+// GetConfig returns the profiles used to create models.
+func GetConfig() *config.Config {
+	return activeConfig
+}
+
+type modeKey struct{}
+
+// WithMode returns a context whose models use the profile of the mode.
+func WithMode(ctx context.Context, mode string) context.Context {
+	return context.WithValue(ctx, modeKey{}, mode)
+}
+
+// CurrentProfile returns the profile of the mode in the context.
+func CurrentProfile(ctx context.Context) (*config.Profile, error) {
+	mode, _ := ctx.Value(modeKey{}).(string)
+	return activeConfig.Profile(mode)
+}
+
+// GenerateContent generates content for the prompt with the profile of the
+// mode in the context, see WithMode. When the cache is enabled, the answer
+// to a prompt asked before is taken from it, unless WithoutCache is used.
 func GenerateContent(ctx context.Context, prompt string) (string, error) {
+	return GenerateContentStream(ctx, prompt, nil)
+}
+
+// GenerateContentStream is GenerateContent passing the answer to stream
+// while it is generated. A cached answer is not streamed, it is only
+// returned.
+func GenerateContentStream(ctx context.Context, prompt string, stream func(ctx context.Context, chunk []byte) error) (string, error) {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+
+	key := ""
+	if activeCache.Enabled() {
+		if profile, err := CurrentProfile(ctx); err == nil {
+			key = cacheKey(profile, prompt)
+			if bypass, _ := ctx.Value(noCacheKey{}).(bool); !bypass {
+				if resp, ok := activeCache.Get(key); ok {
+					logger.Info("NUWA TERMINAL: answer taken from the cache")
+					return resp, nil
+				}
+			}
+		}
+	}
 
 	model, err := GetLLMBackend(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to get LLM backend: %w", err)
 	}
 
-	modeTemperature, err := strconv.ParseFloat(os.Getenv("LLM_TEMPERATURE"), 64)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse LLM_TEMPERATURE: %w", err)
+	options := []lcllms.CallOption{}
+	if stream != nil {
+		options = append(options, lcllms.WithStreamingFunc(stream))
 	}
-
-	resp, err := lcllms.GenerateFromSinglePrompt(ctx, model, prompt, lcllms.WithTemperature(modeTemperature))
+	resp, err := lcllms.GenerateFromSinglePrompt(ctx, model, prompt, options...)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate content: %w", err)
 	}
+
+	if key != "" {
+		profile, _ := CurrentProfile(ctx)
+		if err := activeCache.Put(key, profile, resp); err != nil {
+			logger.Warn("NUWA TERMINAL: failed to cache the answer,", logger.Args("err", err.Error()))
+		}
+	}
 	return resp, nil
 }
 
+// GetLLMBackend creates the model of the profile of the mode in the context.
+// Failed calls are retried, and answered by the fallback profiles if the
+// profile keeps failing.
 func GetLLMBackend(ctx context.Context) (lcllms.Model, error) {
 	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
-	llmBackend := os.Getenv("LLM_BACKEND")
-	modelName := os.Getenv("LLM_MODEL_NAME")
-	apiKey := os.Getenv("LLM_API_KEY")
-
-	if llmBackend == "" {
-		llmBackend = "gemini"
-		modelName = "gemini-1.5-pro"
+	profile, err := CurrentProfile(ctx)
+	if err != nil {
+		logger.Error("NUWA TERMINAL: invalid LLM profile,", logger.Args("err", err.Error()))
+		return nil, err
 	}
+	return newResilientModel(ctx, profile)
+}
 
-	if apiKey == "" {
-		logger.Error("LLM_API_KEY is not set")
-		return nil, errors.New("LLM_API_KEY is not set")
+// NewModel creates the model of a profile, the temperature, max tokens and
+// timeout of the profile apply to every call of the model.
+func NewModel(ctx context.Context, profile *config.Profile) (lcllms.Model, error) {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	if profile.Cassette != "" && profile.CassetteMode == config.CassetteReplay {
+		// the backend is not needed to play back
+		player, err := sharedModel("replay:"+profile.Cassette, func() (lcllms.Model, error) {
+			return fake.NewPlayer(profile.Cassette)
+		})
+		if err != nil {
+			logger.Error("NUWA TERMINAL: failed to load cassette,", logger.Args("err", err.Error()))
+			return nil, err
+		}
+		return newProfileModel(player, profile), nil
+	}
+	if err := checkProfile(profile); err != nil {
+		logger.Error("NUWA TERMINAL: invalid LLM profile,", logger.Args("err", err.Error()))
+		return nil, err
+	}
+	apiKey := profile.Key()
+	hints := &retryHints{}
+	client, err := newHTTPClient(profile, hints)
+	if err != nil {
+		logger.Error("NUWA TERMINAL: invalid LLM profile,", logger.Args("err", err.Error()))
+		return nil, err
 	}
 
 	var model lcllms.Model
-	var err error
-	switch llmBackend {
+	switch profile.Backend {
 	case "gemini":
+		modelName := valueOr(profile.Model, "gemini-1.5-pro")
 		model, err = googleai.New(ctx, googleai.WithAPIKey(apiKey), googleai.WithDefaultModel(modelName))
 	case "ollama":
-		serverUrl := os.Getenv("OLLAMA_SERVER_URL")
-		if serverUrl == "" {
-			logger.Error("OLLAMA_SERVER_URL is not set")
-			return nil, errors.New("OLLAMA_SERVER_URL is not set")
+		model, err = lcollama.New(
+			lcollama.WithModel(profile.Model),
+			lcollama.WithServerURL(profile.BaseURL),
+			lcollama.WithHTTPClient(client),
+		)
+		if err == nil {
+			var tools lcllms.Model
+			tools, err = openai.New(
+				openai.WithModel(profile.Model),
+				openai.WithBaseURL(ollamaOpenAIURL(profile.BaseURL)),
+				openai.WithToken("ollama"),
+				openai.WithHTTPClient(client),
+			)
+			model = &toolRouter{Model: model, tools: tools}
 		}
-		model, err = lcollama.New(lcollama.WithModel(modelName), lcollama.WithServerURL(serverUrl))
 	case "groq":
 		model, err = openai.New(
-			openai.WithModel("llama3-8b-8192"),
-			openai.WithBaseURL("https://api.groq.com/openai/v1"),
+			openai.WithModel(valueOr(profile.Model, "llama3-8b-8192")),
+			openai.WithBaseURL(valueOr(profile.BaseURL, "https://api.groq.com/openai/v1")),
 			openai.WithToken(apiKey),
+			openai.WithHTTPClient(client),
 		)
 	case "deepseek":
-		baseurl := os.Getenv("LLM_BASE_URL")
-		if baseurl == "" {
-			logger.Error("LLM_BASE_URL is not set")
-			return nil, errors.New("LLM_BASE_URL is not set")
-		}
 		model, err = openai.New(
-			openai.WithModel(modelName),
-			openai.WithBaseURL(baseurl),
+			openai.WithModel(profile.Model),
+			openai.WithBaseURL(profile.BaseURL),
 			openai.WithToken(apiKey),
+			openai.WithHTTPClient(client),
 		)
+	case OpenAICompatibleBackend:
+		// the client needs a token, it is not sent when there is no key
+		model, err = openai.New(
+			openai.WithModel(profile.Model),
+			openai.WithBaseURL(profile.BaseURL),
+			openai.WithToken(valueOr(apiKey, "none")),
+			openai.WithHTTPClient(client),
+		)
+	case FakeBackend:
+		model, err = sharedModel("fake:"+profile.Fixture, func() (lcllms.Model, error) {
+			return fake.Load(profile.Fixture)
+		})
 	case "claude":
 		model, err = anthropic.New(
-			anthropic.WithModel("claude-3-5-sonnet-20240620"),
+			anthropic.WithModel(valueOr(profile.Model, "claude-3-5-sonnet-20240620")),
 			anthropic.WithToken(apiKey),
+			anthropic.WithHTTPClient(client),
 		)
+	}
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to create %s client, error:", profile.Backend), logger.Args("err", err.Error()))
+		return nil, err
+	}
+
+	if profile.Cassette != "" && profile.CassetteMode == config.CassetteRecord {
+		backend := model
+		model, _ = sharedModel("record:"+profile.Cassette, func() (lcllms.Model, error) {
+			return fake.NewRecorder(backend, profile.Cassette), nil
+		})
+	}
+	profileModel := newProfileModel(model, profile)
+	profileModel.hints = hints
+	return profileModel, nil
+}
+
+// checkProfile checks that the profile has what its backend needs
+func checkProfile(profile *config.Profile) error {
+	switch profile.Backend {
+	case "gemini", "groq", "claude":
+	case "ollama":
+		if profile.BaseURL == "" {
+			return missingSetting(profile, "no server URL", "base_url", config.OllamaServerEnv)
+		}
+	case FakeBackend:
+		if profile.Fixture == "" {
+			return missingSetting(profile, "no fixture file", "fixture", config.FixtureEnv)
+		}
+		return nil
+	case "deepseek", OpenAICompatibleBackend:
+		if profile.BaseURL == "" {
+			return missingSetting(profile, "no base URL", "base_url", config.BaseURLEnv)
+		}
 	default:
-		return nil, fmt.Errorf("unknown LLM backend: %s", llmBackend)
+		return fmt.Errorf("profile %q: unknown LLM backend: %s", profile.Name, profile.Backend)
+	}
+	if profile.Model == "" && (profile.Backend == "ollama" || profile.Backend == "deepseek" || profile.Backend == OpenAICompatibleBackend) {
+		return missingSetting(profile, "no model", "model", config.ModelEnv)
 	}
+	// local servers usually need no key
+	if profile.Key() == "" && profile.Backend != "ollama" && profile.Backend != OpenAICompatibleBackend {
+		return missingSetting(profile, "no API key", "api_key or api_key_env", config.APIKeyEnv)
+	}
+	return nil
+}
 
+// missingSetting describes a setting the profile lacks and where it can be set
+func missingSetting(profile *config.Profile, what, field, env string) error {
+	return fmt.Errorf("profile %q (%s backend): %s, set %s in %s or %s",
+		profile.Name, profile.Backend, what, field, config.DefaultConfigPath(), env)
+}
+
+func valueOrDuration(value, fallback time.Duration) time.Duration {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// profileModel applies the call settings of a profile to a model
+type profileModel struct {
+	lcllms.Model
+	profile *config.Profile
+	options []lcllms.CallOption
+	timeout time.Duration
+	// hints has the Retry-After of the last failed request, if the backend uses our http client
+	hints *retryHints
+}
+
+func newProfileModel(model lcllms.Model, profile *config.Profile) *profileModel {
+	m := &profileModel{Model: model, profile: profile, timeout: valueOrDuration(profile.Timeout, DefaultCallTimeout)}
+	if profile.Temperature != nil {
+		m.options = append(m.options, lcllms.WithTemperature(*profile.Temperature))
+	}
+	if profile.MaxTokens > 0 {
+		m.options = append(m.options, lcllms.WithMaxTokens(profile.MaxTokens))
+	}
+	return m
+}
+
+// GenerateContent calls the model with the settings of the profile, the
+// options of the caller win. A prompt which does not fit the context window
+// is refused. The tokens of a successful call are recorded.
+func (m *profileModel) GenerateContent(ctx context.Context, messages []lcllms.MessageContent, options ...lcllms.CallOption) (*lcllms.ContentResponse, error) {
+	if err := checkPromptBudget(m.profile, messages); err != nil {
+		return nil, err
+	}
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+	resp, err := m.Model.GenerateContent(ctx, messages, append(append([]lcllms.CallOption{}, m.options...), options...)...)
 	if err != nil {
-		logger.Error(fmt.Sprintf("failed to create %s client, error:", llmBackend), logger.Args("err", err.Error()))
 		return nil, err
 	}
+	recordUsage(ctx, m.profile, messages, resp)
+	return resp, nil
+}
 
-	return model, nil
+func (m *profileModel) Call(ctx context.Context, prompt string, options ...lcllms.CallOption) (string, error) {
+	return lcllms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
 }
@@ -0,0 +1,24 @@
+package llms
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateContentStream(t *testing.T) {
+	profile := fakeProfile(t, "test", "responses:\n  - content: \"first line\\nsecond line\"\n")
+	useProfiles(t, profile)
+
+	chunks := []string{}
+	answer, err := GenerateContentStream(context.Background(), "hi", func(ctx context.Context, chunk []byte) error {
+		chunks = append(chunks, string(chunk))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "first line\nsecond line", answer)
+	assert.Greater(t, len(chunks), 1)
+	assert.Equal(t, answer, strings.Join(chunks, ""))
+}
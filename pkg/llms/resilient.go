@@ -0,0 +1,215 @@
+package llms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/pterm/pterm"
+	lcllms "github.com/tmc/langchaingo/llms"
+)
+
+const (
+	// DefaultMaxRetries is how many times a failed call is retried when the
+	// profile does not say
+	DefaultMaxRetries = 2
+	// DefaultRetryBackoff is the wait before the first retry, it doubles
+	// with every retry up to maxRetryBackoff
+	DefaultRetryBackoff = time.Second
+	maxRetryBackoff     = 30 * time.Second
+	// maxRetryAfter caps the wait a server can ask for with Retry-After
+	maxRetryAfter = time.Minute
+)
+
+// sleep waits or returns the error of the context, tests replace it
+var sleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// resilientModel retries the calls which failed for a passing reason, like
+// a rate limit, and falls back to the next profile when a profile keeps
+// failing. The first profile is the one selected for the mode.
+type resilientModel struct {
+	models []*profileModel
+}
+
+var _ lcllms.Model = &resilientModel{}
+
+// newResilientModel creates the models of the profile and of its fallbacks,
+// a fallback which can not be created is skipped with a warning.
+func newResilientModel(ctx context.Context, profile *config.Profile) (lcllms.Model, error) {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	model, err := NewModel(ctx, profile)
+	if err != nil {
+		return nil, err
+	}
+	models := []*profileModel{asProfileModel(model, profile)}
+
+	for _, name := range profile.Fallback {
+		fallback, err := activeConfig.NamedProfile(name)
+		if err == nil {
+			model, err = NewModel(ctx, fallback)
+		}
+		if err != nil {
+			logger.Warn("NUWA TERMINAL: skipping fallback profile,", logger.Args("profile", name, "err", err.Error()))
+			continue
+		}
+		models = append(models, asProfileModel(model, fallback))
+	}
+	return &resilientModel{models: models}, nil
+}
+
+func asProfileModel(model lcllms.Model, profile *config.Profile) *profileModel {
+	if m, ok := model.(*profileModel); ok {
+		return m
+	}
+	return newProfileModel(model, profile)
+}
+
+func (r *resilientModel) GenerateContent(ctx context.Context, messages []lcllms.MessageContent, options ...lcllms.CallOption) (*lcllms.ContentResponse, error) {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+
+	// once output was streamed, a retry would show it twice
+	streamed := false
+	opts := lcllms.CallOptions{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+	if opts.StreamingFunc != nil {
+		stream := opts.StreamingFunc
+		options = append(options, lcllms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+			streamed = true
+			return stream(ctx, chunk)
+		}))
+	}
+
+	var errs []error
+	for i, model := range r.models {
+		resp, err := model.generateWithRetries(ctx, messages, &streamed, options...)
+		if err == nil {
+			if i > 0 {
+				logger.Warn("NUWA TERMINAL: answered by fallback profile "+describeProfile(model.profile),
+					logger.Args("failed", describeProfile(r.models[0].profile)))
+			}
+			return resp, nil
+		}
+		errs = append(errs, fmt.Errorf("profile %s: %w", model.profile.Name, err))
+		if streamed || ctx.Err() != nil || IsContextLengthError(err) {
+			break
+		}
+		if i+1 < len(r.models) {
+			logger.Warn("NUWA TERMINAL: profile failed, falling back to "+describeProfile(r.models[i+1].profile),
+				logger.Args("profile", model.profile.Name, "err", err.Error()))
+		}
+	}
+	if len(errs) == 1 {
+		return nil, errors.Unwrap(errs[0])
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (r *resilientModel) Call(ctx context.Context, prompt string, options ...lcllms.CallOption) (string, error) {
+	return lcllms.GenerateFromSinglePrompt(ctx, r, prompt, options...)
+}
+
+// generateWithRetries calls the model, a call which failed for a passing
+// reason is retried with an exponential backoff
+func (m *profileModel) generateWithRetries(ctx context.Context, messages []lcllms.MessageContent, streamed *bool, options ...lcllms.CallOption) (*lcllms.ContentResponse, error) {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	retries := DefaultMaxRetries
+	if m.profile.MaxRetries != nil {
+		retries = *m.profile.MaxRetries
+	}
+	backoff := valueOrDuration(m.profile.RetryBackoff, DefaultRetryBackoff)
+
+	for attempt := 0; ; attempt++ {
+		resp, err := m.GenerateContent(ctx, messages, options...)
+		if err == nil {
+			return resp, nil
+		}
+		if attempt >= retries || *streamed || ctx.Err() != nil || !IsRetryableError(err) {
+			return nil, err
+		}
+
+		wait := retryWait(backoff, attempt, m.hints.take())
+		logger.Warn(fmt.Sprintf("NUWA TERMINAL: LLM call failed, retrying in %s,", wait.Round(100*time.Millisecond)),
+			logger.Args("profile", m.profile.Name, "attempt", attempt+1, "err", err.Error()))
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryWait returns the wait before a retry: the Retry-After of the server
+// if it sent one, or else the backoff with jitter
+func retryWait(backoff time.Duration, attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, maxRetryAfter)
+	}
+	wait := min(backoff<<attempt, maxRetryBackoff)
+	// full jitter in the upper half, so clients failing together spread out
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+var statusCodeRe = regexp.MustCompile(`status code:? (\d{3})`)
+
+// IsRetryableError reports whether err looks like a passing failure of the
+// provider: a rate limit, an overloaded or unavailable server, a timeout or
+// a network error.
+func IsRetryableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	if match := statusCodeRe.FindStringSubmatch(msg); match != nil {
+		code, _ := strconv.Atoi(match[1])
+		return code == 408 || code == 429 || code >= 500
+	}
+	for _, hint := range []string{
+		"rate limit",
+		"too many requests",
+		"overloaded",
+		"unavailable",
+		"resource exhausted",
+		"resource_exhausted",
+		"timeout",
+		"connection refused",
+		"connection reset",
+		"eof",
+	} {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// describeProfile names the profile with its backend and model
+func describeProfile(profile *config.Profile) string {
+	if profile.Model == "" {
+		return fmt.Sprintf("%s (%s)", profile.Name, profile.Backend)
+	}
+	return fmt.Sprintf("%s (%s %s)", profile.Name, profile.Backend, profile.Model)
+}
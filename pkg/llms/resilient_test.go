@@ -0,0 +1,147 @@
+package llms
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/stretchr/testify/assert"
+	lcllms "github.com/tmc/langchaingo/llms"
+)
+
+// fakeProfile returns a fake profile answering with the fixture
+func fakeProfile(t *testing.T, name string, fixture string) *config.Profile {
+	path := filepath.Join(t.TempDir(), name+".yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(fixture), 0o644))
+	return &config.Profile{Name: name, Backend: FakeBackend, Fixture: path}
+}
+
+// recordSleeps makes the retries return at once, the waits are returned
+func recordSleeps(t *testing.T) *[]time.Duration {
+	waits := &[]time.Duration{}
+	previous := sleep
+	sleep = func(ctx context.Context, d time.Duration) error {
+		*waits = append(*waits, d)
+		return nil
+	}
+	t.Cleanup(func() { sleep = previous })
+	return waits
+}
+
+func useProfiles(t *testing.T, profiles ...*config.Profile) {
+	cfg := &config.Config{Profiles: map[string]*config.Profile{}, DefaultProfile: profiles[0].Name}
+	for _, p := range profiles {
+		cfg.Profiles[p.Name] = p
+	}
+	previous := activeConfig
+	SetConfig(cfg)
+	t.Cleanup(func() { SetConfig(previous) })
+}
+
+func TestRetryAfterPassingFailure(t *testing.T) {
+	waits := recordSleeps(t)
+	primary := fakeProfile(t, "primary", `
+responses:
+  - error: "API returned unexpected status code: 429: slow down"
+  - error: "API returned unexpected status code: 503"
+  - content: ok
+`)
+	useProfiles(t, primary)
+
+	model, err := newResilientModel(context.Background(), primary)
+	assert.NoError(t, err)
+	answer, err := lcllms.GenerateFromSinglePrompt(context.Background(), model, "hi")
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", answer)
+	assert.Len(t, *waits, 2)
+	assert.GreaterOrEqual(t, (*waits)[1], DefaultRetryBackoff)
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	waits := recordSleeps(t)
+	primary := fakeProfile(t, "primary", `
+responses:
+  - error: "API returned unexpected status code: 400: bad request"
+  - content: not reached
+`)
+	useProfiles(t, primary)
+
+	model, err := newResilientModel(context.Background(), primary)
+	assert.NoError(t, err)
+	_, err = lcllms.GenerateFromSinglePrompt(context.Background(), model, "hi")
+	assert.ErrorContains(t, err, "status code: 400")
+	assert.Empty(t, *waits)
+}
+
+func TestFallbackProfile(t *testing.T) {
+	recordSleeps(t)
+	retries := 1
+	primary := fakeProfile(t, "primary", `
+responses:
+  - error: "connection refused"
+  - error: "connection refused"
+`)
+	primary.MaxRetries = &retries
+	primary.Fallback = []string{"broken", "local"}
+	broken := &config.Profile{Name: "broken", Backend: "deepseek"}
+	local := fakeProfile(t, "local", "responses:\n  - content: from local\n")
+	useProfiles(t, primary, broken, local)
+
+	model, err := newResilientModel(context.Background(), primary)
+	assert.NoError(t, err)
+	answer, err := lcllms.GenerateFromSinglePrompt(context.Background(), model, "hi")
+	assert.NoError(t, err)
+	assert.Equal(t, "from local", answer)
+
+	_, err = lcllms.GenerateFromSinglePrompt(context.Background(), model, "again")
+	assert.ErrorContains(t, err, "profile primary")
+	assert.ErrorContains(t, err, "profile local")
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	waits := recordSleeps(t)
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":{"message":"slow down"}}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(chatCompletion))
+	}))
+	defer server.Close()
+	profile := &config.Profile{Name: "local", Backend: OpenAICompatibleBackend, Model: "local", BaseURL: server.URL}
+	useProfiles(t, profile)
+
+	model, err := newResilientModel(context.Background(), profile)
+	assert.NoError(t, err)
+	answer, err := lcllms.GenerateFromSinglePrompt(context.Background(), model, "hi")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", answer)
+	assert.Equal(t, []time.Duration{3 * time.Second}, *waits)
+}
+
+func TestIsRetryableError(t *testing.T) {
+	assert.True(t, IsRetryableError(errors.New("API returned unexpected status code: 429")))
+	assert.True(t, IsRetryableError(errors.New("API returned unexpected status code: 502: bad gateway")))
+	assert.True(t, IsRetryableError(context.DeadlineExceeded))
+	assert.True(t, IsRetryableError(errors.New("rpc error: code = Unavailable desc = overloaded")))
+	assert.False(t, IsRetryableError(errors.New("API returned unexpected status code: 401: invalid key")))
+	assert.False(t, IsRetryableError(context.Canceled))
+
+	now := time.Date(2024, 6, 8, 7, 0, 0, 0, time.UTC)
+	wait, ok := parseRetryAfter("Sat, 08 Jun 2024 07:00:10 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, wait)
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+}
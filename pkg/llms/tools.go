@@ -0,0 +1,67 @@
+package llms
+
+import (
+	"context"
+	"strings"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	lcllms "github.com/tmc/langchaingo/llms"
+)
+
+// toolBackends are the backends whose clients send tool definitions and
+// return the tool calls of the model
+var toolBackends = map[string]bool{
+	"gemini":                true,
+	"groq":                  true,
+	"deepseek":              true,
+	"claude":                true,
+	"ollama":                true,
+	OpenAICompatibleBackend: true,
+}
+
+// SupportsTools reports whether the model of the profile is asked with tool
+// definitions and answers with tool calls. The profile decides with
+// tool_calls, or else its backend.
+func SupportsTools(profile *config.Profile) bool {
+	if profile.ToolCalls != nil {
+		return *profile.ToolCalls
+	}
+	return toolBackends[profile.Backend]
+}
+
+// ToolCalling reports whether the profile of the mode in the context supports tool calls.
+func ToolCalling(ctx context.Context) bool {
+	profile, err := CurrentProfile(ctx)
+	if err != nil {
+		return false
+	}
+	return SupportsTools(profile)
+}
+
+// toolRouter sends the calls with tools to another client of the same
+// server, for backends whose own client does not support tools
+type toolRouter struct {
+	lcllms.Model
+	tools lcllms.Model
+}
+
+func (r *toolRouter) GenerateContent(ctx context.Context, messages []lcllms.MessageContent, options ...lcllms.CallOption) (*lcllms.ContentResponse, error) {
+	opts := lcllms.CallOptions{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+	if len(opts.Tools) > 0 {
+		return r.tools.GenerateContent(ctx, messages, options...)
+	}
+	return r.Model.GenerateContent(ctx, messages, options...)
+}
+
+func (r *toolRouter) Call(ctx context.Context, prompt string, options ...lcllms.CallOption) (string, error) {
+	return lcllms.GenerateFromSinglePrompt(ctx, r, prompt, options...)
+}
+
+// ollamaOpenAIURL is the OpenAI compatible API of an ollama server, the
+// ollama client does not support tools
+func ollamaOpenAIURL(serverURL string) string {
+	return strings.TrimSuffix(serverURL, "/") + "/v1"
+}
@@ -0,0 +1,36 @@
+package llms
+
+import (
+	"context"
+	"testing"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms/fake"
+	"github.com/stretchr/testify/assert"
+	lcllms "github.com/tmc/langchaingo/llms"
+)
+
+func TestSupportsTools(t *testing.T) {
+	off := false
+	assert.True(t, SupportsTools(&config.Profile{Backend: "claude"}))
+	assert.True(t, SupportsTools(&config.Profile{Backend: OpenAICompatibleBackend}))
+	assert.False(t, SupportsTools(&config.Profile{Backend: FakeBackend}))
+	assert.False(t, SupportsTools(&config.Profile{Backend: "groq", ToolCalls: &off}))
+	assert.Equal(t, "http://localhost:11434/v1", ollamaOpenAIURL("http://localhost:11434/"))
+}
+
+func TestToolRouter(t *testing.T) {
+	plain, err := fake.New(fake.Response{Content: "plain"})
+	assert.NoError(t, err)
+	tools, err := fake.New(fake.Response{Content: "tools"})
+	assert.NoError(t, err)
+	router := &toolRouter{Model: plain, tools: tools}
+
+	ctx := context.Background()
+	answer, err := router.Call(ctx, "hello", lcllms.WithTools([]lcllms.Tool{{Type: "function"}}))
+	assert.NoError(t, err)
+	assert.Equal(t, "tools", answer)
+	answer, err = router.Call(ctx, "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", answer)
+}
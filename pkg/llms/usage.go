@@ -0,0 +1,113 @@
+package llms
+
+import (
+	"context"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	lcllms "github.com/tmc/langchaingo/llms"
+)
+
+// Usage is the tokens used by one call to a model.
+type Usage struct {
+	Mode             string
+	Profile          string
+	Backend          string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	// Estimated is set when the backend did not report the tokens and they
+	// were estimated from the text
+	Estimated bool
+}
+
+// usageRecorder gets the usage of every successful call, nil if nobody listens
+var usageRecorder func(ctx context.Context, usage Usage)
+
+// SetUsageRecorder sets the function which gets the usage of every
+// successful call to a model.
+func SetUsageRecorder(recorder func(ctx context.Context, usage Usage)) {
+	usageRecorder = recorder
+}
+
+// defaultPrices are the list prices of known models in dollars per million
+// tokens, the prices of the config win over them
+var defaultPrices = map[string]config.Price{
+	"gpt-4o":                     {Input: 2.50, Output: 10.00},
+	"gpt-4o-mini":                {Input: 0.15, Output: 0.60},
+	"deepseek-chat":              {Input: 0.27, Output: 1.10},
+	"deepseek-reasoner":          {Input: 0.55, Output: 2.19},
+	"claude-3-5-sonnet-20240620": {Input: 3.00, Output: 15.00},
+	"claude-3-5-haiku-20241022":  {Input: 0.80, Output: 4.00},
+	"claude-3-opus-20240229":     {Input: 15.00, Output: 75.00},
+	"gemini-1.5-pro":             {Input: 1.25, Output: 5.00},
+	"gemini-1.5-flash":           {Input: 0.075, Output: 0.30},
+	"llama3-8b-8192":             {Input: 0.05, Output: 0.08},
+	"llama3-70b-8192":            {Input: 0.59, Output: 0.79},
+}
+
+// Cost returns the cost in dollars of the tokens used with a model, ok is
+// false when the price of the model is not known. Local backends cost
+// nothing unless the config gives a price for their model.
+func Cost(backend, model string, promptTokens, completionTokens int) (cost float64, ok bool) {
+	price, ok := activeConfig.Prices[model]
+	if !ok {
+		price, ok = defaultPrices[model]
+	}
+	if !ok {
+		switch backend {
+		case "ollama", OpenAICompatibleBackend, FakeBackend:
+			return 0, true
+		}
+		return 0, false
+	}
+	return (float64(promptTokens)*price.Input + float64(completionTokens)*price.Output) / 1e6, true
+}
+
+// recordUsage passes the usage of a call to the recorder, the tokens the
+// backend reported are used, or else they are estimated
+func recordUsage(ctx context.Context, profile *config.Profile, messages []lcllms.MessageContent, resp *lcllms.ContentResponse) {
+	if usageRecorder == nil || resp == nil {
+		return
+	}
+	mode, _ := ctx.Value(modeKey{}).(string)
+	usage := Usage{Mode: mode, Profile: profile.Name, Backend: profile.Backend, Model: profile.Model}
+	usage.PromptTokens, usage.CompletionTokens = reportedTokens(resp)
+	if usage.PromptTokens == 0 && usage.CompletionTokens == 0 {
+		usage.Estimated = true
+		usage.PromptTokens = EstimateMessagesTokens(messages)
+		for _, choice := range resp.Choices {
+			usage.CompletionTokens += EstimateTokens(choice.Content)
+		}
+	}
+	usageRecorder(ctx, usage)
+}
+
+// reportedTokens reads the tokens the backend put in the generation info,
+// the backends use different keys for them
+func reportedTokens(resp *lcllms.ContentResponse) (promptTokens, completionTokens int) {
+	for _, choice := range resp.Choices {
+		info := choice.GenerationInfo
+		if prompt := firstInt(info, "PromptTokens", "InputTokens", "input_tokens"); prompt > promptTokens {
+			// every choice reports the same prompt
+			promptTokens = prompt
+		}
+		completionTokens += firstInt(info, "CompletionTokens", "OutputTokens", "output_tokens")
+	}
+	return promptTokens, completionTokens
+}
+
+func firstInt(info map[string]any, keys ...string) int {
+	for _, key := range keys {
+		switch v := info[key].(type) {
+		case int:
+			return v
+		case int32:
+			return int(v)
+		case int64:
+			return int(v)
+		case float64:
+			return int(v)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package llms
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/stretchr/testify/assert"
+	lcllms "github.com/tmc/langchaingo/llms"
+)
+
+// recordUsages keeps the usage of every call
+func recordUsages(t *testing.T) *[]Usage {
+	usages := &[]Usage{}
+	previous := usageRecorder
+	SetUsageRecorder(func(ctx context.Context, usage Usage) {
+		*usages = append(*usages, usage)
+	})
+	t.Cleanup(func() { SetUsageRecorder(previous) })
+	return usages
+}
+
+func TestUsageReportedByBackend(t *testing.T) {
+	usages := recordUsages(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"1","object":"chat.completion","created":1,"model":"local",
+"choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}],
+"usage":{"prompt_tokens":42,"completion_tokens":7,"total_tokens":49}}`))
+	}))
+	defer server.Close()
+	profile := &config.Profile{Name: "local", Backend: OpenAICompatibleBackend, Model: "local", BaseURL: server.URL}
+
+	model, err := NewModel(context.Background(), profile)
+	assert.NoError(t, err)
+	_, err = lcllms.GenerateFromSinglePrompt(WithMode(context.Background(), "cmdmode"), model, "hi")
+	assert.NoError(t, err)
+	assert.Equal(t, []Usage{{
+		Mode: "cmdmode", Profile: "local", Backend: OpenAICompatibleBackend, Model: "local",
+		PromptTokens: 42, CompletionTokens: 7,
+	}}, *usages)
+}
+
+func TestUsageEstimated(t *testing.T) {
+	usages := recordUsages(t)
+	profile := fakeProfile(t, "test", `
+responses:
+  - error: "API returned unexpected status code: 400"
+  - content: "a reply of some words"
+`)
+
+	model, err := NewModel(context.Background(), profile)
+	assert.NoError(t, err)
+	_, err = lcllms.GenerateFromSinglePrompt(context.Background(), model, "hi")
+	assert.Error(t, err)
+	assert.Empty(t, *usages, "failed calls use no tokens")
+
+	_, err = lcllms.GenerateFromSinglePrompt(context.Background(), model, "hi")
+	assert.NoError(t, err)
+	assert.Len(t, *usages, 1)
+	assert.True(t, (*usages)[0].Estimated)
+	assert.Equal(t, EstimateTokens("a reply of some words"), (*usages)[0].CompletionTokens)
+}
+
+func TestCost(t *testing.T) {
+	useProfiles(t, &config.Profile{Name: "default", Backend: "deepseek"})
+	activeConfig.Prices = map[string]config.Price{"my-model": {Input: 1, Output: 2}}
+
+	cost, ok := Cost("deepseek", "deepseek-chat", 1_000_000, 1_000_000)
+	assert.True(t, ok)
+	assert.InDelta(t, 1.37, cost, 1e-9)
+
+	cost, ok = Cost(OpenAICompatibleBackend, "my-model", 500_000, 250_000)
+	assert.True(t, ok)
+	assert.InDelta(t, 1.0, cost, 1e-9)
+
+	cost, ok = Cost("ollama", "llama3", 1000, 1000)
+	assert.True(t, ok)
+	assert.Zero(t, cost)
+
+	_, ok = Cost("groq", "unknown-model", 1000, 1000)
+	assert.False(t, ok)
+}
+
+func TestContextWindow(t *testing.T) {
+	assert.Equal(t, 128000, ContextWindow(&config.Profile{Model: "gpt-4o-mini"}))
+	assert.Equal(t, 8192, ContextWindow(&config.Profile{Model: "gpt-4"}))
+	assert.Equal(t, 131072, ContextWindow(&config.Profile{Model: "llama3.1:8b"}))
+	assert.Equal(t, DefaultContextWindow, ContextWindow(&config.Profile{Model: "my-model"}))
+	assert.Equal(t, 4096, ContextWindow(&config.Profile{Model: "gpt-4o", ContextWindow: 4096}))
+	assert.Equal(t, 3072, PromptBudget(&config.Profile{ContextWindow: 4096}))
+	assert.Equal(t, 3596, PromptBudget(&config.Profile{ContextWindow: 4096, MaxTokens: 500}))
+}
+
+func TestEstimateTokens(t *testing.T) {
+	// the estimate errs on the high side: 3 characters a token and a margin
+	assert.Equal(t, 481, EstimateTokens(strings.Repeat("abcd", 300)))
+	// characters outside ASCII take a token each
+	assert.Equal(t, 121, EstimateTokens(strings.Repeat("你好", 50)))
+	assert.Zero(t, EstimateTokens(""))
+}
+
+func TestPromptBudget(t *testing.T) {
+	profile := fakeProfile(t, "small", `
+responses:
+  - content: ok
+`)
+	profile.ContextWindow = 1000
+	useProfiles(t, profile)
+	model, err := newResilientModel(context.Background(), profile)
+	assert.NoError(t, err)
+
+	// the prompt does not fit, the model is not called
+	_, err = lcllms.GenerateFromSinglePrompt(context.Background(), model, strings.Repeat("word ", 1000))
+	assert.ErrorIs(t, err, ErrPromptTooLong)
+	assert.True(t, IsContextLengthError(err))
+
+	answer, err := lcllms.GenerateFromSinglePrompt(context.Background(), model, "hi")
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", answer)
+}
@@ -2,13 +2,24 @@ package nmemory
 
 import (
 	"context"
+	"time"
 
 	"github.com/tmc/langchaingo/llms"
 	"github.com/tmc/langchaingo/memory"
 )
 
+const (
+	// chatMode is the mode the chat messages are recorded with
+	chatMode = "chatmode"
+	// titleMaxLen is the max length of a session title taken from the first user message
+	titleMaxLen = 60
+)
+
 type ChatHistory struct {
 	history *memory.ChatMessageHistory
+	// session and store are nil for a history which only lives in memory
+	session *Session
+	store   SessionStore
 }
 
 // NewChatHistory creates a new ChatHistory instance
@@ -18,14 +29,58 @@ func NewChatHistory() *ChatHistory {
 	}
 }
 
+// NewFileChatHistory creates a ChatHistory which records everything into the
+// session and saves it to the store after every change. The chat messages
+// already recorded in the session are loaded, so a resumed session continues
+// where it stopped.
+func NewFileChatHistory(store SessionStore, session *Session) *ChatHistory {
+	return &ChatHistory{
+		history: memory.NewChatMessageHistory(memory.WithPreviousMessages(chatMessages(session.Entries))),
+		session: session,
+		store:   store,
+	}
+}
+
+// chatMessages returns the chat messages recorded in the entries since the
+// chat history was last cleared
+func chatMessages(entries []Entry) []llms.ChatMessage {
+	messages := []llms.ChatMessage{}
+	for _, entry := range entries {
+		if entry.Mode != chatMode {
+			continue
+		}
+		switch entry.Kind {
+		case EntryUser:
+			messages = append(messages, llms.HumanChatMessage{Content: entry.Content})
+		case EntryAI:
+			messages = append(messages, llms.AIChatMessage{Content: entry.Content})
+		case EntryClear:
+			messages = []llms.ChatMessage{}
+		}
+	}
+	return messages
+}
+
 // AddUserMessage adds a user message to the chat history
 func (ch *ChatHistory) AddUserMessage(ctx context.Context, content string) error {
-	return ch.history.AddUserMessage(ctx, content)
+	if err := ch.history.AddUserMessage(ctx, content); err != nil {
+		return err
+	}
+	return ch.record(chatMode, EntryUser, content)
 }
 
 // AddAIMessage adds an AI message to the chat history
 func (ch *ChatHistory) AddAIMessage(ctx context.Context, content string) error {
-	return ch.history.AddAIMessage(ctx, content)
+	if err := ch.history.AddAIMessage(ctx, content); err != nil {
+		return err
+	}
+	return ch.record(chatMode, EntryAI, content)
+}
+
+// AddEntry records what happened in a mode other than chat, like an executed
+// command and its output. It is not part of the chat messages.
+func (ch *ChatHistory) AddEntry(mode string, kind EntryKind, content string) error {
+	return ch.record(mode, kind, content)
 }
 
 // GetMessages returns all messages in the chat history
@@ -33,7 +88,115 @@ func (ch *ChatHistory) GetMessages(ctx context.Context) ([]llms.ChatMessage, err
 	return ch.history.Messages(ctx)
 }
 
-// Clear clears all messages from the chat history
+// Clear clears all messages from the chat history. The recorded session is
+// kept, a marker is added so the cleared messages are not loaded on resume.
 func (ch *ChatHistory) Clear(ctx context.Context) error {
-	return ch.history.Clear(ctx)
+	if err := ch.history.Clear(ctx); err != nil {
+		return err
+	}
+	return ch.record(chatMode, EntryClear, "")
+}
+
+// Undo removes the last input of the user and everything recorded after it,
+// like the answer of the model or the executed command. It returns the
+// removed entries, none if there is no input to undo.
+func (ch *ChatHistory) Undo(ctx context.Context) ([]Entry, error) {
+	if ch.session == nil {
+		return ch.undoMessages(ctx)
+	}
+	last := -1
+	for i, entry := range ch.session.Entries {
+		if entry.Kind == EntryUser {
+			last = i
+		}
+	}
+	if last < 0 {
+		return nil, nil
+	}
+
+	removed := append([]Entry{}, ch.session.Entries[last:]...)
+	ch.session.Entries = ch.session.Entries[:last]
+	ch.session.UpdatedAt = time.Now()
+	if err := ch.history.SetMessages(ctx, chatMessages(ch.session.Entries)); err != nil {
+		return nil, err
+	}
+	if ch.store == nil {
+		return removed, nil
+	}
+	// the file is written even if no entry is left, unlike Save
+	return removed, ch.store.Save(ch.session)
+}
+
+// undoMessages removes the last user message and the answer to it from a
+// history which only lives in memory
+func (ch *ChatHistory) undoMessages(ctx context.Context) ([]Entry, error) {
+	messages, err := ch.history.Messages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].GetType() != llms.ChatMessageTypeHuman {
+			continue
+		}
+		removed := []Entry{}
+		for _, msg := range messages[i:] {
+			kind := EntryAI
+			if msg.GetType() == llms.ChatMessageTypeHuman {
+				kind = EntryUser
+			}
+			removed = append(removed, Entry{Mode: chatMode, Kind: kind, Content: msg.GetContent()})
+		}
+		return removed, ch.history.SetMessages(ctx, messages[:i])
+	}
+	return nil, nil
+}
+
+// AddUsage records the tokens used by a call to a model
+func (ch *ChatHistory) AddUsage(usage Usage) error {
+	if ch.session == nil {
+		return nil
+	}
+	if usage.Time.IsZero() {
+		usage.Time = time.Now()
+	}
+	ch.session.Usage = append(ch.session.Usage, usage)
+	return ch.Save()
+}
+
+// Session returns the session the history records into, nil for an in-memory history
+func (ch *ChatHistory) Session() *Session {
+	return ch.session
+}
+
+// Save writes the session to the store
+func (ch *ChatHistory) Save() error {
+	if ch.session == nil || ch.store == nil {
+		return nil
+	}
+	// do not leave empty files behind for sessions in which nothing happened
+	if len(ch.session.Entries) == 0 {
+		return nil
+	}
+	return ch.store.Save(ch.session)
+}
+
+func (ch *ChatHistory) record(mode string, kind EntryKind, content string) error {
+	if ch.session == nil {
+		return nil
+	}
+	now := time.Now()
+	if ch.session.Title == "" && kind == EntryUser {
+		ch.session.Title = sessionTitle(content)
+	}
+	ch.session.Entries = append(ch.session.Entries, Entry{Time: now, Mode: mode, Kind: kind, Content: content})
+	ch.session.UpdatedAt = now
+	return ch.Save()
+}
+
+func sessionTitle(content string) string {
+	runes := []rune(content)
+	if len(runes) > titleMaxLen {
+		return string(runes[:titleMaxLen]) + "..."
+	}
+	return string(runes)
 }
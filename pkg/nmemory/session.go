@@ -0,0 +1,228 @@
+package nmemory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/google/uuid"
+)
+
+// SessionFormatVersion is the version of the session file format written by
+// this build. Files with a newer version are refused instead of being
+// silently truncated on the next save.
+const SessionFormatVersion = 1
+
+const (
+	SessionsDir    = "sessions"
+	sessionFileExt = ".json"
+)
+
+// ErrSessionNotFound is returned when no session file exists for an ID.
+var ErrSessionNotFound = errors.New("session not found")
+
+// EntryKind is the kind of a session entry.
+type EntryKind string
+
+const (
+	// EntryUser is a message typed by the user.
+	EntryUser EntryKind = "user"
+	// EntryAI is a reply of the model.
+	EntryAI EntryKind = "ai"
+	// EntryCommand is a command executed in cmd mode.
+	EntryCommand EntryKind = "command"
+	// EntryOutput is the output of an executed command or script.
+	EntryOutput EntryKind = "output"
+	// EntryScript is a script generated in task or script mode.
+	EntryScript EntryKind = "script"
+	// EntryAgent is a step of an agent run.
+	EntryAgent EntryKind = "agent"
+	// EntryClear marks the point where the chat history was cleared.
+	EntryClear EntryKind = "clear"
+)
+
+// Entry is one record of a session.
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Mode    string    `json:"mode"`
+	Kind    EntryKind `json:"kind"`
+	Content string    `json:"content"`
+}
+
+// Session is everything which happened in one run of the terminal.
+type Session struct {
+	Version   int       `json:"version"`
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Entries   []Entry   `json:"entries"`
+	// Usage are the tokens used by the calls to the models
+	Usage []Usage `json:"usage,omitempty"`
+}
+
+// Usage is the tokens used by one call to a model.
+type Usage struct {
+	Time             time.Time `json:"time"`
+	Mode             string    `json:"mode"`
+	Profile          string    `json:"profile"`
+	Backend          string    `json:"backend"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	// Estimated is set when the backend did not report the tokens
+	Estimated bool `json:"estimated,omitempty"`
+}
+
+// NewSession creates an empty session with a new ID.
+func NewSession() *Session {
+	now := time.Now()
+	return &Session{
+		Version:   SessionFormatVersion,
+		ID:        now.Format("20060102-150405") + "-" + uuid.New().String()[:8],
+		CreatedAt: now,
+		UpdatedAt: now,
+		Entries:   []Entry{},
+	}
+}
+
+// SessionStore saves and loads sessions.
+type SessionStore interface {
+	// Save writes the session, replacing any previous version of it.
+	Save(session *Session) error
+	// Load reads the session with the given ID.
+	Load(id string) (*Session, error)
+	// List returns all sessions, most recently updated first.
+	List() ([]*Session, error)
+	// Delete removes the session with the given ID.
+	Delete(id string) error
+}
+
+// FileSessionStore stores every session as a JSON file in a directory.
+type FileSessionStore struct {
+	Dir string
+}
+
+// NewFileSessionStore creates a SessionStore which keeps its files in dir.
+func NewFileSessionStore(dir string) SessionStore {
+	return &FileSessionStore{Dir: dir}
+}
+
+// DefaultSessionDir returns the directory sessions are stored in, ~/.nuwa-terminal/sessions.
+func DefaultSessionDir() string {
+	return config.HomePath(SessionsDir)
+}
+
+func (s *FileSessionStore) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("invalid session id: %q", id)
+	}
+	return filepath.Join(s.Dir, id+sessionFileExt), nil
+}
+
+// Save writes the session to a temporary file first, then renames it, so an
+// interrupted write never leaves a broken session behind.
+func (s *FileSessionStore) Save(session *Session) error {
+	path, err := s.path(session.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create session directory: %w", err)
+	}
+
+	session.Version = SessionFormatVersion
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	return nil
+}
+
+// Load reads and validates the session with the given ID.
+func (s *FileSessionStore) Load(id string) (*Session, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+	return decodeSession(data)
+}
+
+func decodeSession(data []byte) (*Session, error) {
+	session := &Session{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, fmt.Errorf("failed to decode session: %w", err)
+	}
+	if session.Version > SessionFormatVersion {
+		return nil, fmt.Errorf("session %s has format version %d, this version of nuwa supports up to %d",
+			session.ID, session.Version, SessionFormatVersion)
+	}
+	// files written before the version field existed are compatible with version 1
+	if session.Version == 0 {
+		session.Version = SessionFormatVersion
+	}
+	return session, nil
+}
+
+// List returns all readable sessions, most recently updated first.
+func (s *FileSessionStore) List() ([]*Session, error) {
+	files, err := os.ReadDir(s.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []*Session{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session directory: %w", err)
+	}
+
+	sessions := []*Session{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), sessionFileExt) {
+			continue
+		}
+		session, err := s.Load(strings.TrimSuffix(file.Name(), sessionFileExt))
+		if err != nil {
+			// a broken or newer file must not hide the other sessions
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].UpdatedAt.After(sessions[j].UpdatedAt)
+	})
+	return sessions, nil
+}
+
+// Delete removes the session file with the given ID.
+func (s *FileSessionStore) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+package nmemory
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestFileChatHistoryResume(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileSessionStore(t.TempDir())
+	session := NewSession()
+
+	history := NewFileChatHistory(store, session)
+	assert.NoError(t, history.AddUserMessage(ctx, "who are you?"))
+	assert.NoError(t, history.AddAIMessage(ctx, "I am NUWA"))
+	assert.NoError(t, history.AddEntry("cmdmode", EntryCommand, "ls -l"))
+	assert.NoError(t, history.AddUsage(Usage{Mode: "cmdmode", Profile: "default", PromptTokens: 120, CompletionTokens: 8}))
+
+	saved, err := store.Load(session.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, SessionFormatVersion, saved.Version)
+	assert.Equal(t, "who are you?", saved.Title)
+	assert.Len(t, saved.Entries, 3)
+	assert.Len(t, saved.Usage, 1)
+	assert.Equal(t, 120, saved.Usage[0].PromptTokens)
+
+	resumed := NewFileChatHistory(store, saved)
+	messages, err := resumed.GetMessages(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []llms.ChatMessage{
+		llms.HumanChatMessage{Content: "who are you?"},
+		llms.AIChatMessage{Content: "I am NUWA"},
+	}, messages)
+}
+
+func TestFileChatHistoryClearIsKeptOnResume(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileSessionStore(t.TempDir())
+	session := NewSession()
+
+	history := NewFileChatHistory(store, session)
+	assert.NoError(t, history.AddUserMessage(ctx, "first"))
+	assert.NoError(t, history.Clear(ctx))
+	assert.NoError(t, history.AddUserMessage(ctx, "second"))
+
+	saved, err := store.Load(session.ID)
+	assert.NoError(t, err)
+	messages, err := NewFileChatHistory(store, saved).GetMessages(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []llms.ChatMessage{llms.HumanChatMessage{Content: "second"}}, messages)
+}
+
+func TestFileChatHistoryUndo(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileSessionStore(t.TempDir())
+	session := NewSession()
+
+	history := NewFileChatHistory(store, session)
+	assert.NoError(t, history.AddUserMessage(ctx, "who are you?"))
+	assert.NoError(t, history.AddAIMessage(ctx, "I am NUWA"))
+	assert.NoError(t, history.AddEntry("cmdmode", EntryUser, "list files"))
+	assert.NoError(t, history.AddEntry("cmdmode", EntryCommand, "ls -l"))
+
+	removed, err := history.Undo(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, removed, 2)
+	assert.Equal(t, "list files", removed[0].Content)
+
+	removed, err = history.Undo(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, removed, 2)
+	messages, err := history.GetMessages(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	saved, err := store.Load(session.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, saved.Entries)
+
+	removed, err = history.Undo(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+}
+
+func TestFileSessionStoreRejectsNewerVersion(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileSessionStore(dir)
+	err := os.WriteFile(filepath.Join(dir, "future.json"), []byte(`{"version": 99, "id": "future"}`), 0o600)
+	assert.NoError(t, err)
+
+	_, err = store.Load("future")
+	assert.Error(t, err)
+
+	sessions, err := store.List()
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+func TestFileSessionStoreDelete(t *testing.T) {
+	store := NewFileSessionStore(t.TempDir())
+	session := NewSession()
+	assert.NoError(t, store.Save(session))
+
+	assert.NoError(t, store.Delete(session.ID))
+	_, err := store.Load(session.ID)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+	assert.ErrorIs(t, store.Delete(session.ID), ErrSessionNotFound)
+	assert.Error(t, store.Delete("../escape"))
+}
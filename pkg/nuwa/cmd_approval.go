@@ -0,0 +1,255 @@
+package nuwa
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pterm/pterm"
+)
+
+// ApprovalDecision is what the user decided to do with a generated command.
+type ApprovalDecision int
+
+const (
+	// ApprovalRun runs the (possibly edited) command.
+	ApprovalRun ApprovalDecision = iota
+	// ApprovalRegenerate asks the model for another command.
+	ApprovalRegenerate
+	// ApprovalCancel drops the command.
+	ApprovalCancel
+)
+
+const (
+	approveRun        = "Run"
+	approveEdit       = "Edit"
+	approveRegenerate = "Regenerate"
+	approveCancel     = "Cancel"
+	approveAlways     = "Always allow "
+
+	// NuwaAutoApproveEnv skips the approval, it is meant for non-interactive use.
+	NuwaAutoApproveEnv = "NUWA_AUTO_APPROVE"
+)
+
+// ErrNoTerminal is returned when a command needs approval but there is no terminal to ask on.
+var ErrNoTerminal = errors.New("no terminal to approve the command, set " + NuwaAutoApproveEnv + "=true to run commands without approval")
+
+// CommandApprover decides whether a command generated by the model may run.
+type CommandApprover interface {
+	// Approve returns the decision and the command to run, which the user may have edited.
+	Approve(cmd string) (ApprovalDecision, string, error)
+}
+
+// AllowRules are the commands the user allowed to run without asking again.
+// Only read-only commands can be allowed, the rules live as long as the process.
+type AllowRules struct {
+	mu    sync.Mutex
+	rules map[string]bool
+}
+
+func NewAllowRules() *AllowRules {
+	return &AllowRules{rules: map[string]bool{}}
+}
+
+// Allow adds the rules which make cmd run without approval.
+func (a *AllowRules) Allow(cmd string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, key := range readOnlyKeys(cmd) {
+		a.rules[key] = true
+	}
+}
+
+// IsAllowed reports whether cmd is read-only and every part of it is allowed.
+func (a *AllowRules) IsAllowed(cmd string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keys := readOnlyKeys(cmd)
+	if len(keys) == 0 {
+		return false
+	}
+	for _, key := range keys {
+		if !a.rules[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionAllowRules are shared by all cmd mode runs of this process
+var sessionAllowRules = NewAllowRules()
+
+// InteractiveApprover asks the user on the terminal.
+type InteractiveApprover struct {
+	rules *AllowRules
+}
+
+func NewInteractiveApprover(rules *AllowRules) *InteractiveApprover {
+	return &InteractiveApprover{rules: rules}
+}
+
+// Approve shows the command and lets the user run, edit, regenerate or cancel it.
+// An edited command is shown again, so the user always approves what is run.
+func (a *InteractiveApprover) Approve(cmd string) (ApprovalDecision, string, error) {
+	if autoApprove() || a.rules.IsAllowed(cmd) {
+		return ApprovalRun, cmd, nil
+	}
+	if !isTerminal(os.Stdin) {
+		return ApprovalCancel, cmd, ErrNoTerminal
+	}
+
+	for {
+		pterm.DefaultBox.WithTitle("Command to run").Println(cmd)
+
+		options := []string{approveRun, approveEdit, approveRegenerate, approveCancel}
+		keys := readOnlyKeys(cmd)
+		if len(keys) > 0 {
+			options = append(options, approveAlways+strings.Join(keys, ", "))
+		}
+
+		interrupted := false
+		choice, err := pterm.DefaultInteractiveSelect.
+			WithOptions(options).
+			WithDefaultOption(approveRun).
+			WithOnInterruptFunc(func() { interrupted = true }).
+			Show("Run this command?")
+		if err != nil {
+			return ApprovalCancel, cmd, fmt.Errorf("failed to read approval: %w", err)
+		}
+		if interrupted {
+			return ApprovalCancel, cmd, nil
+		}
+
+		switch {
+		case choice == approveRun:
+			return ApprovalRun, cmd, nil
+		case choice == approveRegenerate:
+			return ApprovalRegenerate, cmd, nil
+		case choice == approveCancel:
+			return ApprovalCancel, cmd, nil
+		case strings.HasPrefix(choice, approveAlways):
+			a.rules.Allow(cmd)
+			return ApprovalRun, cmd, nil
+		case choice == approveEdit:
+			edited, err := pterm.DefaultInteractiveTextInput.
+				WithDefaultValue(cmd).
+				WithOnInterruptFunc(func() { interrupted = true }).
+				Show("Edit command")
+			if err != nil {
+				return ApprovalCancel, cmd, fmt.Errorf("failed to read edited command: %w", err)
+			}
+			if interrupted {
+				return ApprovalCancel, cmd, nil
+			}
+			if strings.TrimSpace(edited) != "" {
+				cmd = strings.TrimSpace(edited)
+			}
+		}
+	}
+}
+
+func autoApprove() bool {
+	switch strings.ToLower(os.Getenv(NuwaAutoApproveEnv)) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// readOnlyBinaries can not change the system, unless given one of their write
+// flags, see isWriteFlag. Pagers and top are not read-only: less runs shell
+// commands with !, top kills and renices processes.
+var readOnlyBinaries = map[string][]string{
+	"cat": nil, "df": nil, "du": nil, "echo": nil, "free": nil,
+	"grep": nil, "egrep": nil, "head": nil, "id": nil, "ls": nil,
+	"lsblk": nil, "lscpu": nil, "lsof": nil, "printenv": nil, "ps": nil,
+	"pwd": nil, "stat": nil, "tail": nil, "uname": nil, "uptime": nil, "wc": nil,
+	"which": nil, "whoami": nil, "w": nil, "who": nil, "netstat": nil,
+	"cut": nil, "nproc": nil,
+	"date":  {"-s", "--set"},
+	"dmesg": {"-c", "-C", "--clear", "--read-clear"},
+	"file":  {"-C", "--compile"},
+	"ss":    {"-K", "--kill"},
+	"find":  {"-delete", "-exec", "-ok", "-fprint", "-fls"},
+}
+
+// isWriteFlag checks an argument against a write flag. A short flag also
+// matches in a group like -tK, a long one with its value like --set=x, and a
+// find action by its prefix, so -fprint matches -fprint0 and -exec -execdir.
+func isWriteFlag(arg, flag string) bool {
+	switch {
+	case strings.HasPrefix(flag, "--"):
+		return arg == flag || strings.HasPrefix(arg, flag+"=")
+	case len(flag) == 2:
+		return strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && strings.Contains(arg[1:], flag[1:])
+	}
+	return strings.HasPrefix(arg, flag)
+}
+
+// readOnlySubcommands are tools which are read-only only with some subcommands.
+var readOnlySubcommands = map[string]map[string]bool{
+	"git":       {"status": true, "log": true, "diff": true, "show": true},
+	"docker":    {"ps": true, "images": true, "logs": true, "inspect": true, "version": true, "info": true},
+	"kubectl":   {"get": true, "describe": true, "logs": true, "version": true, "top": true},
+	"systemctl": {"status": true, "list-units": true, "is-active": true, "is-enabled": true},
+	"ip":        {"addr": true, "a": true, "route": true, "r": true, "link": true},
+}
+
+// readOnlyKeys returns the allow rule keys of every part of a read-only
+// command, like ["ls", "git status"]. It returns nil if any part of the
+// command may change the system.
+func readOnlyKeys(cmd string) []string {
+	// redirections, command substitution and command lists are never read-only
+	if cmd == "" || strings.ContainsAny(cmd, "><;&`\n") || strings.Contains(cmd, "$(") {
+		return nil
+	}
+
+	keys := []string{}
+	for _, segment := range strings.Split(cmd, "|") {
+		fields := strings.Fields(segment)
+		if len(fields) == 0 {
+			return nil
+		}
+		// --output writes a file, like git log --output=<file>
+		for _, arg := range fields[1:] {
+			if strings.HasPrefix(arg, "--output") {
+				return nil
+			}
+		}
+		binary := fields[0]
+		writeFlags, isReadOnly := readOnlyBinaries[binary]
+		switch {
+		case isReadOnly:
+			for _, arg := range fields[1:] {
+				for _, flag := range writeFlags {
+					if isWriteFlag(arg, flag) {
+						return nil
+					}
+				}
+			}
+			keys = append(keys, binary)
+		case readOnlySubcommands[binary] != nil:
+			if len(fields) < 2 || !readOnlySubcommands[binary][fields[1]] {
+				return nil
+			}
+			// "ip link set" changes the interface, only allow listing
+			if binary == "ip" && len(fields) > 2 && fields[2] != "show" && fields[2] != "list" {
+				return nil
+			}
+			keys = append(keys, binary+" "+fields[1])
+		default:
+			return nil
+		}
+	}
+	return keys
+}
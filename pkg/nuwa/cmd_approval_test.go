@@ -0,0 +1,45 @@
+package nuwa
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnlyKeys(t *testing.T) {
+	assert.Equal(t, []string{"ls"}, readOnlyKeys("ls -la"))
+	assert.Equal(t, []string{"git log", "grep"}, readOnlyKeys("git log --oneline | grep fix"))
+	assert.Equal(t, []string{"kubectl top"}, readOnlyKeys("kubectl top pods"))
+	assert.Equal(t, []string{"find"}, readOnlyKeys("find . -name *.go -print0"))
+	assert.Equal(t, []string{"ss"}, readOnlyKeys("ss -tlnp"))
+	assert.Equal(t, []string{"file"}, readOnlyKeys("file -b main.go"))
+
+	for _, cmd := range []string{
+		"git log --output=/etc/cron.d/job",
+		"git diff --output /tmp/x",
+		"git show HEAD --output-indicator-new=x",
+		"less /var/log/syslog",
+		"more README.md",
+		"top",
+		"htop",
+		"ls > files.txt",
+		"find . -delete",
+		"find . -fprint0 /etc/cron.d/x",
+		"find . -fprintf /tmp/x %p",
+		"find . -execdir rm {} +",
+		"find . -okdir rm {} +",
+		"ss -K dst 10.0.0.1",
+		"ss -tK",
+		"ss --kill",
+		"file -C -m magic",
+		"dmesg -Tc",
+		"git push",
+	} {
+		assert.Nil(t, readOnlyKeys(cmd), cmd)
+	}
+
+	rules := NewAllowRules()
+	rules.Allow("git log")
+	assert.True(t, rules.IsAllowed("git log -5"))
+	assert.False(t, rules.IsAllowed("git log --output=/tmp/log"))
+}
@@ -1,5 +1,11 @@
 package nuwa
 
+import (
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nmemory"
+	"github.com/pterm/pterm"
+)
+
 type Nuwa interface {
 	Run(prompt string) error
 }
@@ -14,7 +20,20 @@ const (
 	CmdModePrefix   = "#"
 	TaskModePrefix  = ">"
 	AgentModePrefix = "&"
+	AutoModePrefix  = "*"
 
-	NuwaCatchDir   = ".nuwa-terminal"
+	NuwaCatchDir   = config.Catchdir
 	NuwaScriptsDir = "scripts"
 )
+
+// recordEntry records an entry into the session, nothing is recorded when
+// there is no session or no content.
+func recordEntry(session *nmemory.ChatHistory, mode string, kind nmemory.EntryKind, content string) {
+	if session == nil || content == "" {
+		return
+	}
+	if err := session.AddEntry(mode, kind, content); err != nil {
+		logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+		logger.Warn("NUWA TERMINAL: failed to save session,", logger.Args("err", err.Error()))
+	}
+}
@@ -6,10 +6,12 @@ import (
 
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/agents"
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nmemory"
 	"github.com/pterm/pterm"
 	lcagents "github.com/tmc/langchaingo/agents"
 	"github.com/tmc/langchaingo/chains"
 	lcllms "github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/schema"
 	"github.com/tmc/langchaingo/tools"
 )
 
@@ -22,6 +24,7 @@ type NuwaAgent struct {
 	prefix       string
 	catchdir     string
 	scriptsdir   string
+	session      *nmemory.ChatHistory
 }
 
 func NewNuwaAgent(ctx context.Context, systemPrompt string) (*NuwaAgent, error) {
@@ -42,6 +45,11 @@ func NewNuwaAgent(ctx context.Context, systemPrompt string) (*NuwaAgent, error)
 	}, nil
 }
 
+// SetSession makes the agent record its transcript into the session
+func (n *NuwaAgent) SetSession(session *nmemory.ChatHistory) {
+	n.session = session
+}
+
 func (n *NuwaAgent) Run(prompt string) error {
 	return n.handleAgentMode(prompt)
 }
@@ -55,18 +63,43 @@ func (n *NuwaAgent) handleAgentMode(input string) error {
 		return err
 	}
 
+	// the steps are shown while the agent runs
+	view := newAgentView()
 	agentTools := []tools.Tool{
-		&agents.ScriptExecutor{},
+		&agents.ScriptExecutor{CallbacksHandler: view},
 	}
 
-	agent := agents.NewTroubleshootingAgent(llm, agentTools, "output", nil)
-	executor := lcagents.NewExecutor(agent)
-	answer, err := chains.Run(context.Background(), executor, input)
+	// models without tool calls write their actions in the text of the answer
+	agent, err := agents.NewTroubleshootingAgent(llm, agentTools, llms.SystemInfoBudget(n.ctx), "output", view, llms.ToolCalling(n.ctx))
+	if err != nil {
+		logger.Error("NUWA TERMINAL: failed to create agent,", logger.Args("err", err.Error()))
+		return err
+	}
+	executor := lcagents.NewExecutor(agent, lcagents.WithReturnIntermediateSteps())
+	outputs, err := chains.Call(n.ctx, executor, map[string]any{"input": input})
+	n.recordTranscript(outputs)
 	if err != nil {
 		logger.Error("NUWA TERMINAL: failed to run agent,", logger.Args("err", err.Error()))
 		return err
 	}
 
+	answer, ok := outputs[agent.OutputKey].(string)
+	if !ok {
+		return fmt.Errorf("agent returned no answer")
+	}
+	recordEntry(n.session, AgentMode, nmemory.EntryAI, answer)
+
 	fmt.Println("NUWA: " + answer)
 	return nil
 }
+
+// recordTranscript records every thought, action and observation of the agent run into the session
+func (n *NuwaAgent) recordTranscript(outputs map[string]any) {
+	steps, ok := outputs["intermediateSteps"].([]schema.AgentStep)
+	if !ok {
+		return
+	}
+	for _, step := range steps {
+		recordEntry(n.session, AgentMode, nmemory.EntryAgent, step.Action.Log+"\nObservation: "+step.Observation)
+	}
+}
@@ -0,0 +1,155 @@
+package nuwa
+
+import (
+	"context"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/prompts"
+	"github.com/pterm/pterm"
+)
+
+// How the mode of an input was chosen in auto mode.
+const (
+	RouteByPrefix    = "prefix"
+	RouteByHeuristic = "heuristic"
+	RouteByModel     = "model"
+)
+
+// Route is the mode an input goes to in auto mode.
+type Route struct {
+	Mode string
+	// Input is the input without the mode prefix
+	Input string
+	// By tells how the mode was chosen
+	By string
+}
+
+// modePrefixes are the prefixes choosing the mode of an input in auto mode,
+// the same ones the prompt shows for each mode
+var modePrefixes = map[string]string{
+	ChatModePrefix:  ChatMode,
+	CmdModePrefix:   CmdMode,
+	TaskModePrefix:  TaskMode,
+	AgentModePrefix: AgentMode,
+}
+
+// questionWords start a question when an auxiliary follows them, like
+// "how do I", while "which python" is a command
+var questionWords = map[string]bool{
+	"what": true, "why": true, "how": true, "who": true, "when": true,
+	"where": true, "which": true, "explain": true, "describe": true,
+}
+
+var auxiliaries = map[string]bool{
+	"is": true, "are": true, "was": true, "were": true, "am": true, "do": true,
+	"does": true, "did": true, "can": true, "could": true, "should": true,
+	"would": true, "will": true, "to": true, "the": true, "a": true, "an": true,
+	"i": true, "you": true, "my": true, "this": true, "that": true, "it": true,
+}
+
+// shellBuiltins are commands which are not in the PATH
+var shellBuiltins = map[string]bool{
+	"cd": true, "export": true, "unset": true, "alias": true, "source": true,
+	"pwd": true, "echo": true, "type": true, "ulimit": true, "umask": true,
+}
+
+// maxShortCommand is how many words an input starting with a command can
+// have to go to cmd mode without shell syntax, like "git status"
+const maxShortCommand = 3
+
+var (
+	// shellSyntax finds flags, paths, file names, variables, globs, pipes,
+	// redirections and command lists
+	shellSyntax = regexp.MustCompile(`(^|\s)(--?\w|~|\.{0,2}/)|\$|\w\.\w|[|<>;&*=]`)
+	taskWords   = regexp.MustCompile(`(?i)\b(script|scripts|automate)\b`)
+	agentWords  = regexp.MustCompile(`(?i)\b(troubleshoot\w*|diagnos\w*|investigat\w*|root cause|find out why|figure out why)\b`)
+)
+
+// RouteInput chooses the mode of an input: the mode of its prefix, or else
+// the mode the heuristics are sure of, or else the mode the model of auto
+// mode picks. Chat mode is used when the model fails.
+func RouteInput(ctx context.Context, input string) Route {
+	if route, ok := routeByPrefix(input); ok {
+		return route
+	}
+	if mode, ok := classifyHeuristic(input); ok {
+		return Route{Mode: mode, Input: input, By: RouteByHeuristic}
+	}
+	return Route{Mode: classifyWithModel(ctx, input), Input: input, By: RouteByModel}
+}
+
+func routeByPrefix(input string) (Route, bool) {
+	input = strings.TrimSpace(input)
+	for prefix, mode := range modePrefixes {
+		if rest, ok := strings.CutPrefix(input, prefix); ok && strings.TrimSpace(rest) != "" {
+			return Route{Mode: mode, Input: strings.TrimSpace(rest), By: RouteByPrefix}, true
+		}
+	}
+	return Route{}, false
+}
+
+// classifyHeuristic recognizes the inputs whose mode is obvious: questions
+// go to chat mode, scripts to task mode, troubleshooting to agent mode and
+// inputs starting with a command to cmd mode. A sentence starting with the
+// name of a command, like "make a backup of my photos", is left to the model.
+func classifyHeuristic(input string) (string, bool) {
+	fields := strings.Fields(strings.ToLower(input))
+	if len(fields) == 0 {
+		return "", false
+	}
+	if strings.HasSuffix(input, "?") || (len(fields) > 1 && questionWords[fields[0]] && auxiliaries[fields[1]]) {
+		return ChatMode, true
+	}
+	if agentWords.MatchString(input) {
+		return AgentMode, true
+	}
+	if taskWords.MatchString(input) {
+		return TaskMode, true
+	}
+	// the case of a command is kept, "Docker" is a word of a sentence
+	command := strings.Fields(input)[0]
+	if len(fields) > maxShortCommand && !shellSyntax.MatchString(input) {
+		return "", false
+	}
+	if shellBuiltins[command] {
+		return CmdMode, true
+	}
+	if _, err := exec.LookPath(command); err == nil {
+		return CmdMode, true
+	}
+	return "", false
+}
+
+// classifyWithModel asks the model of auto mode which mode fits the input
+func classifyWithModel(ctx context.Context, input string) string {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	rsp, err := llms.GenerateContent(llms.WithMode(ctx, AutoMode), prompts.SysPromptForAutoMode+input)
+	if err != nil {
+		logger.Warn("NUWA TERMINAL: failed to classify input, using chat mode,", logger.Args("err", err.Error()))
+		return ChatMode
+	}
+	return parseModeAnswer(rsp)
+}
+
+// parseModeAnswer finds the mode in the answer of the model, the first one
+// named wins
+func parseModeAnswer(answer string) string {
+	for _, word := range strings.FieldsFunc(strings.ToLower(answer), func(r rune) bool {
+		return !('a' <= r && r <= 'z')
+	}) {
+		switch strings.TrimSuffix(word, "mode") {
+		case "chat":
+			return ChatMode
+		case "cmd", "command":
+			return CmdMode
+		case "task":
+			return TaskMode
+		case "agent":
+			return AgentMode
+		}
+	}
+	return ChatMode
+}
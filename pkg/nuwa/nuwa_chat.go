@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nmemory"
 
 	"github.com/pterm/pterm"
 	lcllms "github.com/tmc/langchaingo/llms"
@@ -16,6 +17,11 @@ type NuwaChat struct {
 	model        lcllms.Model
 	chatHistory  []lcllms.MessageContent
 	SystemPrompt string
+	// maxHistoryTokens is the token budget for the history sent to the model,
+	// the rest of the context window is left for the response.
+	maxHistoryTokens int
+	// session records the conversation, it may be nil
+	session *nmemory.ChatHistory
 }
 
 func NewNuwaChat(ctx context.Context, systemPrompt string) (*NuwaChat, error) {
@@ -29,40 +35,136 @@ func NewNuwaChat(ctx context.Context, systemPrompt string) (*NuwaChat, error) {
 	}
 
 	return &NuwaChat{
-		ctx:          ctx,
-		model:        model,
-		chatHistory:  content,
-		SystemPrompt: systemPrompt,
+		ctx:              ctx,
+		model:            model,
+		chatHistory:      content,
+		SystemPrompt:     systemPrompt,
+		maxHistoryTokens: llms.GetPromptBudget(ctx),
 	}, nil
 }
 
 func (n *NuwaChat) Chat(ctx context.Context, message string) (string, error) {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
 	n.chatHistory = append(n.chatHistory, lcllms.TextParts(lcllms.ChatMessageTypeHuman, message))
+	n.fitContextWindow()
 
 	var fullResponse strings.Builder
-
-	// 使用流式生成
-	_, err := n.model.GenerateContent(ctx, n.chatHistory, lcllms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
-		fmt.Printf("%s", chunk) // 实时输出到终端
-		fullResponse.Write(chunk)
-		return nil
-	}))
-
-	if err != nil {
+	for {
+		fullResponse.Reset()
+		// 使用流式生成
+		_, err := n.model.GenerateContent(ctx, n.chatHistory, lcllms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+			fmt.Printf("%s", chunk) // 实时输出到终端
+			fullResponse.Write(chunk)
+			return nil
+		}))
+		if err == nil {
+			break
+		}
+
+		// The estimate was too optimistic for this model, forget the oldest
+		// turn and try again until only the current message is left.
+		if llms.IsContextLengthError(err) && fullResponse.Len() == 0 && n.dropOldestTurn() {
+			logger.Warn("NUWA TERMINAL: chat history exceeds the context window, dropped the oldest turn")
+			continue
+		}
+
+		// Forget the message which got no answer, so it is not sent again.
+		n.chatHistory = n.chatHistory[:len(n.chatHistory)-1]
 		return "", fmt.Errorf("failed to generate content: %w", err)
 	}
 
 	// 将AI的响应添加到聊天历史
 	n.chatHistory = append(n.chatHistory, lcllms.TextParts(lcllms.ChatMessageTypeAI, fullResponse.String()))
 
+	if n.session != nil {
+		if err := n.session.AddUserMessage(ctx, message); err != nil {
+			logger.Warn("NUWA TERMINAL: failed to save session,", logger.Args("err", err.Error()))
+		} else if err := n.session.AddAIMessage(ctx, fullResponse.String()); err != nil {
+			logger.Warn("NUWA TERMINAL: failed to save session,", logger.Args("err", err.Error()))
+		}
+	}
+
 	return fullResponse.String(), nil
 }
 
+// SetSession makes the chat record its turns into the session. The messages
+// already in the session are loaded, so a resumed conversation keeps its context.
+func (n *NuwaChat) SetSession(session *nmemory.ChatHistory) error {
+	messages, err := session.GetMessages(n.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get session messages: %w", err)
+	}
+
+	n.chatHistory = n.chatHistory[:1]
+	for _, msg := range messages {
+		n.chatHistory = append(n.chatHistory, lcllms.TextParts(msg.GetType(), msg.GetContent()))
+	}
+	n.session = session
+	return nil
+}
+
+// Reset forgets the conversation and keeps only the system prompt.
+func (n *NuwaChat) Reset() {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	n.chatHistory = n.chatHistory[:1]
+	if n.session != nil {
+		if err := n.session.Clear(n.ctx); err != nil {
+			logger.Warn("NUWA TERMINAL: failed to save session,", logger.Args("err", err.Error()))
+		}
+	}
+}
+
+// History returns a copy of the conversation, starting with the system prompt.
+func (n *NuwaChat) History() []lcllms.MessageContent {
+	history := make([]lcllms.MessageContent, len(n.chatHistory))
+	copy(history, n.chatHistory)
+	return history
+}
+
+// fitContextWindow drops the oldest turns until the history fits the token budget.
+func (n *NuwaChat) fitContextWindow() {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	dropped := 0
+	for llms.EstimateMessagesTokens(n.chatHistory) > n.maxHistoryTokens && n.dropOldestTurn() {
+		dropped++
+	}
+	if dropped > 0 {
+		logger.Info("NUWA TERMINAL: chat history trimmed to fit the context window", logger.Args("dropped turns", dropped))
+	}
+}
+
+// dropOldestTurn removes the oldest user message together with the replies to it.
+// The system prompt and the latest user message are never removed, false is
+// returned when there is nothing left to drop.
+func (n *NuwaChat) dropOldestTurn() bool {
+	// history is [system, human, ai, human, ai, ..., human]
+	if len(n.chatHistory) <= 2 {
+		return false
+	}
+	end := 2
+	for end < len(n.chatHistory)-1 && n.chatHistory[end].Role != lcllms.ChatMessageTypeHuman {
+		end++
+	}
+	n.chatHistory = append(n.chatHistory[:1], n.chatHistory[end:]...)
+	return true
+}
+
+// SetContext sets the context of the next turns, like the one of a request
+// which is cancelled on Ctrl+C
+func (n *NuwaChat) SetContext(ctx context.Context) {
+	n.ctx = ctx
+}
+
 func (n *NuwaChat) Run(prompt string) error {
 	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
 
 	fmt.Printf("NUWA: ")
 	_, err := n.Chat(n.ctx, prompt)
+	if err != nil && n.ctx.Err() != nil {
+		// interrupted, the caller tells it
+		fmt.Printf("\n")
+		return err
+	}
 	if err != nil {
 		logger.Error("NUWA TERMINAL: failed to generate content,", logger.Args("err", err.Error()))
 		return err
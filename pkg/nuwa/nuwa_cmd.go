@@ -3,10 +3,13 @@ package nuwa
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/cmdexe"
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nmemory"
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/parser"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/prompts"
 	"github.com/pterm/pterm"
 	lcllms "github.com/tmc/langchaingo/llms"
 )
@@ -16,8 +19,14 @@ type NuwaCmd struct {
 	model        lcllms.Model
 	chatHistory  []lcllms.MessageContent
 	systemPrompt string
+	session      *nmemory.ChatHistory
+	approver     CommandApprover
+	shell        *cmdexe.ShellSession
 }
 
+// maxCmdRegenerations is how many times the user can ask for another command in one run
+const maxCmdRegenerations = 5
+
 func NewNuwaCmd(ctx context.Context, systemPrompt string) (*NuwaCmd, error) {
 	model, err := llms.GetLLMBackend(ctx)
 	if err != nil {
@@ -29,35 +38,179 @@ func NewNuwaCmd(ctx context.Context, systemPrompt string) (*NuwaCmd, error) {
 		model:        model,
 		chatHistory:  []lcllms.MessageContent{},
 		systemPrompt: systemPrompt,
+		approver:     NewInteractiveApprover(sessionAllowRules),
 	}, nil
 }
 
+// SetApprover replaces the approver which confirms commands before they run
+func (n *NuwaCmd) SetApprover(approver CommandApprover) {
+	n.approver = approver
+}
+
+// SetSession makes the cmd record the executed command and its output into the session
+func (n *NuwaCmd) SetSession(session *nmemory.ChatHistory) {
+	n.session = session
+}
+
+// SetShell makes the cmd run commands in a long lived shell, so cd and export
+// survive between runs
+func (n *NuwaCmd) SetShell(shell *cmdexe.ShellSession) {
+	n.shell = shell
+}
+
 func (n *NuwaCmd) Run(prompt string) error {
 	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
 
-	rsp, err := llms.GenerateContent(n.ctx, prompt)
+	cmd, err := n.generateCommand(prompt)
+	if err != nil || cmd == "" {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		cmd, err = n.approveCommand(prompt, cmd)
+		if err != nil {
+			logger.Error("NUWA TERMINAL: failed to approve command,", logger.Args("err", err.Error()))
+			return err
+		}
+		if cmd == "" {
+			logger.Info("NUWA TERMINAL: command cancelled")
+			return nil
+		}
+
+		recordEntry(n.session, CmdMode, nmemory.EntryCommand, cmd)
+		result, err := n.execute(cmd)
+		recordResult(n.session, CmdMode, result)
+		if err == nil {
+			return nil
+		}
+		logger.Error("NUWA TERMINAL: failed to execute command,", logger.Args("err", err.Error()))
+		// a failed command must not be answered from the cache again
+		llms.Uncache(n.ctx, prompt)
+
+		// the failure is sent to the model, which answers with a fixed command
+		failed := failedResult(err)
+		if failed == nil || !askRepair(attempt, failed) {
+			return err
+		}
+		prompt = prompt + "\n" + fmt.Sprintf(prompts.CmdRepairPrompt, failed.String())
+		if cmd, err = n.generateCommand(prompt); err != nil || cmd == "" {
+			return err
+		}
+	}
+}
+
+// execute runs the command in the shell session if there is one, the output
+// is shown while the command runs. A sandboxed command runs on its own.
+func (n *NuwaCmd) execute(cmd string) (*cmdexe.ExecResult, error) {
+	if n.shell == nil || cmdexe.SandboxFrom(n.ctx) != nil {
+		return cmdexe.RunCommand(n.ctx, cmd)
+	}
+	return n.shell.Run(n.ctx, cmd)
+}
+
+// approveCommand asks the user to approve the command, a new command is
+// generated as long as the user asks for it. The approved command is returned,
+// or an empty command if the user cancelled.
+func (n *NuwaCmd) approveCommand(prompt string, cmd string) (string, error) {
+	for i := 0; i <= maxCmdRegenerations; i++ {
+		decision, approved, err := n.approver.Approve(cmd)
+		if err != nil {
+			return "", err
+		}
+
+		switch decision {
+		case ApprovalRun:
+			return approved, nil
+		case ApprovalCancel:
+			return "", nil
+		}
+
+		retry := prompt + "\n" + fmt.Sprintf(prompts.CmdRegeneratePrompt, approved)
+		if cmd, err = n.generateCommand(retry); err != nil || cmd == "" {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no command approved after %d regenerations", maxCmdRegenerations)
+}
+
+// generateCommand asks the model for a command, an empty command means there
+// is nothing to run. The explanation is shown while it is generated, the
+// command once the answer is complete and parsed.
+func (n *NuwaCmd) generateCommand(prompt string) (string, error) {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+
+	printer := newStreamPrinter("NUWA: ", "NUWA is thinking...")
+	explanation := &parser.ExplanationStream{}
+	var shown strings.Builder
+	show := func(ctx context.Context, part string) error {
+		if part == "" {
+			return nil
+		}
+		shown.WriteString(part)
+		return printer.write(ctx, []byte(part))
+	}
+	rsp, err := llms.GenerateContentStream(n.ctx, prompt, func(ctx context.Context, chunk []byte) error {
+		return show(ctx, explanation.Write(string(chunk)))
+	})
 	if err != nil {
+		printer.finish(shown.String())
 		logger.Error("NUWA TERMINAL: failed to generate content,", logger.Args("err", err.Error()))
-		return err
+		return "", err
+	}
+	show(n.ctx, explanation.Flush())
+	streamed := shown.Len() > 0
+	if streamed {
+		printer.finish(shown.String())
 	}
-	fmt.Println("NUWA: " + rsp)
 
-	cmd, err := parser.ParseCmdFromString(rsp)
+	answer, err := parser.ParseCmdResponse(rsp)
 	if err != nil {
+		if !streamed {
+			printer.finish(rsp)
+		}
 		logger.Error("NUWA TERMINAL: failed to parse command,", logger.Args("err", err.Error()))
-		return err
+		// an answer which can not be parsed must not come from the cache again
+		llms.Uncache(n.ctx, prompt)
+		return "", err
 	}
 
-	if cmd == "" {
-		logger.Info("NUWA TERMINAL: empty command")
-		return nil
+	// an answer which was not streamed, like a cached one, is shown at once
+	if !streamed {
+		printer.finish(answer.Explanation)
 	}
+	showCmdResponse(answer)
+	if answer.Command == "" {
+		logger.Info("NUWA TERMINAL: no command to run")
+	}
+	return answer.Command, nil
+}
 
-	output, err := cmdexe.ExecCommandWithOutput(cmd)
-	if err != nil {
-		logger.Error("NUWA TERMINAL: failed to execute command,", logger.Args("err", err.Error(), "output", output))
-		return err
+// showCmdResponse shows the risk and the alternatives of the command, the
+// command itself is shown when it is approved
+func showCmdResponse(answer *parser.CmdResponse) {
+	if answer.Command == "" {
+		return
+	}
+
+	var notes []string
+	switch answer.Risk {
+	case parser.RiskHigh:
+		notes = append(notes, pterm.FgRed.Sprint("risk: high"))
+	case parser.RiskMedium:
+		notes = append(notes, pterm.FgYellow.Sprint("risk: medium"))
+	case parser.RiskLow:
+		notes = append(notes, pterm.FgGreen.Sprint("risk: low"))
+	}
+	if answer.NeedsRoot {
+		notes = append(notes, pterm.FgYellow.Sprint("needs root"))
+	}
+	if len(notes) > 0 {
+		fmt.Println(strings.Join(notes, ", "))
+	}
+	if len(answer.Alternatives) > 0 {
+		pterm.FgGray.Println("Alternatives:")
+		for _, alternative := range answer.Alternatives {
+			pterm.FgGray.Println("  " + alternative)
+		}
 	}
-	fmt.Println(output)
-	return nil
 }
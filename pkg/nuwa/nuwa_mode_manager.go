@@ -1,8 +1,10 @@
 package nuwa
 
 import (
+	"context"
 	"os"
 
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/prompts"
 	"github.com/pterm/pterm"
 )
@@ -13,6 +15,10 @@ const (
 	TaskMode  = "taskmode"
 	AgentMode = "agentmode"
 	BashMode  = "bash"
+	// AutoMode sends every input to the mode which fits it
+	AutoMode = "automode"
+	// ScriptMode is not switchable, it is used when a .nw script is executed
+	ScriptMode = "scriptmode"
 )
 
 type NuwaModeManager interface {
@@ -23,7 +29,9 @@ type NuwaModeManager interface {
 	GetModePrefix(mode string) string
 	CheckDirChanged() bool
 	GetSysPrompt() string
+	GetModeSysPrompt(mode string) string
 	GetLivePrefix() (string, bool)
+	ResolveMode(ctx context.Context, input string) Route
 }
 
 type LivePrefix struct {
@@ -100,14 +108,20 @@ func (n *NuwaModeManagerImpl) CheckDirChanged() bool {
 }
 
 func (n *NuwaModeManagerImpl) GetSysPrompt() string {
+	return n.GetModeSysPrompt(n.currentMode)
+}
+
+// GetModeSysPrompt returns the system prompt of a mode, auto mode has none
+func (n *NuwaModeManagerImpl) GetModeSysPrompt(mode string) string {
 	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
-	switch n.currentMode {
+	switch mode {
 	case ChatMode:
 		return prompts.GetChatModePrompt()
 	case CmdMode:
 		return prompts.GetCmdModePrompt()
 	case TaskMode:
-		prompt, err := prompts.GetTaskModePrompt()
+		budget := llms.SystemInfoBudget(llms.WithMode(context.Background(), TaskMode))
+		prompt, err := prompts.GetTaskModePrompt(budget, llms.GetConfig().ScriptLanguage(), Interpreters().Languages())
 		if err != nil {
 			logger.Error("Failed to get task mode prompt:", logger.Args("err", err.Error()))
 			return ""
@@ -120,6 +134,15 @@ func (n *NuwaModeManagerImpl) GetSysPrompt() string {
 	}
 }
 
+// ResolveMode returns the mode handling the input: the current mode, or in
+// auto mode the mode chosen for the input.
+func (n *NuwaModeManagerImpl) ResolveMode(ctx context.Context, input string) Route {
+	if n.currentMode != AutoMode {
+		return Route{Mode: n.currentMode, Input: input}
+	}
+	return RouteInput(ctx, input)
+}
+
 func (n *NuwaModeManagerImpl) GetLivePrefix() (string, bool) {
 	return n.Prefix.Prefix, n.Prefix.IsEnable
 }
@@ -134,6 +157,8 @@ func GetModePrefix(mode string) string {
 		return TaskModePrefix
 	case AgentMode:
 		return AgentModePrefix
+	case AutoMode:
+		return AutoModePrefix
 	default:
 		return ChatModePrefix
 	}
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nmemory"
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/prompts"
 	"github.com/pterm/pterm"
 	lcllms "github.com/tmc/langchaingo/llms"
@@ -20,6 +21,7 @@ type NuwaScript struct {
 	currentDir   string
 	catchdir     string
 	scriptsdir   string
+	session      *nmemory.ChatHistory
 }
 
 func NewNuwaScript(ctx context.Context, systemPrompt string) (*NuwaScript, error) {
@@ -39,6 +41,11 @@ func NewNuwaScript(ctx context.Context, systemPrompt string) (*NuwaScript, error
 	}, nil
 }
 
+// SetSession makes the script record the generated shell script and its output into the session
+func (n *NuwaScript) SetSession(session *nmemory.ChatHistory) {
+	n.session = session
+}
+
 func (n *NuwaScript) Run(prompt string) error {
 	return n.handleNuwaScript(n.ctx, prompt)
 }
@@ -71,21 +78,23 @@ func (n *NuwaScript) handleNuwaScript(ctx context.Context, filepath string) erro
 
 	scriptPrompt := strings.Join(lines[0:], "\n")
 
-	prompt, err := prompts.GetScriptModePrompt()
+	prompt, err := prompts.GetScriptModePrompt(llms.SystemInfoBudget(ctx))
 	if err != nil {
 		logger.Error("NUWA TERMINAL: failed to get script mode prompt,", logger.Args("err", err.Error()))
 		return err
 	}
 	prompt = prompt + "\n" + scriptPrompt
 	// generate content
-	rsp, err := llms.GenerateContent(ctx, prompt)
+	rsp, err := generate(ctx, prompt)
 	if err != nil {
 		logger.Error("NUWA TERMINAL: failed to generate content,", logger.Args("err", err.Error()))
 		return err
 	}
-	fmt.Println("NUWA: " + rsp)
 
-	if err := parseScriptAndExecute(rsp); err != nil {
+	script, result, err := parseScriptAndExecute(ctx, rsp)
+	recordEntry(n.session, ScriptMode, nmemory.EntryScript, script)
+	recordResult(n.session, ScriptMode, result)
+	if err != nil {
 		logger.Error("NUWA TERMINAL: failed to parse script and execute,", logger.Args("err", err.Error()))
 		return err
 	}
@@ -3,8 +3,16 @@ package nuwa
 import (
 	"context"
 	"fmt"
+	"path/filepath"
 
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/cmdexe"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/interpreter"
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nmemory"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/prompts"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/scriptcheck"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/scriptlib"
+	"github.com/google/uuid"
 	"github.com/pterm/pterm"
 	lcllms "github.com/tmc/langchaingo/llms"
 )
@@ -18,6 +26,11 @@ type NuwaTask struct {
 	prefix       string
 	catchdir     string
 	scriptsdir   string
+	session      *nmemory.ChatHistory
+	reviewer     ScriptReviewer
+	// request is the input of the user, it is kept with the script in the library
+	request string
+	library *scriptlib.Library
 }
 
 func NewNuwaTask(ctx context.Context, systemPrompt string) (*NuwaTask, error) {
@@ -35,9 +48,32 @@ func NewNuwaTask(ctx context.Context, systemPrompt string) (*NuwaTask, error) {
 		prefix:       TaskModePrefix,
 		catchdir:     NuwaCatchDir,
 		scriptsdir:   NuwaScriptsDir,
+		reviewer:     NewInteractiveScriptReviewer(),
+		library:      scriptlib.NewLibrary(scriptlib.DefaultLibraryDir()),
 	}, nil
 }
 
+// SetRequest sets the input of the user the prompt is made of, the scripts
+// kept in the library are described by it
+func (n *NuwaTask) SetRequest(request string) {
+	n.request = request
+}
+
+// SetLibrary replaces the library the scripts which succeeded are kept in
+func (n *NuwaTask) SetLibrary(library *scriptlib.Library) {
+	n.library = library
+}
+
+// SetReviewer replaces the reviewer which confirms scripts before they run
+func (n *NuwaTask) SetReviewer(reviewer ScriptReviewer) {
+	n.reviewer = reviewer
+}
+
+// SetSession makes the task record its scripts and their output into the session
+func (n *NuwaTask) SetSession(session *nmemory.ChatHistory) {
+	n.session = session
+}
+
 func (n *NuwaTask) Run(prompt string) error {
 	return n.handleTaskMode(n.ctx, prompt)
 }
@@ -46,17 +82,198 @@ func (n *NuwaTask) Run(prompt string) error {
 func (n *NuwaTask) handleTaskMode(ctx context.Context, prompt string) error {
 	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
 
-	rsp, err := llms.GenerateContent(ctx, prompt)
+	for attempt := 0; ; attempt++ {
+		filename, script, err := n.generateScript(ctx, prompt)
+		if err != nil {
+			return err
+		}
+		if filename == "" {
+			logger.Info("NUWA TERMINAL: empty script")
+			return nil
+		}
+
+		review, filename, err := n.review(ctx, prompt, filename, script)
+		if err != nil {
+			return err
+		}
+		switch review.Decision {
+		case ScriptCancel:
+			logger.Info("NUWA TERMINAL: script cancelled")
+			return nil
+		case ScriptSave:
+			saved, err := n.keepScript(ctx, review.Name, filename, review.Script, prompt)
+			if err != nil {
+				return err
+			}
+			recordEntry(n.session, TaskMode, nmemory.EntryScript, review.Script)
+			logger.Info("NUWA TERMINAL: script saved, run it with: /scripts run " + saved.Name)
+			return nil
+		}
+
+		// only the approved script runs
+		script, result, err := executeScript(ctx, filename, review.Script)
+		recordEntry(n.session, TaskMode, nmemory.EntryScript, script)
+		recordResult(n.session, TaskMode, result)
+		if err == nil {
+			// a script which worked is kept to be run again
+			if kept, err := n.keepScript(ctx, "", filename, script, prompt); err != nil {
+				logger.Warn("NUWA TERMINAL: failed to keep script in the library,", logger.Args("err", err.Error()))
+			} else if result.Sandboxed {
+				ShowSandboxChanges(result)
+				logger.Info("NUWA TERMINAL: script kept, run it on the system with: /scripts run " + kept.Name)
+			} else {
+				n.recordRun(kept.Name, result)
+				logger.Info("NUWA TERMINAL: script kept, run it again with: /scripts run " + kept.Name)
+			}
+			return nil
+		}
+		logger.Error("NUWA TERMINAL: failed to execute script,", logger.Args("err", err.Error()))
+		// a failed script must not be answered from the cache again
+		llms.Uncache(ctx, prompt)
+
+		// the failed script and its result are sent to the model for a fixed script
+		failed := failedResult(err)
+		if failed == nil || !askRepair(attempt, failed) {
+			return err
+		}
+		prompt = prompt + "\n" + fmt.Sprintf(prompts.ScriptRepairPrompt, scriptLanguage(filename), script, failed.String())
+	}
+}
+
+// generateScript asks the model for a script and parses it from the answer
+func (n *NuwaTask) generateScript(ctx context.Context, prompt string) (string, string, error) {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	rsp, err := generate(ctx, prompt)
 	if err != nil {
 		logger.Error("NUWA TERMINAL: failed to generate content,", logger.Args("err", err.Error()))
-		return err
+		return "", "", err
+	}
+	filename, script, err := ParseScript(rsp)
+	if err != nil {
+		logger.Error("NUWA TERMINAL: failed to parse script,", logger.Args("err", err.Error()))
+		// an answer without a script must not be answered from the cache again
+		llms.Uncache(ctx, prompt)
+		return "", "", err
 	}
-	fmt.Println("NUWA: " + rsp)
+	filename, script = n.checkScript(ctx, prompt, filename, script)
+	return filename, script, nil
+}
 
-	if err := parseScriptAndExecute(rsp); err != nil {
-		logger.Error("NUWA TERMINAL: failed to parse script and execute,", logger.Args("err", err.Error()))
-		return err
+// checkScript checks the script before the user is asked to run it, the
+// findings are sent to the model for a fixed script as many times as a
+// failed script would be. The findings left are shown to the user. Only
+// shell scripts are checked.
+func (n *NuwaTask) checkScript(ctx context.Context, prompt, filename, script string) (string, string) {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	var findings []scriptcheck.Finding
+	for attempt := 0; ; attempt++ {
+		if runner, err := Interpreters().ForFile(filename); err != nil || !runner.Shell() {
+			return filename, script
+		}
+		findings = scriptcheck.Check(ctx, script)
+		if len(findings) == 0 {
+			return filename, script
+		}
+		if attempt >= maxRepairAttempts() {
+			break
+		}
+		logger.Info("NUWA TERMINAL: asking NUWA to fix the problems the checks found,", logger.Args("findings", len(findings)))
+
+		fix := prompt + "\n" + fmt.Sprintf(prompts.ScriptCheckPrompt, scriptLanguage(filename), script, scriptcheck.Report(findings))
+		rsp, err := generate(ctx, fix)
+		if err != nil {
+			logger.Warn("NUWA TERMINAL: failed to fix the script,", logger.Args("err", err.Error()))
+			break
+		}
+		fixedFile, fixed, err := ParseScript(rsp)
+		if err != nil {
+			logger.Warn("NUWA TERMINAL: failed to parse fixed script,", logger.Args("err", err.Error()))
+			llms.Uncache(ctx, fix)
+			break
+		}
+		filename, script = fixedFile, fixed
 	}
+	pterm.Warning.Println("The checks of the script found problems:\n" + scriptcheck.Report(findings))
+	return filename, script
+}
 
-	return nil
+// review shows the script to the user until it is run, saved or cancelled,
+// the script is revised by the model or tried in the sandbox as many times
+// as the user asks. The file name of the reviewed script is returned, a
+// revised script may be written in another language.
+func (n *NuwaTask) review(ctx context.Context, prompt, filename, script string) (ScriptReview, string, error) {
+	for {
+		review, err := n.reviewer.Review(script)
+		if err != nil {
+			return review, filename, err
+		}
+		switch review.Decision {
+		case ScriptTry:
+			n.tryScript(ctx, filename, review.Script)
+			script = review.Script
+		case ScriptRevise:
+			revision := prompt + "\n" + fmt.Sprintf(prompts.ScriptRevisePrompt, scriptLanguage(filename), review.Script, review.Instruction)
+			revisedFile, revised, err := n.generateScript(ctx, revision)
+			if err != nil {
+				return review, filename, err
+			}
+			filename, script = revisedFile, revised
+		default:
+			return review, filename, nil
+		}
+	}
+}
+
+// tryScript runs the script in the sandbox, the user sees what it does
+// before it runs on the system
+func (n *NuwaTask) tryScript(ctx context.Context, filename, script string) {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	logger.Info("NUWA TERMINAL: trying the script in the sandbox")
+	_, result, err := executeScript(cmdexe.WithSandbox(ctx, NewSandbox()), uuid.New().String()+filepath.Ext(filename), script)
+	recordEntry(n.session, TaskMode, nmemory.EntryScript, script)
+	recordResult(n.session, TaskMode, result)
+	if result != nil {
+		ShowSandboxChanges(result)
+	}
+	if err != nil {
+		logger.Warn("NUWA TERMINAL: the script failed in the sandbox,", logger.Args("err", err.Error()))
+	}
+}
+
+// keepScript adds the script to the library, with the request of the user,
+// the model which wrote it and its language
+func (n *NuwaTask) keepScript(ctx context.Context, name, filename, script, prompt string) (*scriptlib.Script, error) {
+	request := n.request
+	if request == "" {
+		request = prompt
+	}
+	model := ""
+	if profile, err := llms.CurrentProfile(ctx); err == nil {
+		model = profile.Model
+	}
+	kept := &scriptlib.Script{Name: name, Prompt: request, Model: model, Content: script}
+	if runner, err := Interpreters().ForFile(filename); err == nil && runner.Language != interpreter.DefaultLanguage {
+		kept.Language, kept.Extension = runner.Language, runner.Extension
+	}
+	return n.library.Add(kept)
+}
+
+// scriptLanguage returns the language of a script file, for the code blocks
+// of the prompts
+func scriptLanguage(filename string) string {
+	if runner, err := Interpreters().ForFile(filename); err == nil {
+		return runner.Language
+	}
+	return interpreter.DefaultLanguage
+}
+
+// recordRun adds the run to the history of the script in the library
+func (n *NuwaTask) recordRun(name string, result *cmdexe.ExecResult) {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+	if result == nil {
+		return
+	}
+	if err := n.library.RecordRun(name, scriptlib.Run{ExitCode: result.ExitCode, Duration: result.Duration}); err != nil {
+		logger.Warn("NUWA TERMINAL: failed to record script run,", logger.Args("err", err.Error()))
+	}
 }
@@ -0,0 +1,423 @@
+package nuwa
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/cmdexe"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/interpreter"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nmemory"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/scriptlib"
+	"github.com/stretchr/testify/assert"
+)
+
+// useFixture makes every mode answer with the scripted responses of the
+// fixture, the commands are approved automatically
+func useFixture(t *testing.T, fixture string) string {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fixture.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(fixture), 0o644))
+
+	for _, env := range []string{config.NuwaProfileEnv, config.CacheEnv, config.BackendEnv, config.ModelEnv, config.FixtureEnv, config.CassetteEnv, config.CassetteModeEnv} {
+		t.Setenv(env, "")
+	}
+	t.Setenv("HOME", dir)
+	t.Setenv(NuwaAutoApproveEnv, "1")
+	previous := llms.GetConfig()
+	llms.SetConfig(&config.Config{Profiles: map[string]*config.Profile{
+		"test": {Name: "test", Backend: llms.FakeBackend, Fixture: path},
+	}})
+	t.Cleanup(func() { llms.SetConfig(previous) })
+	return dir
+}
+
+func newTestSession(t *testing.T) *nmemory.ChatHistory {
+	return nmemory.NewFileChatHistory(nmemory.NewFileSessionStore(t.TempDir()), nmemory.NewSession())
+}
+
+// entries returns the contents of the session entries of a kind
+func entries(session *nmemory.ChatHistory, kind nmemory.EntryKind) []string {
+	contents := []string{}
+	for _, entry := range session.Session().Entries {
+		if entry.Kind == kind {
+			contents = append(contents, entry.Content)
+		}
+	}
+	return contents
+}
+
+func TestNuwaCmdRunsCommand(t *testing.T) {
+	dir := useFixture(t, `
+responses:
+  - content: '{"command": "echo hello > $HOME/out.txt", "explanation": "Writes hello to out.txt.", "risk": "medium"}'
+`)
+	ctx := llms.WithMode(context.Background(), CmdMode)
+	cmd, err := NewNuwaCmd(ctx, "write hello to a file")
+	assert.NoError(t, err)
+	session := newTestSession(t)
+	cmd.SetSession(session)
+
+	assert.NoError(t, cmd.Run("write hello to a file"))
+	out, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", string(out))
+	assert.Equal(t, []string{"echo hello > $HOME/out.txt"}, entries(session, nmemory.EntryCommand))
+}
+
+func TestNuwaCmdNoCommand(t *testing.T) {
+	useFixture(t, `
+responses:
+  - content: '{"command": "", "explanation": "This is a question, please use chatmode."}'
+`)
+	ctx := llms.WithMode(context.Background(), CmdMode)
+	cmd, err := NewNuwaCmd(ctx, "")
+	assert.NoError(t, err)
+	session := newTestSession(t)
+	cmd.SetSession(session)
+
+	assert.NoError(t, cmd.Run("who are you?"))
+	assert.Empty(t, entries(session, nmemory.EntryCommand))
+}
+
+// captureStdout returns what fn prints
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	fn()
+	os.Stdout = stdout
+	w.Close()
+	return <-out
+}
+
+func TestNuwaCmdStreamsExplanation(t *testing.T) {
+	useFixture(t, `
+responses:
+  - content: '{"command": "", "explanation": "This is a question, please use chatmode."}'
+`)
+	ctx := llms.WithMode(context.Background(), CmdMode)
+	cmd, err := NewNuwaCmd(ctx, "")
+	assert.NoError(t, err)
+
+	out := captureStdout(t, func() { assert.NoError(t, cmd.Run("who are you?")) })
+	// the explanation is shown once, without the JSON around it
+	assert.Equal(t, 1, strings.Count(out, "NUWA: This is a question, please use chatmode.\n"))
+	assert.NotContains(t, out, `"command"`)
+}
+
+func TestNuwaCmdRepairsFailedCommand(t *testing.T) {
+	dir := useFixture(t, `
+responses:
+  - match: "Exit code: 127"
+    content: "execute command: echo fixed > $HOME/out.txt"
+  - content: "execute command: nuwa-no-such-command"
+`)
+	ctx := llms.WithMode(context.Background(), CmdMode)
+	cmd, err := NewNuwaCmd(ctx, "")
+	assert.NoError(t, err)
+	session := newTestSession(t)
+	cmd.SetSession(session)
+
+	assert.NoError(t, cmd.Run("do it"))
+	out, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "fixed\n", string(out))
+	assert.Equal(t, []string{"nuwa-no-such-command", "echo fixed > $HOME/out.txt"}, entries(session, nmemory.EntryCommand))
+}
+
+func TestNuwaTaskRunsScript(t *testing.T) {
+	// the checks of the first script find problems, which the model fixes
+	dir := useFixture(t, "responses:\n"+
+		"  - match: \"checks of the script below found problems\"\n"+
+		"    content: \"```bash\\nset -euo pipefail\\necho task > ~/task.txt\\n```\"\n"+
+		"  - content: \"```bash\\necho task > $HOME/task.txt\\n```\"\n")
+	ctx := llms.WithMode(context.Background(), TaskMode)
+	task, err := NewNuwaTask(ctx, "")
+	assert.NoError(t, err)
+	session := newTestSession(t)
+	task.SetSession(session)
+
+	assert.NoError(t, task.Run("write task to a file"))
+	out, err := os.ReadFile(filepath.Join(dir, "task.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "task\n", string(out))
+	assert.Equal(t, []string{"set -euo pipefail\necho task > ~/task.txt"}, entries(session, nmemory.EntryScript))
+
+	// the script which worked is kept in the library with its run
+	kept, err := scriptlib.NewLibrary(scriptlib.DefaultLibraryDir()).Get("task-file")
+	assert.NoError(t, err)
+	assert.Equal(t, "set -euo pipefail\necho task > ~/task.txt", kept.Content)
+	assert.Len(t, kept.Runs, 1)
+}
+
+func TestNuwaTaskRunsPythonScript(t *testing.T) {
+	dir := useFixture(t, "responses:\n  - content: \"```python\\nimport os\\nopen(os.path.expanduser('~/task.txt'), 'w').write('python')\\n```\"\n")
+	if python, err := Interpreters().Lookup("python"); err != nil || python.Check() != nil {
+		t.Skip("python3 is not installed")
+	}
+	ctx := llms.WithMode(context.Background(), TaskMode)
+	task, err := NewNuwaTask(ctx, "")
+	assert.NoError(t, err)
+
+	assert.NoError(t, task.Run("write python to a file"))
+	out, err := os.ReadFile(filepath.Join(dir, "task.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "python", string(out))
+
+	// the library runs it with python again
+	library := scriptlib.NewLibrary(scriptlib.DefaultLibraryDir())
+	kept, err := library.Get("python-file")
+	assert.NoError(t, err)
+	assert.Equal(t, "python", kept.Language)
+	assert.Equal(t, ".py", filepath.Ext(library.Path(kept)))
+}
+
+func TestExecuteScriptRemovesFile(t *testing.T) {
+	dir := useFixture(t, "responses: []\n")
+
+	_, result, err := executeScript(context.Background(), "failing.sh", "echo failing\nexit 3\n")
+	assert.Error(t, err)
+	assert.Equal(t, 3, result.ExitCode)
+	// the temporary script is gone after a failure too, it is not in the library
+	_, err = os.Stat(filepath.Join(dir, NuwaCatchDir, NuwaScriptsDir, "failing.sh"))
+	assert.True(t, os.IsNotExist(err))
+	assert.NotEqual(t, filepath.Join(dir, NuwaCatchDir, NuwaScriptsDir), scriptlib.DefaultLibraryDir())
+}
+
+func TestNuwaTaskUnsupportedLanguage(t *testing.T) {
+	useFixture(t, "responses:\n  - content: \"```cobol\\nDISPLAY 'HELLO'.\\n```\"\n")
+	ctx := llms.WithMode(context.Background(), TaskMode)
+	task, err := NewNuwaTask(ctx, "")
+	assert.NoError(t, err)
+
+	err = task.Run("say hello")
+	assert.ErrorIs(t, err, interpreter.ErrUnsupportedLanguage)
+	assert.ErrorContains(t, err, "no interpreter for cobol")
+}
+
+// scriptedReviewer gives its reviews in order and keeps the scripts it was shown
+type scriptedReviewer struct {
+	reviews []ScriptReview
+	shown   []string
+}
+
+func (r *scriptedReviewer) Review(script string) (ScriptReview, error) {
+	r.shown = append(r.shown, script)
+	review := r.reviews[0]
+	r.reviews = r.reviews[1:]
+	if review.Script == "" {
+		review.Script = script
+	}
+	return review, nil
+}
+
+func TestNuwaTaskReviewsScript(t *testing.T) {
+	dir := useFixture(t, "responses:\n"+
+		"  - match: \"wants this change: write revised\"\n"+
+		"    content: \"```bash\\nset -euo pipefail\\necho revised > ~/task.txt\\n```\"\n"+
+		"  - content: \"```bash\\nset -euo pipefail\\necho task > ~/task.txt\\n```\"\n")
+	ctx := llms.WithMode(context.Background(), TaskMode)
+	task, err := NewNuwaTask(ctx, "")
+	assert.NoError(t, err)
+	session := newTestSession(t)
+	task.SetSession(session)
+
+	// the script is revised by the model, then edited by the user before it runs
+	reviewer := &scriptedReviewer{reviews: []ScriptReview{
+		{Decision: ScriptRevise, Instruction: "write revised"},
+		{Decision: ScriptRun, Script: "echo edited > $HOME/task.txt\n"},
+	}}
+	task.SetReviewer(reviewer)
+	assert.NoError(t, task.Run("write task to a file"))
+	assert.Equal(t, []string{"set -euo pipefail\necho task > ~/task.txt", "set -euo pipefail\necho revised > ~/task.txt"}, reviewer.shown)
+	out, err := os.ReadFile(filepath.Join(dir, "task.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "edited\n", string(out))
+	assert.Equal(t, []string{"echo edited > $HOME/task.txt\n"}, entries(session, nmemory.EntryScript))
+}
+
+func TestNuwaTaskTriesScript(t *testing.T) {
+	dir := useFixture(t, "responses:\n  - content: \"```bash\\nset -euo pipefail\\necho task >> ~/task.txt\\n```\"\n")
+	if _, err := cmdexe.RunCommand(cmdexe.WithSandbox(context.Background(), NewSandbox()), "true"); err != nil {
+		t.Skipf("no sandbox on this system: %v", err)
+	}
+	ctx := llms.WithMode(context.Background(), TaskMode)
+	task, err := NewNuwaTask(ctx, "")
+	assert.NoError(t, err)
+
+	// the script is tried in the sandbox first, then it runs on the system
+	reviewer := &scriptedReviewer{reviews: []ScriptReview{{Decision: ScriptTry}, {Decision: ScriptRun}}}
+	task.SetReviewer(reviewer)
+	assert.NoError(t, task.Run("append task to a file"))
+	assert.Len(t, reviewer.shown, 2)
+	out, err := os.ReadFile(filepath.Join(dir, "task.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "task\n", string(out))
+}
+
+func TestNuwaTaskSavesScript(t *testing.T) {
+	dir := useFixture(t, "responses:\n  - content: \"```bash\\nset -euo pipefail\\necho task > ~/task.txt\\n```\"\n")
+	ctx := llms.WithMode(context.Background(), TaskMode)
+	task, err := NewNuwaTask(ctx, "")
+	assert.NoError(t, err)
+	task.SetRequest("write task to a file")
+	task.SetReviewer(&scriptedReviewer{reviews: []ScriptReview{{Decision: ScriptSave, Name: "write-task"}}})
+
+	assert.NoError(t, task.Run("prompt of write task to a file"))
+	saved, err := scriptlib.NewLibrary(scriptlib.DefaultLibraryDir()).Get("write-task")
+	assert.NoError(t, err)
+	assert.Equal(t, "set -euo pipefail\necho task > ~/task.txt", saved.Content)
+	assert.Equal(t, "write task to a file", saved.Prompt)
+	assert.Empty(t, saved.Runs)
+	// the script did not run
+	_, err = os.Stat(filepath.Join(dir, "task.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNuwaAgentLoop(t *testing.T) {
+	useFixture(t, `
+responses:
+  - match: "Observation: agent-ok"
+    content: "Thought: I now know the final answer\nFinal Answer: the system is fine"
+  - content: "Thought: check the system\nAction: ScriptExecutor\nAction_input:\n`+"```bash\\necho agent-ok\\n```"+`"
+`)
+	ctx := llms.WithMode(context.Background(), AgentMode)
+	agent, err := NewNuwaAgent(ctx, "")
+	assert.NoError(t, err)
+	session := newTestSession(t)
+	agent.SetSession(session)
+
+	assert.NoError(t, agent.Run("is the system fine?"))
+	assert.Equal(t, []string{" the system is fine"}, entries(session, nmemory.EntryAI))
+	steps := entries(session, nmemory.EntryAgent)
+	assert.Len(t, steps, 1)
+	assert.Contains(t, steps[0], "Observation: agent-ok")
+}
+
+func TestNuwaAgentChecksScript(t *testing.T) {
+	dir := useFixture(t, `
+responses:
+  - match: "Observation: The script was not run"
+    content: "Thought: I now know the final answer\nFinal Answer: the tool is missing"
+  - content: "Thought: check the system\nAction: ScriptExecutor\nAction_input:\n`+"```bash\\ntouch ~/ran\\nif true; then\\n  nuwa-no-such-tool\\n```"+`"
+`)
+	ctx := llms.WithMode(context.Background(), AgentMode)
+	agent, err := NewNuwaAgent(ctx, "")
+	assert.NoError(t, err)
+	session := newTestSession(t)
+	agent.SetSession(session)
+
+	assert.NoError(t, agent.Run("is the system fine?"))
+	steps := entries(session, nmemory.EntryAgent)
+	assert.Len(t, steps, 1)
+	assert.Contains(t, steps[0], "(syntax)")
+	// the script with errors did not run
+	_, err = os.Stat(filepath.Join(dir, "ran"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNuwaAgentToolCalls(t *testing.T) {
+	useFixture(t, `
+responses:
+  - match: "tool: agent-ok"
+    content: "the system is fine"
+  - content: "check the system"
+    tool_calls:
+      - name: ScriptExecutor
+        arguments: '{"script": "#!/bin/bash\necho agent-ok\n"}'
+`)
+	toolCalls := true
+	llms.GetConfig().Profiles["test"].ToolCalls = &toolCalls
+	ctx := llms.WithMode(context.Background(), AgentMode)
+	agent, err := NewNuwaAgent(ctx, "")
+	assert.NoError(t, err)
+	session := newTestSession(t)
+	agent.SetSession(session)
+
+	assert.NoError(t, agent.Run("is the system fine?"))
+	assert.Equal(t, []string{"the system is fine"}, entries(session, nmemory.EntryAI))
+	steps := entries(session, nmemory.EntryAgent)
+	assert.Len(t, steps, 1)
+	assert.Contains(t, steps[0], "Action: ScriptExecutor\nAction_input: \n#!/bin/bash\necho agent-ok")
+	assert.Contains(t, steps[0], "Observation: agent-ok")
+}
+
+func TestNuwaChatKeepsHistory(t *testing.T) {
+	useFixture(t, `
+responses:
+  - match: "I am NUWA(.|\n)*what did I ask"
+    content: "You asked who I am."
+  - content: "I am NUWA"
+`)
+	ctx := llms.WithMode(context.Background(), ChatMode)
+	chat, err := NewNuwaChat(ctx, "You are NUWA")
+	assert.NoError(t, err)
+
+	answer, err := chat.Chat(ctx, "who are you?")
+	assert.NoError(t, err)
+	assert.Equal(t, "I am NUWA", answer)
+	answer, err = chat.Chat(ctx, "what did I ask?")
+	assert.NoError(t, err)
+	assert.Equal(t, "You asked who I am.", answer)
+}
+
+func TestRouteInput(t *testing.T) {
+	useFixture(t, `
+responses:
+  - match: "user: back up my photos"
+    content: "task"
+  - match: "user: make a backup"
+    content: "task"
+  - match: "user: install nginx"
+    content: "task"
+  - match: "user: (ls the files|test whether)"
+    content: "agent"
+  - content: "Agent."
+`)
+	ctx := context.Background()
+	for input, expected := range map[string]Route{
+		"# show disk usage":                 {Mode: CmdMode, Input: "show disk usage", By: RouteByPrefix},
+		"& why is nginx down":               {Mode: AgentMode, Input: "why is nginx down", By: RouteByPrefix},
+		"how do I list hidden files":        {Mode: ChatMode, Input: "how do I list hidden files", By: RouteByHeuristic},
+		"is docker running?":                {Mode: ChatMode, Input: "is docker running?", By: RouteByHeuristic},
+		"ls -la /tmp":                       {Mode: CmdMode, Input: "ls -la /tmp", By: RouteByHeuristic},
+		"cd /var/log":                       {Mode: CmdMode, Input: "cd /var/log", By: RouteByHeuristic},
+		"write a script to clean logs":      {Mode: TaskMode, Input: "write a script to clean logs", By: RouteByHeuristic},
+		"troubleshoot the slow disk":        {Mode: AgentMode, Input: "troubleshoot the slow disk", By: RouteByHeuristic},
+		"back up my photos":                 {Mode: TaskMode, Input: "back up my photos", By: RouteByModel},
+		"nginx keeps restarting":            {Mode: AgentMode, Input: "nginx keeps restarting", By: RouteByModel},
+		"cd":                                {Mode: CmdMode, Input: "cd", By: RouteByHeuristic},
+		"echo $HOME is where I live":        {Mode: CmdMode, Input: "echo $HOME is where I live", By: RouteByHeuristic},
+		"ls the files of my home directory": {Mode: AgentMode, Input: "ls the files of my home directory", By: RouteByModel},
+		// sentences starting with the name of a command go to the model
+		"make a backup of my photos":      {Mode: TaskMode, Input: "make a backup of my photos", By: RouteByModel},
+		"install nginx and configure TLS": {Mode: TaskMode, Input: "install nginx and configure TLS", By: RouteByModel},
+		"test whether port 80 is open":    {Mode: AgentMode, Input: "test whether port 80 is open", By: RouteByModel},
+	} {
+		assert.Equal(t, expected, RouteInput(ctx, input), input)
+	}
+}
+
+func TestEditInEditor(t *testing.T) {
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", "sed -i s/task/edited/")
+	edited, err := EditInEditor("echo task\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "echo edited\n", edited)
+
+	t.Setenv("EDITOR", "false")
+	_, err = EditInEditor("echo task\n")
+	assert.ErrorContains(t, err, "editor false failed")
+}
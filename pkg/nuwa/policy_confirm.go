@@ -0,0 +1,53 @@
+package nuwa
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/cmdexe"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/policy"
+	"github.com/pterm/pterm"
+)
+
+// SetupPolicy loads the policy file and puts it in front of everything nuwa executes.
+func SetupPolicy(path string) error {
+	cfg, err := policy.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	engine, err := policy.NewEngine(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to load policy %s: %w", path, err)
+	}
+	cmdexe.SetPolicy(engine, ConfirmPolicy)
+	return nil
+}
+
+// ConfirmPolicy shows why the policy flagged a command and asks whether it
+// may run anyway. The command is blocked if there is no terminal to ask on.
+func ConfirmPolicy(command string, decision policy.Decision) bool {
+	if !isTerminal(os.Stdin) {
+		return false
+	}
+
+	findings := []string{}
+	for _, f := range decision.Findings {
+		findings = append(findings, fmt.Sprintf("[%s] %s: %s", f.Level, f.Category, f.Reason))
+	}
+	if decision.Rule != nil {
+		findings = append(findings, decision.Reason())
+	}
+	pterm.Warning.Println("The command is " + decision.Level.String() + " risk:\n" + strings.Join(findings, "\n"))
+	pterm.DefaultBox.WithTitle("Command to run").Println(command)
+
+	interrupted := false
+	confirmed, err := pterm.DefaultInteractiveConfirm.
+		WithDefaultValue(false).
+		WithOnInterruptFunc(func() { interrupted = true }).
+		Show("Run it anyway?")
+	if err != nil || interrupted {
+		return false
+	}
+	return confirmed
+}
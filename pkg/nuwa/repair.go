@@ -0,0 +1,76 @@
+package nuwa
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/cmdexe"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/nmemory"
+	"github.com/pterm/pterm"
+)
+
+const (
+	// NuwaMaxRepairAttemptsEnv sets how many times a failed command or script
+	// can be sent back to the model for a fix, 0 disables it.
+	NuwaMaxRepairAttemptsEnv = "NUWA_MAX_REPAIR_ATTEMPTS"
+	defaultMaxRepairAttempts = 2
+)
+
+func maxRepairAttempts() int {
+	value := os.Getenv(NuwaMaxRepairAttemptsEnv)
+	if value == "" {
+		return defaultMaxRepairAttempts
+	}
+	attempts, err := strconv.Atoi(value)
+	if err != nil || attempts < 0 {
+		logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
+		logger.Warn("NUWA TERMINAL: invalid "+NuwaMaxRepairAttemptsEnv+", using the default,", logger.Args("value", value))
+		return defaultMaxRepairAttempts
+	}
+	return attempts
+}
+
+// failedResult returns the result of a command which ran and failed, it is
+// nil for other errors like a command blocked by the policy.
+func failedResult(err error) *cmdexe.ExecResult {
+	var exitErr *cmdexe.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Result
+	}
+	return nil
+}
+
+// askRepair asks whether the failure should be sent to the model for a fix.
+// Without a terminal, it is only sent when commands are approved automatically.
+func askRepair(attempt int, result *cmdexe.ExecResult) bool {
+	if attempt >= maxRepairAttempts() {
+		return false
+	}
+	if autoApprove() {
+		return true
+	}
+	if !isTerminal(os.Stdin) {
+		return false
+	}
+
+	interrupted := false
+	repair, err := pterm.DefaultInteractiveConfirm.
+		WithDefaultValue(true).
+		WithOnInterruptFunc(func() { interrupted = true }).
+		Show(fmt.Sprintf("It failed with exit code %d, ask NUWA to fix it? (attempt %d of %d)", result.ExitCode, attempt+1, maxRepairAttempts()))
+	return err == nil && !interrupted && repair
+}
+
+// recordResult records the output of a command, the whole result if it failed
+func recordResult(session *nmemory.ChatHistory, mode string, result *cmdexe.ExecResult) {
+	if result == nil {
+		return
+	}
+	if result.Failed() {
+		recordEntry(session, mode, nmemory.EntryOutput, result.String())
+		return
+	}
+	recordEntry(session, mode, nmemory.EntryOutput, result.Output())
+}
@@ -0,0 +1,40 @@
+package nuwa
+
+import (
+	"context"
+	"strings"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/cmdexe"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
+	"github.com/pterm/pterm"
+)
+
+// NewSandbox returns the sandbox with the limits of the config.
+func NewSandbox() *cmdexe.Sandbox {
+	settings := llms.GetConfig().SandboxSettings()
+	return &cmdexe.Sandbox{
+		Network:   settings.Network,
+		CPUTime:   settings.CPUTime,
+		Memory:    int64(settings.MemoryMB) << 20,
+		MaxOutput: settings.MaxOutput,
+	}
+}
+
+// WithModeSandbox returns a context whose commands and scripts run in the
+// sandbox if the config puts the mode in it.
+func WithModeSandbox(ctx context.Context, mode string) context.Context {
+	if !llms.GetConfig().Sandboxed(mode) {
+		return ctx
+	}
+	return cmdexe.WithSandbox(ctx, NewSandbox())
+}
+
+// ShowSandboxChanges shows the files a command wrote or deleted in the
+// sandbox, they were dropped with it.
+func ShowSandboxChanges(result *cmdexe.ExecResult) {
+	if len(result.SandboxChanges) == 0 {
+		pterm.Info.Println("The script changed no files in the sandbox")
+		return
+	}
+	pterm.DefaultBox.WithTitle("Changes in the sandbox, dropped").Println(strings.Join(result.SandboxChanges, "\n"))
+}
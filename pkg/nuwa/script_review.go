@@ -0,0 +1,219 @@
+package nuwa
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/scriptlib"
+	"github.com/pterm/pterm"
+)
+
+// ScriptDecision is what the user decided to do with a generated script.
+type ScriptDecision int
+
+const (
+	// ScriptRun runs the (possibly edited) script.
+	ScriptRun ScriptDecision = iota
+	// ScriptRevise asks the model to change the script as the instruction says.
+	ScriptRevise
+	// ScriptSave keeps the script in the script library without running it.
+	ScriptSave
+	// ScriptCancel drops the script.
+	ScriptCancel
+	// ScriptTry runs the script in the sandbox, then it is reviewed again.
+	ScriptTry
+)
+
+const (
+	reviewRun    = "Run"
+	reviewTry    = "Try in the sandbox"
+	reviewEdit   = "Edit in $EDITOR"
+	reviewRevise = "Ask NUWA to revise"
+	reviewSave   = "Save to the library without running"
+	reviewCancel = "Cancel"
+
+	// defaultEditor is used when neither $VISUAL nor $EDITOR is set
+	defaultEditor = "vi"
+)
+
+// ScriptReview is the decision of the user about a script.
+type ScriptReview struct {
+	Decision ScriptDecision
+	// Script is the script to run or save, the user may have edited it
+	Script string
+	// Instruction tells the model how to revise the script
+	Instruction string
+	// Name is the name of a saved script in the library, it is made of the
+	// request when empty
+	Name string
+}
+
+// ScriptReviewer decides whether a script generated by the model may run.
+type ScriptReviewer interface {
+	Review(script string) (ScriptReview, error)
+}
+
+// InteractiveScriptReviewer shows the script on the terminal and asks what to do with it.
+type InteractiveScriptReviewer struct{}
+
+func NewInteractiveScriptReviewer() *InteractiveScriptReviewer {
+	return &InteractiveScriptReviewer{}
+}
+
+// Review shows the script and lets the user run, try, edit, revise, save
+// or cancel it. An edited script is shown again, so the user always approves
+// what is run.
+func (r *InteractiveScriptReviewer) Review(script string) (ScriptReview, error) {
+	if autoApprove() {
+		return ScriptReview{Decision: ScriptRun, Script: script}, nil
+	}
+	if !isTerminal(os.Stdin) {
+		return ScriptReview{Decision: ScriptCancel, Script: script}, ErrNoTerminal
+	}
+
+	for {
+		pterm.DefaultBox.WithTitle("Script to run").Println(highlightShell(script))
+
+		interrupted := false
+		choice, err := pterm.DefaultInteractiveSelect.
+			WithOptions([]string{reviewRun, reviewTry, reviewEdit, reviewRevise, reviewSave, reviewCancel}).
+			WithDefaultOption(reviewRun).
+			WithOnInterruptFunc(func() { interrupted = true }).
+			Show("Run this script?")
+		if err != nil {
+			return ScriptReview{Decision: ScriptCancel, Script: script}, fmt.Errorf("failed to read review: %w", err)
+		}
+		if interrupted {
+			return ScriptReview{Decision: ScriptCancel, Script: script}, nil
+		}
+
+		switch choice {
+		case reviewRun:
+			return ScriptReview{Decision: ScriptRun, Script: script}, nil
+		case reviewCancel:
+			return ScriptReview{Decision: ScriptCancel, Script: script}, nil
+		case reviewTry:
+			return ScriptReview{Decision: ScriptTry, Script: script}, nil
+		case reviewEdit:
+			edited, err := EditInEditor(script)
+			if err != nil {
+				pterm.Error.Println("Failed to edit the script: " + err.Error())
+				continue
+			}
+			script = edited
+		case reviewRevise:
+			instruction, err := pterm.DefaultInteractiveTextInput.
+				WithOnInterruptFunc(func() { interrupted = true }).
+				Show("How should the script change")
+			if err != nil {
+				return ScriptReview{Decision: ScriptCancel, Script: script}, fmt.Errorf("failed to read instruction: %w", err)
+			}
+			if interrupted {
+				return ScriptReview{Decision: ScriptCancel, Script: script}, nil
+			}
+			if strings.TrimSpace(instruction) != "" {
+				return ScriptReview{Decision: ScriptRevise, Script: script, Instruction: strings.TrimSpace(instruction)}, nil
+			}
+		case reviewSave:
+			name, err := pterm.DefaultInteractiveTextInput.
+				WithOnInterruptFunc(func() { interrupted = true }).
+				Show("Name of the script (empty for a name made of the request)")
+			if err != nil {
+				return ScriptReview{Decision: ScriptCancel, Script: script}, fmt.Errorf("failed to read name: %w", err)
+			}
+			if interrupted {
+				return ScriptReview{Decision: ScriptCancel, Script: script}, nil
+			}
+			name = strings.TrimSpace(name)
+			if name != "" {
+				if err := scriptlib.CheckName(name); err != nil {
+					pterm.Error.Println(err.Error())
+					continue
+				}
+			}
+			return ScriptReview{Decision: ScriptSave, Script: script, Name: name}, nil
+		}
+	}
+}
+
+// editorCommand returns the editor of the user with its arguments, like
+// "code --wait"
+func editorCommand() []string {
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if fields := strings.Fields(os.Getenv(env)); len(fields) > 0 {
+			return fields
+		}
+	}
+	return []string{defaultEditor}
+}
+
+// EditInEditor opens the script in the editor of the user and returns it
+// as it was saved.
+func EditInEditor(script string) (string, error) {
+	file, err := os.CreateTemp("", "nuwa-script-*.sh")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary script: %w", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(script); err != nil {
+		file.Close()
+		return "", fmt.Errorf("failed to write temporary script: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("failed to write temporary script: %w", err)
+	}
+
+	editor := editorCommand()
+	cmd := exec.Command(editor[0], append(editor[1:], file.Name())...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor %s failed: %w", editor[0], err)
+	}
+
+	edited, err := os.ReadFile(file.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to read edited script: %w", err)
+	}
+	if strings.TrimSpace(string(edited)) == "" {
+		return "", fmt.Errorf("the edited script is empty")
+	}
+	return string(edited), nil
+}
+
+var (
+	shellToken = regexp.MustCompile(`(?:^|\s)#.*$|"(?:[^"\\]|\\.)*"|'[^']*'|\$\{[^}]*\}|\$\w+|\$[?#@*0-9]|[A-Za-z_][\w-]*`)
+	// shellKeywords are highlighted in scripts
+	shellKeywords = map[string]bool{
+		"if": true, "then": true, "else": true, "elif": true, "fi": true, "for": true,
+		"while": true, "until": true, "do": true, "done": true, "case": true, "esac": true,
+		"in": true, "function": true, "return": true, "exit": true, "local": true,
+		"export": true, "set": true,
+	}
+)
+
+// highlightShell colors the comments, strings, variables and keywords of a
+// shell script for the terminal
+func highlightShell(script string) string {
+	lines := strings.Split(script, "\n")
+	for i, line := range lines {
+		lines[i] = shellToken.ReplaceAllStringFunc(line, func(token string) string {
+			switch {
+			case strings.HasPrefix(strings.TrimSpace(token), "#"):
+				return pterm.FgGray.Sprint(token)
+			case strings.HasPrefix(token, `"`) || strings.HasPrefix(token, "'"):
+				return pterm.FgGreen.Sprint(token)
+			case strings.HasPrefix(token, "$"):
+				return pterm.FgCyan.Sprint(token)
+			case shellKeywords[token]:
+				return pterm.FgMagenta.Sprint(token)
+			}
+			return token
+		})
+	}
+	return strings.Join(lines, "\n")
+}
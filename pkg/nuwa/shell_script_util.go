@@ -1,50 +1,73 @@
 package nuwa
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/cmdexe"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/interpreter"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/parser"
 	"github.com/google/uuid"
 	"github.com/pterm/pterm"
 )
 
-func parseScriptAndExecute(rsp string) error {
+// parseScriptAndExecute parses the script from the LLM response and executes it,
+// the script content and the result of its execution are returned.
+func parseScriptAndExecute(ctx context.Context, rsp string) (string, *cmdexe.ExecResult, error) {
 	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
 
 	filename, content, err := ParseScript(rsp)
 	if err != nil {
 		logger.Error("NUWA TERMINAL: failed to parse script,", logger.Args("err", err.Error()))
-		return err
+		return "", nil, err
 	}
 
 	if filename == "" {
 		logger.Info("NUWA TERMINAL: empty script")
-		return nil
+		return "", nil, nil
 	}
+	return executeScript(ctx, filename, content)
+}
+
+// executeScript saves the script to the file and executes it, the file is
+// removed after the run
+func executeScript(ctx context.Context, filename, content string) (string, *cmdexe.ExecResult, error) {
+	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
 
 	scriptfile, err := prepareScriptFile(filename, content)
 	if err != nil {
 		logger.Error("NUWA TERMINAL: failed to prepare script file,", logger.Args("err", err.Error()))
-		return err
+		return content, nil, err
 	}
-
-	output, err := cmdexe.ExecScriptWithOutput(scriptfile)
+	defer func() {
+		if err := os.Remove(scriptfile); err != nil {
+			logger.Error("NUWA TERMINAL: failed to remove script file,", logger.Args("err", err.Error()))
+			return
+		}
+		logger.Info("NUWA TERMINAL: script file removed")
+	}()
+
+	interpreter, err := Interpreters().ForFile(filename)
 	if err != nil {
-		logger.Error("NUWA TERMINAL: failed to execute script,", logger.Args("err", err.Error()), logger.Args("output", output))
-		return err
+		logger.Error("NUWA TERMINAL: failed to find script interpreter,", logger.Args("err", err.Error()))
+		return content, nil, err
 	}
-
-	logger.Info("NUWA TERMINAL: script output", logger.Args("output", output))
-
-	if err := os.Remove(scriptfile); err != nil {
-		logger.Error("NUWA TERMINAL: failed to remove script file,", logger.Args("err", err.Error()))
-		return err
+	result, err := interpreter.Run(ctx, scriptfile)
+	if result != nil {
+		// the script file is temporary, only its name is kept
+		result.Command = filename
+	}
+	if err != nil {
+		logger.Error("NUWA TERMINAL: failed to execute script,", logger.Args("err", err.Error()))
+		return content, result, err
 	}
-	logger.Info("NUWA TERMINAL: script file removed")
-	return nil
+
+	// the output was shown while the script ran
+	logger.Info("NUWA TERMINAL: script executed")
+	return content, result, nil
 }
 
 // prepareScriptFile 准备脚本文件
@@ -68,8 +91,15 @@ func prepareScriptFile(filename, content string) (string, error) {
 	return scriptfile, nil
 }
 
+// Interpreters returns the registry of the interpreters of the config.
+func Interpreters() *interpreter.Registry {
+	return interpreter.FromConfig(llms.GetConfig())
+}
+
 // ParseScript parses the code from the LLM response and returns the filename and content of the first source file.
-// If there are no source files found or if there is an error parsing the code, an error is returned.
+// The extension of the filename is the one of the interpreter of the language of the code block.
+// If there are no source files found, if there is an error parsing the code or if no interpreter
+// runs its language, an error is returned.
 func ParseScript(response string) (filename, content string, err error) {
 	logger := pterm.DefaultLogger.WithLevel(pterm.LogLevelTrace)
 	parser := parser.NewGoCodeParser()
@@ -84,8 +114,13 @@ func ParseScript(response string) (filename, content string, err error) {
 		return "", "", fmt.Errorf("no source files found")
 	}
 
-	sources[0].FileName = uuid.New().String() + ".sh"
 	sources[0].ParseFileContent()
+	interpreter, err := Interpreters().Lookup(sources[0].Language)
+	if err != nil {
+		logger.Error("No interpreter for the script in LLM response, error:", logger.Args("err", err.Error()))
+		return "", "", err
+	}
+	sources[0].FileName = uuid.New().String() + interpreter.Extension
 
 	filename = sources[0].FileName
 	content = sources[0].FileContent
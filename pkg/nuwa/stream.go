@@ -0,0 +1,119 @@
+package nuwa
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/llms"
+	"github.com/pterm/pterm"
+	"github.com/tmc/langchaingo/callbacks"
+	"golang.org/x/term"
+)
+
+// streamPrinter shows an answer while it is generated, with a spinner until
+// the first chunk arrives
+type streamPrinter struct {
+	prefix  string
+	spinner *pterm.SpinnerPrinter
+	started bool
+}
+
+// newStreamPrinter starts the spinner, the spinner is only shown on a terminal
+func newStreamPrinter(prefix string, waiting string) *streamPrinter {
+	p := &streamPrinter{prefix: prefix}
+	p.wait(waiting)
+	return p
+}
+
+func (p *streamPrinter) wait(text string) {
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		return
+	}
+	spinner, err := pterm.DefaultSpinner.WithRemoveWhenDone(true).Start(text)
+	if err == nil {
+		p.spinner = spinner
+	}
+}
+
+func (p *streamPrinter) stopSpinner() {
+	if p.spinner != nil {
+		p.spinner.Stop()
+		p.spinner = nil
+	}
+}
+
+// write shows a chunk of the answer, the first one replaces the spinner
+func (p *streamPrinter) write(ctx context.Context, chunk []byte) error {
+	if !p.started {
+		p.stopSpinner()
+		fmt.Print(p.prefix)
+		p.started = true
+	}
+	fmt.Print(string(chunk))
+	return nil
+}
+
+// finish ends the answer, an answer which was not streamed, like a cached
+// one, is shown at once
+func (p *streamPrinter) finish(answer string) {
+	p.stopSpinner()
+	if !p.started {
+		if answer != "" {
+			fmt.Println(p.prefix + answer)
+		}
+		return
+	}
+	if !strings.HasSuffix(answer, "\n") {
+		fmt.Println()
+	}
+	p.started = false
+}
+
+// generate asks the model of the mode in the context, the answer is shown
+// while it is generated
+func generate(ctx context.Context, prompt string) (string, error) {
+	printer := newStreamPrinter("NUWA: ", "NUWA is thinking...")
+	rsp, err := llms.GenerateContentStream(ctx, prompt, printer.write)
+	printer.finish(rsp)
+	return rsp, err
+}
+
+// agentView shows the steps of an agent while it runs: the thought and
+// action of every step as they are generated, then the tool running
+type agentView struct {
+	callbacks.SimpleHandler
+	printer *streamPrinter
+	step    int
+}
+
+var _ callbacks.Handler = &agentView{}
+
+func newAgentView() *agentView {
+	return &agentView{printer: &streamPrinter{}}
+}
+
+// HandleChainStart is called when the agent asks the model for its next step.
+func (v *agentView) HandleChainStart(ctx context.Context, inputs map[string]any) {
+	v.step++
+	pterm.FgCyan.Printfln("Step %d", v.step)
+	v.printer.wait("NUWA is thinking...")
+}
+
+func (v *agentView) HandleStreamingFunc(ctx context.Context, chunk []byte) {
+	v.printer.write(ctx, chunk)
+}
+
+func (v *agentView) HandleChainEnd(ctx context.Context, outputs map[string]any) {
+	text, _ := outputs["text"].(string)
+	v.printer.finish(text)
+}
+
+func (v *agentView) HandleChainError(ctx context.Context, err error) {
+	v.printer.finish("")
+}
+
+func (v *agentView) HandleToolStart(ctx context.Context, input string) {
+	pterm.FgGray.Println("Running the script, its output follows:")
+}
@@ -1,24 +1,229 @@
 package parser
 
 import (
+	"encoding/json"
 	"fmt"
-	"log/slog"
-	"os"
 	"regexp"
+	"strings"
+	"unicode/utf8"
 )
 
+// Risk levels of a command in a CmdResponse.
+const (
+	RiskLow    = "low"
+	RiskMedium = "medium"
+	RiskHigh   = "high"
+)
+
+// CmdResponseSchema is the JSON schema of the answers of cmd mode.
+const CmdResponseSchema = `{
+  "type": "object",
+  "properties": {
+    "command": {"type": "string", "description": "the linux command to execute, empty if the input is not a command request"},
+    "explanation": {"type": "string", "description": "what the command does, or why there is no command"},
+    "risk": {"type": "string", "enum": ["low", "medium", "high"], "description": "how much harm the command can do"},
+    "needs_root": {"type": "boolean", "description": "whether the command must run as root"},
+    "alternatives": {"type": "array", "items": {"type": "string"}, "description": "other commands doing the same"}
+  },
+  "required": ["command", "explanation"]
+}`
+
+// CmdResponse is the answer of the model in cmd mode. An empty Command
+// means the model refused or the input was not a command request, the
+// Explanation tells why.
+type CmdResponse struct {
+	Command      string   `json:"command"`
+	Explanation  string   `json:"explanation"`
+	Risk         string   `json:"risk,omitempty"`
+	NeedsRoot    bool     `json:"needs_root,omitempty"`
+	Alternatives []string `json:"alternatives,omitempty"`
+}
+
+// Validate checks the response against CmdResponseSchema.
+func (r *CmdResponse) Validate() error {
+	switch r.Risk {
+	case "", RiskLow, RiskMedium, RiskHigh:
+	default:
+		return fmt.Errorf("invalid risk %q, it must be %s, %s or %s", r.Risk, RiskLow, RiskMedium, RiskHigh)
+	}
+	if r.Command == "" && r.Explanation == "" {
+		return fmt.Errorf("no command and no explanation")
+	}
+	for _, alternative := range r.Alternatives {
+		if strings.TrimSpace(alternative) == "" {
+			return fmt.Errorf("empty alternative command")
+		}
+	}
+	return nil
+}
+
+var jsonStart = regexp.MustCompile(`(?m)^\s*\{`)
+
+// ParseCmdResponse parses the answer of the model in cmd mode: a JSON object
+// following CmdResponseSchema, possibly in a code block. An answer in the
+// older "execute command: <cmd>" form is accepted too, and any other text is
+// taken as the explanation of a refusal.
+func ParseCmdResponse(input string) (*CmdResponse, error) {
+	// the object starts a line, braces within a sentence are not JSON
+	start, end := -1, strings.LastIndex(input, "}")
+	if loc := jsonStart.FindStringIndex(input); loc != nil {
+		start = loc[1] - 1
+	}
+	if start >= 0 && end < start {
+		return nil, fmt.Errorf("invalid command response: incomplete JSON object")
+	}
+	if start < 0 {
+		if cmd, err := ParseCmdFromString(input); err == nil {
+			return &CmdResponse{Command: cmd}, nil
+		}
+		return &CmdResponse{Explanation: strings.TrimSpace(input)}, nil
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(input[start:end+1]), &fields); err != nil {
+		return nil, fmt.Errorf("invalid command response: %w", err)
+	}
+	if _, ok := fields["command"]; !ok {
+		return nil, fmt.Errorf("invalid command response: no command field")
+	}
+	rsp := &CmdResponse{}
+	if err := json.Unmarshal([]byte(input[start:end+1]), rsp); err != nil {
+		return nil, fmt.Errorf("invalid command response: %w", err)
+	}
+	rsp.Command = strings.TrimSpace(rsp.Command)
+	rsp.Explanation = strings.TrimSpace(rsp.Explanation)
+	rsp.Risk = strings.ToLower(strings.TrimSpace(rsp.Risk))
+	if err := rsp.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid command response: %w", err)
+	}
+	return rsp, nil
+}
+
 // The input string is like:
-// execute command: docker stop xyz, this func just parse the command from the string
+// execute command: docker stop xyz, this func just parse the command from the string.
+// Nothing is logged, the answer is parsed while cmd mode shows it.
 func ParseCmdFromString(input string) (string, error) {
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
-
 	re := regexp.MustCompile(`execute command: (.*)`)
 	match := re.FindStringSubmatch(input)
-	if match != nil {
-		logger.Info("Matched:", "match content", match[1])
-		return match[1], nil
-	} else {
-		logger.Info("No match found.")
+	if match == nil {
 		return "", fmt.Errorf("no match found")
 	}
+	return strings.Trim(trimSentenceEnd(strings.TrimSpace(match[1])), "`"), nil
+}
+
+// trimSentenceEnd removes the period ending the sentence the command is in,
+// like "execute command: docker ps.", a path like "." or "../" is kept
+func trimSentenceEnd(cmd string) string {
+	trimmed, ok := strings.CutSuffix(cmd, ".")
+	if !ok || trimmed == "" {
+		return cmd
+	}
+	switch trimmed[len(trimmed)-1] {
+	case ' ', '.', '/', '\t':
+		return cmd
+	}
+	return trimmed
+}
+
+var explanationKey = regexp.MustCompile(`"explanation"\s*:\s*"`)
+
+// ExplanationStream finds the explanation of a cmd mode answer while the
+// answer is generated, so it can be shown before the command is parsed.
+// The text of an answer which is not JSON is the explanation, it is given
+// line by line until a JSON object, a code block or an "execute command:"
+// line starts.
+type ExplanationStream struct {
+	buf strings.Builder
+	// shown is how much of the explanation was returned
+	shown int
+	// plainShown is how much of a text answer was returned, plainDone is set
+	// once the explanation ends in it
+	plainShown int
+	plainDone  bool
+}
+
+// Write adds a chunk of the answer and returns the part of the explanation
+// it completes, which may be empty.
+func (s *ExplanationStream) Write(chunk string) string {
+	s.buf.WriteString(chunk)
+	text := s.buf.String()
+	if loc := explanationKey.FindStringIndex(text); loc != nil {
+		explanation := decodePartialString(text[loc[1]:])
+		if len(explanation) <= s.shown {
+			return ""
+		}
+		part := explanation[s.shown:]
+		s.shown = len(explanation)
+		return part
+	}
+	if s.plainDone {
+		return ""
+	}
+
+	part := ""
+	for {
+		end := strings.IndexByte(text[s.plainShown:], '\n')
+		if end < 0 {
+			return part
+		}
+		line := text[s.plainShown : s.plainShown+end+1]
+		if endsExplanation(line) {
+			s.plainDone = true
+			return part
+		}
+		part += line
+		s.plainShown += end + 1
+	}
+}
+
+// Flush returns the last line of a text answer once the answer is complete.
+func (s *ExplanationStream) Flush() string {
+	text := s.buf.String()
+	if s.plainDone || explanationKey.MatchString(text) || endsExplanation(text[s.plainShown:]) {
+		return ""
+	}
+	part := text[s.plainShown:]
+	s.plainShown = len(text)
+	return part
+}
+
+// endsExplanation reports whether the line starts a JSON object, a code
+// block or a command in the older "execute command: <cmd>" form
+func endsExplanation(line string) bool {
+	line = strings.TrimSpace(line)
+	return strings.HasPrefix(line, "{") || strings.HasPrefix(line, "```") || strings.HasPrefix(line, "execute command:")
+}
+
+// decodePartialString decodes the JSON string starting at raw, up to its
+// closing quote or to the last character which is complete
+func decodePartialString(raw string) string {
+	end := 0
+	for end < len(raw) && raw[end] != '"' {
+		if raw[end] != '\\' {
+			end++
+			continue
+		}
+		size := 2
+		if end+1 < len(raw) && raw[end+1] == 'u' {
+			size = 6
+			// a high surrogate is decoded with the escape following it
+			if end+5 < len(raw) && strings.ContainsAny(raw[end+2:end+3], "dD") && strings.ContainsAny(raw[end+3:end+4], "89abAB") {
+				size = 12
+			}
+		}
+		if end+size > len(raw) {
+			break
+		}
+		end += size
+	}
+	// a chunk may end within a character
+	for end > 0 && !utf8.ValidString(raw[:end]) {
+		end--
+	}
+
+	var decoded string
+	if err := json.Unmarshal([]byte(`"`+raw[:end]+`"`), &decoded); err != nil {
+		return ""
+	}
+	return decoded
 }
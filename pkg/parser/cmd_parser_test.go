@@ -1,6 +1,8 @@
 package parser
 
 import (
+	"io"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -35,3 +37,113 @@ func TestParseCmdFromStringEmptyInput(t *testing.T) {
 	assert.EqualError(t, err, "no match found")
 	assert.Equal(t, expected, actual)
 }
+
+func TestParseCmdFromStringTrailingPeriod(t *testing.T) {
+	for input, expected := range map[string]string{
+		"execute command: docker start mycontainer.": "docker start mycontainer",
+		"execute command: `ls -l`.":                  "ls -l",
+		"execute command: find . -name '*.go'":       "find . -name '*.go'",
+		"execute command: ls .":                      "ls .",
+		"execute command: cd ..":                     "cd ..",
+	} {
+		actual, err := ParseCmdFromString(input)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual, input)
+	}
+}
+
+func TestParseCmdResponse(t *testing.T) {
+	rsp, err := ParseCmdResponse("```json\n" + `{
+  "command": "systemctl restart nginx",
+  "explanation": "Restarts the nginx service.",
+  "risk": "Medium",
+  "needs_root": true,
+  "alternatives": ["service nginx restart"]
+}` + "\n```")
+	assert.NoError(t, err)
+	assert.Equal(t, &CmdResponse{
+		Command:      "systemctl restart nginx",
+		Explanation:  "Restarts the nginx service.",
+		Risk:         RiskMedium,
+		NeedsRoot:    true,
+		Alternatives: []string{"service nginx restart"},
+	}, rsp)
+
+	rsp, err = ParseCmdResponse(`{"command": "", "explanation": "This is a question, please use chatmode."}`)
+	assert.NoError(t, err)
+	assert.Empty(t, rsp.Command)
+	assert.Equal(t, "This is a question, please use chatmode.", rsp.Explanation)
+
+	rsp, err = ParseCmdResponse("execute command: df -h.")
+	assert.NoError(t, err)
+	assert.Equal(t, "df -h", rsp.Command)
+
+	rsp, err = ParseCmdResponse("I am sorry, I can't help with {that}.")
+	assert.NoError(t, err)
+	assert.Empty(t, rsp.Command)
+	assert.Equal(t, "I am sorry, I can't help with {that}.", rsp.Explanation)
+}
+
+func TestParseCmdResponseInvalid(t *testing.T) {
+	for _, input := range []string{
+		`{"command": "rm -rf /tmp/x", "risk": "extreme"}`,
+		`{"explanation": "no command field"}`,
+		`{"command": "ls", "alternatives": [""]}`,
+		`{"command": 42}`,
+		"{\"command\": \"ls\"",
+	} {
+		_, err := ParseCmdResponse(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestParseCmdResponseWritesNothing(t *testing.T) {
+	// cmd mode shows the answer itself, the parser must not print to the terminal
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	ParseCmdResponse("execute command: df -h")
+	ParseCmdResponse("I can not help with that.")
+	os.Stdout = stdout
+	w.Close()
+	out, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Empty(t, string(out))
+}
+
+// streamExplanation writes the answer in chunks of size bytes and returns what
+// the stream shows
+func streamExplanation(answer string, size int) string {
+	stream := &ExplanationStream{}
+	shown := ""
+	for i := 0; i < len(answer); i += size {
+		shown += stream.Write(answer[i:min(i+size, len(answer))])
+	}
+	return shown + stream.Flush()
+}
+
+func TestExplanationStream(t *testing.T) {
+	answer := `{"command": "ls -la", "explanation": "Lists \"all\" files\nwith 你好 😀", "risk": "low"}`
+	for _, size := range []int{1, 3, 7, len(answer)} {
+		assert.Equal(t, "Lists \"all\" files\nwith 你好 😀", streamExplanation(answer, size), size)
+	}
+
+	answer = `{"command": "", "explanation": "a smile \ud83d\ude00 \u00e9"}`
+	assert.Equal(t, "a smile 😀 é", streamExplanation(answer, 1))
+
+	// the text before a code block is shown, then the explanation in it
+	answer = "Here it is:\n```json\n{\"command\": \"df -h\", \"explanation\": \"Shows the disk usage\"}\n```"
+	assert.Equal(t, "Here it is:\nShows the disk usage", streamExplanation(answer, 4))
+
+	// a text answer is all explanation
+	assert.Equal(t, "I can not do that.\nIt is unsafe.", streamExplanation("I can not do that.\nIt is unsafe.", 5))
+
+	// a command in the older form is not an explanation
+	assert.Equal(t, "Stops it.\n", streamExplanation("Stops it.\nexecute command: docker stop xyz", 3))
+
+	// the command comes first, nothing is shown until the explanation starts
+	stream := &ExplanationStream{}
+	assert.Empty(t, stream.Write(`{"command": "rm -rf build", `))
+	assert.Empty(t, stream.Flush())
+}
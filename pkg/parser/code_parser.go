@@ -5,12 +5,15 @@ import (
 	"log/slog"
 	"os"
 	"regexp"
+	"strings"
 )
 
 type SourceFile struct {
 	FileName     string
 	FileContent  string
 	MatchContent string
+	// Language is what follows the ``` of the code block, like python
+	Language string
 }
 
 // Parse filename and code from the match content
@@ -30,13 +33,14 @@ func (s *SourceFile) ParseFileName() {
 func (s *SourceFile) ParseFileContent() {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 	//```[^\n]*\n([\s\S]*?\n)```
-	regstr := "```[^\n]*\n([" + `\s\S` + "]*?)\n```"
+	regstr := "```([^\n]*)\n([" + `\s\S` + "]*?)\n```"
 	re := regexp.MustCompile(regstr)
 	match := re.FindStringSubmatch(s.MatchContent)
 
 	if match != nil {
-		s.FileContent = match[1]
-		logger.Info("Matched:", "match_content ", match[1])
+		s.Language = strings.TrimSpace(match[1])
+		s.FileContent = match[2]
+		logger.Info("Matched:", "match_content ", match[2])
 	} else {
 		logger.Info("No match found.")
 	}
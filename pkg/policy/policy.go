@@ -0,0 +1,290 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"gopkg.in/yaml.v3"
+)
+
+const PolicyFileName = "policy.yaml"
+
+// Action is what happens to a command.
+type Action string
+
+const (
+	ActionAllow   Action = "allow"
+	ActionConfirm Action = "confirm"
+	ActionDeny    Action = "deny"
+)
+
+// severity orders the actions, the most severe action of a command wins
+func (a Action) severity() int {
+	switch a {
+	case ActionConfirm:
+		return 1
+	case ActionDeny:
+		return 2
+	}
+	return 0
+}
+
+func (a Action) valid() bool {
+	return a == ActionAllow || a == ActionConfirm || a == ActionDeny
+}
+
+// Rule matches simple commands with a regular expression, like "^git push".
+type Rule struct {
+	Pattern string `yaml:"pattern"`
+	Action  Action `yaml:"action"`
+	Reason  string `yaml:"reason,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Config is the policy configuration, it is read from ~/.nuwa-terminal/policy.yaml.
+//
+//	levels:
+//	  medium: allow
+//	categories:
+//	  package-removal: deny
+//	rules:
+//	  - pattern: '^git push'
+//	    action: confirm
+//	    reason: pushing is shared with others
+type Config struct {
+	// Levels maps risk levels to actions
+	Levels map[string]Action `yaml:"levels"`
+	// Categories overrides the action of a risk category
+	Categories map[Category]Action `yaml:"categories"`
+	// Rules are matched against every simple command, in this order
+	Rules []Rule `yaml:"rules"`
+}
+
+// DefaultConfig runs low risk commands, confirms medium and high risk
+// commands and denies critical ones.
+func DefaultConfig() *Config {
+	return &Config{
+		Levels: map[string]Action{
+			LevelLow.String():      ActionAllow,
+			LevelMedium.String():   ActionConfirm,
+			LevelHigh.String():     ActionConfirm,
+			LevelCritical.String(): ActionDeny,
+		},
+		Categories: map[Category]Action{},
+	}
+}
+
+// DefaultConfigPath returns the path of the policy file in the home directory.
+func DefaultConfigPath() string {
+	return config.HomePath(PolicyFileName)
+}
+
+// LoadConfig reads the policy file, the defaults are used if it does not
+// exist. Levels missing in the file keep their default action.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+
+	file := &Config{}
+	if err := yaml.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %w", path, err)
+	}
+	for level, action := range file.Levels {
+		cfg.Levels[strings.ToLower(level)] = action
+	}
+	for category, action := range file.Categories {
+		cfg.Categories[category] = action
+	}
+	cfg.Rules = file.Rules
+	return cfg, nil
+}
+
+// Decision is the result of evaluating a command.
+type Decision struct {
+	Action Action
+	// Level is the highest risk found in the command
+	Level    Level
+	Findings []Finding
+	// Rule is the configured rule which decided, if any
+	Rule *Rule
+}
+
+// Reason explains the decision.
+func (d Decision) Reason() string {
+	if d.Rule != nil {
+		reason := d.Rule.Reason
+		if reason == "" {
+			reason = "matches " + d.Rule.Pattern
+		}
+		return fmt.Sprintf("%s (rule %q)", reason, d.Rule.Pattern)
+	}
+	reasons := []string{}
+	for _, f := range d.Findings {
+		if f.Level == d.Level {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", f.Category, f.Reason))
+		}
+	}
+	if len(reasons) == 0 {
+		return "no risk found"
+	}
+	return fmt.Sprintf("%s risk, %s", d.Level, strings.Join(reasons, "; "))
+}
+
+// BlockedError is returned when the policy does not let a command run.
+type BlockedError struct {
+	Command  string
+	Decision Decision
+}
+
+func (e *BlockedError) Error() string {
+	if e.Decision.Action == ActionConfirm {
+		return "command not confirmed: " + e.Decision.Reason()
+	}
+	return "command blocked by policy: " + e.Decision.Reason()
+}
+
+// Engine decides which commands may run.
+type Engine struct {
+	config *Config
+}
+
+// NewEngine checks the config and compiles its rules.
+func NewEngine(cfg *Config) (*Engine, error) {
+	for level, action := range cfg.Levels {
+		if _, err := ParseLevel(level); err != nil {
+			return nil, err
+		}
+		if !action.valid() {
+			return nil, fmt.Errorf("invalid action %q for level %s", action, level)
+		}
+	}
+	for category, action := range cfg.Categories {
+		if !action.valid() {
+			return nil, fmt.Errorf("invalid action %q for category %s", action, category)
+		}
+	}
+	for i := range cfg.Rules {
+		rule := &cfg.Rules[i]
+		if !rule.Action.valid() {
+			return nil, fmt.Errorf("invalid action %q for rule %q", rule.Action, rule.Pattern)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern of rule %q: %w", rule.Pattern, err)
+		}
+		rule.re = re
+	}
+	return &Engine{config: cfg}, nil
+}
+
+// Evaluate decides what to do with a command line or a script, relative
+// paths are resolved against cwd.
+//
+// A deny rule matching any simple command denies the whole command. An allow
+// rule drops the findings of the simple commands it matches, a confirm rule
+// asks at least for a confirmation. The remaining findings are mapped to
+// actions by their category or level, the most severe action wins.
+func (e *Engine) Evaluate(command string, cwd string) Decision {
+	return e.decide(command, Classify(command, cwd))
+}
+
+// EvaluateCode decides what to do with a script of another language than the
+// shell, like python. It is confirmed at least, since it can not be checked,
+// and the shell commands it runs, like os.system("..."), are evaluated like
+// the commands of a shell script. The rules also match the language.
+func (e *Engine) EvaluateCode(language, code, cwd string) Decision {
+	commands := append([]string{language}, EmbeddedCommands(code)...)
+	return e.decide(strings.Join(commands, "\n"), ClassifyCode(language, code, cwd))
+}
+
+// decide maps the findings of a command to an action, the rules are matched
+// against the simple commands of the command
+func (e *Engine) decide(command string, findings []Finding) Decision {
+	decision := Decision{Action: ActionAllow, Findings: findings}
+
+	commands, _ := Parse(command)
+	allowed := map[string]bool{}
+	for _, cmd := range flatten(commands) {
+		text := cmd.String()
+		if rule := e.match(text); rule != nil {
+			switch rule.Action {
+			case ActionDeny:
+				return Decision{Action: ActionDeny, Level: decision.level(), Findings: decision.Findings, Rule: rule}
+			case ActionAllow:
+				allowed[text] = true
+			case ActionConfirm:
+				if decision.Rule == nil {
+					decision.Action, decision.Rule = ActionConfirm, rule
+				}
+			}
+		}
+	}
+
+	kept := []Finding{}
+	for _, f := range decision.Findings {
+		if !allowed[f.Command] {
+			kept = append(kept, f)
+		}
+	}
+	decision.Findings = kept
+	decision.Level = decision.level()
+	for _, f := range kept {
+		action := e.action(f)
+		if action.severity() > decision.Action.severity() {
+			decision.Action = action
+			// the findings explain the decision now
+			decision.Rule = nil
+		}
+	}
+	return decision
+}
+
+func (e *Engine) match(text string) *Rule {
+	for i := range e.config.Rules {
+		if e.config.Rules[i].re.MatchString(text) {
+			return &e.config.Rules[i]
+		}
+	}
+	return nil
+}
+
+func (e *Engine) action(f Finding) Action {
+	if action, ok := e.config.Categories[f.Category]; ok {
+		return action
+	}
+	if action, ok := e.config.Levels[f.Level.String()]; ok {
+		return action
+	}
+	return ActionConfirm
+}
+
+func (d Decision) level() Level {
+	level := LevelNone
+	for _, f := range d.Findings {
+		if f.Level > level {
+			level = f.Level
+		}
+	}
+	return level
+}
+
+// flatten returns the commands and all the commands nested in them
+func flatten(commands []Command) []Command {
+	result := []Command{}
+	for _, cmd := range commands {
+		result = append(result, cmd)
+		result = append(result, flatten(cmd.Nested)...)
+	}
+	return result
+}
@@ -0,0 +1,915 @@
+package policy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Level is how risky a command is.
+type Level int
+
+const (
+	LevelNone Level = iota
+	LevelLow
+	LevelMedium
+	LevelHigh
+	LevelCritical
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelLow:
+		return "low"
+	case LevelMedium:
+		return "medium"
+	case LevelHigh:
+		return "high"
+	case LevelCritical:
+		return "critical"
+	}
+	return "none"
+}
+
+// ParseLevel parses a level name like "high".
+func ParseLevel(s string) (Level, error) {
+	for l := LevelNone; l <= LevelCritical; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return LevelNone, fmt.Errorf("unknown risk level: %s", s)
+}
+
+// Category is the kind of risk a finding is about.
+type Category string
+
+const (
+	CategoryDestructive  Category = "destructive-file-ops"
+	CategoryDisk         Category = "disk-format"
+	CategoryPackage      Category = "package-removal"
+	CategoryRemoteExec   Category = "remote-exec"
+	CategoryPrivilege    Category = "privilege-escalation"
+	CategoryWriteOutside Category = "write-outside-cwd"
+	CategorySystem       Category = "system-control"
+	CategoryForkBomb     Category = "fork-bomb"
+	CategoryUnparsable   Category = "unparsable"
+	CategoryDynamicCode  Category = "dynamic-code"
+)
+
+// Finding is one risk found in a command.
+type Finding struct {
+	Category Category
+	Level    Level
+	Reason   string
+	// Command is the simple command the finding is about
+	Command string
+}
+
+// classifier walks the parsed commands and collects the findings.
+type classifier struct {
+	cwd      string
+	home     string
+	findings []Finding
+}
+
+func (c *classifier) add(cmd Command, category Category, level Level, format string, args ...any) {
+	c.findings = append(c.findings, Finding{
+		Category: category,
+		Level:    level,
+		Reason:   fmt.Sprintf(format, args...),
+		Command:  cmd.String(),
+	})
+}
+
+var forkBombRe = regexp.MustCompile(`(\w+|:)\s*\(\)\s*\{\s*(\w+|:)\s*\|\s*(\w+|:)\s*&\s*\}\s*;\s*(\w+|:)`)
+
+// Classify returns the risks found in a command line or script, relative paths
+// are resolved against cwd.
+func Classify(script string, cwd string) []Finding {
+	c := &classifier{cwd: filepath.Clean(cwd), home: os.Getenv("HOME")}
+	c.classifyScript(script, 0)
+	return c.findings
+}
+
+// maxDepth limits how deep "bash -c" and "eval" are unwrapped.
+const maxDepth = 4
+
+func (c *classifier) classifyScript(script string, depth int) {
+	if forkBombRe.MatchString(script) {
+		c.add(Command{Args: []string{script}}, CategoryForkBomb, LevelCritical, "fork bomb")
+	}
+	commands, err := Parse(script)
+	if err != nil {
+		c.add(Command{Args: []string{script}}, CategoryUnparsable, LevelMedium, "the command can not be parsed: %s", err.Error())
+		return
+	}
+	c.classifyCommands(commands, depth)
+}
+
+func (c *classifier) classifyCommands(commands []Command, depth int) {
+	for i, cmd := range commands {
+		c.classifyPipe(commands, i)
+		c.classifyCommand(cmd, depth)
+		c.classifyCommands(cmd.Nested, depth)
+	}
+}
+
+// shells and interpreters which run the code given on stdin
+var interpreters = map[string]bool{
+	"sh": true, "bash": true, "zsh": true, "dash": true, "ksh": true, "fish": true,
+	"python": true, "python2": true, "python3": true, "perl": true, "ruby": true, "node": true, "php": true,
+}
+
+// codeFlags are the flags of the interpreters which take the code to run,
+// like python -c
+var codeFlags = map[string][]string{
+	"python": {"-c"}, "python2": {"-c"}, "python3": {"-c"},
+	"perl": {"-e", "-E"}, "ruby": {"-e"}, "node": {"-e", "--eval", "-p", "--print"}, "php": {"-r"},
+}
+
+var downloaders = map[string]bool{"curl": true, "wget": true, "fetch": true, "aria2c": true}
+
+// classifyPipe finds code piped into a shell or an interpreter, like
+// "curl url | sh" or "base64 -d | sh", which can not be checked.
+func (c *classifier) classifyPipe(commands []Command, i int) {
+	cmd := commands[i]
+	args, _ := Unwrap(cmd)
+	if len(args) == 0 || !interpreters[baseName(args[0])] || cmd.Position == 0 || !readsCode(args[1:]) {
+		return
+	}
+	for _, prev := range commands[:i] {
+		if prev.Pipeline == cmd.Pipeline && downloaders[prev.Name()] {
+			c.add(cmd, CategoryRemoteExec, LevelCritical, "runs code downloaded by %s with %s", prev.Name(), baseName(args[0]))
+			return
+		}
+	}
+	c.add(cmd, CategoryDynamicCode, LevelHigh, "runs the code piped into %s, it can not be checked", baseName(args[0]))
+}
+
+// readsCode returns whether an interpreter with the arguments reads its
+// code from stdin: it has no script file, or it is told to read stdin
+func readsCode(args []string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "-s":
+			return true
+		case "-c", "-e":
+			return false
+		}
+	}
+	paths := nonFlags(args)
+	return len(paths) == 0 || paths[0] == "-"
+}
+
+// embeddedCommandRe finds the shell commands run by the code of other
+// languages, like os.system("ls") or subprocess.run(["rm", "-rf", "x"])
+var (
+	embeddedCommandRe = regexp.MustCompile(`\b(?:system|popen|exec|execSync|spawnSync|check_output|check_call|call|run|Popen|getoutput|getstatusoutput|shell_exec|passthru)\s*\(\s*(\[[^\]]*\]|"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*')`)
+	stringLiteralRe   = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"|'((?:[^'\\]|\\.)*)'`)
+)
+
+// EmbeddedCommands returns the shell commands found in the code of another
+// language than the shell, the list arguments of subprocess are joined by spaces.
+func EmbeddedCommands(code string) []string {
+	commands := []string{}
+	for _, match := range embeddedCommandRe.FindAllStringSubmatch(code, -1) {
+		words := []string{}
+		for _, literal := range stringLiteralRe.FindAllStringSubmatch(match[1], -1) {
+			words = append(words, strings.NewReplacer(`\"`, `"`, `\'`, `'`, `\\`, `\`).Replace(literal[1]+literal[2]))
+		}
+		if len(words) > 0 {
+			commands = append(commands, strings.Join(words, " "))
+		}
+	}
+	return commands
+}
+
+// ClassifyCode returns the risks of a script of another language than the
+// shell, like python. Such a script can not be checked, it is a high risk
+// itself, and the shell commands it runs are classified too.
+func ClassifyCode(language, code, cwd string) []Finding {
+	c := &classifier{cwd: filepath.Clean(cwd), home: os.Getenv("HOME")}
+	c.classifyCode(Command{Args: []string{language}}, language, code, 0)
+	return c.findings
+}
+
+func (c *classifier) classifyCode(cmd Command, language, code string, depth int) {
+	c.add(cmd, CategoryDynamicCode, LevelHigh, "runs %s code, it can not be checked", language)
+	for _, embedded := range EmbeddedCommands(code) {
+		c.unwrapScript(cmd, embedded, depth)
+	}
+}
+
+// wrappers run the command given in their arguments, the value is the
+// number of arguments a flag of the wrapper takes.
+var wrappers = map[string]map[string]int{
+	"sudo":    {"-u": 1, "-g": 1, "-C": 1, "-h": 1, "-p": 1, "-U": 1, "-r": 1, "-t": 1, "-D": 1},
+	"doas":    {"-u": 1, "-C": 1},
+	"pkexec":  {"--user": 1},
+	"env":     {"-u": 1, "-C": 1, "-S": 0},
+	"nohup":   {},
+	"nice":    {"-n": 1},
+	"ionice":  {"-c": 1, "-n": 1},
+	"timeout": {"-s": 1, "-k": 1},
+	"time":    {},
+	"exec":    {},
+	"command": {},
+	"builtin": {},
+	"stdbuf":  {"-i": 1, "-o": 1, "-e": 1},
+	"xargs":   {"-I": 1, "-n": 1, "-P": 1, "-d": 1, "-L": 1, "-s": 1, "-a": 1, "-E": 1},
+	"watch":   {"-n": 1, "-d": 0},
+	"chroot":  {},
+	"busybox": {},
+}
+
+var privilegeWrappers = map[string]bool{"sudo": true, "doas": true, "pkexec": true}
+
+// xargsInput stands for the arguments xargs reads from its input, they can
+// not be known before running the command
+const xargsInput = "<input of xargs>"
+
+// Unwrap strips wrappers like sudo and env from a command, it returns the
+// wrapped command and whether it is run with raised privileges. The command
+// run by xargs gets the input of xargs as its last argument.
+func Unwrap(cmd Command) ([]string, bool) {
+	args, privileged, input := unwrap(cmd)
+	if input && len(args) > 0 {
+		args = append(append([]string{}, args...), xargsInput)
+	}
+	return args, privileged
+}
+
+func unwrap(cmd Command) ([]string, bool, bool) {
+	args := cmd.Args
+	privileged, input := false, false
+	for len(args) > 0 {
+		name := baseName(args[0])
+		flags, ok := wrappers[name]
+		if !ok {
+			break
+		}
+		privileged = privileged || privilegeWrappers[name]
+		input = input || name == "xargs"
+		args = args[1:]
+		// timeout and chroot take a positional argument before the command
+		positional := name == "timeout" || name == "chroot"
+		for len(args) > 0 {
+			arg := args[0]
+			switch {
+			case arg == "--":
+				args = args[1:]
+			case strings.HasPrefix(arg, "-"):
+				args = args[1:]
+				if n, ok := flags[arg]; ok && n > 0 && len(args) > 0 {
+					args = args[1:]
+				}
+				continue
+			case name == "env" && isAssignment(arg):
+				args = args[1:]
+				continue
+			case positional:
+				args = args[1:]
+				positional = false
+				continue
+			}
+			break
+		}
+	}
+	return args, privileged, input
+}
+
+func (c *classifier) classifyCommand(cmd Command, depth int) {
+	c.classifyRedirects(cmd)
+
+	args, privileged := Unwrap(cmd)
+	if privileged {
+		c.add(cmd, CategoryPrivilege, LevelHigh, "runs with root privileges through %s", cmd.Name())
+	}
+	if len(args) == 0 {
+		return
+	}
+	if strings.ContainsAny(args[0], "$`") {
+		c.add(cmd, CategoryUnparsable, LevelMedium, "the command %s is only known when it runs", args[0])
+		return
+	}
+
+	name := baseName(args[0])
+	args = args[1:]
+	for _, flag := range codeFlags[name] {
+		if i := indexOf(args, flag); i >= 0 && i+1 < len(args) {
+			c.classifyCode(cmd, name, args[i+1], depth)
+			break
+		}
+	}
+	switch name {
+	case "sh", "bash", "zsh", "dash", "ksh":
+		for i, arg := range args {
+			if arg == "-c" && i+1 < len(args) {
+				c.unwrapScript(cmd, args[i+1], depth)
+				break
+			}
+		}
+		for _, nested := range cmd.Nested {
+			if downloaders[nested.Name()] {
+				c.add(cmd, CategoryRemoteExec, LevelCritical, "runs code downloaded by %s with %s", nested.Name(), name)
+				break
+			}
+		}
+	case "source", ".":
+		for _, nested := range cmd.Nested {
+			if downloaders[nested.Name()] {
+				c.add(cmd, CategoryRemoteExec, LevelCritical, "sources code downloaded by %s", nested.Name())
+				break
+			}
+		}
+	case "eval":
+		c.unwrapScript(cmd, strings.Join(args, " "), depth)
+	case "ssh":
+		// the remote command is run by the shell of the host
+		if remote := sshCommand(args); len(remote) > 0 {
+			c.unwrapScript(cmd, strings.Join(remote, " "), depth)
+		}
+	case "trap":
+		// the action runs when the signal comes, "-" resets it
+		if action := firstNonFlag(args); action != "" && action != "-" {
+			c.unwrapScript(cmd, action, depth)
+		}
+	case "alias":
+		for _, arg := range args {
+			if i := strings.Index(arg, "="); i > 0 {
+				c.unwrapScript(cmd, arg[i+1:], depth)
+			}
+		}
+	case "awk", "gawk", "mawk", "nawk":
+		c.classifyAwk(cmd, name, awkProgram(args), depth)
+	case "curl", "wget", "aria2c":
+		c.classifyWrites(cmd, downloadTargets(name, args))
+	case "tar":
+		if isTarExtract(args) {
+			c.classifyWrites(cmd, flagValues(args, "C", "--directory"))
+		}
+	case "su":
+		c.add(cmd, CategoryPrivilege, LevelHigh, "switches user with su")
+		for i, arg := range args {
+			if (arg == "-c" || arg == "--command") && i+1 < len(args) {
+				c.unwrapScript(cmd, args[i+1], depth)
+				break
+			}
+		}
+	case "rm":
+		c.classifyRm(cmd, args)
+	case "shred", "wipe", "srm":
+		c.add(cmd, CategoryDestructive, LevelHigh, "%s destroys file contents for good", name)
+	case "find":
+		c.classifyFind(cmd, args, depth)
+	case "mv":
+		paths := nonFlags(args)
+		if len(paths) > 0 && paths[len(paths)-1] == "/dev/null" {
+			c.add(cmd, CategoryDestructive, LevelHigh, "moves files to /dev/null")
+		}
+		c.classifyWrites(cmd, lastOf(paths))
+		c.classifyRemovals(cmd, allButLast(paths))
+	case "cp", "install", "ln", "rsync":
+		c.classifyWrites(cmd, lastOf(nonFlags(args)))
+	case "tee", "touch", "mkdir", "truncate", "rmdir", "unlink":
+		c.classifyWrites(cmd, nonFlags(args))
+	case "sed", "perl":
+		// the first argument which is not a flag is the expression
+		if paths := nonFlags(args); hasFlagPrefix(args, "-i") && len(paths) > 1 {
+			c.classifyWrites(cmd, paths[1:])
+		}
+	case "chmod", "chown", "chgrp":
+		c.classifyPermissions(cmd, name, args)
+	case "mkfs", "mke2fs", "mkswap", "fdisk", "sfdisk", "cfdisk", "gdisk", "sgdisk", "parted", "wipefs":
+		c.add(cmd, CategoryDisk, LevelCritical, "%s changes disks or partitions", name)
+	case "dd":
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "of=/dev/") && !isHarmlessDevice(strings.TrimPrefix(arg, "of=")) {
+				c.add(cmd, CategoryDisk, LevelCritical, "dd writes to the device %s", strings.TrimPrefix(arg, "of="))
+			} else if strings.HasPrefix(arg, "of=") {
+				c.classifyWrites(cmd, []string{strings.TrimPrefix(arg, "of=")})
+			}
+		}
+	case "shutdown", "reboot", "halt", "poweroff":
+		c.add(cmd, CategorySystem, LevelHigh, "%s stops the machine", name)
+	case "init", "telinit":
+		if len(args) > 0 && (args[0] == "0" || args[0] == "6") {
+			c.add(cmd, CategorySystem, LevelHigh, "%s %s stops the machine", name, args[0])
+		}
+	case "systemctl":
+		c.classifySystemctl(cmd, args)
+	case "service":
+		if units := nonFlags(args); len(units) > 1 && serviceChanges[units[1]] {
+			c.classifyService(cmd, "service "+units[1], units[:1])
+		}
+	case "kill", "pkill", "killall":
+		for _, arg := range args {
+			if arg == "-1" && name == "kill" || arg == "1" && name == "kill" || arg == "init" || arg == "systemd" {
+				c.add(cmd, CategorySystem, LevelHigh, "%s kills every process or the init process", name)
+				break
+			}
+		}
+	case "visudo", "passwd", "useradd", "userdel", "usermod", "groupadd", "groupdel":
+		c.add(cmd, CategoryPrivilege, LevelHigh, "%s changes users or their privileges", name)
+	default:
+		c.classifyPackage(cmd, name, args)
+	}
+	if strings.HasPrefix(name, "mkfs.") {
+		c.add(cmd, CategoryDisk, LevelCritical, "%s formats a file system", name)
+	}
+}
+
+// sshFlags are the flags of ssh which take an argument
+var sshFlags = map[string]bool{
+	"-B": true, "-b": true, "-c": true, "-D": true, "-E": true, "-e": true, "-F": true, "-I": true, "-i": true, "-J": true,
+	"-L": true, "-l": true, "-m": true, "-O": true, "-o": true, "-p": true, "-Q": true, "-R": true, "-S": true, "-W": true, "-w": true,
+}
+
+// sshCommand returns the words of the command ssh runs on the host, they
+// follow the flags and the host.
+func sshCommand(args []string) []string {
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--":
+			if i+1 < len(args) {
+				return args[i+2:]
+			}
+			return nil
+		case sshFlags[args[i]]:
+			i++
+		case !strings.HasPrefix(args[i], "-"):
+			return args[i+1:]
+		}
+	}
+	return nil
+}
+
+// awkProgram returns the program text of an awk command, it is empty when
+// the program is read from a file.
+func awkProgram(args []string) string {
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-f" || arg == "--file" || strings.HasPrefix(arg, "--file="):
+			return ""
+		case arg == "-e" || arg == "--source" || arg == "--":
+			if i+1 < len(args) {
+				return args[i+1]
+			}
+			return ""
+		case strings.HasPrefix(arg, "--source="):
+			return strings.TrimPrefix(arg, "--source=")
+		case arg == "-F" || arg == "-v":
+			i++
+		case !strings.HasPrefix(arg, "-"):
+			return arg
+		}
+	}
+	return ""
+}
+
+var (
+	// awkCommandRe finds the commands awk runs, system("cmd"), print | "cmd"
+	// and "cmd" | getline
+	awkCommandRe = regexp.MustCompile(`\bsystem\s*\(\s*"((?:[^"\\]|\\.)*)"\s*\)|\|&?\s*"((?:[^"\\]|\\.)*)"|"((?:[^"\\]|\\.)*)"\s*\|&?\s*getline`)
+	awkSystemRe  = regexp.MustCompile(`\bsystem\s*\(`)
+)
+
+// classifyAwk classifies the shell commands an awk program runs, a command
+// which is built when the program runs can not be checked.
+func (c *classifier) classifyAwk(cmd Command, name, program string, depth int) {
+	matches := awkCommandRe.FindAllStringSubmatch(program, -1)
+	literals := 0
+	for _, match := range matches {
+		command := match[1] + match[2] + match[3]
+		if strings.HasPrefix(match[0], "system") {
+			literals++
+		}
+		if unquoted, err := strconv.Unquote(`"` + command + `"`); err == nil {
+			command = unquoted
+		}
+		c.unwrapScript(cmd, command, depth)
+	}
+	if len(awkSystemRe.FindAllString(program, -1)) > literals {
+		c.add(cmd, CategoryUnparsable, LevelMedium, "%s runs a command with system() which is only known when it runs", name)
+	}
+}
+
+// downloadTargets returns the files and directories a downloader writes to,
+// "-" is the standard output.
+func downloadTargets(name string, args []string) []string {
+	var targets []string
+	switch name {
+	case "curl":
+		targets = append(flagValues(args, "o", "--output"), flagValues(args, "", "--output-dir")...)
+	case "wget":
+		targets = append(flagValues(args, "Oo", "--output-document", "--output-file", "--append-output"), flagValues(args, "P", "--directory-prefix")...)
+	case "aria2c":
+		targets = flagValues(args, "do", "--dir", "--out")
+	}
+	files := []string{}
+	for _, target := range targets {
+		if target != "-" {
+			files = append(files, target)
+		}
+	}
+	return files
+}
+
+// isTarExtract checks whether tar extracts an archive, the mode can be in
+// the first argument without a dash, like "tar xzf x.tar".
+func isTarExtract(args []string) bool {
+	for i, arg := range args {
+		switch {
+		case arg == "--extract" || arg == "--get":
+			return true
+		case strings.HasPrefix(arg, "--"):
+		case strings.HasPrefix(arg, "-") || i == 0:
+			if strings.Contains(arg, "x") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// flagValues returns the values of the given flags. A short flag can be
+// grouped with others like -fsSLo and take its value attached or as the next
+// argument, a long flag takes it after "=" or as the next argument.
+func flagValues(args []string, short string, long ...string) []string {
+	values := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if strings.HasPrefix(arg, "--") {
+			for _, flag := range long {
+				if arg == flag && i+1 < len(args) {
+					i++
+					values = append(values, args[i])
+				} else if strings.HasPrefix(arg, flag+"=") {
+					values = append(values, strings.TrimPrefix(arg, flag+"="))
+				}
+			}
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") || short == "" {
+			continue
+		}
+		if j := strings.IndexAny(arg[1:], short); j >= 0 {
+			if value := arg[j+2:]; value != "" {
+				values = append(values, value)
+			} else if i+1 < len(args) {
+				i++
+				values = append(values, args[i])
+			}
+		}
+	}
+	return values
+}
+
+// serviceChanges are the systemctl subcommands which change running services
+var serviceChanges = map[string]bool{
+	"stop": true, "restart": true, "disable": true, "mask": true, "kill": true, "isolate": true, "try-restart": true, "reload-or-restart": true,
+}
+
+// remoteAccessUnits keep the machine reachable, stopping them can lock the user out
+var remoteAccessUnits = regexp.MustCompile(`^(ssh|sshd|network|networking|NetworkManager|systemd-networkd|systemd-resolved|firewalld)(\.service)?$`)
+
+func (c *classifier) classifySystemctl(cmd Command, args []string) {
+	words := nonFlags(args)
+	if len(words) == 0 {
+		return
+	}
+	switch sub := words[0]; {
+	case sub == "poweroff" || sub == "reboot" || sub == "halt" || sub == "kexec":
+		c.add(cmd, CategorySystem, LevelHigh, "systemctl %s stops the machine", sub)
+	case serviceChanges[sub]:
+		c.classifyService(cmd, "systemctl "+sub, words[1:])
+	}
+}
+
+// classifyService flags changes of running services, the ones keeping the
+// machine reachable are a high risk
+func (c *classifier) classifyService(cmd Command, action string, units []string) {
+	for _, unit := range units {
+		if remoteAccessUnits.MatchString(unit) {
+			c.add(cmd, CategorySystem, LevelHigh, "%s %s can cut off the remote access to the machine", action, unit)
+			return
+		}
+	}
+	c.add(cmd, CategorySystem, LevelMedium, "%s changes running services", action)
+}
+
+// classifyFind flags find -delete and classifies the commands run by find -exec.
+func (c *classifier) classifyFind(cmd Command, args []string, depth int) {
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-delete":
+			c.add(cmd, CategoryDestructive, LevelHigh, "find -delete removes every matching file")
+		case "-exec", "-execdir", "-ok", "-okdir":
+			end := i + 1
+			for end < len(args) && args[end] != ";" && args[end] != "+" {
+				end++
+			}
+			if depth < maxDepth {
+				c.classifyCommand(Command{Args: args[i+1 : end]}, depth+1)
+			}
+			i = end
+		}
+	}
+}
+
+func (c *classifier) unwrapScript(cmd Command, script string, depth int) {
+	if depth >= maxDepth {
+		c.add(cmd, CategoryUnparsable, LevelMedium, "the command nests too many shells")
+		return
+	}
+	c.classifyScript(script, depth+1)
+}
+
+// systemPaths are never removed or written by a well behaving command
+var systemPaths = []string{
+	"/bin", "/boot", "/dev", "/etc", "/lib", "/lib32", "/lib64", "/opt", "/proc",
+	"/root", "/sbin", "/sys", "/usr", "/var", "/home", "/srv", "/snap",
+}
+
+func (c *classifier) classifyRm(cmd Command, args []string) {
+	recursive, force := false, false
+	for _, arg := range args {
+		switch {
+		case arg == "--no-preserve-root":
+			c.add(cmd, CategoryDestructive, LevelCritical, "rm --no-preserve-root can remove the whole system")
+		case arg == "--recursive":
+			recursive = true
+		case arg == "--force":
+			force = true
+		case strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--"):
+			recursive = recursive || strings.ContainsAny(arg, "rR")
+			force = force || strings.Contains(arg, "f")
+		}
+	}
+
+	for _, target := range nonFlags(args) {
+		path, resolved := c.resolve(target)
+		switch {
+		case !resolved:
+			if recursive {
+				c.add(cmd, CategoryDestructive, LevelHigh, "rm -r of %s which can not be resolved", target)
+			} else {
+				c.add(cmd, CategoryDestructive, LevelMedium, "rm of %s which can not be resolved", target)
+			}
+		case path == "/" || path == c.home || isSystemPath(path) && strings.Count(path, "/") == 1:
+			c.add(cmd, CategoryDestructive, LevelCritical, "rm of %s removes the system or home directory", target)
+		case !c.insideCwd(path):
+			if recursive || force || isSystemPath(path) {
+				c.add(cmd, CategoryDestructive, LevelHigh, "rm of %s outside the working directory", target)
+			} else {
+				c.add(cmd, CategoryDestructive, LevelMedium, "rm of %s outside the working directory", target)
+			}
+		case recursive && path == c.cwd:
+			c.add(cmd, CategoryDestructive, LevelHigh, "rm -r of the whole working directory")
+		case recursive:
+			c.add(cmd, CategoryDestructive, LevelMedium, "rm -r of %s", target)
+		default:
+			c.add(cmd, CategoryDestructive, LevelLow, "rm of %s", target)
+		}
+	}
+}
+
+// classifyRemovals flags files which are removed from outside the cwd, like the sources of mv.
+func (c *classifier) classifyRemovals(cmd Command, paths []string) {
+	for _, target := range paths {
+		if path, resolved := c.resolve(target); resolved && !c.insideCwd(path) && isSystemPath(path) {
+			c.add(cmd, CategoryDestructive, LevelHigh, "moves %s away from a system directory", target)
+		}
+	}
+}
+
+func (c *classifier) classifyRedirects(cmd Command) {
+	for _, r := range cmd.Redirects {
+		if !strings.Contains(r.Op, ">") || r.Op == ">&" && isFd(r.Target) {
+			continue
+		}
+		if isBlockDevice(r.Target) {
+			c.add(cmd, CategoryDisk, LevelCritical, "writes directly to the device %s", r.Target)
+			continue
+		}
+		c.classifyWrites(cmd, []string{r.Target})
+	}
+}
+
+// classifyWrites flags writes to paths outside the cwd.
+func (c *classifier) classifyWrites(cmd Command, paths []string) {
+	for _, target := range paths {
+		if target == "" || isHarmlessDevice(target) {
+			continue
+		}
+		path, resolved := c.resolve(target)
+		switch {
+		case !resolved:
+			c.add(cmd, CategoryWriteOutside, LevelMedium, "writes to %s which can not be resolved", target)
+		case isSystemPath(path):
+			c.add(cmd, CategoryWriteOutside, LevelHigh, "writes to the system path %s", target)
+		case !c.insideCwd(path):
+			c.add(cmd, CategoryWriteOutside, LevelMedium, "writes to %s outside the working directory", target)
+		}
+	}
+}
+
+var setuidModeRe = regexp.MustCompile(`^[0-7]?[2-7][0-7]{3}$|[ugoa]*\+[rwxXt]*s`)
+
+func (c *classifier) classifyPermissions(cmd Command, name string, args []string) {
+	paths := nonFlags(args)
+	if len(paths) == 0 {
+		return
+	}
+	owner := paths[0]
+	if name == "chmod" && setuidModeRe.MatchString(owner) {
+		c.add(cmd, CategoryPrivilege, LevelHigh, "chmod %s sets the setuid or setgid bit", owner)
+	}
+	if name == "chown" && (owner == "root" || strings.HasPrefix(owner, "root:") || owner == "0") {
+		c.add(cmd, CategoryPrivilege, LevelHigh, "chown gives files to root")
+	}
+	recursive := indexOf(args, "--recursive") >= 0
+	for _, arg := range args {
+		recursive = recursive || strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && strings.Contains(arg, "R")
+	}
+	for _, target := range paths[1:] {
+		if path, resolved := c.resolve(target); recursive && resolved && (path == "/" || path == c.home || isSystemPath(path) && strings.Count(path, "/") == 1) {
+			c.add(cmd, CategoryDestructive, LevelHigh, "%s -R of %s changes the whole system or home directory", name, target)
+		}
+	}
+	c.classifyWrites(cmd, paths[1:])
+}
+
+// packageRemovals maps package managers to their removal subcommands
+var packageRemovals = map[string][]string{
+	"apt":      {"remove", "purge", "autoremove"},
+	"apt-get":  {"remove", "purge", "autoremove"},
+	"aptitude": {"remove", "purge"},
+	"yum":      {"remove", "erase", "autoremove"},
+	"dnf":      {"remove", "erase", "autoremove"},
+	"zypper":   {"remove", "rm"},
+	"apk":      {"del"},
+	"snap":     {"remove"},
+	"flatpak":  {"uninstall"},
+	"brew":     {"uninstall", "remove", "rm"},
+	"pip":      {"uninstall"},
+	"pip3":     {"uninstall"},
+	"gem":      {"uninstall"},
+	"npm":      {"uninstall", "remove", "rm", "un"},
+	"port":     {"uninstall"},
+}
+
+func (c *classifier) classifyPackage(cmd Command, name string, args []string) {
+	sub := firstNonFlag(args)
+	for _, removal := range packageRemovals[name] {
+		if sub == removal {
+			c.add(cmd, CategoryPackage, LevelHigh, "%s %s removes packages", name, sub)
+			return
+		}
+	}
+	switch name {
+	case "pacman":
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "-R") || arg == "--remove" {
+				c.add(cmd, CategoryPackage, LevelHigh, "pacman %s removes packages", arg)
+				return
+			}
+		}
+	case "rpm", "dpkg":
+		for _, arg := range args {
+			if arg == "-e" || arg == "--erase" || arg == "-r" || arg == "-P" || arg == "--remove" || arg == "--purge" {
+				c.add(cmd, CategoryPackage, LevelHigh, "%s %s removes packages", name, arg)
+				return
+			}
+		}
+	}
+}
+
+// resolve makes a path absolute, it returns false if the path depends on
+// variables or globs which can not be known before running the command.
+func (c *classifier) resolve(path string) (string, bool) {
+	switch {
+	case path == "~" || path == "$HOME" || path == "${HOME}":
+		path = c.home
+	case strings.HasPrefix(path, "~/"):
+		path = filepath.Join(c.home, path[2:])
+	case strings.HasPrefix(path, "$HOME/"):
+		path = filepath.Join(c.home, path[len("$HOME/"):])
+	case strings.HasPrefix(path, "${HOME}/"):
+		path = filepath.Join(c.home, path[len("${HOME}/"):])
+	}
+	if path == xargsInput || strings.ContainsAny(path, "$`~") {
+		return path, false
+	}
+	// a glob resolves to the directory it is in, "/*" removes the same as "/"
+	if i := strings.IndexAny(path, "*?["); i >= 0 {
+		path = filepath.Dir(path[:i] + "x")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(c.cwd, path)
+	}
+	return filepath.Clean(path), true
+}
+
+func (c *classifier) insideCwd(path string) bool {
+	return path == c.cwd || strings.HasPrefix(path, strings.TrimSuffix(c.cwd, "/")+"/")
+}
+
+func isSystemPath(path string) bool {
+	for _, sys := range systemPaths {
+		if path == sys || strings.HasPrefix(path, sys+"/") {
+			// the home directories of users are not system paths
+			return sys != "/home" || strings.Count(path, "/") == 1
+		}
+	}
+	return false
+}
+
+func isHarmlessDevice(path string) bool {
+	switch path {
+	case "/dev/null", "/dev/zero", "/dev/stdout", "/dev/stderr", "/dev/stdin", "/dev/tty":
+		return true
+	}
+	return strings.HasPrefix(path, "/dev/fd/")
+}
+
+var blockDeviceRe = regexp.MustCompile(`^/dev/(sd[a-z]|hd[a-z]|vd[a-z]|xvd[a-z]|nvme\d|mmcblk\d|disk\d|md\d|dm-\d|loop\d|mapper/)`)
+
+func isBlockDevice(path string) bool {
+	return blockDeviceRe.MatchString(path)
+}
+
+func isFd(s string) bool {
+	if s == "-" {
+		return true
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func baseName(name string) string {
+	return filepath.Base(name)
+}
+
+func nonFlags(args []string) []string {
+	result := []string{}
+	for i, arg := range args {
+		if arg == "--" {
+			return append(result, args[i+1:]...)
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			result = append(result, arg)
+		}
+	}
+	return result
+}
+
+func indexOf(args []string, word string) int {
+	for i, arg := range args {
+		if arg == word {
+			return i
+		}
+	}
+	return -1
+}
+
+func firstNonFlag(args []string) string {
+	if paths := nonFlags(args); len(paths) > 0 {
+		return paths[0]
+	}
+	return ""
+}
+
+func hasFlagPrefix(args []string, prefix string) bool {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func lastOf(args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	return args[len(args)-1:]
+}
+
+func allButLast(args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	return args[:len(args)-1]
+}
@@ -0,0 +1,501 @@
+package policy
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrUnterminated is returned when a quote, substitution or heredoc is not closed.
+var ErrUnterminated = errors.New("unterminated quote or substitution")
+
+// Redirect is a redirection of a command, like "> out.txt".
+type Redirect struct {
+	Op     string
+	Target string
+}
+
+// Command is a simple command found in a shell command line or script.
+type Command struct {
+	// Args are the words of the command after quote removal, leading
+	// variable assignments are not included.
+	Args      []string
+	Redirects []Redirect
+	// Pipeline is the index of the pipeline the command belongs to,
+	// Position is its place in the pipeline.
+	Pipeline int
+	Position int
+	// Nested are the commands found in $(...), `...`, <(...) and >(...) in
+	// the words of this command.
+	Nested []Command
+}
+
+// Name returns the command name without its directory, like "rm" for "/bin/rm".
+func (c Command) Name() string {
+	if len(c.Args) == 0 {
+		return ""
+	}
+	name := c.Args[0]
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// String returns the command words joined by spaces.
+func (c Command) String() string {
+	return strings.Join(c.Args, " ")
+}
+
+// reservedWords are skipped when they start a command, so the commands in
+// "if rm -rf x; then ...; fi" are still found.
+var reservedWords = map[string]bool{
+	"if": true, "then": true, "else": true, "elif": true, "fi": true, "do": true,
+	"done": true, "while": true, "until": true, "{": true, "}": true, "!": true,
+	"esac": true, "time": true,
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenOp
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	nested []Command
+}
+
+// Parse splits a shell command line or script into its simple commands. It is
+// not a full shell parser, but it understands quotes, escapes, comments,
+// pipelines, command lists, redirections, heredocs and substitutions, which
+// is what is needed to see what a command is going to do.
+func Parse(script string) ([]Command, error) {
+	tokens, err := tokenize(script)
+	if err != nil {
+		return nil, err
+	}
+	return group(tokens), nil
+}
+
+func group(tokens []token) []Command {
+	commands := []Command{}
+	current := Command{}
+	pipeline, position := 0, 0
+	skipUntilSeparator := false
+
+	flush := func() {
+		if len(current.Args) > 0 || len(current.Redirects) > 0 || len(current.Nested) > 0 {
+			current.Pipeline = pipeline
+			current.Position = position
+			commands = append(commands, current)
+		}
+		current = Command{}
+		skipUntilSeparator = false
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.kind == tokenOp {
+			switch {
+			case isRedirectOp(tok.text):
+				target := ""
+				if i+1 < len(tokens) && tokens[i+1].kind == tokenWord {
+					i++
+					target = tokens[i].text
+					current.Nested = append(current.Nested, tokens[i].nested...)
+				}
+				current.Redirects = append(current.Redirects, Redirect{Op: tok.text, Target: target})
+			case tok.text == "|" || tok.text == "|&":
+				flush()
+				position++
+			default:
+				flush()
+				pipeline++
+				position = 0
+			}
+			continue
+		}
+
+		current.Nested = append(current.Nested, tok.nested...)
+		if skipUntilSeparator {
+			continue
+		}
+		if len(current.Args) == 0 {
+			if reservedWords[tok.text] {
+				continue
+			}
+			// the words of "for x in a b" and "case x in" are not commands
+			if tok.text == "for" || tok.text == "select" || tok.text == "case" {
+				skipUntilSeparator = true
+				continue
+			}
+			if isAssignment(tok.text) {
+				continue
+			}
+			// the body of "function f { ...; }" is parsed as commands, the
+			// name is not one
+			if tok.text == "function" {
+				if i+1 < len(tokens) && tokens[i+1].kind == tokenWord {
+					i++
+				}
+				continue
+			}
+			// "coproc cmd" runs cmd, "coproc NAME { ...; }" names the coprocess
+			if tok.text == "coproc" {
+				if i+2 < len(tokens) && tokens[i+1].kind == tokenWord && (tokens[i+2].text == "{" || tokens[i+2].text == "(") {
+					i++
+				}
+				continue
+			}
+		}
+		current.Args = append(current.Args, tok.text)
+	}
+	flush()
+	return commands
+}
+
+func isAssignment(word string) bool {
+	eq := strings.Index(word, "=")
+	if eq <= 0 {
+		return false
+	}
+	for i, r := range word[:eq] {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func isRedirectOp(op string) bool {
+	return strings.ContainsAny(op, "<>")
+}
+
+// redirectOps are sorted longest first so the longest match wins.
+var redirectOps = []string{"&>>", "<<<", "<<-", "&>", ">>", ">&", "<&", ">|", "<>", "<<", ">", "<"}
+
+type lexer struct {
+	src      []rune
+	pos      int
+	tokens   []token
+	heredocs []heredoc
+}
+
+type heredoc struct {
+	delimiter string
+	stripTabs bool
+}
+
+func tokenize(script string) ([]token, error) {
+	l := &lexer{src: []rune(script)}
+	for l.pos < len(l.src) {
+		r := l.src[l.pos]
+		switch {
+		case r == '\n':
+			l.emit(tokenOp, "\n")
+			l.pos++
+			if err := l.skipHeredocs(); err != nil {
+				return nil, err
+			}
+		case r == ' ' || r == '\t' || r == '\r':
+			l.pos++
+		case r == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case r == '\\' && l.peek(1) == '\n':
+			l.pos += 2
+		case r == '|' || r == '&' || r == ';' || r == '(' || r == ')':
+			if r == '&' && l.peek(1) == '>' {
+				l.readRedirect()
+				continue
+			}
+			l.readControlOp()
+		case r == '<' || r == '>':
+			if l.peek(1) == '(' {
+				if err := l.readWord(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			l.readRedirect()
+		case r >= '0' && r <= '9' && l.isFdRedirect():
+			l.readRedirect()
+		default:
+			if err := l.readWord(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(l.heredocs) > 0 {
+		return nil, ErrUnterminated
+	}
+	return l.tokens, nil
+}
+
+func (l *lexer) peek(offset int) rune {
+	if l.pos+offset < len(l.src) {
+		return l.src[l.pos+offset]
+	}
+	return 0
+}
+
+func (l *lexer) emit(kind tokenKind, text string) {
+	l.tokens = append(l.tokens, token{kind: kind, text: text})
+}
+
+// isFdRedirect checks for a file descriptor number followed by a redirection, like 2>
+func (l *lexer) isFdRedirect() bool {
+	i := l.pos
+	for i < len(l.src) && l.src[i] >= '0' && l.src[i] <= '9' {
+		i++
+	}
+	return i < len(l.src) && (l.src[i] == '<' || l.src[i] == '>')
+}
+
+func (l *lexer) readControlOp() {
+	for _, op := range []string{"&&", "||", "|&", ";;", "|", "&", ";", "(", ")"} {
+		if l.hasPrefix(op) {
+			l.pos += len([]rune(op))
+			l.emit(tokenOp, op)
+			return
+		}
+	}
+}
+
+func (l *lexer) hasPrefix(s string) bool {
+	return strings.HasPrefix(string(l.src[l.pos:min(l.pos+4, len(l.src))]), s)
+}
+
+func (l *lexer) readRedirect() {
+	for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+		l.pos++
+	}
+	for _, op := range redirectOps {
+		if l.hasPrefix(op) {
+			l.pos += len([]rune(op))
+			l.emit(tokenOp, op)
+			if op == "<<" || op == "<<-" {
+				l.readHeredocDelimiter(op == "<<-")
+			}
+			return
+		}
+	}
+}
+
+func (l *lexer) readHeredocDelimiter(stripTabs bool) {
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	start := len(l.tokens)
+	if err := l.readWord(); err != nil || len(l.tokens) == start {
+		return
+	}
+	l.heredocs = append(l.heredocs, heredoc{delimiter: l.tokens[len(l.tokens)-1].text, stripTabs: stripTabs})
+}
+
+// skipHeredocs skips the bodies of the heredocs started on the previous line,
+// they are data and not commands.
+func (l *lexer) skipHeredocs() error {
+	for len(l.heredocs) > 0 {
+		doc := l.heredocs[0]
+		found := false
+		for l.pos < len(l.src) {
+			end := l.pos
+			for end < len(l.src) && l.src[end] != '\n' {
+				end++
+			}
+			line := string(l.src[l.pos:end])
+			l.pos = min(end+1, len(l.src))
+			if doc.stripTabs {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if line == doc.delimiter {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrUnterminated
+		}
+		l.heredocs = l.heredocs[1:]
+	}
+	return nil
+}
+
+// readWord reads a word and removes its quotes, the commands in its
+// substitutions are parsed and kept with the word.
+func (l *lexer) readWord() error {
+	var word strings.Builder
+	nested := []Command{}
+
+	addNested := func(src string) error {
+		commands, err := Parse(src)
+		if err != nil {
+			return err
+		}
+		nested = append(nested, commands...)
+		return nil
+	}
+
+loop:
+	for l.pos < len(l.src) {
+		r := l.src[l.pos]
+		switch {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == ';' || r == '|' || r == '&' || r == ')':
+			break loop
+		case r == '(' && word.Len() == 0:
+			break loop
+		case (r == '<' || r == '>') && l.peek(1) != '(':
+			break loop
+		case r == '\\':
+			if l.pos+1 < len(l.src) {
+				word.WriteRune(l.src[l.pos+1])
+			}
+			l.pos += 2
+		case r == '\'':
+			end := l.indexFrom(l.pos+1, '\'')
+			if end < 0 {
+				return ErrUnterminated
+			}
+			word.WriteString(string(l.src[l.pos+1 : end]))
+			l.pos = end + 1
+		case r == '"':
+			text, inner, err := l.readDoubleQuoted()
+			if err != nil {
+				return err
+			}
+			word.WriteString(text)
+			for _, src := range inner {
+				if err := addNested(src); err != nil {
+					return err
+				}
+			}
+		case r == '`':
+			end := l.indexFrom(l.pos+1, '`')
+			if end < 0 {
+				return ErrUnterminated
+			}
+			src := string(l.src[l.pos+1 : end])
+			word.WriteString("`" + src + "`")
+			if err := addNested(src); err != nil {
+				return err
+			}
+			l.pos = end + 1
+		case (r == '$' || r == '<' || r == '>') && l.peek(1) == '(':
+			if r == '$' && l.peek(2) == '(' {
+				// arithmetic expansion $((...)) runs no command
+				end, err := l.matchParen(l.pos + 1)
+				if err != nil {
+					return err
+				}
+				word.WriteString(string(l.src[l.pos : end+1]))
+				l.pos = end + 1
+				continue
+			}
+			end, err := l.matchParen(l.pos + 1)
+			if err != nil {
+				return err
+			}
+			src := string(l.src[l.pos+2 : end])
+			word.WriteString(string(l.src[l.pos : end+1]))
+			if err := addNested(src); err != nil {
+				return err
+			}
+			l.pos = end + 1
+		default:
+			word.WriteRune(r)
+			l.pos++
+		}
+	}
+
+	l.tokens = append(l.tokens, token{kind: tokenWord, text: word.String(), nested: nested})
+	return nil
+}
+
+// readDoubleQuoted reads a double quoted string, it returns the text and the
+// sources of the command substitutions in it.
+func (l *lexer) readDoubleQuoted() (string, []string, error) {
+	var text strings.Builder
+	inner := []string{}
+	l.pos++
+	for l.pos < len(l.src) {
+		r := l.src[l.pos]
+		switch {
+		case r == '"':
+			l.pos++
+			return text.String(), inner, nil
+		case r == '\\' && l.pos+1 < len(l.src):
+			next := l.src[l.pos+1]
+			if next != '"' && next != '\\' && next != '$' && next != '`' {
+				text.WriteRune(r)
+			}
+			text.WriteRune(next)
+			l.pos += 2
+		case r == '`':
+			end := l.indexFrom(l.pos+1, '`')
+			if end < 0 {
+				return "", nil, ErrUnterminated
+			}
+			inner = append(inner, string(l.src[l.pos+1:end]))
+			text.WriteString(string(l.src[l.pos : end+1]))
+			l.pos = end + 1
+		case r == '$' && l.peek(1) == '(' && l.peek(2) != '(':
+			end, err := l.matchParen(l.pos + 1)
+			if err != nil {
+				return "", nil, err
+			}
+			inner = append(inner, string(l.src[l.pos+2:end]))
+			text.WriteString(string(l.src[l.pos : end+1]))
+			l.pos = end + 1
+		default:
+			text.WriteRune(r)
+			l.pos++
+		}
+	}
+	return "", nil, ErrUnterminated
+}
+
+// matchParen returns the index of the parenthesis closing the one at open,
+// quoted parentheses are ignored.
+func (l *lexer) matchParen(open int) (int, error) {
+	depth := 0
+	for i := open; i < len(l.src); i++ {
+		switch l.src[i] {
+		case '\\':
+			i++
+		case '\'':
+			end := l.indexFrom(i+1, '\'')
+			if end < 0 {
+				return 0, ErrUnterminated
+			}
+			i = end
+		case '"':
+			for i++; i < len(l.src) && l.src[i] != '"'; i++ {
+				if l.src[i] == '\\' {
+					i++
+				}
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, ErrUnterminated
+}
+
+func (l *lexer) indexFrom(from int, r rune) int {
+	for i := from; i < len(l.src); i++ {
+		if l.src[i] == r {
+			return i
+		}
+	}
+	return -1
+}
@@ -3,6 +3,7 @@ package prompts
 import (
 	"strings"
 
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/parser"
 	"github.com/darmenliu/nuwa-terminal-chat/pkg/system"
 	langchaingoprompts "github.com/tmc/langchaingo/prompts"
 )
@@ -80,38 +81,99 @@ Always thinking step by step to about users questions, make sure your answer is
 `
 
 	SysPromptForCmdMode string = `You are NUWA, a terminal chat tool. You are good at software development,
-and you will get instructions to execute linux command. If user's input is a linux command, you need response like:
+and you will get instructions to execute linux command. If user's input is a linux command, or user ask you to execute
+some command to get some information or do some operation, you need response with a JSON object following this schema:
 
-execute command: <user's input>.
+` + parser.CmdResponseSchema + `
 
-Do not response any other information.
+"command" is the linux command to execute, "explanation" tells what it does in one or two sentences, "risk" is low for
+commands which only read, medium for commands which change files or services, high for commands which can destroy
+data or the system. "needs_root" is true if the command must run as root. "alternatives" are other commands doing
+the same, it can be left out.
 
-If user's input is not a linux command, but user ask you to execute some command to get some information or do some operation, 
-you will get instructions to execute linux command, you need response like:
+If user's input is not a linux command, and user do not ask you to execute some command, or you refuse to run the
+command, respond with an empty "command" and tell why in "explanation", like: I'm in cmdmode, please input a linux
+command or ask me to execute some command. If you want ask question or need assistant, please use chatmode.
 
-execute command: <linux command>.
-
-Do not response any other information.
-
-If user's input is not a linux command, and user do not ask you to execute some command, you need response like:
-only response: I am sorry, I'm in cmdmode, I can't understand your input, please input a linux command or
-ask me to execute some command. If you want ask question or need assistant, please use chatmode.
+Do not response any other information than the JSON object.
 
 Below is example prompt from users and your response:
 
 user: docker start mycontainer
-your response: execute command: docker start mycontainer
+your response: {"command": "docker start mycontainer", "explanation": "Starts the container mycontainer.", "risk": "medium", "needs_root": false}
 
-user: use docker start my container mycontainer
-your response: execute command: docker start mycontainer
+user: show the disk usage of my home directory
+your response: {"command": "du -sh ~", "explanation": "Shows the total size of the home directory.", "risk": "low", "needs_root": false, "alternatives": ["ncdu ~"]}
 
 user: who are you?
-your response: I am sorry, I can't understand your input, please input a linux command or ask me to execute some command.
-
-user: docker run hello-world
-your response: execute command: docker run hello-world
+your response: {"command": "", "explanation": "I'm in cmdmode, please input a linux command or ask me to execute some command. If you want ask question or need assistant, please use chatmode."}
 
 Below is the promt from users:
+`
+
+	// SysPromptForAutoMode asks which mode fits an input, the input follows it
+	SysPromptForAutoMode string = `You are NUWA, a terminal chat tool. Decide which mode handles the user's input best:
+
+chat: questions, explanations and conversations, nothing is executed.
+cmd: a single linux command is executed, like listing files or starting a service.
+task: a shell script is generated and executed, for work needing several commands.
+agent: several steps are executed one after another to troubleshoot or analyze the system, like finding why a service fails.
+
+Respond with only one word: chat, cmd, task or agent.
+
+For example:
+
+user: what is the difference between a process and a thread
+your response: chat
+
+user: show the running containers
+your response: cmd
+
+user: back up my home directory to /tmp and compress it
+your response: task
+
+user: my web server is slow, find out what is wrong
+your response: agent
+
+user: `
+
+	// CmdRegeneratePrompt is appended to the cmd mode prompt when the user rejects a command,
+	// %s is the rejected command
+	CmdRegeneratePrompt string = `The user rejected the command: %s
+Think again about the user's input and respond with a different command in the same format.
+`
+
+	// CmdRepairPrompt is appended to the cmd mode prompt when a command failed,
+	// %s is the execution result of the command
+	CmdRepairPrompt string = `The command failed:
+%s
+Find out why it failed and respond with a corrected command in the same format.
+`
+
+	// ScriptRepairPrompt is appended to the task mode prompt when a script failed,
+	// the %s are the language of the script, the script and its execution result
+	ScriptRepairPrompt string = `The script failed:
+` + "```%s\n%s\n```" + `
+%s
+Find out why it failed and respond with a corrected script in the same format.
+`
+
+	// ScriptRevisePrompt is appended to the task mode prompt when the user asks
+	// for changes to a script, the %s are the language of the script, the
+	// script and what the user wants changed
+	ScriptRevisePrompt string = `Revise the script below:
+` + "```%s\n%s\n```" + `
+The user wants this change: %s
+Respond with the whole revised script in the same format.
+`
+
+	// ScriptCheckPrompt is appended to the task mode prompt when the checks
+	// of a script found problems before it runs, the %s are the language of
+	// the script, the script and the findings
+	ScriptCheckPrompt string = `The checks of the script below found problems before it runs:
+` + "```%s\n%s\n```" + `
+%s
+Fix the problems and respond with the whole fixed script in the same format.
 `
 
 	SysPromptForTaskMode string = `You are NUWA, a terminal chat tool. You are good at software development, you are a expert of linux
@@ -123,6 +185,11 @@ Gnerate a script according user's requirments with below format:
 
 {{.shell_script_format}}
 
+Write the script in {{.script_language}} unless the user asks for another language, the languages which can run
+are {{.script_languages}}. Put the language after the ` + "```" + ` of the code block, like ` + "```python" + `.
+Start a shell script with set -euo pipefail, quote the variables and use only the commands which are installed,
+shell scripts are checked before they run.
+
 Always thinking step by step to about users questions, make sure your answer is correct and helpful.
 If user did not ask about excute some task with shell script, then you need only response like:
 I am sorry, I'm in taskmode, I can't understand your input, please input a task to generate shell script.
@@ -145,6 +212,7 @@ Below is the prompt from users:
 
 	ShellExample string = "``` shell\n" +
 		"#!/bin/bash\n" +
+		"set -euo pipefail\n" +
 		"ls -l /usr/bin\n" +
 		"```\n\n"
 
@@ -192,6 +260,17 @@ Begin!
 
 Question: {{.input}}
 {{.agent_scratchpad}}
+`
+
+	SysPromptForAgentToolMode string = `You are NUWA, a terminal chat tool. You are good at software development and troubleshooting, you are a expert of linux
+and shell script. You will act as a agent to do log analysis and find the problem in your system, performs troubleshooting task given to you to the best
+of your abilities. To answer the question or to perform troubleshooting task you could call the tools with shell scripts which are created by yourself
+accord to what action you want to perform. Remember you current time is {{.current_time}}, and OS information and the available tools as below:
+
+{{.system_info}}
+
+Think about what to do next one step at a time, and call a tool to perform each step. Look at the output of a step before deciding the next one.
+When you know the final answer to the task, reply with the final answer and do not call any tool.
 `
 
 	SysPromptForNWScriptMode string = `You are NUWA, a terminal chat tool. You are good at software development, expert of linux
@@ -240,44 +319,53 @@ func GetCmdModePrompt() string {
 	return SysPromptForCmdMode
 }
 
-func GetTaskModePrompt() (string, error) {
+// GetSystemInfo returns the system info as JSON of at most maxLen bytes, the
+// available tools which do not fit are left out.
+func GetSystemInfo(maxLen int) string {
+	info, err := system.GetSystemInfo().ToJSONWithin(maxLen)
+	if err != nil {
+		return ""
+	}
+	return info
+}
+
+// GetTaskModePrompt returns the system prompt of task mode, the system info
+// in it takes at most maxSystemInfoLen bytes. The scripts are written in the
+// language, or in another one of the languages if the user asks.
+func GetTaskModePrompt(maxSystemInfoLen int, language string, languages []string) (string, error) {
+	systemInfo := GetSystemInfo(maxSystemInfoLen)
 	prompt := langchaingoprompts.PromptTemplate{
 		Template:       SysPromptForTaskMode,
 		TemplateFormat: langchaingoprompts.TemplateFormatGoTemplate,
-		InputVariables: []string{"system_info", "shell_script_format", "shell_example"},
+		InputVariables: []string{"system_info", "shell_script_format", "shell_example", "script_language", "script_languages"},
 		PartialVariables: map[string]any{
-			"system_info": func() string {
-				info, err := system.GetSystemInfo().ToJSON()
-				if err != nil {
-					return ""
-				}
-				return info
-			}(),
+			"system_info":         systemInfo,
 			"shell_script_format": ShellScriptFormat,
 			"shell_example":       ShellExample,
+			"script_language":     language,
+			"script_languages":    strings.Join(languages, ", "),
 		},
 	}
 
 	return prompt.Format(map[string]any{
-		"system_info":         system.GetSystemInfo(),
+		"system_info":         systemInfo,
 		"shell_script_format": ShellScriptFormat,
 		"shell_example":       ShellExample,
+		"script_language":     language,
+		"script_languages":    strings.Join(languages, ", "),
 	})
 }
 
-func GetScriptModePrompt() (string, error) {
+// GetScriptModePrompt returns the system prompt of script mode, the system
+// info in it takes at most maxSystemInfoLen bytes.
+func GetScriptModePrompt(maxSystemInfoLen int) (string, error) {
+	systemInfo := GetSystemInfo(maxSystemInfoLen)
 	prompt := langchaingoprompts.PromptTemplate{
 		Template:       SysPromptForNWScriptMode,
 		TemplateFormat: langchaingoprompts.TemplateFormatGoTemplate,
 		InputVariables: []string{"system_info", "nuwa_script_format", "shell_script_format", "nuwa_script_example", "shell_example"},
 		PartialVariables: map[string]any{
-			"system_info": func() string {
-				info, err := system.GetSystemInfo().ToJSON()
-				if err != nil {
-					return ""
-				}
-				return info
-			}(),
+			"system_info":         systemInfo,
 			"nuwa_script_format": NuwaScriptFormat,
 			"shell_script_format": ShellScriptFormat,
 			"nuwa_script_example": NuwaScriptExample,
@@ -286,7 +374,7 @@ func GetScriptModePrompt() (string, error) {
 	}
 
 	return prompt.Format(map[string]any{
-		"system_info":         system.GetSystemInfo(),
+		"system_info":         systemInfo,
 		"nuwa_script_format":  NuwaScriptFormat,
 		"shell_script_format": ShellScriptFormat,
 		"nuwa_script_example": NuwaScriptExample,
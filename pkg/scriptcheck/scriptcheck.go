@@ -0,0 +1,501 @@
+// Package scriptcheck checks shell scripts before they run: their syntax,
+// the commands they need and the mistakes a shell linter would point out.
+package scriptcheck
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/policy"
+)
+
+// Severity is how bad a finding is, a script with errors can not work.
+type Severity int
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// The rules of the findings.
+const (
+	RuleSyntax           = "syntax"
+	RuleMissingCommand   = "missing-command"
+	RuleUnquotedVariable = "unquoted-variable"
+	RuleUnsafeGlob       = "unsafe-glob"
+	RuleStrictMode       = "strict-mode"
+)
+
+// Finding is a problem found in a script, Line is 0 when it is about the
+// whole script.
+type Finding struct {
+	Rule     string
+	Line     int
+	Severity Severity
+	Message  string
+}
+
+func (f Finding) String() string {
+	if f.Line > 0 {
+		return fmt.Sprintf("%s: line %d: %s (%s)", f.Severity, f.Line, f.Message, f.Rule)
+	}
+	return fmt.Sprintf("%s: %s (%s)", f.Severity, f.Message, f.Rule)
+}
+
+// Report returns the findings one per line, as they are shown to the user
+// and to the model.
+func Report(findings []Finding) string {
+	lines := make([]string, 0, len(findings))
+	for _, f := range findings {
+		lines = append(lines, f.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// HasErrors returns whether one of the findings is an error.
+func HasErrors(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Check runs all the checks on a bash script, the errors come first.
+func Check(ctx context.Context, script string) []Finding {
+	findings := checkSyntax(ctx, script)
+	findings = append(findings, checkCommands(script)...)
+	findings = append(findings, checkStrictMode(script)...)
+	findings = append(findings, checkUnquotedVariables(script)...)
+	return findings
+}
+
+var syntaxLine = regexp.MustCompile(`line (\d+): (.*)`)
+
+// checkSyntax parses the script with bash -n, nothing is run
+func checkSyntax(ctx context.Context, script string) []Finding {
+	cmd := exec.CommandContext(ctx, "bash", "-n")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		// a valid script, or bash can not be run to check it
+		return nil
+	}
+
+	output := strings.TrimSpace(stderr.String())
+	for _, line := range strings.Split(output, "\n") {
+		m := syntaxLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		return []Finding{{Rule: RuleSyntax, Line: n, Severity: SeverityError, Message: m[2]}}
+	}
+	if output == "" {
+		output = "bash -n failed: " + err.Error()
+	}
+	return []Finding{{Rule: RuleSyntax, Severity: SeverityError, Message: output}}
+}
+
+var (
+	// arithmetic (( ... )) looks like a command to the parser
+	arithmetic = regexp.MustCompile(`\(\([^()]*\)\)`)
+	// functions are defined as "name() {" or "function name {"
+	functionDef = regexp.MustCompile(`(?m)^\s*(?:function\s+([\w.:-]+)|([\w.:-]+)\s*\(\s*\))`)
+
+	// builtins are the builtins and keywords of bash, they are not in PATH
+	builtins = map[string]bool{
+		".": true, ":": true, "[": true, "[[": true, "]]": true, "{": true, "}": true, "!": true,
+		"alias": true, "bg": true, "bind": true, "break": true, "builtin": true, "caller": true,
+		"cd": true, "command": true, "compgen": true, "complete": true, "compopt": true,
+		"continue": true, "declare": true, "dirs": true, "disown": true, "echo": true,
+		"enable": true, "eval": true, "exec": true, "exit": true, "export": true, "false": true,
+		"fc": true, "fg": true, "getopts": true, "hash": true, "help": true, "history": true,
+		"jobs": true, "kill": true, "let": true, "local": true, "logout": true, "mapfile": true,
+		"popd": true, "printf": true, "pushd": true, "pwd": true, "read": true, "readarray": true,
+		"readonly": true, "return": true, "set": true, "shift": true, "shopt": true,
+		"source": true, "suspend": true, "test": true, "time": true, "times": true, "trap": true,
+		"true": true, "type": true, "typeset": true, "ulimit": true, "umask": true,
+		"unalias": true, "unset": true, "wait": true,
+	}
+)
+
+// lookups are the commands a script checks whether a command is installed with
+var lookups = map[string]bool{"type": true, "hash": true, "which": true}
+
+// packageManagers install the commands a script uses after them
+var packageManagers = map[string]bool{
+	"apt": true, "apt-get": true, "aptitude": true, "yum": true, "dnf": true, "zypper": true,
+	"apk": true, "pacman": true, "brew": true, "port": true, "snap": true, "pip": true,
+	"pip3": true, "pipx": true, "npm": true, "gem": true, "cargo": true,
+}
+
+// checkedNames returns the names a script looks up or installs, like jq in
+// "command -v jq" or "apt-get install -y jq", the script takes care of them
+// when they are missing
+func checkedNames(commands []policy.Command) map[string]bool {
+	names := map[string]bool{}
+	for _, cmd := range commands {
+		if cmd.Name() == "command" && len(cmd.Args) > 2 && (cmd.Args[1] == "-v" || cmd.Args[1] == "-V") {
+			for _, name := range cmd.Args[2:] {
+				names[name] = true
+			}
+			continue
+		}
+		args, _ := policy.Unwrap(cmd)
+		if len(args) == 0 {
+			continue
+		}
+		if name := filepath.Base(args[0]); lookups[name] || packageManagers[name] {
+			for _, arg := range args[1:] {
+				if !strings.HasPrefix(arg, "-") {
+					names[arg] = true
+				}
+			}
+		}
+	}
+	return names
+}
+
+// checkCommands finds the commands which are not installed and the rm
+// commands whose globs may remove more than meant. A missing command is a
+// warning, the script may install it before it runs it.
+func checkCommands(script string) []Finding {
+	commands, err := policy.Parse(arithmetic.ReplaceAllString(script, "true"))
+	if err != nil {
+		// bash -n reports the script if it can not be parsed
+		return nil
+	}
+	functions := map[string]bool{}
+	for _, m := range functionDef.FindAllStringSubmatch(script, -1) {
+		functions[m[1]+m[2]] = true
+	}
+
+	findings := []Finding{}
+	commands = flatten(commands)
+	seen := checkedNames(commands)
+	for _, cmd := range commands {
+		args, _ := policy.Unwrap(cmd)
+		names := []string{}
+		if len(cmd.Args) > 0 {
+			names = append(names, cmd.Args[0])
+		}
+		if len(args) > 0 && len(args) < len(cmd.Args) {
+			names = append(names, args[0])
+		}
+		for _, name := range names {
+			if seen[name] || functions[name] || !isMissing(name) {
+				continue
+			}
+			seen[name] = true
+			findings = append(findings, Finding{
+				Rule:     RuleMissingCommand,
+				Line:     lineOf(script, commandPattern(name)),
+				Severity: SeverityWarning,
+				Message:  fmt.Sprintf("command %s is not found in PATH", name),
+			})
+		}
+		if len(args) > 0 && filepath.Base(args[0]) == "rm" {
+			findings = append(findings, checkRmGlobs(script, args[1:])...)
+		}
+	}
+	return findings
+}
+
+// isMissing returns whether the command can not be found, the words which
+// are made when the script runs can not be checked
+func isMissing(name string) bool {
+	if name == "" || builtins[name] || strings.ContainsAny(name, "$`(){}=*?") {
+		return false
+	}
+	if strings.Contains(name, "/") {
+		if !filepath.IsAbs(name) {
+			// a relative path may be made by the script
+			return false
+		}
+		_, err := os.Stat(name)
+		return err != nil
+	}
+	_, err := exec.LookPath(name)
+	return err != nil
+}
+
+var leadingVariable = regexp.MustCompile(`^\$(\{[^}]*\}|\w+)`)
+
+// checkRmGlobs warns about globs after a variable, which remove from / when
+// the variable is empty, and globs which may expand to options
+func checkRmGlobs(script string, args []string) []Finding {
+	findings := []Finding{}
+	options := true
+	for _, arg := range args {
+		if options && arg == "--" {
+			options = false
+			continue
+		}
+		if options && strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if !strings.Contains(arg, "*") {
+			continue
+		}
+		// the part of the argument after its variable is as it is in the script
+		tail := leadingVariable.ReplaceAllString(arg, "")
+		line := lineOf(script, regexp.MustCompile(`\brm\b.*`+regexp.QuoteMeta(tail)))
+		switch {
+		case strings.HasPrefix(arg, "$") && !strings.Contains(arg, ":?"):
+			findings = append(findings, Finding{
+				Rule:     RuleUnsafeGlob,
+				Line:     line,
+				Severity: SeverityWarning,
+				Message:  fmt.Sprintf("rm %s removes from / when the variable is empty, use ${var:?} to stop on an empty variable", arg),
+			})
+		case strings.HasPrefix(arg, "*") && options:
+			findings = append(findings, Finding{
+				Rule:     RuleUnsafeGlob,
+				Line:     line,
+				Severity: SeverityWarning,
+				Message:  fmt.Sprintf("rm %s reads file names starting with - as options, use ./%s", arg, arg),
+			})
+		}
+	}
+	return findings
+}
+
+var setCommand = regexp.MustCompile(`^\s*set\s+(.*)$`)
+
+// checkStrictMode warns when the script does not stop on errors, unset
+// variables and failed pipes
+func checkStrictMode(script string) []Finding {
+	set := map[string]bool{}
+	for _, line := range strings.Split(script, "\n") {
+		m := setCommand.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		fields := strings.Fields(m[1])
+		for i, field := range fields {
+			switch {
+			case field == "-o" && i+1 < len(fields):
+				set[fields[i+1]] = true
+			case strings.HasPrefix(field, "-") && !strings.HasPrefix(field, "--"):
+				set["errexit"] = set["errexit"] || strings.Contains(field, "e")
+				set["nounset"] = set["nounset"] || strings.Contains(field, "u")
+				if strings.HasSuffix(field, "o") && i+1 < len(fields) {
+					set[fields[i+1]] = true
+				}
+			}
+		}
+	}
+
+	missing := []string{}
+	for _, option := range []struct{ name, flag string }{{"errexit", "-e"}, {"nounset", "-u"}, {"pipefail", "-o pipefail"}} {
+		if !set[option.name] {
+			missing = append(missing, option.flag)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return []Finding{{
+		Rule:     RuleStrictMode,
+		Severity: SeverityWarning,
+		Message:  fmt.Sprintf("the script does not set %s, start it with set -euo pipefail", strings.Join(missing, ", ")),
+	}}
+}
+
+var (
+	heredocStart   = regexp.MustCompile(`(?:^|[^<])<<-?\s*['"]?([\w-]+)['"]?`)
+	assignmentWord = regexp.MustCompile(`^[A-Za-z_]\w*(\[[^]]*\])?\+?=`)
+)
+
+// checkUnquotedVariables warns about variables outside of double quotes,
+// which are split into words and expanded as globs. Assignments, [[ ]] and
+// the words of for and case are not split, they are left alone.
+func checkUnquotedVariables(script string) []Finding {
+	findings := []Finding{}
+	var quote rune
+	heredoc := ""
+	for i, line := range strings.Split(script, "\n") {
+		if heredoc != "" {
+			if strings.TrimSpace(strings.TrimLeft(line, "\t")) == heredoc {
+				heredoc = ""
+			}
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if quote == 0 && (strings.HasPrefix(trimmed, "for ") || strings.HasPrefix(trimmed, "case ")) {
+			continue
+		}
+
+		var variables []string
+		quote, variables = unquotedVariables(line, quote)
+		seen := map[string]bool{}
+		for _, v := range variables {
+			if seen[v] {
+				continue
+			}
+			seen[v] = true
+			findings = append(findings, Finding{
+				Rule:     RuleUnquotedVariable,
+				Line:     i + 1,
+				Severity: SeverityWarning,
+				Message:  fmt.Sprintf("%s is not quoted, use \"%s\"", v, v),
+			})
+		}
+		if quote == 0 {
+			if m := heredocStart.FindStringSubmatch(line); m != nil {
+				heredoc = m[1]
+			}
+		}
+	}
+	return findings
+}
+
+// unquotedVariables returns the unquoted variables of a line, the quote is
+// the one the line starts in and the one it ends in
+func unquotedVariables(line string, quote rune) (rune, []string) {
+	variables := []string{}
+	runes := []rune(line)
+	wordStart, assignment, test := true, false, false
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if quote == '\'' {
+			if r == '\'' {
+				quote = 0
+			}
+			continue
+		}
+		if r == '\\' {
+			i++
+			wordStart = false
+			continue
+		}
+		if quote == '"' {
+			if r == '"' {
+				quote = 0
+			}
+			continue
+		}
+
+		switch {
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '#' && wordStart:
+			return quote, variables
+		case r == '(' && i+1 < len(runes) && runes[i+1] == '(':
+			// arithmetic is not split
+			end := strings.Index(string(runes[i:]), "))")
+			if end < 0 {
+				return quote, variables
+			}
+			i += len([]rune(string(runes[i:])[:end])) + 1
+		case unicode.IsSpace(r) || strings.ContainsRune(";|&()<>", r):
+			wordStart, assignment = true, false
+			continue
+		case r == '$':
+			if i+1 < len(runes) && runes[i+1] == '(' {
+				// command substitution is left alone, arithmetic is skipped
+				if i+2 < len(runes) && runes[i+2] == '(' {
+					end := strings.Index(string(runes[i:]), "))")
+					if end < 0 {
+						return quote, variables
+					}
+					i += len([]rune(string(runes[i:])[:end])) + 1
+				}
+				break
+			}
+			name, n := variableName(runes[i+1:])
+			i += n
+			if bare := strings.TrimPrefix(name, "{"); bare != "" && !assignment && !test && !strings.ContainsAny(bare[:1], "?#$!-") {
+				variables = append(variables, "$"+name)
+			}
+		default:
+			if wordStart {
+				rest := string(runes[i:])
+				switch {
+				case strings.HasPrefix(rest, "[["):
+					test = true
+				case strings.HasPrefix(rest, "]]"):
+					test = false
+				case assignmentWord.MatchString(rest):
+					assignment = true
+				}
+			}
+		}
+		wordStart = false
+	}
+	return quote, variables
+}
+
+// variableName reads the name of a variable after $, like "HOME" or
+// "{files[@]}", it returns the name and the number of runes read
+func variableName(runes []rune) (string, int) {
+	if len(runes) == 0 {
+		return "", 0
+	}
+	if runes[0] == '{' {
+		for i, r := range runes {
+			if r == '}' {
+				return string(runes[:i+1]), i + 1
+			}
+		}
+		return "", 0
+	}
+	n := 0
+	for n < len(runes) && (runes[n] == '_' || unicode.IsLetter(runes[n]) || unicode.IsDigit(runes[n])) {
+		n++
+	}
+	if n == 0 && strings.ContainsRune("@*?#$!-", runes[0]) {
+		n = 1
+	}
+	return string(runes[:n]), n
+}
+
+// commandPattern matches a command name as a word of a line
+func commandPattern(name string) *regexp.Regexp {
+	return regexp.MustCompile(`(^|[\s;|&(` + "`" + `])` + regexp.QuoteMeta(name) + `($|[\s;|&)])`)
+}
+
+// lineOf returns the first line matching the pattern which is not a
+// comment, 0 when there is none
+func lineOf(script string, pattern *regexp.Regexp) int {
+	for i, line := range strings.Split(script, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if pattern.MatchString(line) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// flatten returns the commands and all the commands nested in them
+func flatten(commands []policy.Command) []policy.Command {
+	result := []policy.Command{}
+	for _, cmd := range commands {
+		result = append(result, cmd)
+		result = append(result, flatten(cmd.Nested)...)
+	}
+	return result
+}
@@ -0,0 +1,92 @@
+package scriptcheck
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func rules(findings []Finding) []string {
+	result := []string{}
+	for _, f := range findings {
+		result = append(result, f.Rule)
+	}
+	return result
+}
+
+func TestCheckCleanScript(t *testing.T) {
+	script := `#!/bin/bash
+set -euo pipefail
+backup() {
+  local dir=$1
+  tar czf "$dir.tgz" "$dir"
+}
+count=$(ls | wc -l)
+if [[ $count -gt 0 ]]; then
+  backup "$HOME/docs"
+fi
+for f in $FILES; do echo "$f"; done
+(( total = count + 1 ))
+echo "total: $((total * 2)) $?"
+cat <<EOF
+unquoted $HOME in a heredoc
+EOF
+rm -rf -- "${dir:?}"/*
+`
+	assert.Empty(t, Check(context.Background(), script))
+}
+
+func TestCheckSyntax(t *testing.T) {
+	findings := Check(context.Background(), "set -euo pipefail\nif true; then\n  echo hi\n")
+	assert.Equal(t, RuleSyntax, findings[0].Rule)
+	assert.Equal(t, SeverityError, findings[0].Severity)
+	assert.Greater(t, findings[0].Line, 0)
+	assert.True(t, HasErrors(findings))
+}
+
+func TestCheckMissingCommand(t *testing.T) {
+	findings := Check(context.Background(), "set -euo pipefail\n# nuwa-no-such-tool\nls\nenv -u HOME nuwa-no-such-tool --all\n")
+	assert.Equal(t, []Finding{{
+		Rule:     RuleMissingCommand,
+		Line:     4,
+		Severity: SeverityWarning,
+		Message:  "command nuwa-no-such-tool is not found in PATH",
+	}}, findings)
+	assert.Equal(t, "warning: line 4: command nuwa-no-such-tool is not found in PATH (missing-command)", Report(findings))
+	assert.False(t, HasErrors(findings))
+
+	// a command the script installs or looks up first is not reported
+	findings = Check(context.Background(), `set -euo pipefail
+env DEBIAN_FRONTEND=noninteractive apt-get install -y nuwa-no-such-tool
+nuwa-no-such-tool --all
+if ! command -v nuwa-other-tool >/dev/null; then
+  pip3 install --user nuwa-other-tool
+fi
+nuwa-other-tool
+type nuwa-third-tool && nuwa-third-tool
+`)
+	// the package managers themselves may be missing on this system
+	assert.NotContains(t, Report(findings), "nuwa-")
+}
+
+func TestCheckLint(t *testing.T) {
+	script := `#!/bin/bash
+set -e
+echo $HOME "$USER" '$PATH'
+cp $1 ${TARGET}/ > $LOG
+rm -rf $dir/*
+rm -f *.log
+`
+	findings := Check(context.Background(), script)
+	assert.Equal(t, []string{RuleUnsafeGlob, RuleUnsafeGlob, RuleStrictMode, RuleUnquotedVariable,
+		RuleUnquotedVariable, RuleUnquotedVariable, RuleUnquotedVariable, RuleUnquotedVariable}, rules(findings))
+	assert.False(t, HasErrors(findings))
+	assert.Equal(t, 5, findings[0].Line)
+	assert.Equal(t, 6, findings[1].Line)
+	assert.Contains(t, findings[2].Message, "-u, -o pipefail")
+	assert.Equal(t, 3, findings[3].Line)
+	assert.Equal(t, `$HOME is not quoted, use "$HOME"`, findings[3].Message)
+	assert.Equal(t, `${TARGET} is not quoted, use "${TARGET}"`, findings[5].Message)
+	assert.Equal(t, 5, findings[7].Line)
+}
@@ -0,0 +1,309 @@
+// Package scriptlib keeps the task scripts worth running again, with the
+// request they were made for and the history of their runs.
+package scriptlib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/config"
+	"github.com/darmenliu/nuwa-terminal-chat/pkg/history"
+)
+
+const (
+	// LibraryDir is not the scripts directory, where task mode writes the
+	// scripts it is running
+	LibraryDir = "library"
+
+	scriptExt = ".sh"
+	metaExt   = ".json"
+	// maxRuns is how many runs of a script are remembered
+	maxRuns = 50
+	// maxNameWords is how many words of the request make the name of a script
+	maxNameWords = 5
+)
+
+// ErrScriptNotFound is returned when the library has no script with the name.
+var ErrScriptNotFound = errors.New("script not found")
+
+// Script is a script of the library, its content is kept in <name>.sh, or
+// the extension of its language, and the rest in <name>.json, so the script
+// can be run or edited as it is.
+type Script struct {
+	Name string `json:"name"`
+	// Prompt is the request in natural language the script was made for
+	Prompt string `json:"prompt"`
+	Model  string `json:"model,omitempty"`
+	// Language is the language of the script, bash when empty, and
+	// Extension the extension of its file
+	Language  string    `json:"language,omitempty"`
+	Extension string    `json:"extension,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Runs      []Run     `json:"runs,omitempty"`
+	Content   string    `json:"-"`
+}
+
+// Run is a run of a script.
+type Run struct {
+	Time     time.Time     `json:"time"`
+	ExitCode int           `json:"exit_code"`
+	Duration time.Duration `json:"duration"`
+}
+
+// LastRun returns the last run of the script, nil if it never ran.
+func (s *Script) LastRun() *Run {
+	if len(s.Runs) == 0 {
+		return nil
+	}
+	return &s.Runs[len(s.Runs)-1]
+}
+
+// Library keeps the scripts in a directory.
+type Library struct {
+	dir string
+}
+
+// DefaultLibraryDir returns the directory of the library in the home directory.
+func DefaultLibraryDir() string {
+	return config.HomePath(LibraryDir)
+}
+
+func NewLibrary(dir string) *Library {
+	return &Library{dir: dir}
+}
+
+// Path returns the file of the script, it can be run with the interpreter of its language.
+func (l *Library) Path(script *Script) string {
+	if script.Extension != "" {
+		return filepath.Join(l.dir, script.Name+script.Extension)
+	}
+	return filepath.Join(l.dir, script.Name+scriptExt)
+}
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// CheckName returns an error if the name can not be the name of a script.
+func CheckName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid script name %q, use lowercase letters, digits, - and _", name)
+	}
+	return nil
+}
+
+// Add keeps a new script. Without a name, the script is named after the
+// words of its prompt. A script with the same content as one of the
+// library is not added again, the script of the library is returned.
+func (l *Library) Add(script *Script) (*Script, error) {
+	scripts, err := l.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, existing := range scripts {
+		if strings.TrimSpace(existing.Content) == strings.TrimSpace(script.Content) {
+			return existing, nil
+		}
+	}
+
+	if script.Name == "" {
+		script.Name = l.freeName(NameFromPrompt(script.Prompt))
+	} else if _, err := l.Get(script.Name); err == nil {
+		return nil, fmt.Errorf("script %s already exists", script.Name)
+	}
+	if script.CreatedAt.IsZero() {
+		script.CreatedAt = time.Now()
+	}
+	script.UpdatedAt = script.CreatedAt
+	if err := l.Save(script); err != nil {
+		return nil, err
+	}
+	return script, nil
+}
+
+// freeName returns the name, or the name with a number when it is taken
+func (l *Library) freeName(name string) string {
+	candidate := name
+	for i := 2; ; i++ {
+		if _, err := os.Stat(l.metaPath(candidate)); errors.Is(err, os.ErrNotExist) {
+			return candidate
+		}
+		candidate = name + "-" + strconv.Itoa(i)
+	}
+}
+
+// NameFromPrompt makes a script name of the first words of a prompt, like
+// "backup-home-directory" for "Backup my home directory".
+func NameFromPrompt(prompt string) string {
+	words := strings.FieldsFunc(strings.ToLower(prompt), func(r rune) bool {
+		return !('a' <= r && r <= 'z' || '0' <= r && r <= '9')
+	})
+	kept := []string{}
+	for _, word := range words {
+		if len(kept) == maxNameWords {
+			break
+		}
+		if fillerWords[word] {
+			continue
+		}
+		kept = append(kept, word)
+	}
+	if len(kept) == 0 {
+		return "script"
+	}
+	return strings.Join(kept, "-")
+}
+
+// fillerWords are left out of the names made of prompts
+var fillerWords = map[string]bool{
+	"a": true, "an": true, "the": true, "my": true, "me": true, "please": true,
+	"to": true, "of": true, "for": true, "and": true, "in": true, "on": true,
+	"all": true, "i": true, "want": true, "script": true, "write": true,
+}
+
+// Save writes the script and its details, replacing them.
+func (l *Library) Save(script *Script) error {
+	if err := CheckName(script.Name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create script library: %w", err)
+	}
+	if err := os.WriteFile(l.Path(script), []byte(script.Content), 0o700); err != nil {
+		return fmt.Errorf("failed to save script: %w", err)
+	}
+	data, err := json.MarshalIndent(script, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode script: %w", err)
+	}
+	if err := os.WriteFile(l.metaPath(script.Name), data, 0o600); err != nil {
+		return fmt.Errorf("failed to save script: %w", err)
+	}
+	return nil
+}
+
+// Get returns the script with the name.
+func (l *Library) Get(name string) (*Script, error) {
+	if err := CheckName(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(l.metaPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrScriptNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read script: %w", err)
+	}
+	script := &Script{}
+	if err := json.Unmarshal(data, script); err != nil {
+		return nil, fmt.Errorf("failed to parse script %s: %w", name, err)
+	}
+	script.Name = name
+	content, err := os.ReadFile(l.Path(script))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read script: %w", err)
+	}
+	script.Content = string(content)
+	return script, nil
+}
+
+// List returns the scripts sorted by name.
+func (l *Library) List() ([]*Script, error) {
+	files, err := os.ReadDir(l.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []*Script{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read script library: %w", err)
+	}
+
+	scripts := []*Script{}
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), metaExt)
+		if !ok || file.IsDir() || CheckName(name) != nil {
+			continue
+		}
+		script, err := l.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, script)
+	}
+	sort.Slice(scripts, func(i, j int) bool { return scripts[i].Name < scripts[j].Name })
+	return scripts, nil
+}
+
+// Delete removes the script with the name.
+func (l *Library) Delete(name string) error {
+	script, err := l.Get(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(l.metaPath(name)); err != nil {
+		return fmt.Errorf("failed to delete script: %w", err)
+	}
+	if err := os.Remove(l.Path(script)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete script: %w", err)
+	}
+	return nil
+}
+
+// RecordRun adds a run to the history of the script, the oldest runs are forgotten.
+func (l *Library) RecordRun(name string, run Run) error {
+	script, err := l.Get(name)
+	if err != nil {
+		return err
+	}
+	if run.Time.IsZero() {
+		run.Time = time.Now()
+	}
+	script.Runs = append(script.Runs, run)
+	if len(script.Runs) > maxRuns {
+		script.Runs = script.Runs[len(script.Runs)-maxRuns:]
+	}
+	return l.Save(script)
+}
+
+// Search returns the scripts whose name, prompt or tags match the query
+// fuzzily, the best matches first.
+func (l *Library) Search(query string) ([]*Script, error) {
+	scripts, err := l.List()
+	if err != nil {
+		return nil, err
+	}
+	type match struct {
+		script *Script
+		score  int
+	}
+	matches := []match{}
+	for _, script := range scripts {
+		best, found := 0, false
+		for _, text := range append([]string{script.Name, script.Prompt}, script.Tags...) {
+			if score, ok := history.FuzzyScore(query, text); ok && (!found || score > best) {
+				best, found = score, true
+			}
+		}
+		if found {
+			matches = append(matches, match{script, best})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+
+	found := make([]*Script, 0, len(matches))
+	for _, m := range matches {
+		found = append(found, m.script)
+	}
+	return found, nil
+}
+
+func (l *Library) metaPath(name string) string {
+	return filepath.Join(l.dir, name+metaExt)
+}
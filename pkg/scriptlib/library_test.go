@@ -0,0 +1,69 @@
+package scriptlib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNameFromPrompt(t *testing.T) {
+	assert.Equal(t, "backup-home-directory", NameFromPrompt("Backup my home directory"))
+	assert.Equal(t, "find-large-files-under-var", NameFromPrompt("find all large files under /var, then delete them"))
+	assert.Equal(t, "script", NameFromPrompt("???"))
+}
+
+func TestLibrary(t *testing.T) {
+	dir := t.TempDir()
+	lib := NewLibrary(dir)
+	// a script being run by nuwa is not part of the library
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "0b6c1c2e.sh"), []byte("echo tmp"), 0o700))
+
+	backup, err := lib.Add(&Script{Prompt: "Backup my home directory", Model: "deepseek-chat", Content: "tar czf home.tgz ~\n"})
+	assert.NoError(t, err)
+	assert.Equal(t, "backup-home-directory", backup.Name)
+	data, err := os.ReadFile(lib.Path(backup))
+	assert.NoError(t, err)
+	assert.Equal(t, "tar czf home.tgz ~\n", string(data))
+
+	// the same script is kept once, another one with the same prompt gets a number
+	again, err := lib.Add(&Script{Prompt: "backup home directory", Content: "tar czf home.tgz ~"})
+	assert.NoError(t, err)
+	assert.Equal(t, backup.Name, again.Name)
+	other, err := lib.Add(&Script{Prompt: "backup home directory", Tags: []string{"disk"}, Content: "rsync -a ~ /backup"})
+	assert.NoError(t, err)
+	assert.Equal(t, "backup-home-directory-2", other.Name)
+	_, err = lib.Add(&Script{Name: other.Name, Content: "ls"})
+	assert.ErrorContains(t, err, "already exists")
+
+	assert.NoError(t, lib.RecordRun(backup.Name, Run{ExitCode: 1}))
+	assert.NoError(t, lib.RecordRun(backup.Name, Run{ExitCode: 0}))
+	got, err := lib.Get(backup.Name)
+	assert.NoError(t, err)
+	assert.Len(t, got.Runs, 2)
+	assert.Equal(t, 0, got.LastRun().ExitCode)
+	assert.Equal(t, "deepseek-chat", got.Model)
+
+	scripts, err := lib.List()
+	assert.NoError(t, err)
+	assert.Len(t, scripts, 2)
+	found, err := lib.Search("disk")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{other.Name}, []string{found[0].Name})
+
+	assert.NoError(t, lib.Delete(backup.Name))
+	_, err = lib.Get(backup.Name)
+	assert.ErrorIs(t, err, ErrScriptNotFound)
+	assert.ErrorIs(t, lib.Delete(backup.Name), ErrScriptNotFound)
+	assert.Error(t, CheckName("../etc"))
+
+	// a script of another language is kept with its extension
+	count, err := lib.Add(&Script{Prompt: "count lines", Language: "python", Extension: ".py", Content: "print(1)\n"})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "count-lines.py"), lib.Path(count))
+	got, err = lib.Get(count.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, "python", got.Language)
+	assert.Equal(t, "print(1)\n", got.Content)
+}
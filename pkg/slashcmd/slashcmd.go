@@ -0,0 +1,402 @@
+// Package slashcmd is the registry of the commands typed as "/name args" in
+// the interactive terminal. Packages register their commands with Register,
+// the terminal runs them with Execute and completes them with Complete.
+package slashcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/pterm/pterm"
+)
+
+// Prefix starts a slash command.
+const Prefix = "/"
+
+// ErrUnknownCommand is returned when no command is registered with the name.
+var ErrUnknownCommand = errors.New("unknown command")
+
+// ErrUsage is returned by a command whose arguments are wrong, the usage of
+// the command is shown.
+var ErrUsage = errors.New("wrong arguments")
+
+// Command is a slash command.
+type Command struct {
+	// Name is typed after the slash, like "mode" for /mode
+	Name    string
+	Aliases []string
+	// Args describes the arguments in the help, like "[name]"
+	Args        string
+	Description string
+	// Complete returns the candidates for the last argument, the arguments
+	// before it are given. It may be nil.
+	Complete func(args []string) []Suggestion
+	// Run runs the command with its arguments.
+	Run func(ctx context.Context, args []string) error
+}
+
+// Usage returns how the command is typed, like "/mode [name]".
+func (c *Command) Usage() string {
+	return strings.TrimSpace(Prefix + c.Name + " " + c.Args)
+}
+
+// Suggestion is a completion candidate.
+type Suggestion struct {
+	Text        string
+	Description string
+}
+
+// Registry holds the commands by name.
+type Registry struct {
+	mu       sync.RWMutex
+	commands map[string]*Command
+	aliases  map[string]string
+	// deprecated maps the words typed without the slash to their command
+	deprecated map[string]string
+}
+
+// NewRegistry returns a registry with the /help command.
+func NewRegistry() *Registry {
+	r := &Registry{commands: map[string]*Command{}, aliases: map[string]string{}, deprecated: map[string]string{}}
+	r.Register(&Command{
+		Name:        "help",
+		Args:        "[command]",
+		Description: "Show the commands, or the usage of one command",
+		Complete: func(args []string) []Suggestion {
+			if len(args) > 1 {
+				return nil
+			}
+			return r.nameSuggestions("")
+		},
+		Run: func(ctx context.Context, args []string) error {
+			return r.showHelp(args)
+		},
+	})
+	return r
+}
+
+// Register adds a command, its name and aliases must not be taken.
+func (r *Registry) Register(cmd *Command) error {
+	if cmd.Name == "" || cmd.Run == nil {
+		return fmt.Errorf("command %q has no name or no run function", cmd.Name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if !validName(name) {
+			return fmt.Errorf("invalid command name %q", name)
+		}
+		if _, ok := r.lookup(name); ok {
+			return fmt.Errorf("command %s%s is already registered", Prefix, name)
+		}
+	}
+	r.commands[cmd.Name] = cmd
+	for _, alias := range cmd.Aliases {
+		r.aliases[alias] = cmd.Name
+	}
+	return nil
+}
+
+// Deprecate makes a word typed without the slash run a command, like
+// "clearchat" for "/clear". The command of the input must be registered.
+func (r *Registry) Deprecate(word string, input string) error {
+	name, _, err := Parse(input)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.lookup(name); !ok {
+		return fmt.Errorf("%w %s%s", ErrUnknownCommand, Prefix, name)
+	}
+	if _, ok := r.deprecated[word]; ok || strings.ContainsFunc(word, unicode.IsSpace) {
+		return fmt.Errorf("invalid or taken word %q", word)
+	}
+	r.deprecated[word] = input
+	return nil
+}
+
+// Deprecated returns the slash command of an input starting with a
+// deprecated word, like "/sessions list" for "sessions list", and the word.
+// The word alone is the command, arguments are taken only when the first one
+// is known to the command, so a request like "usage of the disk" is not a
+// command.
+func (r *Registry) Deprecated(input string) (string, string, bool) {
+	word, rest, _ := strings.Cut(strings.TrimSpace(input), " ")
+	r.mu.RLock()
+	target, ok := r.deprecated[word]
+	r.mu.RUnlock()
+	if !ok {
+		return "", "", false
+	}
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return target, word, true
+	}
+
+	name, args, err := Parse(target)
+	if err != nil || len(args) > 0 {
+		return "", "", false
+	}
+	cmd, ok := r.Lookup(name)
+	if !ok || cmd.Complete == nil {
+		return "", "", false
+	}
+	first, _, _ := strings.Cut(rest, " ")
+	for _, s := range cmd.Complete([]string{""}) {
+		if s.Text == first {
+			return target + " " + rest, word, true
+		}
+	}
+	return "", "", false
+}
+
+// Lookup returns the command with the name or alias.
+func (r *Registry) Lookup(name string) (*Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.lookup(name)
+}
+
+func (r *Registry) lookup(name string) (*Command, bool) {
+	if target, ok := r.aliases[name]; ok {
+		name = target
+	}
+	cmd, ok := r.commands[name]
+	return cmd, ok
+}
+
+// Commands returns the commands sorted by name.
+func (r *Registry) Commands() []*Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	commands := make([]*Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		commands = append(commands, cmd)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+// Execute runs the slash command of the input.
+func (r *Registry) Execute(ctx context.Context, input string) error {
+	name, args, err := Parse(input)
+	if err != nil {
+		return err
+	}
+	cmd, ok := r.Lookup(name)
+	if !ok {
+		return fmt.Errorf("%w %s%s, %shelp lists the commands", ErrUnknownCommand, Prefix, name, Prefix)
+	}
+	err = cmd.Run(ctx, args)
+	if errors.Is(err, ErrUsage) {
+		return fmt.Errorf("%w, usage: %s", err, cmd.Usage())
+	}
+	return err
+}
+
+// Complete returns the candidates for the input: the commands while the
+// name is typed, then the candidates of the command for its arguments.
+func (r *Registry) Complete(input string) []Suggestion {
+	if !IsCommand(input) && input != Prefix {
+		return nil
+	}
+	rest := strings.TrimPrefix(input, Prefix)
+	name, argText, hasArgs := strings.Cut(rest, " ")
+	if !hasArgs {
+		return r.nameSuggestions(name)
+	}
+
+	cmd, ok := r.Lookup(name)
+	if !ok || cmd.Complete == nil {
+		return nil
+	}
+	args, err := SplitArgs(argText)
+	if err != nil {
+		return nil
+	}
+	// a trailing space starts a new argument
+	if len(args) == 0 || strings.HasSuffix(argText, " ") {
+		args = append(args, "")
+	}
+	last := args[len(args)-1]
+	suggestions := []Suggestion{}
+	for _, s := range cmd.Complete(args) {
+		if strings.HasPrefix(s.Text, last) {
+			suggestions = append(suggestions, s)
+		}
+	}
+	return suggestions
+}
+
+func (r *Registry) nameSuggestions(prefix string) []Suggestion {
+	suggestions := []Suggestion{}
+	for _, cmd := range r.Commands() {
+		if strings.HasPrefix(cmd.Name, prefix) {
+			suggestions = append(suggestions, Suggestion{Text: Prefix + cmd.Name, Description: cmd.Description})
+		}
+	}
+	return suggestions
+}
+
+func (r *Registry) showHelp(args []string) error {
+	if len(args) > 1 {
+		return ErrUsage
+	}
+	if len(args) == 1 {
+		cmd, ok := r.Lookup(strings.TrimPrefix(args[0], Prefix))
+		if !ok {
+			return fmt.Errorf("%w %s", ErrUnknownCommand, args[0])
+		}
+		fmt.Println(cmd.Usage())
+		fmt.Println("  " + cmd.Description)
+		if len(cmd.Aliases) > 0 {
+			fmt.Println("  aliases: " + Prefix + strings.Join(cmd.Aliases, ", "+Prefix))
+		}
+		if words := r.deprecatedWords(cmd.Name); len(words) > 0 {
+			fmt.Println("  deprecated: " + strings.Join(words, ", "))
+		}
+		return nil
+	}
+
+	data := pterm.TableData{{"Command", "Description"}}
+	for _, cmd := range r.Commands() {
+		data = append(data, []string{cmd.Usage(), cmd.Description})
+	}
+	return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
+
+// deprecatedWords returns the deprecated words of the command, sorted
+func (r *Registry) deprecatedWords(name string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	words := []string{}
+	for word, input := range r.deprecated {
+		if target, _, err := Parse(input); err == nil && target == name {
+			words = append(words, word)
+		}
+	}
+	sort.Strings(words)
+	return words
+}
+
+// IsCommand reports whether the input is a slash command: a slash followed
+// by a name, "/usr/bin/ls" is a path and not a command.
+func IsCommand(input string) bool {
+	rest, ok := strings.CutPrefix(input, Prefix)
+	if !ok {
+		return false
+	}
+	name, _, _ := strings.Cut(rest, " ")
+	return validName(name)
+}
+
+// Parse splits a slash command into its name and arguments, the arguments
+// are split like a shell does, with quotes and backslashes.
+func Parse(input string) (string, []string, error) {
+	input = strings.TrimSpace(input)
+	if !IsCommand(input) {
+		return "", nil, fmt.Errorf("not a command: %s", input)
+	}
+	name, argText, _ := strings.Cut(strings.TrimPrefix(input, Prefix), " ")
+	args, err := SplitArgs(argText)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, args, nil
+}
+
+// SplitArgs splits the arguments at whitespace, quoted parts and escaped
+// characters are kept in one argument.
+func SplitArgs(text string) ([]string, error) {
+	args := []string{}
+	var arg strings.Builder
+	inArg, escaped := false, false
+	var quote rune
+	for _, c := range text {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote, inArg = c, true
+		case unicode.IsSpace(c):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in: %s", text)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in: %s", text)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultRegistry has the commands of the terminal
+var defaultRegistry = NewRegistry()
+
+// Register adds a command to the commands of the terminal.
+func Register(cmd *Command) error {
+	return defaultRegistry.Register(cmd)
+}
+
+// Execute runs the slash command of the input with the commands of the terminal.
+func Execute(ctx context.Context, input string) error {
+	return defaultRegistry.Execute(ctx, input)
+}
+
+// Complete returns the completion candidates of the input for the commands of the terminal.
+func Complete(input string) []Suggestion {
+	return defaultRegistry.Complete(input)
+}
+
+// Deprecate makes a word typed without the slash run a command of the terminal.
+func Deprecate(word string, input string) error {
+	return defaultRegistry.Deprecate(word, input)
+}
+
+// Deprecated returns the slash command of an input starting with a deprecated word.
+func Deprecated(input string) (string, string, bool) {
+	return defaultRegistry.Deprecated(input)
+}
+
+// Lookup returns the command of the terminal with the name or alias.
+func Lookup(name string) (*Command, bool) {
+	return defaultRegistry.Lookup(name)
+}
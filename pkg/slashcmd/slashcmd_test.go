@@ -0,0 +1,105 @@
+package slashcmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitArgs(t *testing.T) {
+	args, err := SplitArgs(`save "my chat.md"  it\'s 'a b'`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"save", "my chat.md", "it's", "a b"}, args)
+
+	args, err = SplitArgs("   ")
+	assert.NoError(t, err)
+	assert.Empty(t, args)
+
+	_, err = SplitArgs(`"open`)
+	assert.ErrorContains(t, err, "unterminated quote")
+}
+
+func TestParse(t *testing.T) {
+	name, args, err := Parse(" /model  gpt-4o ")
+	assert.NoError(t, err)
+	assert.Equal(t, "model", name)
+	assert.Equal(t, []string{"gpt-4o"}, args)
+
+	assert.True(t, IsCommand("/help"))
+	assert.False(t, IsCommand("/usr/bin/ls -l"))
+	assert.False(t, IsCommand("/"))
+	assert.False(t, IsCommand("help"))
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	var got []string
+	cmd := &Command{
+		Name:    "mode",
+		Aliases: []string{"m"},
+		Args:    "<name>",
+		Complete: func(args []string) []Suggestion {
+			return []Suggestion{{Text: "chatmode"}, {Text: "cmdmode"}}
+		},
+		Run: func(ctx context.Context, args []string) error {
+			if len(args) != 1 {
+				return ErrUsage
+			}
+			got = args
+			return nil
+		},
+	}
+	assert.NoError(t, r.Register(cmd))
+	assert.ErrorContains(t, r.Register(&Command{Name: "m", Run: cmd.Run}), "already registered")
+	assert.Error(t, r.Register(&Command{Name: "a/b", Run: cmd.Run}))
+
+	ctx := context.Background()
+	assert.NoError(t, r.Execute(ctx, "/m cmdmode"))
+	assert.Equal(t, []string{"cmdmode"}, got)
+	assert.ErrorContains(t, r.Execute(ctx, "/mode"), "usage: /mode <name>")
+	assert.ErrorIs(t, r.Execute(ctx, "/nothing"), ErrUnknownCommand)
+
+	assert.Equal(t, []Suggestion{{Text: "/mode"}}, r.Complete("/mo"))
+	assert.Len(t, r.Complete("/"), 2)
+	assert.Equal(t, []Suggestion{{Text: "cmdmode"}}, r.Complete("/mode cm"))
+	assert.Len(t, r.Complete("/mode "), 2)
+	assert.Nil(t, r.Complete("/usr/bin"))
+}
+
+func TestDeprecated(t *testing.T) {
+	r := NewRegistry()
+	run := func(ctx context.Context, args []string) error { return nil }
+	assert.NoError(t, r.Register(&Command{Name: "clear", Run: run}))
+	assert.NoError(t, r.Register(&Command{
+		Name: "usage",
+		Complete: func(args []string) []Suggestion {
+			return []Suggestion{{Text: "all"}}
+		},
+		Run: run,
+	}))
+	assert.NoError(t, r.Register(&Command{Name: "mode", Run: run}))
+	assert.NoError(t, r.Deprecate("clearchat", "/clear"))
+	assert.NoError(t, r.Deprecate("usage", "/usage"))
+	assert.NoError(t, r.Deprecate("chatmode", "/mode chat"))
+	assert.Error(t, r.Deprecate("clearchat", "/clear"))
+	assert.ErrorIs(t, r.Deprecate("newchat", "/new"), ErrUnknownCommand)
+
+	command, word, ok := r.Deprecated(" clearchat ")
+	assert.True(t, ok)
+	assert.Equal(t, "/clear", command)
+	assert.Equal(t, "clearchat", word)
+
+	command, _, ok = r.Deprecated("usage all")
+	assert.True(t, ok)
+	assert.Equal(t, "/usage all", command)
+	command, _, ok = r.Deprecated("chatmode")
+	assert.True(t, ok)
+	assert.Equal(t, "/mode chat", command)
+
+	// a request starting with the word is not a command
+	for _, input := range []string{"usage of the disk in /var", "clearchat please", "chatmode on", "clear the screen"} {
+		_, _, ok := r.Deprecated(input)
+		assert.False(t, ok, input)
+	}
+}
@@ -6,15 +6,29 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"sort"
 	"strings"
 )
 
+// commonTools are kept first when the list of tools has to be cut, they are
+// what the generated commands and scripts use most
+var commonTools = []string{
+	"bash", "sh", "sudo", "grep", "sed", "awk", "find", "xargs", "sort", "uniq", "head", "tail", "cut", "tr", "wc",
+	"cat", "ls", "cp", "mv", "rm", "mkdir", "chmod", "chown", "ln", "tar", "gzip", "zip", "unzip",
+	"curl", "wget", "ssh", "scp", "rsync", "git", "jq", "yq", "python3", "python", "perl", "make", "gcc", "go", "node", "npm",
+	"ps", "top", "kill", "pkill", "free", "df", "du", "lsof", "uptime", "uname", "lscpu", "lsblk", "mount",
+	"ip", "ss", "netstat", "ping", "dig", "nslookup", "iptables", "systemctl", "journalctl", "service", "crontab",
+	"docker", "podman", "kubectl", "helm", "apt", "apt-get", "dpkg", "yum", "dnf", "rpm", "apk", "pacman", "zypper", "brew",
+}
+
 type SystemInfo struct {
 	OS             OSInfo   `json:"os"`
 	Arch           string   `json:"arch"`
 	CPU            int      `json:"cpu"`
 	Memory         string   `json:"memory"`
 	AvailableTools []string `json:"available_tools"`
+	// OmittedTools is how many tools were left out to keep the info short
+	OmittedTools int `json:"omitted_tools,omitempty"`
 }
 
 type OSInfo struct {
@@ -99,6 +113,8 @@ func getAvailableTools() []string {
 	for tool := range toolSet {
 		availableTools = append(availableTools, tool)
 	}
+	// sorted, so the prompts stay the same from one run to the next
+	sort.Strings(availableTools)
 
 	return availableTools
 }
@@ -116,6 +132,64 @@ func (si SystemInfo) ToJSON() (string, error) {
 	return string(jsonBytes), nil
 }
 
+// ToJSONWithin converts SystemInfo to a JSON string of at most maxLen bytes
+// if it can, the available tools which do not fit are left out, the common
+// ones are kept first.
+func (si SystemInfo) ToJSONWithin(maxLen int) (string, error) {
+	info, err := si.ToJSON()
+	if err != nil || len(info) <= maxLen {
+		return info, err
+	}
+
+	tools := prioritizeTools(si.AvailableTools)
+	trimmed := si
+	trimmed.AvailableTools = []string{}
+	// the count is at most the number of tools, its length is an upper bound
+	trimmed.OmittedTools = len(tools)
+	base, err := trimmed.ToJSON()
+	if err != nil {
+		return "", err
+	}
+
+	size := len(base)
+	kept := 0
+	for _, tool := range tools {
+		quoted, _ := json.Marshal(tool)
+		// the tool and the comma before it
+		if size+len(quoted)+1 > maxLen {
+			break
+		}
+		size += len(quoted) + 1
+		kept++
+	}
+	trimmed.AvailableTools = tools[:kept]
+	trimmed.OmittedTools = len(tools) - kept
+	return trimmed.ToJSON()
+}
+
+// prioritizeTools returns the common tools which are available, then the
+// others sorted by name
+func prioritizeTools(available []string) []string {
+	set := make(map[string]bool, len(available))
+	for _, tool := range available {
+		set[tool] = true
+	}
+
+	tools := make([]string, 0, len(available))
+	for _, tool := range commonTools {
+		if set[tool] {
+			tools = append(tools, tool)
+			delete(set, tool)
+		}
+	}
+	rest := make([]string, 0, len(set))
+	for tool := range set {
+		rest = append(rest, tool)
+	}
+	sort.Strings(rest)
+	return append(tools, rest...)
+}
+
 // 新增函数：将 SystemInfo 转换为格式化的 JSON 字符串
 func (si SystemInfo) ToPrettyJSON() (string, error) {
 	jsonBytes, err := json.MarshalIndent(si, "", "  ")
@@ -0,0 +1,32 @@
+package system
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToJSONWithin(t *testing.T) {
+	info := SystemInfo{OS: OSInfo{Name: "linux", Version: "1", ID: "test"}, Arch: "amd64", CPU: 4}
+	for i := 0; i < 500; i++ {
+		info.AvailableTools = append(info.AvailableTools, fmt.Sprintf("tool-%03d", i))
+	}
+	info.AvailableTools = append(info.AvailableTools, "git", "curl")
+
+	full, err := info.ToJSON()
+	assert.NoError(t, err)
+	same, err := info.ToJSONWithin(len(full))
+	assert.NoError(t, err)
+	assert.Equal(t, full, same)
+
+	short, err := info.ToJSONWithin(400)
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(short), 400)
+
+	var trimmed SystemInfo
+	assert.NoError(t, json.Unmarshal([]byte(short), &trimmed))
+	assert.Equal(t, []string{"curl", "git"}, trimmed.AvailableTools[:2], "common tools are kept first")
+	assert.Equal(t, len(info.AvailableTools), len(trimmed.AvailableTools)+trimmed.OmittedTools)
+}